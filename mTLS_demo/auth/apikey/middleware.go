@@ -16,6 +16,10 @@ import (
 type Key struct {
 	ID        string
 	Hash      string
+	// Owner is the workload or user the key was issued to, such as a
+	// SPIFFE ID. It is the subject of the principal; keys without an owner
+	// are identified by their ID.
+	Owner     string
 	Roles     []string
 	ExpiresAt time.Time
 	CreatedAt time.Time
@@ -87,13 +91,18 @@ func (s *InMemoryStore) AddKey(key *Key) error {
 // Middleware handles API key authentication
 type Middleware struct {
 	store       Store
-	metrics     common.AuthMetricsCollector
+	skip        *common.RouteMatcher
+	metrics     *common.AuthMetricsCollector
 	serviceName string
 }
 
 // Config holds the API key configuration
 type Config struct {
 	Store Store
+
+	// Routes configures the routes served without an API key. /health and
+	// /metrics are skipped by default.
+	Routes common.RouteConfig
 }
 
 // NewMiddleware creates a new API key middleware
@@ -106,8 +115,14 @@ func NewMiddleware(config *Config, serviceName string) (*Middleware, error) {
 		return nil, fmt.Errorf("store cannot be nil")
 	}
 
+	skip, err := common.NewSkipMatcher(config.Routes, serviceName, common.DefaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Middleware{
 		store:       config.Store,
+		skip:        skip,
 		metrics:     common.NewAuthMetricsCollector(),
 		serviceName: serviceName,
 	}, nil
@@ -119,43 +134,22 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		// Skip validation for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Extract API key from header
-		keyString, err := m.ExtractKey(r)
-		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "missing_key")
-			http.Error(w, "API key required", http.StatusUnauthorized)
-			return
-		}
-
-		// Hash the key
-		keyHash := m.hashKey(keyString)
-
-		// Look up the key
-		key, err := m.store.GetKey(r.Context(), keyHash)
+		// Authenticate the API key
+		principal, err := m.Authenticate(r)
 		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "invalid_key")
-			http.Error(w, "Invalid API key", http.StatusUnauthorized)
-			return
-		}
-
-		// Update last used timestamp
-		if err := m.store.UpdateLastUsed(r.Context(), key.ID); err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "update_failed")
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			authErr := common.AsAuthError(err)
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), authErr.Reason)
+			http.Error(w, authErr.Message, authErr.Status)
 			return
 		}
 
-		// Add authentication info to context
-		ctx := r.Context()
-		ctx = common.WithAuthMethod(ctx, common.AuthMethodAPIKey)
-		ctx = common.WithServiceID(ctx, key.ID)
-		ctx = common.WithRoles(ctx, key.Roles)
-		r = r.WithContext(ctx)
+		// Add the authenticated principal to context
+		r = r.WithContext(common.WithPrincipal(r.Context(), principal))
 
 		// Record successful authentication
 		m.metrics.RecordAuthRequest(m.serviceName, string(common.AuthMethodAPIKey), "success", time.Since(start).Seconds())
@@ -165,20 +159,36 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// shouldSkipValidation determines if authentication should be skipped
-func (m *Middleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
+// Authenticate looks up the API key of the request and returns the
+// principal of its owner
+func (m *Middleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	// Extract API key from header
+	keyString, err := m.ExtractKey(r)
+	if err != nil {
+		return nil, common.Unauthorized("missing_key", "API key required", common.ErrNoCredentials)
 	}
 
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
-		}
+	// Hash the key
+	keyHash := m.hashKey(keyString)
+
+	// Look up the key
+	key, err := m.store.GetKey(r.Context(), keyHash)
+	if err != nil {
+		return nil, common.Unauthorized("invalid_key", "Invalid API key", err)
+	}
+
+	// Update last used timestamp
+	if err := m.store.UpdateLastUsed(r.Context(), key.ID); err != nil {
+		return nil, &common.AuthError{Reason: "update_failed", Message: "Internal server error", Status: http.StatusInternalServerError, Err: err}
 	}
-	return false
+
+	subject := key.ID
+	if key.Owner != "" {
+		subject = key.Owner
+	}
+	principal := common.NewPrincipal(common.AuthMethodAPIKey, subject)
+	principal.Roles = key.Roles
+	return principal, nil
 }
 
 // ExtractKey extracts the API key from the request
@@ -208,44 +218,23 @@ func (m *Middleware) hashKey(key string) string {
 func (m *Middleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get authentication method
-			method, err := common.GetAuthMethodFromContext(r.Context())
+			// Get the authenticated principal
+			principal, err := common.GetPrincipalFromContext(r.Context())
 			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "missing_auth_method")
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "missing_principal")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
 			// Verify API key authentication
-			if method != common.AuthMethodAPIKey {
+			if !principal.HasMethod(common.AuthMethodAPIKey) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "invalid_auth_method")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Get roles from context
-			tokenRoles, err := common.GetRolesFromContext(r.Context())
-			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "missing_roles")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			// Check if any required role is present
-			hasRole := false
-			for _, requiredRole := range roles {
-				for _, tokenRole := range tokenRoles {
-					if requiredRole == tokenRole {
-						hasRole = true
-						break
-					}
-				}
-				if hasRole {
-					break
-				}
-			}
-
-			if !hasRole {
+			// Check if this method granted any required role
+			if !principal.HasMethodRole(common.AuthMethodAPIKey, roles...) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodAPIKey), "insufficient_roles")
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
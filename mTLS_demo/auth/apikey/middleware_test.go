@@ -150,12 +150,10 @@ func TestMiddleware_RequireRole(t *testing.T) {
 			// Create test request
 			req := httptest.NewRequest("GET", "/api/test", nil)
 
-			// Add authentication info to context
-			ctx := req.Context()
-			ctx = common.WithAuthMethod(ctx, common.AuthMethodAPIKey)
-			ctx = common.WithServiceID(ctx, "test-key")
-			ctx = common.WithRoles(ctx, tt.contextRoles)
-			req = req.WithContext(ctx)
+			// Add the authenticated principal to context
+			principal := common.NewPrincipal(common.AuthMethodAPIKey, "test-key")
+			principal.Roles = tt.contextRoles
+			req = req.WithContext(common.WithPrincipal(req.Context(), principal))
 
 			// Create test response recorder
 			rr := httptest.NewRecorder()
@@ -237,4 +235,26 @@ func TestInMemoryStore_UpdateLastUsed(t *testing.T) {
 	// Test updating non-existent key
 	err = store.UpdateLastUsed(context.Background(), "non-existent")
 	assert.Error(t, err)
-} 
\ No newline at end of file
+}
+
+func TestMiddleware_Authenticate_Owner(t *testing.T) {
+	middleware, store := setupTestMiddleware(t)
+
+	// Add a key issued to a workload
+	err := store.AddKey(&Key{
+		ID:        "owned-key",
+		Hash:      middleware.hashKey("owned-secret"),
+		Owner:     "spiffe://example.org/ns/demo/sa/frontend",
+		ExpiresAt: time.Now().Add(time.Hour),
+		CreatedAt: time.Now(),
+	})
+	assert.NoError(t, err)
+
+	// The owner is the subject of the principal
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("X-API-Key", "owned-secret")
+	principal, err := middleware.Authenticate(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/ns/demo/sa/frontend", principal.Subject)
+	assert.True(t, principal.HasMethod(common.AuthMethodAPIKey))
+}
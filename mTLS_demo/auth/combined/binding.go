@@ -0,0 +1,120 @@
+package combined
+
+import (
+	"fmt"
+	"net/http"
+
+	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// BindingConfig binds bearer credentials, such as JWTs and API keys, to the
+// workload identity of the connection they are presented on. The subject of
+// every bearer credential must be the SPIFFE ID of the peer certificate, or
+// be delegated to it. Exchanged tokens are bound to their actor instead.
+type BindingConfig struct {
+	// Delegations maps a peer SPIFFE ID to the other subjects whose
+	// credentials it may present, such as the service ID of a JWT or the
+	// owner of an API key
+	Delegations map[string][]string
+}
+
+// Validate checks the configuration
+func (c *BindingConfig) Validate() error {
+	for peer := range c.Delegations {
+		if _, err := spiffeid.FromString(peer); err != nil {
+			return fmt.Errorf("invalid delegating SPIFFE ID %q: %v", peer, err)
+		}
+	}
+	return nil
+}
+
+// BindingError is a bearer credential presented on the connection of a
+// workload it is not bound to
+type BindingError struct {
+	// Method is the authenticator that accepted the credential
+	Method string
+	// Subject is the subject of the credential
+	Subject string
+	// PeerID is the SPIFFE ID of the peer certificate
+	PeerID spiffeid.ID
+}
+
+func (e *BindingError) Error() string {
+	return fmt.Sprintf("%s credential of %q is not bound to peer %s", e.Method, e.Subject, e.PeerID)
+}
+
+// checkBinding verifies that the bearer credentials accepted by the chain
+// belong to the peer workload. Requests without a verified peer
+// certificate are not checked.
+func (m *CombinedMiddleware) checkBinding(r *http.Request, results []Result) error {
+	peerID, ok := peerIdentity(r, results)
+	if !ok {
+		return nil
+	}
+
+	for _, result := range results {
+		if !result.Succeeded() || result.Principal.HasMethod(common.AuthMethodMTLS) {
+			continue
+		}
+		if !m.bound(peerID, result.Principal) {
+			return common.Forbidden("binding_mismatch", "Forbidden", &BindingError{
+				Method:  result.Name,
+				Subject: result.Principal.Subject,
+				PeerID:  peerID,
+			})
+		}
+	}
+	return nil
+}
+
+// bound reports whether the credential of principal may be presented by
+// the workload peerID
+func (m *CombinedMiddleware) bound(peerID spiffeid.ID, principal *common.Principal) bool {
+	if principal.SPIFFEID == peerID || principal.Subject == peerID.String() {
+		return true
+	}
+	// An exchanged token acts for its subject and is presented by its actor
+	if actorSubject(principal) == peerID.String() {
+		return true
+	}
+	for _, subject := range m.binding.Delegations[peerID.String()] {
+		if subject == principal.Subject {
+			return true
+		}
+	}
+	return false
+}
+
+// actorSubject returns the current actor of an exchanged token, the sub of
+// its act claim (RFC 8693), or "" for other credentials
+func actorSubject(principal *common.Principal) string {
+	act, ok := principal.Claims["act"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	subject, _ := act["sub"].(string)
+	return subject
+}
+
+// peerIdentity returns the SPIFFE ID of the verified peer certificate,
+// taken from a successful mTLS authenticator or from the chain verified
+// during the handshake
+func peerIdentity(r *http.Request, results []Result) (spiffeid.ID, bool) {
+	for _, result := range results {
+		if result.Succeeded() && result.Principal.HasMethod(common.AuthMethodMTLS) && !result.Principal.SPIFFEID.IsZero() {
+			return result.Principal.SPIFFEID, true
+		}
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return spiffeid.ID{}, false
+	}
+	id, err := spiffe.IDFromCertificate(r.TLS.VerifiedChains[0][0])
+	if err != nil {
+		return spiffeid.ID{}, false
+	}
+	return id, true
+}
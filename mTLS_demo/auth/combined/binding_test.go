@@ -0,0 +1,247 @@
+package combined
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mTLS_demo/auth/apikey"
+	"mTLS_demo/auth/common"
+	authjwt "mTLS_demo/auth/jwt"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+const backendID = "spiffe://example.org/ns/demo/sa/backend"
+
+func TestCombinedMiddleware_Binding(t *testing.T) {
+	methods, ca, store := setupTestMethods(t)
+	addTestKey(t, store, &apikey.Key{ID: "frontend-key", Owner: frontendID}, "frontend-secret")
+	addTestKey(t, store, &apikey.Key{ID: "batch-key", Owner: "batch-job"}, "batch-secret")
+	addTestKey(t, store, &apikey.Key{ID: "backend-key", Owner: backendID}, "backend-secret")
+
+	binding := &BindingConfig{
+		Delegations: map[string][]string{
+			frontendID: {"batch-job"},
+		},
+	}
+
+	// Any accepted credential is checked
+	middleware, err := NewCombinedMiddleware(&Config{Methods: methods, Policy: PolicyAny, Binding: binding}, testServiceID)
+	assert.NoError(t, err)
+
+	// The API key runs first and the mTLS authenticator is never reached,
+	// so the peer is taken from the handshake
+	fallback, err := NewCombinedMiddleware(&Config{
+		Methods: []Method{methods[1], methods[0]},
+		Policy:  PolicyFallback,
+		Binding: binding,
+	}, testServiceID)
+	assert.NoError(t, err)
+
+	frontendCert := ca.IssueSVID(t, frontendID).Certificate
+
+	tests := []struct {
+		name           string
+		middleware     *CombinedMiddleware
+		tls            *tls.ConnectionState
+		apiKey         string
+		expectedStatus int
+		expectBinding  bool
+	}{
+		{
+			name:           "Certificate only",
+			middleware:     middleware,
+			tls:            peerState(frontendCert),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key owned by peer",
+			middleware:     middleware,
+			tls:            peerState(frontendCert),
+			apiKey:         "frontend-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key delegated to peer",
+			middleware:     middleware,
+			tls:            peerState(frontendCert),
+			apiKey:         "batch-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Key of another workload",
+			middleware:     middleware,
+			tls:            peerState(frontendCert),
+			apiKey:         "backend-secret",
+			expectedStatus: http.StatusForbidden,
+			expectBinding:  true,
+		},
+		{
+			name:           "Key without owner",
+			middleware:     middleware,
+			tls:            peerState(frontendCert),
+			apiKey:         testAPIKey,
+			expectedStatus: http.StatusForbidden,
+			expectBinding:  true,
+		},
+		{
+			name:           "No peer certificate",
+			middleware:     middleware,
+			apiKey:         "backend-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Unverified peer certificate is ignored",
+			middleware:     fallback,
+			tls:            peerState(frontendCert),
+			apiKey:         "backend-secret",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:       "Peer verified during handshake",
+			middleware: fallback,
+			tls: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{frontendCert},
+				VerifiedChains:   [][]*x509.Certificate{{frontendCert}},
+			},
+			apiKey:         "backend-secret",
+			expectedStatus: http.StatusForbidden,
+			expectBinding:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := newTestRequest("/api/test", testCredentials{tls: tt.tls, apiKey: tt.apiKey})
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			tt.middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+
+			// Violations are reported as binding errors
+			_, err := tt.middleware.Authenticate(newTestRequest("/api/test", testCredentials{tls: tt.tls, apiKey: tt.apiKey}))
+			var bindingErr *BindingError
+			assert.Equal(t, tt.expectBinding, errors.As(err, &bindingErr))
+			if tt.expectBinding {
+				assert.Equal(t, "binding_mismatch", common.AsAuthError(err).Reason)
+				assert.Equal(t, "apikey", bindingErr.Method)
+				assert.Equal(t, frontendID, bindingErr.PeerID.String())
+			}
+		})
+	}
+}
+
+func TestCombinedMiddleware_BindingExchangedToken(t *testing.T) {
+	methods, ca, _ := setupTestMethods(t)
+
+	// Create the JWT authenticator
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tm, err := authjwt.NewTokenManager(privateKey, &privateKey.PublicKey)
+	assert.NoError(t, err)
+	jwtMethod := Method{Name: "jwt", Authenticator: authjwt.NewJWTMiddleware(tm, testServiceID)}
+
+	middleware, err := NewCombinedMiddleware(&Config{
+		Methods: []Method{methods[0], jwtMethod},
+		Policy:  PolicyAll,
+		Binding: &BindingConfig{},
+	}, testServiceID)
+	assert.NoError(t, err)
+
+	// signToken signs a token of alice, exchanged by actor if set
+	signToken := func(actor string) string {
+		now := time.Now()
+		claims := authjwt.TokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "alice",
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+			ServiceID: "alice",
+			Roles:     []string{"reader"},
+		}
+		if actor != "" {
+			claims.Actor = &authjwt.Actor{Subject: actor, Actor: &authjwt.Actor{Subject: "spiffe://example.org/ns/demo/sa/gateway"}}
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(privateKey)
+		if err != nil {
+			t.Fatalf("Failed to sign test token: %v", err)
+		}
+		return token
+	}
+
+	frontendCert := ca.IssueSVID(t, frontendID).Certificate
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{
+			name:           "Exchanged by peer",
+			token:          signToken(frontendID),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Exchanged by another workload",
+			token:          signToken(backendID),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Token of another subject",
+			token:          signToken(""),
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := newTestRequest("/api/test", testCredentials{tls: peerState(frontendCert)})
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestBindingConfig_Validate(t *testing.T) {
+	config := &BindingConfig{Delegations: map[string][]string{frontendID: {"batch-job"}}}
+	assert.NoError(t, config.Validate())
+
+	config = &BindingConfig{Delegations: map[string][]string{"frontend": {"batch-job"}}}
+	assert.Error(t, config.Validate())
+}
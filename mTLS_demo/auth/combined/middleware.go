@@ -2,303 +2,339 @@ package combined
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"mTLS_demo/auth/common"
-	"mTLS_demo/auth/jwt"
-	"mTLS_demo/auth/mtls"
 )
 
-// ContextKey is a type for context keys
-type ContextKey string
+// Policy decides how the results of the authenticators of a chain combine
+type Policy string
 
 const (
-	// AuthMethodContextKey is the key for storing the authentication method in context
-	AuthMethodContextKey ContextKey = "auth_method"
-	// ServiceIDContextKey is the key for storing the service ID in context
-	ServiceIDContextKey ContextKey = "service_id"
-	// RolesContextKey is the key for storing the roles in context
-	RolesContextKey ContextKey = "roles"
+	// PolicyAny runs every authenticator and accepts the request if at
+	// least one succeeds. The principals of all successful authenticators
+	// are merged.
+	PolicyAny Policy = "any"
+	// PolicyAll accepts the request only if every authenticator succeeds
+	PolicyAll Policy = "all"
+	// PolicyFirstMatch lets the first authenticator whose credentials the
+	// request carries decide. Invalid credentials are rejected even if a
+	// later authenticator would accept the request.
+	PolicyFirstMatch Policy = "first-match"
+	// PolicyFallback tries the authenticators in order and accepts the
+	// request on the first success, falling through on any failure
+	PolicyFallback Policy = "fallback"
 )
 
-// AuthMethod represents the authentication method used
-type AuthMethod string
+// ResultsContextKey is the key for storing the chain results in context
+const ResultsContextKey common.ContextKey = "auth_results"
+
+// Method is a named authenticator of a chain
+type Method struct {
+	// Name identifies the authenticator in results and metrics, such as
+	// "mtls" or "apikey"
+	Name string
+	// Authenticator authenticates requests. The mtls, jwt, oidc and apikey
+	// middlewares all implement it.
+	Authenticator common.Authenticator
+}
 
-const (
-	// AuthMethodMTLS represents mTLS authentication
-	AuthMethodMTLS AuthMethod = "mtls"
-	// AuthMethodJWT represents JWT authentication
-	AuthMethodJWT AuthMethod = "jwt"
-)
+// Result is the outcome of one authenticator of a chain
+type Result struct {
+	// Name is the name of the authenticator
+	Name string
+	// Principal is set when the authenticator succeeded
+	Principal *common.Principal
+	// Err is why the authenticator failed
+	Err error
+	// Skipped is set when the policy decided before the authenticator ran
+	Skipped bool
+}
 
-// CombinedMiddleware handles both mTLS and JWT authentication
-type CombinedMiddleware struct {
-	mtlsMiddleware *mtls.Middleware
-	jwtMiddleware  *jwt.JWTMiddleware
-	metrics        *common.AuthMetricsCollector
-	serviceName    string
-	config         *Config
+// Succeeded reports whether the authenticator ran and succeeded
+func (r Result) Succeeded() bool {
+	return !r.Skipped && r.Err == nil
+}
+
+// ChainError is a request rejected by a chain. It reports why each
+// authenticator failed.
+type ChainError struct {
+	Policy  Policy
+	Results []Result
+}
+
+func (e *ChainError) Error() string {
+	var failures []string
+	for _, result := range e.Results {
+		if result.Skipped || result.Err == nil {
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", result.Name, result.Err))
+	}
+	return fmt.Sprintf("authentication failed (policy %s): %s", e.Policy, strings.Join(failures, "; "))
 }
 
-// Config holds the combined authentication configuration
+// Config holds the authentication chain configuration
 type Config struct {
-	// mTLS configuration
-	MTLSConfig *mtls.Config
-	// JWT configuration
-	JWTConfig *jwt.Config
-	// Combined settings
-	RequireMTLS bool
-	RequireJWT  bool
-	AllowBoth   bool
+	// Methods are the authenticators of the chain, in the order they run
+	Methods []Method
+	// Policy decides how the results of the authenticators combine
+	Policy Policy
+	// Binding, if set, rejects bearer credentials presented on the mTLS
+	// connection of a workload they are not bound to
+	Binding *BindingConfig
+
+	// Routes configures the routes served without authentication. /health,
+	// /metrics and /auth/token are skipped by default.
+	Routes common.RouteConfig
+}
+
+// defaultSkipRoutes are served without authentication unless Routes says
+// otherwise
+var defaultSkipRoutes = []common.RouteRule{
+	{Pattern: "/health"},
+	{Pattern: "/metrics"},
+	{Pattern: "/auth/token"}, // Token endpoint
+}
+
+// Validate checks the configuration
+func (c *Config) Validate() error {
+	if len(c.Methods) == 0 {
+		return fmt.Errorf("at least one authentication method is required")
+	}
+
+	names := make(map[string]bool)
+	for i, method := range c.Methods {
+		if method.Name == "" {
+			return fmt.Errorf("authentication method %d has no name", i)
+		}
+		if names[method.Name] {
+			return fmt.Errorf("duplicate authentication method %q", method.Name)
+		}
+		names[method.Name] = true
+
+		if method.Authenticator == nil {
+			return fmt.Errorf("authentication method %q has no authenticator", method.Name)
+		}
+	}
+
+	switch c.Policy {
+	case PolicyAny, PolicyAll, PolicyFirstMatch, PolicyFallback:
+	case "":
+		return fmt.Errorf("policy is required")
+	default:
+		return fmt.Errorf("unknown policy %q", c.Policy)
+	}
+
+	if c.Binding != nil {
+		if err := c.Binding.Validate(); err != nil {
+			return fmt.Errorf("invalid binding: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// CombinedMiddleware authenticates requests with a chain of authenticators
+type CombinedMiddleware struct {
+	methods     []Method
+	policy      Policy
+	binding     *BindingConfig
+	skip        *common.RouteMatcher
+	metrics     *common.AuthMetricsCollector
+	serviceName string
 }
 
 // NewCombinedMiddleware creates a new combined authentication middleware
 func NewCombinedMiddleware(config *Config, serviceName string) (*CombinedMiddleware, error) {
-	mtlsMiddleware, err := mtls.NewMiddleware(config.MTLSConfig, serviceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create mTLS middleware: %v", err)
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
 	}
 
-	jwtMiddleware := jwt.NewJWTMiddleware(config.JWTConfig.TokenManager, serviceName)
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+
+	skip, err := common.NewSkipMatcher(config.Routes, serviceName, defaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
 
 	return &CombinedMiddleware{
-		mtlsMiddleware: mtlsMiddleware,
-		jwtMiddleware:  jwtMiddleware,
-		metrics:        common.NewAuthMetricsCollector(),
-		serviceName:    serviceName,
-		config:         config,
+		methods:     append([]Method(nil), config.Methods...),
+		policy:      config.Policy,
+		binding:     config.Binding,
+		skip:        skip,
+		metrics:     common.NewAuthMetricsCollector(),
+		serviceName: serviceName,
 	}, nil
 }
 
-// Middleware returns a middleware function that validates both mTLS and JWT
+// Middleware returns a middleware function that authenticates requests with
+// the chain
 func (m *CombinedMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
 		// Skip validation for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Try mTLS authentication first
-		mtlsSuccess := false
-		if m.config.RequireMTLS || m.config.AllowBoth {
-			mtlsSuccess = m.tryMTLSAuth(r)
-		}
-
-		// Try JWT authentication if needed
-		jwtSuccess := false
-		if m.config.RequireJWT || m.config.AllowBoth {
-			jwtSuccess = m.tryJWTAuth(r)
+		// Run the chain
+		principal, results, err := m.run(r)
+		for _, result := range results {
+			if !result.Skipped && result.Err != nil {
+				m.metrics.RecordAuthError(m.serviceName, result.Name, common.AsAuthError(result.Err).Reason)
+			}
 		}
-
-		// Check if authentication requirements are met
-		if !m.isAuthenticationValid(mtlsSuccess, jwtSuccess) {
-			m.metrics.RecordAuthError(m.serviceName, "combined", "authentication_failed")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if err != nil {
+			var bindingErr *BindingError
+			if errors.As(err, &bindingErr) {
+				m.metrics.RecordAuthError(m.serviceName, "binding", "binding_mismatch")
+			}
+			authErr := common.AsAuthError(err)
+			http.Error(w, authErr.Message, authErr.Status)
 			return
 		}
 
+		// Add the authenticated principal and the results to context
+		ctx := common.WithPrincipal(r.Context(), principal)
+		ctx = context.WithValue(ctx, ResultsContextKey, results)
+		r = r.WithContext(ctx)
+
 		// Record successful authentication
-		m.metrics.RecordAuthRequest(m.serviceName, "combined", "success", time.Since(start))
+		m.metrics.RecordAuthRequest(m.serviceName, "combined", "success", time.Since(start).Seconds())
 
 		// Call next handler
 		next.ServeHTTP(w, r)
 	})
 }
 
-// shouldSkipValidation determines if authentication should be skipped
-func (m *CombinedMiddleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
-		"/auth/token", // Token endpoint
-	}
-
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
-		}
-	}
-	return false
+// Authenticate runs the chain and returns the combined principal. A
+// rejected request returns an *common.AuthError wrapping a *ChainError, or
+// a *BindingError, so that chains can be nested.
+func (m *CombinedMiddleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	principal, _, err := m.run(r)
+	return principal, err
 }
 
-// tryMTLSAuth attempts mTLS authentication
-func (m *CombinedMiddleware) tryMTLSAuth(r *http.Request) bool {
-	// Check if TLS connection exists
-	if r.TLS == nil {
-		return false
+// run applies the policy to the authenticators and returns the result of
+// each of them
+func (m *CombinedMiddleware) run(r *http.Request) (*common.Principal, []Result, error) {
+	results := make([]Result, len(m.methods))
+	for i, method := range m.methods {
+		results[i] = Result{Name: method.Name, Skipped: true}
 	}
 
-	// Verify client certificate
-	if len(r.TLS.PeerCertificates) == 0 {
-		return false
-	}
-
-	// Get client certificate
-	clientCert := r.TLS.PeerCertificates[0]
-
-	// Verify certificate
-	if err := m.mtlsMiddleware.VerifyCertificate(clientCert); err != nil {
-		return false
+	var principal *common.Principal
+	accept := func(p *common.Principal) {
+		if principal == nil {
+			principal = p
+		} else {
+			principal = principal.Merge(p)
+		}
 	}
 
-	// Add authentication info to context
-	ctx := context.WithValue(r.Context(), AuthMethodContextKey, AuthMethodMTLS)
-	ctx = context.WithValue(ctx, ServiceIDContextKey, clientCert.Subject.CommonName)
-	*r = *r.WithContext(ctx)
+	for i, method := range m.methods {
+		p, err := method.Authenticator.Authenticate(r)
+		results[i] = Result{Name: method.Name, Principal: p, Err: err}
+		if err == nil && p == nil {
+			results[i].Err = fmt.Errorf("authenticator returned no principal")
+		}
 
-	return true
-}
+		if results[i].Succeeded() {
+			accept(p)
+			if m.policy == PolicyFirstMatch || m.policy == PolicyFallback {
+				break
+			}
+			continue
+		}
 
-// tryJWTAuth attempts JWT authentication
-func (m *CombinedMiddleware) tryJWTAuth(r *http.Request) bool {
-	// Extract token from Authorization header
-	tokenString, err := m.jwtMiddleware.ExtractToken(r)
-	if err != nil {
-		return false
+		if m.policy == PolicyAll {
+			principal = nil
+			break
+		}
+		if m.policy == PolicyFirstMatch && !errors.Is(err, common.ErrNoCredentials) {
+			// The request presented credentials that were rejected
+			break
+		}
 	}
 
-	// Verify token
-	claims, err := m.jwtMiddleware.TokenManager.VerifyToken(tokenString)
-	if err != nil {
-		return false
+	if principal == nil {
+		return nil, results, m.reject(results)
 	}
 
-	// Validate claims
-	if err := m.jwtMiddleware.TokenManager.ValidateClaims(claims); err != nil {
-		return false
+	// Bearer credentials must belong to the peer workload
+	if m.binding != nil {
+		if err := m.checkBinding(r, results); err != nil {
+			return nil, results, err
+		}
 	}
-
-	// Add authentication info to context
-	ctx := context.WithValue(r.Context(), AuthMethodContextKey, AuthMethodJWT)
-	ctx = context.WithValue(ctx, ServiceIDContextKey, claims.ServiceID)
-	ctx = context.WithValue(ctx, RolesContextKey, claims.Roles)
-	*r = *r.WithContext(ctx)
-
-	return true
+	return principal, results, nil
 }
 
-// isAuthenticationValid checks if the authentication requirements are met
-func (m *CombinedMiddleware) isAuthenticationValid(mtlsSuccess, jwtSuccess bool) bool {
-	if m.config.RequireMTLS && !mtlsSuccess {
-		return false
-	}
-
-	if m.config.RequireJWT && !jwtSuccess {
-		return false
-	}
-
-	if m.config.AllowBoth {
-		return mtlsSuccess || jwtSuccess
-	}
+// reject creates the error of a rejected request. It is forbidden if an
+// authenticator rejected a caller it identified, and unauthorized otherwise.
+func (m *CombinedMiddleware) reject(results []Result) error {
+	chainErr := &ChainError{Policy: m.policy, Results: results}
 
-	return true
-}
-
-// GetAuthMethodFromContext extracts the authentication method from context
-func GetAuthMethodFromContext(ctx context.Context) (AuthMethod, error) {
-	method, ok := ctx.Value(AuthMethodContextKey).(AuthMethod)
-	if !ok {
-		return "", fmt.Errorf("auth method not found in context")
+	noCredentials := true
+	for _, result := range results {
+		if result.Skipped || result.Err == nil {
+			continue
+		}
+		if common.AsAuthError(result.Err).Status == http.StatusForbidden {
+			return common.Forbidden("authentication_failed", "Forbidden", chainErr)
+		}
+		if !errors.Is(result.Err, common.ErrNoCredentials) {
+			noCredentials = false
+		}
 	}
-	return method, nil
-}
 
-// GetServiceIDFromContext extracts the service ID from context
-func GetServiceIDFromContext(ctx context.Context) (string, error) {
-	serviceID, ok := ctx.Value(ServiceIDContextKey).(string)
-	if !ok {
-		return "", fmt.Errorf("service ID not found in context")
+	if noCredentials {
+		return common.Unauthorized("no_credentials", "Unauthorized", fmt.Errorf("%w: %w", common.ErrNoCredentials, chainErr))
 	}
-	return serviceID, nil
+	return common.Unauthorized("authentication_failed", "Unauthorized", chainErr)
 }
 
-// GetRolesFromContext extracts the roles from context
-func GetRolesFromContext(ctx context.Context) ([]string, error) {
-	roles, ok := ctx.Value(RolesContextKey).([]string)
+// GetResultsFromContext extracts the results of the chain from context
+func GetResultsFromContext(ctx context.Context) ([]Result, error) {
+	results, ok := ctx.Value(ResultsContextKey).([]Result)
 	if !ok {
-		return nil, fmt.Errorf("roles not found in context")
+		return nil, fmt.Errorf("authentication results not found in context")
 	}
-	return roles, nil
+	return results, nil
 }
 
-// RequireRole creates a middleware that checks for required roles
+// RequireRole creates a middleware that checks for required roles. The
+// roles of the combined principal are checked; they include the roles of
+// every method that authenticated the same caller as the first one.
+// Credentials of other subjects keep their roles in their own result.
 func (m *CombinedMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get authentication method
-			method, err := GetAuthMethodFromContext(r.Context())
+			// Get the authenticated principal
+			principal, err := common.GetPrincipalFromContext(r.Context())
 			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, "role_check", "missing_auth_method")
+				m.metrics.RecordAuthError(m.serviceName, "role_check", "missing_principal")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// For mTLS, check certificate roles
-			if method == AuthMethodMTLS {
-				if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
-					m.metrics.RecordAuthError(m.serviceName, "role_check", "missing_certificate")
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
-					return
-				}
-
-				certRoles := m.mtlsMiddleware.GetCertificateRoles(r.TLS.PeerCertificates[0])
-				hasRole := false
-				for _, requiredRole := range roles {
-					for _, certRole := range certRoles {
-						if requiredRole == certRole {
-							hasRole = true
-							break
-						}
-					}
-					if hasRole {
-						break
-					}
-				}
-
-				if !hasRole {
-					m.metrics.RecordAuthError(m.serviceName, "role_check", "insufficient_roles")
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
-			}
-
-			// For JWT, check token roles
-			if method == AuthMethodJWT {
-				tokenRoles, err := GetRolesFromContext(r.Context())
-				if err != nil {
-					m.metrics.RecordAuthError(m.serviceName, "role_check", "missing_roles")
-					http.Error(w, "Unauthorized", http.StatusUnauthorized)
-					return
-				}
-
-				hasRole := false
-				for _, requiredRole := range roles {
-					for _, tokenRole := range tokenRoles {
-						if requiredRole == tokenRole {
-							hasRole = true
-							break
-						}
-					}
-					if hasRole {
-						break
-					}
-				}
-
-				if !hasRole {
-					m.metrics.RecordAuthError(m.serviceName, "role_check", "insufficient_roles")
-					http.Error(w, "Forbidden", http.StatusForbidden)
-					return
-				}
+			// Check if any required role is present
+			if !principal.HasAnyRole(roles...) {
+				m.metrics.RecordAuthError(m.serviceName, "role_check", "insufficient_roles")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
 			}
 
 			next.ServeHTTP(w, r)
 		})
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,73 @@
+// Package common holds what the authentication middlewares share: the
+// Principal they attach to requests, the Authenticator interface, metrics
+// and the routes served without authentication.
+//
+// Each middleware serves /health and /metrics without authentication, and
+// the OIDC and JWT middlewares also skip their /auth/callback and
+// /auth/token endpoints. Set Routes.SkipRoutes in a middleware's config to
+// change this. A RouteRule pattern is an exact path, a glob such as
+// /docs/*.html or a prefix such as /public/**, optionally limited to some
+// HTTP methods. List the role-protected routes in Routes.RoleRoutes to get
+// a startup warning when a skip rule shadows one.
+package common
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrNoCredentials is wrapped by authentication errors of requests that
+// carry none of an authenticator's credentials, such as a request without
+// an Authorization header, so that a chain can try the next authenticator
+var ErrNoCredentials = errors.New("no credentials presented")
+
+// Authenticator authenticates a request without writing a response. All
+// middlewares implement it, so that they can be composed into a chain.
+type Authenticator interface {
+	// Authenticate returns the principal of the request, or an *AuthError
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AuthError is a failed authentication
+type AuthError struct {
+	// Reason is a short label recorded in metrics, such as "invalid_token"
+	Reason string
+	// Message is the response text
+	Message string
+	// Status is the response status, usually 401 or 403
+	Status int
+	// Err is the underlying error, if any
+	Err error
+}
+
+// Unauthorized creates an error for missing or invalid credentials
+func Unauthorized(reason, message string, err error) *AuthError {
+	return &AuthError{Reason: reason, Message: message, Status: http.StatusUnauthorized, Err: err}
+}
+
+// Forbidden creates an error for valid credentials of a caller that is not
+// allowed
+func Forbidden(reason, message string, err error) *AuthError {
+	return &AuthError{Reason: reason, Message: message, Status: http.StatusForbidden, Err: err}
+}
+
+func (e *AuthError) Error() string {
+	if e.Err != nil {
+		return e.Reason + ": " + e.Err.Error()
+	}
+	return e.Reason
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// AsAuthError returns err as an *AuthError, wrapping errors of other types
+// as an internal error
+func AsAuthError(err error) *AuthError {
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return authErr
+	}
+	return &AuthError{Reason: "internal_error", Message: "Internal server error", Status: http.StatusInternalServerError, Err: err}
+}
@@ -2,7 +2,6 @@ package common
 
 import (
 	"sync"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -68,7 +67,7 @@ var (
 	)
 )
 
-// AuthMetricsCollector implements the AuthMetricsCollector interface
+// AuthMetricsCollector implements the AuthMetricsRecorder interface
 type AuthMetricsCollector struct {
 	authRequests *prometheus.CounterVec
 	authErrors   *prometheus.CounterVec
@@ -78,37 +77,13 @@ type AuthMetricsCollector struct {
 
 // NewAuthMetricsCollector creates a new metrics collector
 func NewAuthMetricsCollector() *AuthMetricsCollector {
-	collector := &AuthMetricsCollector{
-		authRequests: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "auth_requests_total",
-				Help: "Total number of authentication requests",
-			},
-			[]string{"service", "method", "result"},
-		),
-		authErrors: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name: "auth_errors_total",
-				Help: "Total number of authentication errors",
-			},
-			[]string{"service", "method", "error_type"},
-		),
-		authDuration: prometheus.NewHistogramVec(
-			prometheus.HistogramOpts{
-				Name:    "auth_duration_seconds",
-				Help:    "Authentication request duration in seconds",
-				Buckets: prometheus.DefBuckets,
-			},
-			[]string{"service", "method"},
-		),
+	// Every collector records into the package-level vectors, which are
+	// registered once when the package is loaded
+	return &AuthMetricsCollector{
+		authRequests: AuthRequestsTotal,
+		authErrors:   AuthErrorsTotal,
+		authDuration: AuthRequestDuration,
 	}
-
-	// Register metrics
-	prometheus.MustRegister(collector.authRequests)
-	prometheus.MustRegister(collector.authErrors)
-	prometheus.MustRegister(collector.authDuration)
-
-	return collector
 }
 
 // RecordAuthRequest records a successful authentication request
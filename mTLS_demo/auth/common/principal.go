@@ -0,0 +1,224 @@
+package common
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// PrincipalContextKey is the key for storing the authenticated principal in
+// context
+const PrincipalContextKey ContextKey = "principal"
+
+// Principal is the authenticated caller of a request. Every middleware
+// stores one in the request context; handlers read it with
+// GetPrincipalFromContext.
+type Principal struct {
+	// Subject identifies the caller: the SPIFFE ID of a workload, the
+	// subject of a token or the ID of an API key
+	Subject string
+	// SPIFFEID is set when the caller presented an X509-SVID or a JWT-SVID
+	SPIFFEID spiffeid.ID
+	// TrustDomain is the trust domain of SPIFFEID
+	TrustDomain string
+	// Issuer is the issuer of the token the caller presented
+	Issuer string
+	// Roles are the roles granted to the caller
+	Roles []string
+	// Scopes are the OAuth2 scopes granted to the caller
+	Scopes []string
+	// Claims are the raw claims of the token the caller presented
+	Claims map[string]interface{}
+	// Certificates is the verified peer certificate chain, leaf first
+	Certificates []*x509.Certificate
+	// Methods lists every authentication method the caller satisfied, in
+	// the order they ran
+	Methods []AuthMethod
+	// AuthTime is when the caller was first authenticated
+	AuthTime time.Time
+
+	// methodRoles holds the roles each method granted once principals of
+	// several methods have been merged
+	methodRoles map[AuthMethod][]string
+}
+
+// NewSPIFFEPrincipal creates a principal for a workload authenticated by
+// method with the SPIFFE ID id
+func NewSPIFFEPrincipal(method AuthMethod, id spiffeid.ID) *Principal {
+	return &Principal{
+		Subject:     id.String(),
+		SPIFFEID:    id,
+		TrustDomain: id.TrustDomain().Name(),
+		Methods:     []AuthMethod{method},
+		AuthTime:    time.Now(),
+	}
+}
+
+// NewPrincipal creates a principal for a caller authenticated by method
+// with subject
+func NewPrincipal(method AuthMethod, subject string) *Principal {
+	return &Principal{
+		Subject:  subject,
+		Methods:  []AuthMethod{method},
+		AuthTime: time.Now(),
+	}
+}
+
+// HasMethod reports whether the caller satisfied method
+func (p *Principal) HasMethod(method AuthMethod) bool {
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyRole reports whether the caller has at least one of roles
+func (p *Principal) HasAnyRole(roles ...string) bool {
+	return containsAny(p.Roles, roles)
+}
+
+// MethodRoles returns the roles granted by method alone
+func (p *Principal) MethodRoles(method AuthMethod) []string {
+	if roles, ok := p.methodRoles[method]; ok {
+		return roles
+	}
+	if len(p.Methods) == 1 && p.Methods[0] == method {
+		return p.Roles
+	}
+	return nil
+}
+
+// HasMethodRole reports whether method authenticated the caller and
+// granted at least one of roles. RequireRole of a middleware checks it, so
+// that roles granted by another method of a stack do not count.
+func (p *Principal) HasMethodRole(method AuthMethod, roles ...string) bool {
+	return p.HasMethod(method) && containsAny(p.MethodRoles(method), roles)
+}
+
+// containsAny reports whether values holds at least one of wanted
+func containsAny(values, wanted []string) bool {
+	for _, w := range wanted {
+		for _, v := range values {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Merge combines p with a principal authenticated by a later middleware.
+// The identity of p is kept and only missing fields are filled in from
+// other; methods are accumulated, each with the roles it granted (see
+// MethodRoles). Roles and scopes are only accumulated
+// when other is the same caller, since a credential of another subject
+// must not grant its permissions to p.
+func (p *Principal) Merge(other *Principal) *Principal {
+	merged := *p
+	if merged.Subject == "" {
+		merged.Subject = other.Subject
+	}
+	if merged.SPIFFEID.IsZero() {
+		merged.SPIFFEID = other.SPIFFEID
+		merged.TrustDomain = other.TrustDomain
+	}
+	if merged.Issuer == "" {
+		merged.Issuer = other.Issuer
+	}
+	if merged.Claims == nil {
+		merged.Claims = other.Claims
+	}
+	if merged.Certificates == nil {
+		merged.Certificates = other.Certificates
+	}
+	if merged.AuthTime.IsZero() {
+		merged.AuthTime = other.AuthTime
+	}
+	merged.Roles = append([]string(nil), p.Roles...)
+	merged.Scopes = append([]string(nil), p.Scopes...)
+	if p.sameCaller(other) {
+		merged.Roles = appendUnique(merged.Roles, other.Roles...)
+		merged.Scopes = appendUnique(merged.Scopes, other.Scopes...)
+	}
+	merged.Methods = append([]AuthMethod(nil), p.Methods...)
+	for _, method := range other.Methods {
+		if !merged.HasMethod(method) {
+			merged.Methods = append(merged.Methods, method)
+		}
+	}
+
+	// Each method keeps the roles it granted itself
+	merged.methodRoles = make(map[AuthMethod][]string)
+	for _, principal := range []*Principal{p, other} {
+		for _, method := range principal.Methods {
+			merged.methodRoles[method] = appendUnique(merged.methodRoles[method], principal.MethodRoles(method)...)
+		}
+	}
+	return &merged
+}
+
+// sameCaller reports whether other identifies the same caller as p. A
+// subject or SPIFFE ID that either principal leaves empty is not compared.
+func (p *Principal) sameCaller(other *Principal) bool {
+	if p.Subject != "" && other.Subject != "" && p.Subject != other.Subject {
+		return false
+	}
+	if !p.SPIFFEID.IsZero() && !other.SPIFFEID.IsZero() && p.SPIFFEID != other.SPIFFEID {
+		return false
+	}
+	return true
+}
+
+// WithPrincipal adds the principal to the context. A principal already in
+// the context, stored by an earlier middleware, is merged with it.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	if existing, ok := ctx.Value(PrincipalContextKey).(*Principal); ok {
+		principal = existing.Merge(principal)
+	}
+	return context.WithValue(ctx, PrincipalContextKey, principal)
+}
+
+// GetPrincipalFromContext extracts the authenticated principal from context
+func GetPrincipalFromContext(ctx context.Context) (*Principal, error) {
+	principal, ok := ctx.Value(PrincipalContextKey).(*Principal)
+	if !ok {
+		return nil, fmt.Errorf("principal not found in context")
+	}
+	return principal, nil
+}
+
+// ClaimsToMap converts typed token claims to raw claims for a principal
+func ClaimsToMap(claims interface{}) map[string]interface{} {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil
+	}
+	return raw
+}
+
+// appendUnique appends the values not already in s
+func appendUnique(s []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range s {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, value)
+		}
+	}
+	return s
+}
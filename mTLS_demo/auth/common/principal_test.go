@@ -0,0 +1,83 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipal_Context(t *testing.T) {
+	// A context without a principal is unauthenticated
+	_, err := GetPrincipalFromContext(context.Background())
+	assert.Error(t, err)
+
+	id := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/frontend")
+	workload := NewSPIFFEPrincipal(AuthMethodMTLS, id)
+	workload.Roles = []string{"reader"}
+
+	token := NewPrincipal(AuthMethodJWT, id.String())
+	token.Issuer = "https://issuer.example.org"
+	token.Roles = []string{"reader", "writer"}
+	token.Scopes = []string{"orders:read"}
+	token.Claims = map[string]interface{}{"sub": id.String()}
+
+	// Stacked middlewares accumulate methods, keeping the first identity
+	ctx := WithPrincipal(context.Background(), workload)
+	ctx = WithPrincipal(ctx, token)
+
+	principal, err := GetPrincipalFromContext(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, id.String(), principal.Subject)
+	assert.Equal(t, id, principal.SPIFFEID)
+	assert.Equal(t, "example.org", principal.TrustDomain)
+	assert.Equal(t, "https://issuer.example.org", principal.Issuer)
+	assert.Equal(t, []string{"reader", "writer"}, principal.Roles)
+	assert.Equal(t, []string{"orders:read"}, principal.Scopes)
+	assert.Equal(t, id.String(), principal.Claims["sub"])
+	assert.Equal(t, []AuthMethod{AuthMethodMTLS, AuthMethodJWT}, principal.Methods)
+	assert.Equal(t, workload.AuthTime, principal.AuthTime)
+
+	// Each method keeps the roles it granted
+	assert.Equal(t, []string{"reader"}, principal.MethodRoles(AuthMethodMTLS))
+	assert.Equal(t, []string{"reader", "writer"}, principal.MethodRoles(AuthMethodJWT))
+	assert.True(t, principal.HasMethodRole(AuthMethodJWT, "writer"))
+	assert.False(t, principal.HasMethodRole(AuthMethodMTLS, "writer"))
+	assert.False(t, principal.HasMethodRole(AuthMethodAPIKey, "reader"))
+
+	// The stored principals are not modified
+	assert.Equal(t, []AuthMethod{AuthMethodMTLS}, workload.Methods)
+	assert.Equal(t, []string{"reader"}, workload.Roles)
+
+	// Roles and scopes of another caller are not merged
+	key := NewPrincipal(AuthMethodAPIKey, "key-1")
+	key.Roles = []string{"admin"}
+	key.Scopes = []string{"orders:write"}
+	other := NewSPIFFEPrincipal(AuthMethodJWT, spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/backend"))
+	other.Roles = []string{"admin"}
+
+	for _, p := range []*Principal{key, other} {
+		principal, err = GetPrincipalFromContext(WithPrincipal(WithPrincipal(context.Background(), workload), p))
+		assert.NoError(t, err)
+		assert.Equal(t, id.String(), principal.Subject)
+		assert.Equal(t, []string{"reader"}, principal.Roles)
+		assert.Empty(t, principal.Scopes)
+		assert.Equal(t, []AuthMethod{AuthMethodMTLS, p.Methods[0]}, principal.Methods)
+
+		// The other caller's roles are not granted by either method
+		assert.False(t, principal.HasMethodRole(AuthMethodMTLS, "admin"))
+		assert.Equal(t, p.Roles, principal.MethodRoles(p.Methods[0]))
+	}
+}
+
+func TestPrincipal_Checks(t *testing.T) {
+	principal := NewPrincipal(AuthMethodAPIKey, "key-1")
+	principal.Roles = []string{"service"}
+
+	assert.True(t, principal.HasMethod(AuthMethodAPIKey))
+	assert.False(t, principal.HasMethod(AuthMethodMTLS))
+	assert.True(t, principal.HasAnyRole("admin", "service"))
+	assert.False(t, principal.HasAnyRole("admin"))
+	assert.False(t, principal.HasAnyRole())
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// DefaultSkipRoutes are served without authentication by every middleware
+// whose configuration does not set SkipRoutes
+var DefaultSkipRoutes = []RouteRule{
+	{Pattern: "/health"},
+	{Pattern: "/metrics"},
+}
+
+// RouteRule matches requests by method and path. Pattern is one of
+//
+//   - an exact path, such as /health
+//   - a path.Match glob, such as /docs/*.html, where '*' matches one path
+//     segment
+//   - a prefix ending in /**, such as /public/**, which matches the prefix
+//     itself and every path below it
+type RouteRule struct {
+	// Methods limits the rule to these HTTP methods. It matches every
+	// method when empty.
+	Methods []string
+	// Pattern is the path pattern
+	Pattern string
+}
+
+// String returns the rule as "GET,HEAD /pattern", or just the pattern when
+// it matches every method
+func (r RouteRule) String() string {
+	if len(r.Methods) == 0 {
+		return r.Pattern
+	}
+	return strings.Join(r.Methods, ",") + " " + r.Pattern
+}
+
+// RoleRoute is a route that requires roles. Path is a concrete path or a
+// prefix ending in /**; Method is empty when every method requires the
+// roles.
+type RoleRoute struct {
+	Method string
+	Path   string
+	Roles  []string
+}
+
+// RouteConfig configures the routes a middleware serves without
+// authentication
+type RouteConfig struct {
+	// SkipRoutes are served without authentication. Nil keeps the
+	// middleware's defaults; an empty slice authenticates every route.
+	SkipRoutes []RouteRule
+	// RoleRoutes lists the routes that require roles, so that skip rules
+	// shadowing them are reported at startup
+	RoleRoutes []RoleRoute
+}
+
+// RouteMatcher decides which requests a middleware lets through without
+// authentication. A nil RouteMatcher matches nothing.
+type RouteMatcher struct {
+	rules []routeRule
+}
+
+// routeRule is a validated RouteRule
+type routeRule struct {
+	rule    RouteRule
+	methods map[string]struct{}
+	// prefix is set for /** rules, without the trailing /**
+	prefix   string
+	isPrefix bool
+	isGlob   bool
+}
+
+// NewRouteMatcher creates a matcher from rules, rejecting malformed patterns
+func NewRouteMatcher(rules ...RouteRule) (*RouteMatcher, error) {
+	m := &RouteMatcher{}
+	for _, rule := range rules {
+		parsed, err := parseRouteRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		m.rules = append(m.rules, parsed)
+	}
+	return m, nil
+}
+
+// NewSkipMatcher creates the matcher of a middleware from its route
+// configuration, falling back to defaults when SkipRoutes is nil. Skip
+// rules that shadow a role route are logged as warnings.
+func NewSkipMatcher(config RouteConfig, serviceName string, defaults ...RouteRule) (*RouteMatcher, error) {
+	rules := config.SkipRoutes
+	if rules == nil {
+		rules = defaults
+	}
+
+	m, err := NewRouteMatcher(rules...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid skip routes: %v", err)
+	}
+
+	for _, shadowed := range m.Shadowed(config.RoleRoutes) {
+		log.Printf("Warning: %s: %s", serviceName, shadowed)
+	}
+
+	return m, nil
+}
+
+// parseRouteRule validates a rule and precomputes how it matches
+func parseRouteRule(rule RouteRule) (routeRule, error) {
+	if !strings.HasPrefix(rule.Pattern, "/") {
+		return routeRule{}, fmt.Errorf("invalid route pattern %q: must start with /", rule.Pattern)
+	}
+
+	parsed := routeRule{rule: rule}
+	if len(rule.Methods) > 0 {
+		parsed.methods = make(map[string]struct{}, len(rule.Methods))
+		for _, method := range rule.Methods {
+			if method == "" {
+				return routeRule{}, fmt.Errorf("invalid route %q: empty method", rule)
+			}
+			parsed.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+
+	switch {
+	case rule.Pattern == "/**" || strings.HasSuffix(rule.Pattern, "/**"):
+		parsed.isPrefix = true
+		parsed.prefix = strings.TrimSuffix(rule.Pattern, "/**")
+		if strings.ContainsAny(parsed.prefix, "*?[") {
+			return routeRule{}, fmt.Errorf("invalid route pattern %q: wildcards are not allowed before /**", rule.Pattern)
+		}
+	case strings.ContainsAny(rule.Pattern, "*?[\\"):
+		// Reject malformed globs up front instead of failing every match later
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return routeRule{}, fmt.Errorf("invalid route pattern %q: %v", rule.Pattern, err)
+		}
+		parsed.isGlob = true
+	}
+
+	return parsed, nil
+}
+
+// Match reports whether the request is served without authentication
+func (m *RouteMatcher) Match(r *http.Request) bool {
+	return m.MatchRoute(r.Method, r.URL.Path)
+}
+
+// MatchRoute reports whether method and path are served without
+// authentication. The path is cleaned first, so dot segments cannot step
+// out of a skipped prefix.
+func (m *RouteMatcher) MatchRoute(method, urlPath string) bool {
+	if m == nil {
+		return false
+	}
+	urlPath = cleanPath(urlPath)
+	for _, rule := range m.rules {
+		if rule.matchMethod(method) && rule.matchPath(urlPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// Shadowed describes every role route that a skip rule lets through
+// without authentication, and with it without a role check
+func (m *RouteMatcher) Shadowed(routes []RoleRoute) []string {
+	if m == nil {
+		return nil
+	}
+
+	var shadowed []string
+	for _, route := range routes {
+		for _, rule := range m.rules {
+			if !rule.overlapsMethod(route.Method) || !rule.overlapsPath(route.Path) {
+				continue
+			}
+			shadowed = append(shadowed, fmt.Sprintf(
+				"skip rule %q shadows route %q requiring roles %v",
+				rule.rule, strings.TrimSpace(route.Method+" "+route.Path), route.Roles))
+		}
+	}
+	return shadowed
+}
+
+func (r routeRule) matchMethod(method string) bool {
+	if r.methods == nil {
+		return true
+	}
+	_, ok := r.methods[strings.ToUpper(method)]
+	return ok
+}
+
+func (r routeRule) matchPath(urlPath string) bool {
+	switch {
+	case r.isPrefix:
+		return urlPath == r.prefix || strings.HasPrefix(urlPath, r.prefix+"/")
+	case r.isGlob:
+		ok, _ := path.Match(r.rule.Pattern, urlPath)
+		return ok
+	default:
+		return urlPath == r.rule.Pattern
+	}
+}
+
+// cleanPath returns the canonical form of urlPath the way http.ServeMux
+// routes it: dot segments and repeated slashes are removed and a trailing
+// slash is kept
+func cleanPath(urlPath string) string {
+	if urlPath == "" {
+		return "/"
+	}
+	if urlPath[0] != '/' {
+		urlPath = "/" + urlPath
+	}
+	cleaned := path.Clean(urlPath)
+	if strings.HasSuffix(urlPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// overlapsMethod reports whether the rule covers a request to a route
+// with method, where an empty method stands for every method
+func (r routeRule) overlapsMethod(method string) bool {
+	return method == "" || r.matchMethod(method)
+}
+
+// overlapsPath reports whether the rule matches the route path or, for a
+// /** route, any path below it
+func (r routeRule) overlapsPath(routePath string) bool {
+	if !strings.HasSuffix(routePath, "/**") {
+		return r.matchPath(routePath)
+	}
+
+	prefix := strings.TrimSuffix(routePath, "/**")
+	if r.matchPath(prefix) {
+		return true
+	}
+	switch {
+	case r.isPrefix:
+		// Either prefix contains the other
+		return r.prefix == "" || prefix == "" ||
+			strings.HasPrefix(r.prefix+"/", prefix+"/") || strings.HasPrefix(prefix+"/", r.prefix+"/")
+	default:
+		// Exact paths and globs below the route prefix
+		return strings.HasPrefix(r.rule.Pattern, prefix+"/")
+	}
+}
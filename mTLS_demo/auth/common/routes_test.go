@@ -0,0 +1,171 @@
+package common
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteMatcher_Match(t *testing.T) {
+	matcher, err := NewRouteMatcher(
+		RouteRule{Pattern: "/health"},
+		RouteRule{Pattern: "/docs/*.html"},
+		RouteRule{Pattern: "/public/**"},
+		RouteRule{Methods: []string{"post"}, Pattern: "/auth/token"},
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		expected bool
+	}{
+		{name: "Exact path", method: http.MethodGet, path: "/health", expected: true},
+		{name: "Exact path with suffix", method: http.MethodGet, path: "/health/details", expected: false},
+		{name: "Glob", method: http.MethodGet, path: "/docs/index.html", expected: true},
+		{name: "Glob matches one segment", method: http.MethodGet, path: "/docs/api/index.html", expected: false},
+		{name: "Prefix itself", method: http.MethodGet, path: "/public", expected: true},
+		{name: "Below prefix", method: http.MethodGet, path: "/public/css/site.css", expected: true},
+		{name: "Sibling of prefix", method: http.MethodGet, path: "/publicity", expected: false},
+		{name: "Allowed method", method: http.MethodPost, path: "/auth/token", expected: true},
+		{name: "Other method", method: http.MethodGet, path: "/auth/token", expected: false},
+		{name: "Unmatched path", method: http.MethodGet, path: "/api/admin", expected: false},
+		{name: "Dot segments out of prefix", method: http.MethodGet, path: "/public/../api/admin", expected: false},
+		{name: "Dot segments out of glob", method: http.MethodGet, path: "/docs/../api/admin.html", expected: false},
+		{name: "Dot segments within prefix", method: http.MethodGet, path: "/public/css/../site.css", expected: true},
+		{name: "Repeated slashes", method: http.MethodGet, path: "//health", expected: true},
+		{name: "Trailing slash below prefix", method: http.MethodGet, path: "/public/", expected: true},
+		{name: "Trailing slash is kept", method: http.MethodGet, path: "/health/", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			assert.Equal(t, tt.expected, matcher.Match(req))
+		})
+	}
+
+	// A nil matcher skips nothing
+	var nilMatcher *RouteMatcher
+	assert.False(t, nilMatcher.MatchRoute(http.MethodGet, "/health"))
+}
+
+func TestNewRouteMatcher_InvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule RouteRule
+	}{
+		{name: "Relative path", rule: RouteRule{Pattern: "health"}},
+		{name: "Malformed glob", rule: RouteRule{Pattern: "/docs/[a"}},
+		{name: "Wildcard before prefix", rule: RouteRule{Pattern: "/*/public/**"}},
+		{name: "Empty method", rule: RouteRule{Methods: []string{""}, Pattern: "/health"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRouteMatcher(tt.rule)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRouteMatcher_Shadowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     RouteRule
+		route    RoleRoute
+		shadowed bool
+	}{
+		{
+			name:     "Exact path",
+			rule:     RouteRule{Pattern: "/api/admin"},
+			route:    RoleRoute{Path: "/api/admin", Roles: []string{"admin"}},
+			shadowed: true,
+		},
+		{
+			name:     "Prefix covers route",
+			rule:     RouteRule{Pattern: "/api/**"},
+			route:    RoleRoute{Path: "/api/admin", Roles: []string{"admin"}},
+			shadowed: true,
+		},
+		{
+			name:     "Glob below route prefix",
+			rule:     RouteRule{Pattern: "/admin/*"},
+			route:    RoleRoute{Path: "/admin/**", Roles: []string{"admin"}},
+			shadowed: true,
+		},
+		{
+			name:     "Prefix below route prefix",
+			rule:     RouteRule{Pattern: "/admin/public/**"},
+			route:    RoleRoute{Path: "/admin/**", Roles: []string{"admin"}},
+			shadowed: true,
+		},
+		{
+			name:     "Rule method covers part of route",
+			rule:     RouteRule{Methods: []string{http.MethodGet}, Pattern: "/api/admin"},
+			route:    RoleRoute{Path: "/api/admin", Roles: []string{"admin"}},
+			shadowed: true,
+		},
+		{
+			name:     "Different method",
+			rule:     RouteRule{Methods: []string{http.MethodGet}, Pattern: "/api/admin"},
+			route:    RoleRoute{Method: http.MethodPost, Path: "/api/admin", Roles: []string{"admin"}},
+			shadowed: false,
+		},
+		{
+			name:     "Different path",
+			rule:     RouteRule{Pattern: "/health"},
+			route:    RoleRoute{Path: "/admin/**", Roles: []string{"admin"}},
+			shadowed: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matcher, err := NewRouteMatcher(tt.rule)
+			assert.NoError(t, err)
+
+			shadowed := matcher.Shadowed([]RoleRoute{tt.route})
+			if tt.shadowed {
+				assert.Len(t, shadowed, 1)
+			} else {
+				assert.Empty(t, shadowed)
+			}
+		})
+	}
+}
+
+func TestNewSkipMatcher(t *testing.T) {
+	// Capture startup warnings
+	var logs bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(output)
+
+	// Nil skip routes keep the defaults
+	matcher, err := NewSkipMatcher(RouteConfig{}, "test-service", DefaultSkipRoutes...)
+	assert.NoError(t, err)
+	assert.True(t, matcher.MatchRoute(http.MethodGet, "/metrics"))
+
+	// An empty list authenticates every route
+	matcher, err = NewSkipMatcher(RouteConfig{SkipRoutes: []RouteRule{}}, "test-service", DefaultSkipRoutes...)
+	assert.NoError(t, err)
+	assert.False(t, matcher.MatchRoute(http.MethodGet, "/metrics"))
+	assert.Empty(t, logs.String())
+
+	// Shadowed role routes are logged
+	_, err = NewSkipMatcher(RouteConfig{
+		SkipRoutes: []RouteRule{{Pattern: "/api/**"}},
+		RoleRoutes: []RoleRoute{{Path: "/api/admin", Roles: []string{"admin"}}},
+	}, "test-service")
+	assert.NoError(t, err)
+	assert.Contains(t, logs.String(), `test-service: skip rule "/api/**" shadows route "/api/admin" requiring roles [admin]`)
+
+	_, err = NewSkipMatcher(RouteConfig{SkipRoutes: []RouteRule{{Pattern: "api"}}}, "test-service")
+	assert.Error(t, err)
+}
@@ -0,0 +1,345 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// Client assertion types of token requests
+const (
+	// ClientAssertionType is a JWT signed with the client's registered key
+	// (RFC 7523)
+	ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	// ClientAssertionTypeSVID is a JWT-SVID of the client's workload
+	ClientAssertionTypeSVID = "urn:ietf:params:oauth:client-assertion-type:jwt-spiffe"
+)
+
+// DefaultAssertionLifetime is the longest lifetime of an accepted client
+// assertion unless configured otherwise
+const DefaultAssertionLifetime = 5 * time.Minute
+
+var (
+	// ErrInvalidAssertion is returned for client assertions that fail
+	// validation
+	ErrInvalidAssertion = errors.New("invalid client assertion")
+	// ErrAssertionReplayed is returned for client assertions that were
+	// already used
+	ErrAssertionReplayed = errors.New("client assertion already used")
+)
+
+// ReplayCache remembers the client assertions that were used
+type ReplayCache interface {
+	// Use records id until expiry. It returns false if id was already used.
+	Use(id string, expiry time.Time) bool
+}
+
+// replaySweepInterval is how often an InMemoryReplayCache drops expired
+// entries
+const replaySweepInterval = time.Minute
+
+// InMemoryReplayCache is a simple in-memory implementation of ReplayCache.
+// Expired entries are ignored and dropped at most once per minute.
+type InMemoryReplayCache struct {
+	mu        sync.Mutex
+	used      map[string]time.Time
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+// NewInMemoryReplayCache creates a new in-memory replay cache
+func NewInMemoryReplayCache() *InMemoryReplayCache {
+	return &InMemoryReplayCache{
+		used: make(map[string]time.Time),
+		now:  time.Now,
+	}
+}
+
+// Use records id until expiry and reports whether it was unused
+func (c *InMemoryReplayCache) Use(id string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(c.nextSweep) {
+		for usedID, usedExpiry := range c.used {
+			if now.After(usedExpiry) {
+				delete(c.used, usedID)
+			}
+		}
+		c.nextSweep = now.Add(replaySweepInterval)
+	}
+
+	if usedExpiry, exists := c.used[id]; exists && !now.After(usedExpiry) {
+		return false
+	}
+	c.used[id] = expiry
+	return true
+}
+
+// AssertionConfig configures client assertion validation
+type AssertionConfig struct {
+	// Audience is the URL of the token endpoint. Assertions must name it
+	// as their audience.
+	Audience string
+	// MaxLifetime is the longest accepted lifetime of an assertion. It
+	// defaults to DefaultAssertionLifetime.
+	MaxLifetime time.Duration
+	// ReplayCache remembers used assertions. It defaults to an in-memory
+	// cache, which is not shared between replicas of the token endpoint.
+	ReplayCache ReplayCache
+	// Bundles provides the JWT authorities that sign JWT-SVID assertions,
+	// usually a Workload API client. Without it, JWT-SVIDs are rejected.
+	Bundles jwtbundle.Source
+}
+
+// AssertionVerifier validates client assertions
+type AssertionVerifier struct {
+	audience    string
+	maxLifetime time.Duration
+	replay      ReplayCache
+	bundles     jwtbundle.Source
+}
+
+// NewAssertionVerifier creates a new client assertion verifier
+func NewAssertionVerifier(config *AssertionConfig) (*AssertionVerifier, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.Audience == "" {
+		return nil, fmt.Errorf("audience is required")
+	}
+
+	maxLifetime := config.MaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = DefaultAssertionLifetime
+	}
+	replay := config.ReplayCache
+	if replay == nil {
+		replay = NewInMemoryReplayCache()
+	}
+
+	return &AssertionVerifier{
+		audience:    config.Audience,
+		maxLifetime: maxLifetime,
+		replay:      replay,
+		bundles:     config.Bundles,
+	}, nil
+}
+
+// AssertionSubject returns the subject of an assertion without verifying
+// it, to find the client whose key verifies it
+func AssertionSubject(assertion string) (string, error) {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(assertion, &claims); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidAssertion)
+	}
+	return claims.Subject, nil
+}
+
+// VerifyPrivateKeyJWT validates a private_key_jwt assertion of client. It
+// must be signed with the client's key, have the client as issuer and
+// subject, be addressed to the token endpoint, be short-lived and carry a
+// jti that was not used before.
+func (v *AssertionVerifier) VerifyPrivateKeyJWT(assertion string, client *Client) error {
+	if client.PublicKey == nil {
+		return fmt.Errorf("%w: client %s has no public key", ErrInvalidAssertion, client.ID)
+	}
+	method, err := signingMethodForKey(client.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+
+	// Verify signature, expiration and not-before
+	var claims jwt.RegisteredClaims
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{method.Alg()}))
+	if _, err := parser.ParseWithClaims(assertion, &claims, func(*jwt.Token) (interface{}, error) {
+		return client.PublicKey, nil
+	}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+
+	if claims.Issuer != client.ID || claims.Subject != client.ID {
+		return fmt.Errorf("%w: issuer and subject must be the client ID", ErrInvalidAssertion)
+	}
+	if claims.ID == "" {
+		return fmt.Errorf("%w: missing jti", ErrInvalidAssertion)
+	}
+	if !claims.VerifyAudience(v.audience, true) {
+		return fmt.Errorf("%w: audience must be %s", ErrInvalidAssertion, v.audience)
+	}
+	if err := v.checkLifetime(claims.IssuedAt, claims.ExpiresAt); err != nil {
+		return err
+	}
+
+	return v.use(client.ID+":"+claims.ID, claims.ExpiresAt.Time)
+}
+
+// VerifySVID validates a JWT-SVID assertion of client. The SVID must be
+// signed by an authority of its trust domain, have the client's SPIFFE ID
+// as subject, be addressed to the token endpoint and be short-lived.
+// JWT-SVIDs are single-use: they are recorded by jti, or by a hash of their
+// signed content when they have none, so clients must fetch a fresh SVID for
+// every token request.
+func (v *AssertionVerifier) VerifySVID(assertion string, client *Client) error {
+	if v.bundles == nil {
+		return fmt.Errorf("%w: JWT-SVID assertions are not supported", ErrInvalidAssertion)
+	}
+
+	svid, err := jwtsvid.ParseAndValidate(assertion, v.bundles, []string{v.audience})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAssertion, err)
+	}
+	if svid.ID.String() != client.SPIFFEID {
+		return fmt.Errorf("%w: subject %s is not the client's SPIFFE ID", ErrInvalidAssertion, svid.ID)
+	}
+
+	var issuedAt *jwt.NumericDate
+	if iat, ok := svid.Claims["iat"].(float64); ok {
+		issuedAt = jwt.NewNumericDate(time.Unix(int64(iat), 0))
+	}
+	if err := v.checkLifetime(issuedAt, jwt.NewNumericDate(svid.Expiry)); err != nil {
+		return err
+	}
+
+	if jti, ok := svid.Claims["jti"].(string); ok && jti != "" {
+		return v.use(svid.ID.String()+":"+jti, svid.Expiry)
+	}
+	return v.use(svid.ID.String()+":"+assertionHash(assertion), svid.Expiry)
+}
+
+// assertionHash identifies an assertion without a jti. Only the signed
+// header and payload are hashed, since ECDSA signatures can be altered
+// without invalidating them.
+func assertionHash(assertion string) string {
+	signed := assertion
+	if i := strings.LastIndex(assertion, "."); i >= 0 {
+		signed = assertion[:i]
+	}
+	sum := sha256.Sum256([]byte(signed))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkLifetime rejects assertions that are valid for longer than the
+// maximum lifetime
+func (v *AssertionVerifier) checkLifetime(issuedAt, expiresAt *jwt.NumericDate) error {
+	if expiresAt == nil {
+		return fmt.Errorf("%w: missing expiration", ErrInvalidAssertion)
+	}
+	if time.Until(expiresAt.Time) > v.maxLifetime {
+		return fmt.Errorf("%w: expires in more than %v", ErrInvalidAssertion, v.maxLifetime)
+	}
+	if issuedAt != nil && expiresAt.Sub(issuedAt.Time) > v.maxLifetime {
+		return fmt.Errorf("%w: lifetime exceeds %v", ErrInvalidAssertion, v.maxLifetime)
+	}
+	return nil
+}
+
+// use marks an assertion as used
+func (v *AssertionVerifier) use(id string, expiry time.Time) error {
+	if !v.replay.Use(id, expiry) {
+		return ErrAssertionReplayed
+	}
+	return nil
+}
+
+// signingMethodForKey returns the signing method of JWTs verified by key
+func signingMethodForKey(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		// Each ECDSA algorithm is bound to one curve (RFC 7518)
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA curve %s", key.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type")
+	}
+}
+
+// NewClientAssertion creates a private_key_jwt assertion for clientID,
+// signed with key and addressed to the token endpoint audience. Each
+// assertion has a unique jti and can be used for a single token request.
+func NewClientAssertion(clientID, audience string, key crypto.PrivateKey, lifetime time.Duration) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("unsupported key type")
+	}
+	method, err := signingMethodForKey(signer.Public())
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Issuer:    clientID,
+		Subject:   clientID,
+		Audience:  jwt.ClaimStrings{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(lifetime)),
+		ID:        uuid.NewString(),
+	}
+	return jwt.NewWithClaims(method, claims).SignedString(key)
+}
+
+// SVIDFetcher fetches JWT-SVIDs of the workload, such as a workload.Client
+type SVIDFetcher interface {
+	FetchJWTSVID(ctx context.Context, audience string, extraAudiences ...string) (*jwtsvid.SVID, error)
+}
+
+// NewSVIDAssertion fetches a JWT-SVID addressed to the token endpoint
+// audience to use as client assertion. The assertion can be used for a
+// single token request, so fetcher must return a fresh SVID on every call
+// rather than a cached one.
+func NewSVIDAssertion(ctx context.Context, fetcher SVIDFetcher, audience string) (string, error) {
+	svid, err := fetcher.FetchJWTSVID(ctx, audience)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch JWT-SVID: %v", err)
+	}
+	return svid.Marshal(), nil
+}
+
+// ClientAssertionForm returns the form of a client_credentials token
+// request authenticated with assertion. scope may be empty to request all
+// scopes of the client.
+func ClientAssertionForm(clientID, assertionType, assertion, scope string) url.Values {
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {clientID},
+		"client_assertion_type": {assertionType},
+		"client_assertion":      {assertion},
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	return form
+}
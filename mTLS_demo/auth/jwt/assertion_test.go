@@ -0,0 +1,331 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestAssertionVerifier(t *testing.T) (*AssertionVerifier, *spiffetest.JWTAuthority, *spiffetest.JWTAuthority) {
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+	otherAuthority := spiffetest.NewJWTAuthority(t, "other.org", "key-1")
+
+	verifier, err := NewAssertionVerifier(&AssertionConfig{
+		Audience: testEndpoint,
+		Bundles:  jwtbundle.NewSet(authority.Bundle(t)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create assertion verifier: %v", err)
+	}
+
+	return verifier, authority, otherAuthority
+}
+
+func TestAssertionVerifier_VerifyPrivateKeyJWT(t *testing.T) {
+	verifier, _, _ := setupTestAssertionVerifier(t)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	client := &Client{ID: "reporting", PublicKey: &clientKey.PublicKey}
+
+	now := time.Now()
+	claims := func(modify func(*jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := jwt.RegisteredClaims{
+			Issuer:    "reporting",
+			Subject:   "reporting",
+			Audience:  jwt.ClaimStrings{testEndpoint},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			ID:        "assertion-1",
+		}
+		modify(&c)
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		key     *ecdsa.PrivateKey
+		claims  jwt.RegisteredClaims
+		wantErr error
+	}{
+		{
+			name:   "Valid assertion",
+			key:    clientKey,
+			claims: claims(func(c *jwt.RegisteredClaims) {}),
+		},
+		{
+			name:    "Other audience",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"https://other.example.org/token"} }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Missing jti",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.ID = "" }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Expires too late",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(time.Hour)) }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Lifetime too long",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(-10 * time.Minute)) }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Missing expiration",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Expired",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Second)) }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Other issuer",
+			key:     clientKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) { c.Issuer = "batch" }),
+			wantErr: ErrInvalidAssertion,
+		},
+		{
+			name:    "Signed by another key",
+			key:     otherKey,
+			claims:  claims(func(c *jwt.RegisteredClaims) {}),
+			wantErr: ErrInvalidAssertion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertion := signTestAssertion(t, tt.key, tt.claims)
+
+			err := verifier.VerifyPrivateKeyJWT(assertion, client)
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+
+			// Assertions are single-use
+			err = verifier.VerifyPrivateKeyJWT(assertion, client)
+			assert.True(t, errors.Is(err, ErrAssertionReplayed), "got %v", err)
+		})
+	}
+}
+
+func TestAssertionVerifier_ECDSACurves(t *testing.T) {
+	verifier, _, _ := setupTestAssertionVerifier(t)
+
+	tests := []struct {
+		name       string
+		curve      elliptic.Curve
+		wantMethod jwt.SigningMethod
+	}{
+		{name: "P-256", curve: elliptic.P256(), wantMethod: jwt.SigningMethodES256},
+		{name: "P-384", curve: elliptic.P384(), wantMethod: jwt.SigningMethodES384},
+		{name: "P-521", curve: elliptic.P521(), wantMethod: jwt.SigningMethodES512},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+			assert.NoError(t, err)
+
+			method, err := signingMethodForKey(&key.PublicKey)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantMethod, method)
+
+			// Assertions are signed and verified with the curve's algorithm
+			assertion, err := NewClientAssertion("reporting", testEndpoint, key, time.Minute)
+			assert.NoError(t, err)
+			token, _, err := new(jwt.Parser).ParseUnverified(assertion, &jwt.RegisteredClaims{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantMethod.Alg(), token.Header["alg"])
+
+			client := &Client{ID: "reporting", PublicKey: &key.PublicKey}
+			assert.NoError(t, verifier.VerifyPrivateKeyJWT(assertion, client))
+		})
+	}
+
+	// Curves without a JWS algorithm are rejected
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	assert.NoError(t, err)
+	_, err = signingMethodForKey(&key.PublicKey)
+	assert.Error(t, err)
+	_, err = NewClientAssertion("reporting", testEndpoint, key, time.Minute)
+	assert.Error(t, err)
+}
+
+func TestAssertionVerifier_VerifySVID(t *testing.T) {
+	verifier, authority, otherAuthority := setupTestAssertionVerifier(t)
+	client := &Client{ID: "frontend", SPIFFEID: frontendID}
+
+	tests := []struct {
+		name      string
+		assertion string
+		wantErr   bool
+	}{
+		{
+			name:      "Valid JWT-SVID",
+			assertion: authority.SignSVID(t, frontendID, []string{testEndpoint}, time.Now().Add(time.Minute)),
+		},
+		{
+			name:      "JWT-SVID of another workload",
+			assertion: authority.SignSVID(t, backendID, []string{testEndpoint}, time.Now().Add(time.Minute)),
+			wantErr:   true,
+		},
+		{
+			name:      "Other audience",
+			assertion: authority.SignSVID(t, frontendID, []string{"spiffe://example.org/backend"}, time.Now().Add(time.Minute)),
+			wantErr:   true,
+		},
+		{
+			name:      "Expires too late",
+			assertion: authority.SignSVID(t, frontendID, []string{testEndpoint}, time.Now().Add(time.Hour)),
+			wantErr:   true,
+		},
+		{
+			name:      "Untrusted authority",
+			assertion: otherAuthority.SignSVID(t, "spiffe://other.org/ns/demo/sa/frontend", []string{testEndpoint}, time.Now().Add(time.Minute)),
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.VerifySVID(tt.assertion, client)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidAssertion), "got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	// JWT-SVIDs without a jti are single-use too, even with another
+	// signature over the same content
+	assertion := authority.SignSVID(t, frontendID, []string{testEndpoint}, time.Now().Add(2*time.Minute))
+	assert.NoError(t, verifier.VerifySVID(assertion, client))
+	err := verifier.VerifySVID(assertion, client)
+	assert.True(t, errors.Is(err, ErrAssertionReplayed), "got %v", err)
+	resigned := strings.Join(append(strings.Split(assertion, ".")[:2], "c2lnbmF0dXJl"), ".")
+	assert.Equal(t, assertionHash(assertion), assertionHash(resigned))
+
+	// Without bundles, JWT-SVIDs are rejected
+	noBundles, err := NewAssertionVerifier(&AssertionConfig{Audience: testEndpoint})
+	assert.NoError(t, err)
+	err = noBundles.VerifySVID(authority.SignSVID(t, frontendID, []string{testEndpoint}, time.Now().Add(time.Minute)), client)
+	assert.True(t, errors.Is(err, ErrInvalidAssertion))
+}
+
+func TestInMemoryReplayCache_Use(t *testing.T) {
+	cache := NewInMemoryReplayCache()
+
+	assert.True(t, cache.Use("client:1", time.Now().Add(time.Minute)))
+	assert.False(t, cache.Use("client:1", time.Now().Add(time.Minute)))
+	assert.True(t, cache.Use("client:2", time.Now().Add(time.Minute)))
+
+	// Expired entries can be reused
+	assert.True(t, cache.Use("client:3", time.Now().Add(-time.Second)))
+	assert.True(t, cache.Use("client:3", time.Now().Add(time.Minute)))
+	assert.Len(t, cache.used, 3)
+
+	// Expired entries are dropped by the next sweep
+	cache.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	assert.True(t, cache.Use("client:4", time.Now().Add(time.Hour)))
+	assert.Len(t, cache.used, 1)
+	assert.False(t, cache.Use("client:4", time.Now().Add(time.Hour)))
+}
+
+// testSVIDFetcher returns JWT-SVIDs signed by a test authority
+type testSVIDFetcher struct {
+	t         *testing.T
+	authority *spiffetest.JWTAuthority
+	id        string
+}
+
+func (f testSVIDFetcher) FetchJWTSVID(ctx context.Context, audience string, extraAudiences ...string) (*jwtsvid.SVID, error) {
+	token := f.authority.SignSVID(f.t, f.id, append([]string{audience}, extraAudiences...), time.Now().Add(time.Minute))
+	return jwtsvid.ParseInsecure(token, []string{audience})
+}
+
+func TestTokenHandler_ClientAssertions(t *testing.T) {
+	_, tm, _, clientKey := setupTestTokenHandler(t)
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+
+	registry := NewInMemoryClientRegistry()
+	assert.NoError(t, registry.AddClient(&Client{
+		ID:          "reporting",
+		AuthMethods: []string{ClientAuthPrivateKeyJWT},
+		PublicKey:   &clientKey.PublicKey,
+		Roles:       []string{"reader"},
+	}))
+	assert.NoError(t, registry.AddClient(&Client{
+		ID:          "frontend",
+		AuthMethods: []string{ClientAuthSVID},
+		SPIFFEID:    frontendID,
+		Roles:       []string{"reader"},
+	}))
+	tokenHandler, err := NewTokenHandler(tm, &TokenHandlerConfig{
+		Registry:    registry,
+		Endpoint:    testEndpoint,
+		SVIDBundles: jwtbundle.NewSet(authority.Bundle(t)),
+	}, "test-service")
+	assert.NoError(t, err)
+
+	requestToken := func(clientID, assertionType, assertion string) int {
+		rr := httptest.NewRecorder()
+		tokenHandler.ServeHTTP(rr, newTokenRequest(ClientAssertionForm(clientID, assertionType, assertion, "")))
+		return rr.Code
+	}
+
+	// The client helper builds single-use assertions
+	assertion, err := NewClientAssertion("reporting", testEndpoint, clientKey, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, requestToken("reporting", ClientAssertionType, assertion))
+	assert.Equal(t, http.StatusUnauthorized, requestToken("reporting", ClientAssertionType, assertion))
+
+	assertion, err = NewClientAssertion("reporting", testEndpoint, clientKey, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, requestToken("reporting", ClientAssertionType, assertion))
+
+	// Assertions are addressed to one endpoint
+	assertion, err = NewClientAssertion("reporting", "https://other.example.org/token", clientKey, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, requestToken("reporting", ClientAssertionType, assertion))
+
+	// A JWT-SVID authenticates a client registered with its SPIFFE ID
+	assertion, err = NewSVIDAssertion(context.Background(), testSVIDFetcher{t: t, authority: authority, id: frontendID}, testEndpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, requestToken("frontend", ClientAssertionTypeSVID, assertion))
+	assert.Equal(t, http.StatusBadRequest, requestToken("", ClientAssertionTypeSVID, assertion))
+	assert.Equal(t, http.StatusUnauthorized, requestToken("reporting", ClientAssertionTypeSVID, assertion))
+	assert.Equal(t, http.StatusUnauthorized, requestToken("frontend", ClientAssertionTypeSVID, assertion))
+
+	// JWT-SVIDs are not accepted as private_key_jwt assertions
+	assert.Equal(t, http.StatusUnauthorized, requestToken("frontend", ClientAssertionType, assertion))
+}
@@ -0,0 +1,57 @@
+package jwt
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrCertificateMismatch is returned for certificate-bound tokens presented
+// without the client certificate they are bound to
+var ErrCertificateMismatch = errors.New("token is bound to another client certificate")
+
+// Confirmation is the cnf claim of a certificate-bound token (RFC 8705)
+type Confirmation struct {
+	// X5TS256 is the base64url SHA-256 thumbprint of the client
+	// certificate the token is bound to
+	X5TS256 string `json:"x5t#S256,omitempty"`
+}
+
+// CertificateThumbprint returns the x5t#S256 thumbprint of cert
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// peerCertificate returns the client certificate of a TLS connection, if
+// any. The handshake proved the client holds its key.
+func peerCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// VerifyCertificateBinding checks that a certificate-bound token is
+// presented over a connection using the certificate it is bound to. Tokens
+// without a cnf claim are bearer tokens and always pass.
+func VerifyCertificateBinding(claims *TokenClaims, state *tls.ConnectionState) error {
+	if claims.Confirmation == nil || claims.Confirmation.X5TS256 == "" {
+		return nil
+	}
+
+	cert := peerCertificate(state)
+	if cert == nil {
+		return fmt.Errorf("%w: no client certificate presented", ErrCertificateMismatch)
+	}
+
+	thumbprint := CertificateThumbprint(cert)
+	if subtle.ConstantTimeCompare([]byte(thumbprint), []byte(claims.Confirmation.X5TS256)) != 1 {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
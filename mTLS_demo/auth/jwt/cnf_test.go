@@ -0,0 +1,155 @@
+package jwt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func peerState(cert *x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+}
+
+func TestVerifyCertificateBinding(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	cert := ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate
+	otherCert := ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate
+
+	privateKey, publicKey := setupTestKeys(t)
+	tm, err := NewTokenManager(privateKey, publicKey)
+	assert.NoError(t, err)
+
+	// The thumbprint is carried in the cnf claim
+	token, err := tm.GenerateBoundToken("test-service", []string{"admin"}, "", time.Hour, cert)
+	assert.NoError(t, err)
+	claims, err := tm.VerifyToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, CertificateThumbprint(cert), claims.Confirmation.X5TS256)
+	assert.Len(t, claims.Confirmation.X5TS256, 43)
+
+	assert.NoError(t, VerifyCertificateBinding(claims, peerState(cert)))
+	assert.True(t, errors.Is(VerifyCertificateBinding(claims, peerState(otherCert)), ErrCertificateMismatch))
+	assert.True(t, errors.Is(VerifyCertificateBinding(claims, nil), ErrCertificateMismatch))
+
+	// Refreshed tokens stay bound
+	refreshed, err := tm.RefreshToken(token, time.Hour)
+	assert.NoError(t, err)
+	claims, err = tm.VerifyToken(refreshed)
+	assert.NoError(t, err)
+	assert.Equal(t, CertificateThumbprint(cert), claims.Confirmation.X5TS256)
+
+	// Bearer tokens are not bound
+	token, err = tm.GenerateToken("test-service", []string{"admin"}, "", time.Hour)
+	assert.NoError(t, err)
+	claims, err = tm.VerifyToken(token)
+	assert.NoError(t, err)
+	assert.Nil(t, claims.Confirmation)
+	assert.NoError(t, VerifyCertificateBinding(claims, nil))
+
+	_, err = tm.GenerateBoundToken("test-service", []string{"admin"}, "", time.Hour, nil)
+	assert.Error(t, err)
+}
+
+func TestJWTMiddleware_CertificateBoundToken(t *testing.T) {
+	middleware, tm := setupTestMiddleware(t)
+	ca := spiffetest.NewCA(t, "example.org")
+	cert := ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate
+	otherCert := ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/backend").Certificate
+
+	token, err := tm.GenerateBoundToken("test-service", []string{"admin"}, "", time.Hour, cert)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		tls            *tls.ConnectionState
+		expectedStatus int
+	}{
+		{
+			name:           "Same certificate",
+			tls:            peerState(cert),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Other certificate",
+			tls:            peerState(otherCert),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "No client certificate",
+			tls:            &tls.ConnectionState{},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "No TLS",
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.TLS = tt.tls
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestTokenHandler_CertificateBoundToken(t *testing.T) {
+	tokenHandler, tm, ca, _ := setupTestTokenHandler(t)
+	refreshHandler, err := NewRefreshHandler(tm, &RefreshHandlerConfig{Registry: tokenHandler.registry}, "test-service")
+	assert.NoError(t, err)
+	cert := ca.IssueSVID(t, frontendID).Certificate
+	otherCert := ca.IssueSVID(t, backendID).Certificate
+
+	// Create test request over mTLS
+	req := newTokenRequest(url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}})
+	req.TLS = peerState(cert)
+	rr := httptest.NewRecorder()
+	tokenHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The token is bound to the client certificate
+	var response TokenResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	claims, err := tm.VerifyToken(response.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, CertificateThumbprint(cert), claims.Confirmation.X5TS256)
+
+	// It can only be refreshed with the same certificate
+	req = httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	req.TLS = peerState(otherCert)
+	rr = httptest.NewRecorder()
+	refreshHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	req.TLS = peerState(cert)
+	rr = httptest.NewRecorder()
+	refreshHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
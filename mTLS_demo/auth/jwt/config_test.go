@@ -13,7 +13,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func setupTestKeys(t *testing.T) (string, string) {
+func setupTestKeyFiles(t *testing.T) (string, string) {
 	// Generate private key
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	assert.NoError(t, err)
@@ -66,7 +66,7 @@ func TestConfig_DefaultConfig(t *testing.T) {
 }
 
 func TestConfig_LoadKeys(t *testing.T) {
-	privateKeyPath, publicKeyPath := setupTestKeys(t)
+	privateKeyPath, publicKeyPath := setupTestKeyFiles(t)
 	defer os.Remove(privateKeyPath)
 	defer os.Remove(publicKeyPath)
 
@@ -81,7 +81,7 @@ func TestConfig_LoadKeys(t *testing.T) {
 }
 
 func TestConfig_Validate(t *testing.T) {
-	privateKeyPath, publicKeyPath := setupTestKeys(t)
+	privateKeyPath, publicKeyPath := setupTestKeyFiles(t)
 	defer os.Remove(privateKeyPath)
 	defer os.Remove(publicKeyPath)
 
@@ -179,7 +179,7 @@ func TestConfig_Validate(t *testing.T) {
 }
 
 func TestNewTokenManagerFromConfig(t *testing.T) {
-	privateKeyPath, publicKeyPath := setupTestKeys(t)
+	privateKeyPath, publicKeyPath := setupTestKeyFiles(t)
 	defer os.Remove(privateKeyPath)
 	defer os.Remove(publicKeyPath)
 
@@ -0,0 +1,517 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mTLS_demo/auth/common"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// GrantTypeTokenExchange is the grant type of token exchange requests
+// (RFC 8693)
+const GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+// Token types of token exchange requests
+const (
+	// TokenTypeAccessToken is a JWT issued by this service
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	// TokenTypeIDToken is an OIDC ID token
+	TokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
+	// TokenTypeSVID is a JWT-SVID
+	TokenTypeSVID = "urn:ietf:params:oauth:token-type:jwt-spiffe"
+)
+
+// Actor is the act claim of an exchanged token (RFC 8693 section 4.1). It
+// names the party acting on behalf of the subject; a nested Actor names the
+// party that acted before it.
+type Actor struct {
+	Subject string `json:"sub"`
+	Actor   *Actor `json:"act,omitempty"`
+}
+
+// Chain returns the subjects of the actor chain, the current actor first
+func (a *Actor) Chain() []string {
+	var chain []string
+	for actor := a; actor != nil; actor = actor.Actor {
+		chain = append(chain, actor.Subject)
+	}
+	return chain
+}
+
+// ExchangeRule allows an actor to exchange subject tokens for tokens
+// addressed to some audiences
+type ExchangeRule struct {
+	// Actor is the SPIFFE ID or service ID of the actor
+	Actor string
+	// SubjectTokenTypes are the types of subject tokens it may exchange
+	SubjectTokenTypes []string
+	// Audiences are the services it may request tokens for
+	Audiences []string
+	// Roles are the most roles an exchanged token carries. Subject tokens
+	// that carry roles narrow them further.
+	Roles []string
+	// Scopes are the scopes the actor may request. Subject tokens issued by
+	// this service narrow them further.
+	Scopes []string
+}
+
+// ExchangePolicy defines which actors may exchange which subject tokens,
+// for which audiences. Requests no rule allows are rejected.
+type ExchangePolicy struct {
+	Rules []ExchangeRule
+}
+
+// Validate checks the policy
+func (p *ExchangePolicy) Validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("exchange policy has no rules")
+	}
+	for _, rule := range p.Rules {
+		if rule.Actor == "" {
+			return fmt.Errorf("exchange rule without actor")
+		}
+		if len(rule.SubjectTokenTypes) == 0 {
+			return fmt.Errorf("exchange rule for %s has no subject token types", rule.Actor)
+		}
+		for _, tokenType := range rule.SubjectTokenTypes {
+			switch tokenType {
+			case TokenTypeAccessToken, TokenTypeIDToken, TokenTypeSVID:
+			default:
+				return fmt.Errorf("exchange rule for %s has unknown subject token type %q", rule.Actor, tokenType)
+			}
+		}
+		if len(rule.Audiences) == 0 {
+			return fmt.Errorf("exchange rule for %s has no audiences", rule.Actor)
+		}
+		if len(rule.Roles) == 0 {
+			return fmt.Errorf("exchange rule for %s has no roles", rule.Actor)
+		}
+	}
+	return nil
+}
+
+// rule returns the rule that allows actor to exchange a subject token for
+// audience
+func (p *ExchangePolicy) rule(actor, subjectTokenType, audience string) (*ExchangeRule, error) {
+	known := false
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if rule.Actor != actor || !contains(rule.SubjectTokenTypes, subjectTokenType) {
+			continue
+		}
+		known = true
+		if contains(rule.Audiences, audience) {
+			return rule, nil
+		}
+	}
+
+	if !known {
+		return nil, &tokenError{
+			reason:      "actor_not_allowed",
+			status:      http.StatusBadRequest,
+			code:        "unauthorized_client",
+			description: "actor may not exchange this subject token",
+		}
+	}
+	return nil, &tokenError{
+		reason:      "audience_not_allowed",
+		status:      http.StatusBadRequest,
+		code:        "invalid_target",
+		description: fmt.Sprintf("actor may not request tokens for %s", audience),
+	}
+}
+
+// IDTokenVerifier verifies OIDC ID tokens, usually an oidc.Middleware
+type IDTokenVerifier interface {
+	VerifyIDToken(ctx context.Context, rawIDToken string) (*common.Principal, error)
+}
+
+// ExchangeHandlerConfig holds the token exchange endpoint configuration
+type ExchangeHandlerConfig struct {
+	// Policy defines the exchanges the endpoint performs
+	Policy *ExchangePolicy
+	// Endpoint is the URL of the token exchange endpoint. JWT-SVID actor
+	// tokens must be addressed to it.
+	Endpoint string
+	// IDTokens verifies ID token subject tokens. Without it, ID tokens are
+	// rejected.
+	IDTokens IDTokenVerifier
+	// SVIDBundles verifies JWT-SVID subject and actor tokens, usually a
+	// Workload API client. Without it, JWT-SVIDs are rejected.
+	SVIDBundles jwtbundle.Source
+	// TokenDuration is the longest lifetime of issued tokens. It defaults
+	// to one hour; tokens never outlive their subject token.
+	TokenDuration time.Duration
+}
+
+// ExchangeHandler is an OAuth2 token exchange endpoint (RFC 8693). An actor
+// presents a subject token it received, such as a user's ID token, together
+// with its own actor token, and gets a down-scoped token for one audience
+// that carries the subject and an act claim naming the actor chain.
+type ExchangeHandler struct {
+	tokenManager  *TokenManager
+	policy        *ExchangePolicy
+	endpoint      string
+	idTokens      IDTokenVerifier
+	bundles       jwtbundle.Source
+	tokenDuration time.Duration
+	metrics       *common.AuthMetricsCollector
+	serviceName   string
+}
+
+// NewExchangeHandler creates a new token exchange handler
+func NewExchangeHandler(tokenManager *TokenManager, config *ExchangeHandlerConfig, serviceName string) (*ExchangeHandler, error) {
+	if tokenManager == nil {
+		return nil, fmt.Errorf("token manager cannot be nil")
+	}
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.Policy == nil {
+		return nil, fmt.Errorf("exchange policy cannot be nil")
+	}
+	if err := config.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid exchange policy: %v", err)
+	}
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("token exchange endpoint URL is required")
+	}
+
+	tokenDuration := config.TokenDuration
+	if tokenDuration == 0 {
+		tokenDuration = time.Hour
+	}
+
+	return &ExchangeHandler{
+		tokenManager:  tokenManager,
+		policy:        config.Policy,
+		endpoint:      config.Endpoint,
+		idTokens:      config.IDTokens,
+		bundles:       config.SVIDBundles,
+		tokenDuration: tokenDuration,
+		metrics:       common.NewAuthMetricsCollector(),
+		serviceName:   serviceName,
+	}, nil
+}
+
+// exchangeSubject is the verified subject of a subject token
+type exchangeSubject struct {
+	id string
+	// roles limit the roles of the exchanged token, unless empty
+	roles []string
+	// scopes limit the scopes of the exchanged token if scoped is set
+	scopes []string
+	scoped bool
+	// expiresAt caps the lifetime of the exchanged token
+	expiresAt time.Time
+	// actor is the act claim of the subject token
+	actor *Actor
+}
+
+// ServeHTTP handles token exchange requests
+func (h *ExchangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Only allow POST requests
+	if r.Method != http.MethodPost {
+		h.metrics.RecordAuthError(h.serviceName, "token_exchange", "invalid_method")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse form parameters
+	if err := r.ParseForm(); err != nil {
+		h.writeError(w, invalidRequest("invalid_request", "malformed request body"))
+		return
+	}
+
+	// Validate grant type
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case GrantTypeTokenExchange:
+	case "":
+		h.writeError(w, invalidRequest("missing_grant_type", "grant_type is required"))
+		return
+	default:
+		h.writeError(w, &tokenError{
+			reason:      "unsupported_grant_type",
+			status:      http.StatusBadRequest,
+			code:        "unsupported_grant_type",
+			description: fmt.Sprintf("grant type %q is not supported", grantType),
+		})
+		return
+	}
+
+	// Only access tokens are issued
+	if requested := r.PostForm.Get("requested_token_type"); requested != "" && requested != TokenTypeAccessToken {
+		h.writeError(w, invalidRequest("unsupported_token_type", "requested_token_type is not supported"))
+		return
+	}
+
+	// Exactly one audience must be requested
+	audiences := r.PostForm["audience"]
+	switch {
+	case len(audiences) == 0 || audiences[0] == "":
+		h.writeError(w, invalidRequest("missing_audience", "audience is required"))
+		return
+	case len(audiences) > 1:
+		h.writeError(w, &tokenError{
+			reason:      "multiple_audiences",
+			status:      http.StatusBadRequest,
+			code:        "invalid_target",
+			description: "only one audience may be requested",
+		})
+		return
+	}
+	audience := audiences[0]
+
+	// Identify the actor
+	actor, err := h.verifyActor(r)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	// Verify the subject token
+	subjectTokenType := r.PostForm.Get("subject_token_type")
+	subject, err := h.verifySubject(r, subjectTokenType, actor)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+
+	// Check the policy and narrow the roles and scopes of the token
+	rule, err := h.policy.rule(actor, subjectTokenType, audience)
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	roles := rule.Roles
+	if len(subject.roles) > 0 {
+		roles = intersect(rule.Roles, subject.roles)
+	}
+	if len(roles) == 0 {
+		h.writeError(w, &tokenError{
+			reason:      "no_roles",
+			status:      http.StatusBadRequest,
+			code:        "invalid_scope",
+			description: fmt.Sprintf("subject has none of the roles allowed for %s", audience),
+		})
+		return
+	}
+	allowedScopes := rule.Scopes
+	if subject.scoped {
+		allowedScopes = intersect(rule.Scopes, subject.scopes)
+	}
+	scopes, err := grantScopes(allowedScopes, r.PostForm.Get("scope"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	scope := strings.Join(scopes, " ")
+
+	// The token never outlives its subject token
+	duration := h.tokenDuration
+	if remaining := time.Until(subject.expiresAt); !subject.expiresAt.IsZero() && remaining < duration {
+		duration = remaining.Truncate(time.Second)
+	}
+	if duration <= 0 {
+		h.writeError(w, invalidRequest("invalid_subject_token", "subject token has expired"))
+		return
+	}
+
+	// Generate token for the audience, with the actor prepended to the act
+	// chain of the subject token, bound to the client certificate when the
+	// request arrives over mTLS (RFC 8705)
+	claims := h.tokenManager.newClaims(subject.id, roles, scope, duration)
+	claims.Audience = []string{audience}
+	claims.Actor = &Actor{Subject: actor, Actor: subject.actor}
+	if cert := peerCertificate(r.TLS); cert != nil {
+		claims.Confirmation = &Confirmation{X5TS256: CertificateThumbprint(cert)}
+	}
+	token, err := h.tokenManager.signToken(claims)
+	if err != nil {
+		h.metrics.RecordAuthError(h.serviceName, "token_exchange", "generation_failed")
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// Create response
+	resp := TokenResponse{
+		AccessToken:     token,
+		TokenType:       "Bearer",
+		ExpiresIn:       int64(duration.Seconds()),
+		ExpiresAt:       claims.ExpiresAt.Time,
+		Scope:           scope,
+		IssuedTokenType: TokenTypeAccessToken,
+	}
+
+	// Record metrics
+	h.metrics.RecordAuthRequest(h.serviceName, "token_exchange", "success", time.Since(start).Seconds())
+	h.metrics.RecordNewToken(h.serviceName)
+
+	// Send response
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeError records a rejected token exchange request and sends its error
+// response
+func (h *ExchangeHandler) writeError(w http.ResponseWriter, err error) {
+	h.metrics.RecordAuthError(h.serviceName, "token_exchange", writeTokenError(w, err))
+}
+
+// verifyActor verifies the actor token and returns the actor's SPIFFE ID or
+// service ID
+func (h *ExchangeHandler) verifyActor(r *http.Request) (string, error) {
+	token := r.PostForm.Get("actor_token")
+	if token == "" {
+		return "", invalidRequest("missing_actor_token", "actor_token is required")
+	}
+	invalid := invalidRequest("invalid_actor_token", "invalid actor token")
+
+	switch r.PostForm.Get("actor_token_type") {
+	case TokenTypeAccessToken:
+		claims, err := h.tokenManager.VerifyToken(token)
+		if err != nil {
+			return "", invalid
+		}
+		if err := h.tokenManager.ValidateClaims(claims); err != nil {
+			return "", invalid
+		}
+		// Certificate-bound tokens must be presented with their certificate
+		if err := VerifyCertificateBinding(claims, r.TLS); err != nil {
+			return "", invalid
+		}
+		// Exchanged tokens act for their subject and do not identify it
+		if claims.Actor != nil {
+			return "", invalidRequest("invalid_actor_token", "exchanged tokens cannot be actor tokens")
+		}
+		return claims.ServiceID, nil
+	case TokenTypeSVID:
+		if h.bundles == nil {
+			return "", invalidRequest("unsupported_token_type", "JWT-SVID actor tokens are not supported")
+		}
+		// The JWT-SVID must be addressed to the exchange endpoint
+		svid, err := jwtsvid.ParseAndValidate(token, h.bundles, []string{h.endpoint})
+		if err != nil {
+			return "", invalid
+		}
+		return svid.ID.String(), nil
+	case "":
+		return "", invalidRequest("missing_actor_token_type", "actor_token_type is required")
+	default:
+		return "", invalidRequest("unsupported_token_type", "unsupported actor_token_type")
+	}
+}
+
+// verifySubject verifies the subject token that actor received
+func (h *ExchangeHandler) verifySubject(r *http.Request, tokenType, actor string) (*exchangeSubject, error) {
+	token := r.PostForm.Get("subject_token")
+	if token == "" {
+		return nil, invalidRequest("missing_subject_token", "subject_token is required")
+	}
+	invalid := invalidRequest("invalid_subject_token", "invalid subject token")
+
+	switch tokenType {
+	case TokenTypeAccessToken:
+		claims, err := h.tokenManager.VerifyToken(token)
+		if err != nil {
+			return nil, invalid
+		}
+		if err := h.tokenManager.ValidateClaims(claims); err != nil {
+			return nil, invalid
+		}
+		// Certificate-bound tokens can only be exchanged by their holder
+		if err := VerifyCertificateBinding(claims, r.TLS); err != nil {
+			return nil, invalid
+		}
+		// Tokens for an audience can only be exchanged by it
+		if len(claims.Audience) > 0 && !claims.VerifyAudience(actor, true) {
+			return nil, invalidRequest("invalid_subject_token", "subject token is not addressed to the actor")
+		}
+		return &exchangeSubject{
+			id:        claims.ServiceID,
+			roles:     claims.Roles,
+			scopes:    strings.Fields(claims.Scope),
+			scoped:    true,
+			expiresAt: claims.ExpiresAt.Time,
+			actor:     claims.Actor,
+		}, nil
+	case TokenTypeIDToken:
+		if h.idTokens == nil {
+			return nil, invalidRequest("unsupported_token_type", "ID token subject tokens are not supported")
+		}
+		principal, err := h.idTokens.VerifyIDToken(r.Context(), token)
+		if err != nil {
+			return nil, invalid
+		}
+		subject := &exchangeSubject{id: principal.Subject, roles: principal.Roles}
+		if exp, ok := principal.Claims["exp"].(float64); ok {
+			subject.expiresAt = time.Unix(int64(exp), 0)
+		}
+		return subject, nil
+	case TokenTypeSVID:
+		if h.bundles == nil {
+			return nil, invalidRequest("unsupported_token_type", "JWT-SVID subject tokens are not supported")
+		}
+		// The JWT-SVID must be addressed to the actor
+		svid, err := jwtsvid.ParseAndValidate(token, h.bundles, []string{actor})
+		if err != nil {
+			return nil, invalid
+		}
+		return &exchangeSubject{id: svid.ID.String(), expiresAt: svid.Expiry}, nil
+	case "":
+		return nil, invalidRequest("missing_subject_token_type", "subject_token_type is required")
+	default:
+		return nil, invalidRequest("unsupported_token_type", "unsupported subject_token_type")
+	}
+}
+
+// TokenExchangeForm returns the form of a token exchange request for a
+// token addressed to audience. scope may be empty to request all scopes the
+// policy allows.
+func TokenExchangeForm(subjectToken, subjectTokenType, actorToken, actorTokenType, audience, scope string) url.Values {
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {subjectTokenType},
+		"actor_token":        {actorToken},
+		"actor_token_type":   {actorTokenType},
+		"audience":           {audience},
+	}
+	if scope != "" {
+		form.Set("scope", scope)
+	}
+	return form
+}
+
+// contains reports whether values contains value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// intersect returns the values of a that are also in b, in the order of a
+func intersect(a, b []string) []string {
+	var values []string
+	for _, v := range a {
+		if contains(b, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,449 @@
+package jwt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testExchangeEndpoint = "https://auth.example.org/auth/exchange"
+	databaseID           = "spiffe://example.org/ns/demo/sa/database"
+)
+
+// testIDTokens accepts the ID tokens it maps to a principal
+type testIDTokens map[string]*common.Principal
+
+func (v testIDTokens) VerifyIDToken(ctx context.Context, rawIDToken string) (*common.Principal, error) {
+	principal, ok := v[rawIDToken]
+	if !ok {
+		return nil, errors.New("invalid ID token")
+	}
+	return principal, nil
+}
+
+// setupTestExchangeHandler creates a token exchange endpoint where frontend
+// exchanges user tokens for backend, backend exchanges them again for
+// database and batch exchanges JWT-SVIDs for backend
+func setupTestExchangeHandler(t *testing.T) (*ExchangeHandler, *TokenManager, *spiffetest.JWTAuthority) {
+	privateKey, publicKey := setupTestKeys(t)
+	tm, err := NewTokenManager(privateKey, publicKey)
+	if err != nil {
+		t.Fatalf("Failed to create token manager: %v", err)
+	}
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+
+	alice := common.NewPrincipal(common.AuthMethodOIDC, "alice")
+	alice.Roles = []string{"reader"}
+	alice.Claims = map[string]interface{}{"exp": float64(time.Now().Add(10 * time.Minute).Unix())}
+	bob := common.NewPrincipal(common.AuthMethodOIDC, "bob")
+	bob.Roles = []string{"auditor"}
+
+	policy := &ExchangePolicy{Rules: []ExchangeRule{
+		{
+			Actor:             frontendID,
+			SubjectTokenTypes: []string{TokenTypeIDToken, TokenTypeAccessToken},
+			Audiences:         []string{backendID},
+			Roles:             []string{"reader", "writer"},
+			Scopes:            []string{"orders:read", "orders:write"},
+		},
+		{
+			Actor:             backendID,
+			SubjectTokenTypes: []string{TokenTypeAccessToken},
+			Audiences:         []string{databaseID},
+			Roles:             []string{"reader"},
+			Scopes:            []string{"orders:read"},
+		},
+		{
+			Actor:             "batch",
+			SubjectTokenTypes: []string{TokenTypeSVID},
+			Audiences:         []string{backendID},
+			Roles:             []string{"writer"},
+		},
+	}}
+
+	exchangeHandler, err := NewExchangeHandler(tm, &ExchangeHandlerConfig{
+		Policy:      policy,
+		Endpoint:    testExchangeEndpoint,
+		IDTokens:    testIDTokens{"alice-id-token": alice, "bob-id-token": bob},
+		SVIDBundles: jwtbundle.NewSet(authority.Bundle(t)),
+	}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create token exchange handler: %v", err)
+	}
+
+	return exchangeHandler, tm, authority
+}
+
+// exchangeToken sends a token exchange request and returns the recorded
+// response
+func exchangeToken(handler *ExchangeHandler, form url.Values) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newTokenRequest(form))
+	return rr
+}
+
+func TestExchangeHandler_ServeHTTP(t *testing.T) {
+	handler, tm, authority := setupTestExchangeHandler(t)
+
+	frontendSVID := authority.SignSVID(t, frontendID, []string{testExchangeEndpoint}, time.Now().Add(time.Minute))
+	batchToken, err := tm.GenerateToken("batch", []string{"writer"}, "", time.Hour)
+	assert.NoError(t, err)
+	userToken, err := tm.GenerateToken("carol", []string{"reader"}, "orders:read", time.Hour)
+	assert.NoError(t, err)
+	workloadSVID := authority.SignSVID(t, "spiffe://example.org/ns/demo/sa/worker", []string{"batch"}, time.Now().Add(time.Minute))
+
+	tests := []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+		expectedError  string
+		expectedRoles  []string
+		expectedScope  string
+	}{
+		{
+			name:           "ID token for allowed audience",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusOK,
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "orders:read orders:write",
+		},
+		{
+			name:           "Access token narrows scopes",
+			form:           TokenExchangeForm(userToken, TokenTypeAccessToken, frontendSVID, TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusOK,
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "orders:read",
+		},
+		{
+			name:           "Requested scope",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, "orders:read"),
+			expectedStatus: http.StatusOK,
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "orders:read",
+		},
+		{
+			name:           "JWT-SVID subject with access token actor",
+			form:           TokenExchangeForm(workloadSVID, TokenTypeSVID, batchToken, TokenTypeAccessToken, backendID, ""),
+			expectedStatus: http.StatusOK,
+			expectedRoles:  []string{"writer"},
+		},
+		{
+			name:           "Scope beyond subject token",
+			form:           TokenExchangeForm(userToken, TokenTypeAccessToken, frontendSVID, TokenTypeSVID, backendID, "orders:write"),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_scope",
+		},
+		{
+			name:           "Subject without allowed roles",
+			form:           TokenExchangeForm("bob-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_scope",
+		},
+		{
+			name:           "Audience not allowed",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, databaseID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_target",
+		},
+		{
+			name:           "Subject token type not allowed",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, batchToken, TokenTypeAccessToken, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "unauthorized_client",
+		},
+		{
+			name:           "Invalid subject token",
+			form:           TokenExchangeForm("mallory-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "JWT-SVID subject for another actor",
+			form:           TokenExchangeForm(workloadSVID, TokenTypeSVID, frontendSVID, TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "Actor JWT-SVID for another audience",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, authority.SignSVID(t, frontendID, []string{backendID}, time.Now().Add(time.Minute)), TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "Missing actor token",
+			form:           TokenExchangeForm("alice-id-token", TokenTypeIDToken, "", TokenTypeSVID, backendID, ""),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name: "Missing audience",
+			form: url.Values{
+				"grant_type":         {GrantTypeTokenExchange},
+				"subject_token":      {"alice-id-token"},
+				"subject_token_type": {TokenTypeIDToken},
+				"actor_token":        {frontendSVID},
+				"actor_token_type":   {TokenTypeSVID},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name: "Multiple audiences",
+			form: func() url.Values {
+				form := TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, "")
+				form.Add("audience", databaseID)
+				return form
+			}(),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_target",
+		},
+		{
+			name: "Unsupported requested token type",
+			form: func() url.Values {
+				form := TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, "")
+				form.Set("requested_token_type", TokenTypeIDToken)
+				return form
+			}(),
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "Client credentials grant",
+			form:           url.Values{"grant_type": {"client_credentials"}},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "unsupported_grant_type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := exchangeToken(handler, tt.form)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+			assert.Equal(t, "no-cache", rr.Header().Get("Pragma"))
+
+			if tt.expectedStatus != http.StatusOK {
+				var errResp TokenErrorResponse
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&errResp))
+				assert.Equal(t, tt.expectedError, errResp.Error)
+				return
+			}
+
+			var response TokenResponse
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+			assert.Equal(t, TokenTypeAccessToken, response.IssuedTokenType)
+			assert.Equal(t, tt.expectedScope, response.Scope)
+
+			claims, err := tm.VerifyToken(response.AccessToken)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedRoles, claims.Roles)
+			assert.Equal(t, []string{backendID}, []string(claims.Audience))
+		})
+	}
+}
+
+func TestExchangeHandler_ActorChain(t *testing.T) {
+	handler, tm, authority := setupTestExchangeHandler(t)
+	ca := spiffetest.NewCA(t, "example.org")
+	backendCert := ca.IssueSVID(t, backendID).Certificate
+
+	// frontend exchanges the user's ID token for backend
+	frontendSVID := authority.SignSVID(t, frontendID, []string{testExchangeEndpoint}, time.Now().Add(time.Minute))
+	rr := exchangeToken(handler, TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response TokenResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	claims, err := tm.VerifyToken(response.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "alice", claims.ServiceID)
+	assert.Equal(t, []string{frontendID}, claims.Actor.Chain())
+
+	// The token does not outlive the ID token
+	assert.LessOrEqual(t, response.ExpiresIn, int64(600))
+	assert.True(t, claims.ExpiresAt.Before(time.Now().Add(11*time.Minute)))
+
+	// Exchanged tokens cannot identify an actor
+	rr = exchangeToken(handler, TokenExchangeForm(response.AccessToken, TokenTypeAccessToken, response.AccessToken, TokenTypeAccessToken, databaseID, ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// backend exchanges it again for database over mTLS
+	backendToken, err := tm.GenerateBoundToken(backendID, []string{"service"}, "", time.Hour, backendCert)
+	assert.NoError(t, err)
+	req := newTokenRequest(TokenExchangeForm(response.AccessToken, TokenTypeAccessToken, backendToken, TokenTypeAccessToken, databaseID, ""))
+	req.TLS = peerState(backendCert)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// The actor is prepended to the act chain, and the token is bound to
+	// the certificate of the request
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+	claims, err = tm.VerifyToken(response.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, []string{databaseID}, []string(claims.Audience))
+	assert.Equal(t, []string{backendID, frontendID}, claims.Actor.Chain())
+	assert.Equal(t, "orders:read", response.Scope)
+	assert.Equal(t, CertificateThumbprint(backendCert), claims.Confirmation.X5TS256)
+
+	// Exchanged tokens cannot be refreshed past their subject token
+	_, err = tm.RefreshToken(response.AccessToken, time.Hour)
+	assert.Error(t, err)
+	req = httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.Header.Set("Authorization", "Bearer "+response.AccessToken)
+	req.TLS = peerState(backendCert)
+	rr = httptest.NewRecorder()
+	refreshHandler, err := NewRefreshHandler(tm, &RefreshHandlerConfig{Registry: NewInMemoryClientRegistry()}, "test-service")
+	assert.NoError(t, err)
+	refreshHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	// Without its certificate, the backend token is not a valid actor token
+	rr = exchangeToken(handler, TokenExchangeForm(response.AccessToken, TokenTypeAccessToken, backendToken, TokenTypeAccessToken, databaseID, ""))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestNewExchangeHandler_InvalidConfig(t *testing.T) {
+	privateKey, publicKey := setupTestKeys(t)
+	tm, err := NewTokenManager(privateKey, publicKey)
+	assert.NoError(t, err)
+
+	validRule := ExchangeRule{
+		Actor:             frontendID,
+		SubjectTokenTypes: []string{TokenTypeIDToken},
+		Audiences:         []string{backendID},
+		Roles:             []string{"reader"},
+	}
+
+	tests := []struct {
+		name   string
+		config *ExchangeHandlerConfig
+	}{
+		{
+			name: "Nil config",
+		},
+		{
+			name:   "Missing policy",
+			config: &ExchangeHandlerConfig{Endpoint: testExchangeEndpoint},
+		},
+		{
+			name:   "Missing endpoint",
+			config: &ExchangeHandlerConfig{Policy: &ExchangePolicy{Rules: []ExchangeRule{validRule}}},
+		},
+		{
+			name:   "Empty policy",
+			config: &ExchangeHandlerConfig{Policy: &ExchangePolicy{}, Endpoint: testExchangeEndpoint},
+		},
+		{
+			name: "Unknown subject token type",
+			config: &ExchangeHandlerConfig{Policy: &ExchangePolicy{Rules: []ExchangeRule{{
+				Actor:             frontendID,
+				SubjectTokenTypes: []string{"urn:ietf:params:oauth:token-type:saml2"},
+				Audiences:         []string{backendID},
+				Roles:             []string{"reader"},
+			}}}, Endpoint: testExchangeEndpoint},
+		},
+		{
+			name: "Rule without audiences",
+			config: &ExchangeHandlerConfig{Policy: &ExchangePolicy{Rules: []ExchangeRule{{
+				Actor:             frontendID,
+				SubjectTokenTypes: []string{TokenTypeIDToken},
+				Roles:             []string{"reader"},
+			}}}, Endpoint: testExchangeEndpoint},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewExchangeHandler(tm, tt.config, "test-service")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestJWTMiddleware_ExchangedTokenAudience(t *testing.T) {
+	handler, tm, authority := setupTestExchangeHandler(t)
+
+	// frontend exchanges the user's ID token for backend
+	frontendSVID := authority.SignSVID(t, frontendID, []string{testExchangeEndpoint}, time.Now().Add(time.Minute))
+	rr := exchangeToken(handler, TokenExchangeForm("alice-id-token", TokenTypeIDToken, frontendSVID, TokenTypeSVID, backendID, ""))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var response TokenResponse
+	assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+
+	// Tokens without an audience are accepted everywhere
+	clientToken, err := tm.GenerateToken("batch", []string{"writer"}, "", time.Hour)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		audiences      []string
+		token          string
+		expectedStatus int
+	}{
+		{
+			name:           "Addressed to this service",
+			audiences:      []string{backendID},
+			token:          response.AccessToken,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Addressed to another service",
+			audiences:      []string{databaseID},
+			token:          response.AccessToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "No accepted audiences",
+			token:          response.AccessToken,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Token without audience",
+			audiences:      []string{databaseID},
+			token:          clientToken,
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := NewJWTMiddleware(tm, "test-service")
+			middleware.SetAudiences(tt.audiences...)
+
+			// Create test handler
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(next).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
@@ -1,21 +1,18 @@
 package jwt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"mTLS_demo/auth/common"
-)
 
-// TokenRequest represents a token request
-type TokenRequest struct {
-	ServiceID string   `json:"service_id"`
-	Roles     []string `json:"roles"`
-	Scope     string   `json:"scope,omitempty"`
-}
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+)
 
 // TokenResponse represents a token response
 type TokenResponse struct {
@@ -23,22 +20,124 @@ type TokenResponse struct {
 	TokenType   string    `json:"token_type"`
 	ExpiresIn   int64     `json:"expires_in"`
 	ExpiresAt   time.Time `json:"expires_at"`
+	Scope       string    `json:"scope,omitempty"`
+	// IssuedTokenType is set by the token exchange endpoint (RFC 8693)
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// TokenErrorResponse is an error response of the token endpoint (RFC 6749
+// section 5.2)
+type TokenErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// tokenError is a rejected token request
+type tokenError struct {
+	// reason is recorded in metrics
+	reason      string
+	status      int
+	code        string
+	description string
 }
 
-// TokenHandler handles token requests
+func (e *tokenError) Error() string {
+	return e.code + ": " + e.description
+}
+
+// invalidRequest creates an error for a malformed token request
+func invalidRequest(reason, description string) *tokenError {
+	return &tokenError{reason: reason, status: http.StatusBadRequest, code: "invalid_request", description: description}
+}
+
+// invalidClient creates an error for a client that failed to authenticate
+func invalidClient(reason, description string) *tokenError {
+	return &tokenError{reason: reason, status: http.StatusUnauthorized, code: "invalid_client", description: description}
+}
+
+// TokenHandlerConfig holds the token endpoint configuration
+type TokenHandlerConfig struct {
+	// Registry holds the clients allowed to request tokens
+	Registry ClientRegistry
+	// Endpoint is the URL of the token endpoint. Client assertions must be
+	// addressed to it.
+	Endpoint string
+	// Certificates verifies client certificates for tls_client_auth,
+	// usually an mtls.Middleware
+	Certificates common.Authenticator
+	// APIKeys verifies API keys, usually an apikey.Middleware. Keys are
+	// issued with the client ID as their owner.
+	APIKeys common.Authenticator
+	// TokenDuration is the lifetime of issued tokens. It defaults to one
+	// hour.
+	TokenDuration time.Duration
+
+	// AssertionLifetime is the longest accepted lifetime of a client
+	// assertion. It defaults to DefaultAssertionLifetime.
+	AssertionLifetime time.Duration
+	// ReplayCache remembers used client assertions. It defaults to an
+	// in-memory cache.
+	ReplayCache ReplayCache
+	// SVIDBundles verifies JWT-SVID client assertions, usually a Workload
+	// API client. Without it, JWT-SVID assertions are rejected.
+	SVIDBundles jwtbundle.Source
+}
+
+// TokenHandler is an OAuth2 token endpoint for the client_credentials grant
+// (RFC 6749 section 4.4). Callers authenticate with a client certificate,
+// an API key, a client assertion signed with their registered key or a
+// JWT-SVID; their tokens get the roles and scopes of their registration.
 type TokenHandler struct {
-	tokenManager *TokenManager
-	metrics      *common.AuthMetricsCollector
-	serviceName  string
+	tokenManager  *TokenManager
+	registry      ClientRegistry
+	assertions    *AssertionVerifier
+	certificates  common.Authenticator
+	apiKeys       common.Authenticator
+	tokenDuration time.Duration
+	metrics       *common.AuthMetricsCollector
+	serviceName   string
 }
 
 // NewTokenHandler creates a new token handler
-func NewTokenHandler(tokenManager *TokenManager, serviceName string) *TokenHandler {
-	return &TokenHandler{
-		tokenManager: tokenManager,
-		metrics:      common.NewAuthMetricsCollector(),
-		serviceName:  serviceName,
+func NewTokenHandler(tokenManager *TokenManager, config *TokenHandlerConfig, serviceName string) (*TokenHandler, error) {
+	if tokenManager == nil {
+		return nil, fmt.Errorf("token manager cannot be nil")
+	}
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
 	}
+	if config.Registry == nil {
+		return nil, fmt.Errorf("client registry cannot be nil")
+	}
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("token endpoint URL is required")
+	}
+
+	assertions, err := NewAssertionVerifier(&AssertionConfig{
+		Audience:    config.Endpoint,
+		MaxLifetime: config.AssertionLifetime,
+		ReplayCache: config.ReplayCache,
+		Bundles:     config.SVIDBundles,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create assertion verifier: %v", err)
+	}
+
+	tokenDuration := config.TokenDuration
+	if tokenDuration == 0 {
+		tokenDuration = time.Hour
+	}
+
+	return &TokenHandler{
+		tokenManager:  tokenManager,
+		registry:      config.Registry,
+		assertions:    assertions,
+		certificates:  config.Certificates,
+		apiKeys:       config.APIKeys,
+		tokenDuration: tokenDuration,
+		metrics:       common.NewAuthMetricsCollector(),
+		serviceName:   serviceName,
+	}, nil
 }
 
 // ServeHTTP handles token requests
@@ -52,30 +151,51 @@ func (h *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse request body
-	var req TokenRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.metrics.RecordAuthError(h.serviceName, "token", "invalid_request")
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	// Parse form parameters
+	if err := r.ParseForm(); err != nil {
+		h.writeError(w, invalidRequest("invalid_request", "malformed request body"))
 		return
 	}
 
-	// Validate request
-	if req.ServiceID == "" {
-		h.metrics.RecordAuthError(h.serviceName, "token", "missing_service_id")
-		http.Error(w, "Service ID is required", http.StatusBadRequest)
+	// Validate grant type
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case "client_credentials":
+	case "":
+		h.writeError(w, invalidRequest("missing_grant_type", "grant_type is required"))
+		return
+	default:
+		h.writeError(w, &tokenError{
+			reason:      "unsupported_grant_type",
+			status:      http.StatusBadRequest,
+			code:        "unsupported_grant_type",
+			description: fmt.Sprintf("grant type %q is not supported", grantType),
+		})
 		return
 	}
 
-	if len(req.Roles) == 0 {
-		h.metrics.RecordAuthError(h.serviceName, "token", "missing_roles")
-		http.Error(w, "At least one role is required", http.StatusBadRequest)
+	// Authenticate the client
+	client, err := h.authenticateClient(r)
+	if err != nil {
+		h.writeError(w, err)
 		return
 	}
 
-	// Generate token
-	tokenDuration := 1 * time.Hour // Configurable
-	token, err := h.tokenManager.GenerateToken(req.ServiceID, req.Roles, req.Scope, tokenDuration)
+	// Grant the requested scopes
+	scopes, err := grantScopes(client.Scopes, r.PostForm.Get("scope"))
+	if err != nil {
+		h.writeError(w, err)
+		return
+	}
+	scope := strings.Join(scopes, " ")
+
+	// Generate token, bound to the client certificate when the request
+	// arrives over mTLS (RFC 8705)
+	var token string
+	if cert := peerCertificate(r.TLS); cert != nil {
+		token, err = h.tokenManager.GenerateBoundToken(client.ID, client.Roles, scope, h.tokenDuration, cert)
+	} else {
+		token, err = h.tokenManager.GenerateToken(client.ID, client.Roles, scope, h.tokenDuration)
+	}
 	if err != nil {
 		h.metrics.RecordAuthError(h.serviceName, "token", "generation_failed")
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
@@ -83,37 +203,241 @@ func (h *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create response
-	expiresAt := time.Now().Add(tokenDuration)
 	resp := TokenResponse{
 		AccessToken: token,
 		TokenType:   "Bearer",
-		ExpiresIn:   int64(tokenDuration.Seconds()),
-		ExpiresAt:   expiresAt,
+		ExpiresIn:   int64(h.tokenDuration.Seconds()),
+		ExpiresAt:   time.Now().Add(h.tokenDuration),
+		Scope:       scope,
 	}
 
 	// Record metrics
-	h.metrics.RecordAuthRequest(h.serviceName, "token", "success", time.Since(start))
+	h.metrics.RecordAuthRequest(h.serviceName, "token", "success", time.Since(start).Seconds())
 	h.metrics.RecordNewToken(h.serviceName)
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// RefreshHandler handles token refresh requests
+// writeError records a rejected token request and sends its error response
+func (h *TokenHandler) writeError(w http.ResponseWriter, err error) {
+	h.metrics.RecordAuthError(h.serviceName, "token", writeTokenError(w, err))
+}
+
+// writeTokenError sends the error response of a rejected token request and
+// returns the reason to record in metrics
+func writeTokenError(w http.ResponseWriter, err error) string {
+	tokenErr, ok := err.(*tokenError)
+	if !ok {
+		tokenErr = &tokenError{reason: "internal_error", status: http.StatusInternalServerError, code: "server_error"}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if tokenErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+	}
+	w.WriteHeader(tokenErr.status)
+	json.NewEncoder(w).Encode(TokenErrorResponse{Error: tokenErr.code, ErrorDescription: tokenErr.description})
+	return tokenErr.reason
+}
+
+// authenticateClient authenticates the caller with exactly one client
+// authentication method and returns its registration
+func (h *TokenHandler) authenticateClient(r *http.Request) (*Client, error) {
+	clientID := r.PostForm.Get("client_id")
+	hasAssertion := r.PostForm.Get("client_assertion") != "" || r.PostForm.Get("client_assertion_type") != ""
+	hasAPIKey := r.Header.Get("X-API-Key") != ""
+
+	switch {
+	case hasAssertion && hasAPIKey:
+		return nil, invalidRequest("multiple_credentials", "only one client authentication method may be used")
+	case hasAssertion:
+		return h.authenticateAssertion(r, clientID)
+	case hasAPIKey:
+		return h.authenticateAPIKey(r, clientID)
+	case peerCertificate(r.TLS) != nil:
+		return h.authenticateCertificate(r, clientID)
+	default:
+		return nil, invalidClient("missing_credentials", "client authentication required")
+	}
+}
+
+// authenticateCertificate authenticates a client by the SPIFFE ID of its
+// certificate (tls_client_auth)
+func (h *TokenHandler) authenticateCertificate(r *http.Request, clientID string) (*Client, error) {
+	if h.certificates == nil {
+		return nil, invalidClient("unsupported_auth_method", "tls_client_auth is not supported")
+	}
+	if clientID == "" {
+		return nil, invalidRequest("missing_client_id", "client_id is required")
+	}
+
+	principal, err := h.certificates.Authenticate(r)
+	if err != nil {
+		return nil, invalidClient("invalid_certificate", "invalid client certificate")
+	}
+
+	client, err := h.lookupClient(r.Context(), clientID, ClientAuthTLS)
+	if err != nil {
+		return nil, err
+	}
+	if principal.SPIFFEID.String() != client.SPIFFEID {
+		return nil, invalidClient("certificate_mismatch", "certificate does not belong to the client")
+	}
+	return client, nil
+}
+
+// authenticateAPIKey authenticates a client by an API key it owns
+func (h *TokenHandler) authenticateAPIKey(r *http.Request, clientID string) (*Client, error) {
+	if h.apiKeys == nil {
+		return nil, invalidClient("unsupported_auth_method", "API keys are not supported")
+	}
+
+	principal, err := h.apiKeys.Authenticate(r)
+	if err != nil {
+		return nil, invalidClient("invalid_key", "invalid API key")
+	}
+	if clientID != "" && clientID != principal.Subject {
+		return nil, invalidClient("client_mismatch", "API key does not belong to the client")
+	}
+
+	return h.lookupClient(r.Context(), principal.Subject, ClientAuthAPIKey)
+}
+
+// authenticateAssertion authenticates a client by a JWT signed with its
+// registered key (private_key_jwt) or by a JWT-SVID of its workload
+func (h *TokenHandler) authenticateAssertion(r *http.Request, clientID string) (*Client, error) {
+	assertion := r.PostForm.Get("client_assertion")
+
+	var client *Client
+	var err error
+	switch r.PostForm.Get("client_assertion_type") {
+	case ClientAssertionType:
+		// The subject of the assertion identifies the client
+		subject, subjectErr := AssertionSubject(assertion)
+		if subjectErr != nil {
+			return nil, invalidClient("invalid_assertion", "malformed client assertion")
+		}
+		if clientID != "" && clientID != subject {
+			return nil, invalidClient("client_mismatch", "client assertion does not belong to the client")
+		}
+		if client, err = h.lookupClient(r.Context(), subject, ClientAuthPrivateKeyJWT); err != nil {
+			return nil, err
+		}
+		err = h.assertions.VerifyPrivateKeyJWT(assertion, client)
+	case ClientAssertionTypeSVID:
+		// The subject of a JWT-SVID is a SPIFFE ID, so the client must be
+		// named
+		if clientID == "" {
+			return nil, invalidRequest("missing_client_id", "client_id is required")
+		}
+		if client, err = h.lookupClient(r.Context(), clientID, ClientAuthSVID); err != nil {
+			return nil, err
+		}
+		err = h.assertions.VerifySVID(assertion, client)
+	default:
+		return nil, invalidClient("invalid_assertion_type", "unsupported client_assertion_type")
+	}
+
+	switch {
+	case errors.Is(err, ErrAssertionReplayed):
+		return nil, invalidClient("assertion_replayed", "client assertion was already used")
+	case err != nil:
+		return nil, invalidClient("invalid_assertion", "invalid client assertion")
+	}
+	return client, nil
+}
+
+// lookupClient returns the registration of a client that may authenticate
+// with method
+func (h *TokenHandler) lookupClient(ctx context.Context, clientID, method string) (*Client, error) {
+	client, err := h.registry.GetClient(ctx, clientID)
+	if err != nil {
+		return nil, invalidClient("unknown_client", "unknown client")
+	}
+	if !client.AllowsAuthMethod(method) {
+		return nil, invalidClient("auth_method_not_allowed", fmt.Sprintf("client may not use %s", method))
+	}
+	return client, nil
+}
+
+// grantScopes returns the scopes of a token: the requested scopes, which
+// must all be allowed, or all allowed scopes
+func grantScopes(allowed []string, requested string) ([]string, error) {
+	if requested == "" {
+		return allowed, nil
+	}
+
+	registered := make(map[string]bool)
+	for _, scope := range allowed {
+		registered[scope] = true
+	}
+
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !registered[scope] {
+			return nil, &tokenError{
+				reason:      "invalid_scope",
+				status:      http.StatusBadRequest,
+				code:        "invalid_scope",
+				description: fmt.Sprintf("scope %q is not granted", scope),
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// RefreshHandlerConfig holds the refresh endpoint configuration
+type RefreshHandlerConfig struct {
+	// Registry holds the clients whose tokens can be refreshed, usually the
+	// registry of the TokenHandler
+	Registry ClientRegistry
+	// TokenDuration is the lifetime of refreshed tokens. It defaults to one
+	// hour.
+	TokenDuration time.Duration
+}
+
+// RefreshHandler handles token refresh requests. Refreshed tokens get the
+// roles of the client's current registration and keep only the scopes it
+// still allows, so removed clients and revoked permissions are not
+// extended.
 type RefreshHandler struct {
-	tokenManager *TokenManager
-	metrics      *common.AuthMetricsCollector
-	serviceName  string
+	tokenManager  *TokenManager
+	registry      ClientRegistry
+	tokenDuration time.Duration
+	metrics       *common.AuthMetricsCollector
+	serviceName   string
 }
 
 // NewRefreshHandler creates a new refresh handler
-func NewRefreshHandler(tokenManager *TokenManager, serviceName string) *RefreshHandler {
-	return &RefreshHandler{
-		tokenManager: tokenManager,
-		metrics:      common.NewAuthMetricsCollector(),
-		serviceName:  serviceName,
+func NewRefreshHandler(tokenManager *TokenManager, config *RefreshHandlerConfig, serviceName string) (*RefreshHandler, error) {
+	if tokenManager == nil {
+		return nil, fmt.Errorf("token manager cannot be nil")
+	}
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
 	}
+	if config.Registry == nil {
+		return nil, fmt.Errorf("client registry cannot be nil")
+	}
+
+	tokenDuration := config.TokenDuration
+	if tokenDuration == 0 {
+		tokenDuration = time.Hour
+	}
+
+	return &RefreshHandler{
+		tokenManager:  tokenManager,
+		registry:      config.Registry,
+		tokenDuration: tokenDuration,
+		metrics:       common.NewAuthMetricsCollector(),
+		serviceName:   serviceName,
+	}, nil
 }
 
 // ServeHTTP handles token refresh requests
@@ -135,9 +459,30 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Certificate-bound tokens can only be refreshed with their certificate
+	claims, err := h.tokenManager.VerifyToken(tokenString)
+	if err != nil {
+		h.metrics.RecordAuthError(h.serviceName, "refresh", "refresh_failed")
+		http.Error(w, "Failed to refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err := VerifyCertificateBinding(claims, r.TLS); err != nil {
+		h.metrics.RecordAuthError(h.serviceName, "refresh", "certificate_mismatch")
+		http.Error(w, "Failed to refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	// The client must still be registered
+	client, err := h.registry.GetClient(r.Context(), claims.ServiceID)
+	if err != nil {
+		h.metrics.RecordAuthError(h.serviceName, "refresh", "unknown_client")
+		http.Error(w, "Failed to refresh token", http.StatusUnauthorized)
+		return
+	}
+	scope := strings.Join(intersect(strings.Fields(claims.Scope), client.Scopes), " ")
+
 	// Refresh token
-	tokenDuration := 1 * time.Hour // Configurable
-	newToken, err := h.tokenManager.RefreshToken(tokenString, tokenDuration)
+	newToken, err := h.tokenManager.reissueToken(claims, client.Roles, scope, h.tokenDuration)
 	if err != nil {
 		h.metrics.RecordAuthError(h.serviceName, "refresh", "refresh_failed")
 		http.Error(w, "Failed to refresh token", http.StatusUnauthorized)
@@ -145,20 +490,23 @@ func (h *RefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create response
-	expiresAt := time.Now().Add(tokenDuration)
+	expiresAt := time.Now().Add(h.tokenDuration)
 	resp := TokenResponse{
 		AccessToken: newToken,
 		TokenType:   "Bearer",
-		ExpiresIn:   int64(tokenDuration.Seconds()),
+		ExpiresIn:   int64(h.tokenDuration.Seconds()),
 		ExpiresAt:   expiresAt,
+		Scope:       scope,
 	}
 
 	// Record metrics
-	h.metrics.RecordAuthRequest(h.serviceName, "refresh", "success", time.Since(start))
+	h.metrics.RecordAuthRequest(h.serviceName, "refresh", "success", time.Since(start).Seconds())
 	h.metrics.RecordNewToken(h.serviceName)
 
 	// Send response
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
 	json.NewEncoder(w).Encode(resp)
 }
 
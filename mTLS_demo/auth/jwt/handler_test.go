@@ -1,17 +1,37 @@
 package jwt
 
 import (
-	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
+	"mTLS_demo/auth/apikey"
+	"mTLS_demo/auth/mtls"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
 )
 
-func setupTestHandlers(t *testing.T) (*TokenHandler, *RefreshHandler, *TokenManager) {
+const (
+	testEndpoint = "https://auth.example.org/auth/token"
+	frontendID   = "spiffe://example.org/ns/demo/sa/frontend"
+	backendID    = "spiffe://example.org/ns/demo/sa/backend"
+)
+
+// setupTestTokenHandler creates a token endpoint with three clients:
+// frontend uses its certificate, batch an API key and reporting client
+// assertions signed with the returned key
+func setupTestTokenHandler(t *testing.T) (*TokenHandler, *TokenManager, *spiffetest.CA, *ecdsa.PrivateKey) {
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		t.Fatalf("Failed to generate test key: %v", err)
@@ -22,71 +42,297 @@ func setupTestHandlers(t *testing.T) (*TokenHandler, *RefreshHandler, *TokenMana
 		t.Fatalf("Failed to create token manager: %v", err)
 	}
 
-	tokenHandler := NewTokenHandler(tm, "test-service")
-	refreshHandler := NewRefreshHandler(tm, "test-service")
+	// Create the client certificate authenticator
+	ca := spiffetest.NewCA(t, "example.org")
+	certificates, err := mtls.NewMiddleware(&mtls.Config{
+		TrustBundle:       ca.Roots(),
+		AllowedIDPatterns: []string{"spiffe://example.org/ns/demo/sa/*"},
+	}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create mTLS middleware: %v", err)
+	}
+
+	// Create the API key authenticator
+	store := apikey.NewInMemoryStore()
+	for secret, owner := range map[string]string{
+		"batch-secret":    "batch",
+		"frontend-secret": "frontend",
+		"stray-secret":    "unknown",
+	} {
+		hash := sha256.Sum256([]byte(secret))
+		err := store.AddKey(&apikey.Key{
+			ID:        secret + "-id",
+			Hash:      hex.EncodeToString(hash[:]),
+			Owner:     owner,
+			ExpiresAt: time.Now().Add(time.Hour),
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			t.Fatalf("Failed to add test key: %v", err)
+		}
+	}
+	apiKeys, err := apikey.NewMiddleware(&apikey.Config{Store: store}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create API key middleware: %v", err)
+	}
+
+	// Register the clients
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate client key: %v", err)
+	}
+	registry := NewInMemoryClientRegistry()
+	for _, client := range []*Client{
+		{
+			ID:          "frontend",
+			AuthMethods: []string{ClientAuthTLS},
+			SPIFFEID:    frontendID,
+			Roles:       []string{"reader"},
+			Scopes:      []string{"orders:read", "orders:write"},
+		},
+		{
+			ID:          "batch",
+			AuthMethods: []string{ClientAuthAPIKey},
+			Roles:       []string{"writer"},
+			Scopes:      []string{"orders:write"},
+		},
+		{
+			ID:          "reporting",
+			AuthMethods: []string{ClientAuthPrivateKeyJWT},
+			PublicKey:   &clientKey.PublicKey,
+			Roles:       []string{"reader"},
+			Scopes:      []string{"reports:read"},
+		},
+	} {
+		if err := registry.AddClient(client); err != nil {
+			t.Fatalf("Failed to register client: %v", err)
+		}
+	}
+
+	tokenHandler, err := NewTokenHandler(tm, &TokenHandlerConfig{
+		Registry:     registry,
+		Endpoint:     testEndpoint,
+		Certificates: certificates,
+		APIKeys:      apiKeys,
+	}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create token handler: %v", err)
+	}
+
+	return tokenHandler, tm, ca, clientKey
+}
+
+func setupTestHandlers(t *testing.T) (*TokenHandler, *RefreshHandler, *TokenManager) {
+	tokenHandler, tm, _, _ := setupTestTokenHandler(t)
+	refreshHandler, err := NewRefreshHandler(tm, &RefreshHandlerConfig{
+		Registry:      tokenHandler.registry,
+		TokenDuration: 30 * time.Minute,
+	}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create refresh handler: %v", err)
+	}
 	return tokenHandler, refreshHandler, tm
 }
 
+// signTestAssertion signs a client assertion with key
+func signTestAssertion(t *testing.T, key *ecdsa.PrivateKey, claims jwt.RegisteredClaims) string {
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign client assertion: %v", err)
+	}
+	return assertion
+}
+
+// newTokenRequest creates a form-encoded token request
+func newTokenRequest(form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
 func TestTokenHandler_ServeHTTP(t *testing.T) {
-	tokenHandler, _, _ := setupTestHandlers(t)
+	tokenHandler, tm, ca, clientKey := setupTestTokenHandler(t)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	assertionClaims := func(audience string, expiresIn time.Duration) jwt.RegisteredClaims {
+		now := time.Now()
+		return jwt.RegisteredClaims{
+			Issuer:    "reporting",
+			Subject:   "reporting",
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+			ID:        "assertion-1",
+		}
+	}
+	validAssertion := signTestAssertion(t, clientKey, assertionClaims(testEndpoint, time.Minute))
 
 	tests := []struct {
 		name           string
-		method         string
-		request        TokenRequest
+		form           url.Values
+		cert           string
+		apiKey         string
 		expectedStatus int
-		checkResponse  bool
+		expectedError  string
+		expectedClient string
+		expectedRoles  []string
+		expectedScope  string
 	}{
 		{
-			name:   "Valid request",
-			method: http.MethodPost,
-			request: TokenRequest{
-				ServiceID: "test-service",
-				Roles:     []string{"admin"},
-				Scope:     "read:write",
+			name:           "Client certificate",
+			form:           url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}},
+			cert:           frontendID,
+			expectedStatus: http.StatusOK,
+			expectedClient: "frontend",
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "orders:read orders:write",
+		},
+		{
+			name:           "Requested scope",
+			form:           url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}, "scope": {"orders:read"}},
+			cert:           frontendID,
+			expectedStatus: http.StatusOK,
+			expectedClient: "frontend",
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "orders:read",
+		},
+		{
+			name:           "Scope not registered",
+			form:           url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}, "scope": {"admin"}},
+			cert:           frontendID,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_scope",
+		},
+		{
+			name:           "Client certificate without client ID",
+			form:           url.Values{"grant_type": {"client_credentials"}},
+			cert:           frontendID,
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "Certificate of another workload",
+			form:           url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}},
+			cert:           backendID,
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name:           "API key",
+			form:           url.Values{"grant_type": {"client_credentials"}, "service_id": {"admin"}, "roles": {"admin"}},
+			apiKey:         "batch-secret",
+			expectedStatus: http.StatusOK,
+			expectedClient: "batch",
+			expectedRoles:  []string{"writer"},
+			expectedScope:  "orders:write",
+		},
+		{
+			name:           "API key of client using certificates",
+			form:           url.Values{"grant_type": {"client_credentials"}},
+			apiKey:         "frontend-secret",
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name:           "API key of unknown client",
+			form:           url.Values{"grant_type": {"client_credentials"}},
+			apiKey:         "stray-secret",
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name:           "Invalid API key",
+			form:           url.Values{"grant_type": {"client_credentials"}},
+			apiKey:         "wrong",
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name: "Client assertion",
+			form: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {validAssertion},
 			},
 			expectedStatus: http.StatusOK,
-			checkResponse:  true,
+			expectedClient: "reporting",
+			expectedRoles:  []string{"reader"},
+			expectedScope:  "reports:read",
 		},
 		{
-			name:   "Invalid method",
-			method: http.MethodGet,
-			request: TokenRequest{
-				ServiceID: "test-service",
-				Roles:     []string{"admin"},
+			name: "Client assertion for another endpoint",
+			form: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {signTestAssertion(t, clientKey, assertionClaims("https://other.example.org/token", time.Minute))},
 			},
-			expectedStatus: http.StatusMethodNotAllowed,
-			checkResponse:  false,
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
 		},
 		{
-			name:   "Missing service ID",
-			method: http.MethodPost,
-			request: TokenRequest{
-				Roles: []string{"admin"},
+			name: "Expired client assertion",
+			form: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {signTestAssertion(t, clientKey, assertionClaims(testEndpoint, -time.Minute))},
 			},
-			expectedStatus: http.StatusBadRequest,
-			checkResponse:  false,
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name: "Client assertion signed by another key",
+			form: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {signTestAssertion(t, otherKey, assertionClaims(testEndpoint, time.Minute))},
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
 		},
 		{
-			name:   "Missing roles",
-			method: http.MethodPost,
-			request: TokenRequest{
-				ServiceID: "test-service",
+			name: "Client assertion and API key",
+			form: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {validAssertion},
 			},
+			apiKey:         "batch-secret",
 			expectedStatus: http.StatusBadRequest,
-			checkResponse:  false,
+			expectedError:  "invalid_request",
+		},
+		{
+			name:           "No client authentication",
+			form:           url.Values{"grant_type": {"client_credentials"}, "client_id": {"frontend"}},
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "invalid_client",
+		},
+		{
+			name:           "Unsupported grant type",
+			form:           url.Values{"grant_type": {"password"}},
+			apiKey:         "batch-secret",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "unsupported_grant_type",
+		},
+		{
+			name:           "Missing grant type",
+			form:           url.Values{},
+			apiKey:         "batch-secret",
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_request",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			// Create request body
-			body, err := json.Marshal(tt.request)
-			assert.NoError(t, err)
-
 			// Create test request
-			req := httptest.NewRequest(tt.method, "/auth/token", bytes.NewBuffer(body))
-			req.Header.Set("Content-Type", "application/json")
+			req := newTokenRequest(tt.form)
+			if tt.cert != "" {
+				req.TLS = peerState(ca.IssueSVID(t, tt.cert).Certificate)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -96,17 +342,55 @@ func TestTokenHandler_ServeHTTP(t *testing.T) {
 
 			// Check response status
 			assert.Equal(t, tt.expectedStatus, rr.Code)
+			assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+			assert.Equal(t, "no-cache", rr.Header().Get("Pragma"))
 
-			// Check response body if needed
-			if tt.checkResponse {
-				var response TokenResponse
+			if tt.expectedError != "" {
+				var response TokenErrorResponse
 				err := json.NewDecoder(rr.Body).Decode(&response)
 				assert.NoError(t, err)
-				assert.NotEmpty(t, response.AccessToken)
-				assert.Equal(t, "Bearer", response.TokenType)
-				assert.Greater(t, response.ExpiresIn, int64(0))
-				assert.True(t, response.ExpiresAt.After(time.Now()))
+				assert.Equal(t, tt.expectedError, response.Error)
+				return
 			}
+
+			// Roles and scopes come from the registration
+			var response TokenResponse
+			err := json.NewDecoder(rr.Body).Decode(&response)
+			assert.NoError(t, err)
+			assert.Equal(t, "Bearer", response.TokenType)
+			assert.Equal(t, tt.expectedScope, response.Scope)
+			assert.Greater(t, response.ExpiresIn, int64(0))
+
+			claims, err := tm.VerifyToken(response.AccessToken)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedClient, claims.ServiceID)
+			assert.Equal(t, tt.expectedRoles, claims.Roles)
+			assert.Equal(t, tt.expectedScope, claims.Scope)
+		})
+	}
+
+	// Only POST is allowed
+	rr := httptest.NewRecorder()
+	tokenHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/auth/token", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestNewTokenHandler_InvalidConfig(t *testing.T) {
+	_, tm, _, _ := setupTestTokenHandler(t)
+
+	tests := []struct {
+		name   string
+		config *TokenHandlerConfig
+	}{
+		{name: "Nil config", config: nil},
+		{name: "Missing registry", config: &TokenHandlerConfig{Endpoint: testEndpoint}},
+		{name: "Missing endpoint", config: &TokenHandlerConfig{Registry: NewInMemoryClientRegistry()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTokenHandler(tm, tt.config, "test-service")
+			assert.Error(t, err)
 		})
 	}
 }
@@ -114,8 +398,11 @@ func TestTokenHandler_ServeHTTP(t *testing.T) {
 func TestRefreshHandler_ServeHTTP(t *testing.T) {
 	_, refreshHandler, tm := setupTestHandlers(t)
 
-	// Generate a valid token
-	token, err := tm.GenerateToken("test-service", []string{"admin"}, "read:write", time.Hour)
+	// Generate a valid token, with roles and scopes the registration no
+	// longer grants
+	token, err := tm.GenerateToken("frontend", []string{"admin"}, "orders:read admin", time.Hour)
+	assert.NoError(t, err)
+	unknownToken, err := tm.GenerateToken("test-service", []string{"admin"}, "read:write", time.Hour)
 	assert.NoError(t, err)
 
 	tests := []struct {
@@ -153,6 +440,13 @@ func TestRefreshHandler_ServeHTTP(t *testing.T) {
 			expectedStatus: http.StatusUnauthorized,
 			checkResponse:  false,
 		},
+		{
+			name:           "Client not registered",
+			method:         http.MethodPost,
+			token:          "Bearer " + unknownToken,
+			expectedStatus: http.StatusUnauthorized,
+			checkResponse:  false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -179,11 +473,30 @@ func TestRefreshHandler_ServeHTTP(t *testing.T) {
 				assert.NoError(t, err)
 				assert.NotEmpty(t, response.AccessToken)
 				assert.Equal(t, "Bearer", response.TokenType)
-				assert.Greater(t, response.ExpiresIn, int64(0))
+				assert.Equal(t, int64(1800), response.ExpiresIn)
 				assert.True(t, response.ExpiresAt.After(time.Now()))
+				assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+				assert.Equal(t, "no-cache", rr.Header().Get("Pragma"))
+
+				// The registration decides the roles and scopes
+				claims, err := tm.VerifyToken(response.AccessToken)
+				assert.NoError(t, err)
+				assert.Equal(t, "frontend", claims.ServiceID)
+				assert.Equal(t, []string{"reader"}, claims.Roles)
+				assert.Equal(t, "orders:read", claims.Scope)
+				assert.Equal(t, "orders:read", response.Scope)
+
+				// Refreshed tokens get the configured lifetime
+				assert.WithinDuration(t, time.Now().Add(30*time.Minute), claims.ExpiresAt.Time, time.Minute)
 			}
 		})
 	}
+
+	// A registry is required
+	_, err = NewRefreshHandler(tm, nil, "test-service")
+	assert.Error(t, err)
+	_, err = NewRefreshHandler(tm, &RefreshHandlerConfig{}, "test-service")
+	assert.Error(t, err)
 }
 
 func TestTokenHandler_ConcurrentRequests(t *testing.T) {
@@ -193,18 +506,9 @@ func TestTokenHandler_ConcurrentRequests(t *testing.T) {
 
 	for i := 0; i < concurrentRequests; i++ {
 		go func() {
-			// Create request body
-			request := TokenRequest{
-				ServiceID: "test-service",
-				Roles:     []string{"admin"},
-				Scope:     "read:write",
-			}
-			body, err := json.Marshal(request)
-			assert.NoError(t, err)
-
 			// Create test request
-			req := httptest.NewRequest(http.MethodPost, "/auth/token", bytes.NewBuffer(body))
-			req.Header.Set("Content-Type", "application/json")
+			req := newTokenRequest(url.Values{"grant_type": {"client_credentials"}})
+			req.Header.Set("X-API-Key", "batch-secret")
 
 			// Create response recorder
 			rr := httptest.NewRecorder()
@@ -216,7 +520,7 @@ func TestTokenHandler_ConcurrentRequests(t *testing.T) {
 			assert.Equal(t, http.StatusOK, rr.Code)
 
 			var response TokenResponse
-			err = json.NewDecoder(rr.Body).Decode(&response)
+			err := json.NewDecoder(rr.Body).Decode(&response)
 			assert.NoError(t, err)
 			assert.NotEmpty(t, response.AccessToken)
 
@@ -228,4 +532,4 @@ func TestTokenHandler_ConcurrentRequests(t *testing.T) {
 	for i := 0; i < concurrentRequests; i++ {
 		<-done
 	}
-} 
\ No newline at end of file
+}
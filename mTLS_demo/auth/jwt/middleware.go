@@ -20,61 +20,92 @@ const (
 	ClaimsContextKey ContextKey = "claims"
 )
 
+// defaultSkipRoutes are served without a token unless the routes are
+// configured otherwise
+var defaultSkipRoutes = []common.RouteRule{
+	{Pattern: "/health"},
+	{Pattern: "/metrics"},
+	{Pattern: "/auth/token"}, // Token endpoint
+}
+
 // JWTMiddleware handles JWT authentication
 type JWTMiddleware struct {
 	tokenManager *TokenManager
-	metrics      common.AuthMetricsCollector
+	skip         *common.RouteMatcher
+	audiences    []string
+	metrics      *common.AuthMetricsCollector
 	serviceName  string
 }
 
-// NewJWTMiddleware creates a new JWT middleware
+// NewJWTMiddleware creates a new JWT middleware. /health, /metrics and the
+// /auth/token endpoint are served without a token until SetRoutes is called.
 func NewJWTMiddleware(tokenManager *TokenManager, serviceName string) *JWTMiddleware {
+	skip, _ := common.NewRouteMatcher(defaultSkipRoutes...)
 	return &JWTMiddleware{
 		tokenManager: tokenManager,
+		skip:         skip,
 		metrics:      common.NewAuthMetricsCollector(),
 		serviceName:  serviceName,
 	}
 }
 
+// SetRoutes configures the routes served without a token. It must be
+// called before the middleware serves requests.
+func (m *JWTMiddleware) SetRoutes(config common.RouteConfig) error {
+	skip, err := common.NewSkipMatcher(config, m.serviceName, defaultSkipRoutes...)
+	if err != nil {
+		return err
+	}
+	m.skip = skip
+	return nil
+}
+
+// SetAudiences configures the audiences this service accepts, usually its
+// SPIFFE ID. Tokens with an aud claim must name one of them; tokens without
+// one, such as client_credentials tokens, are accepted regardless. It must
+// be called before the middleware serves requests.
+func (m *JWTMiddleware) SetAudiences(audiences ...string) {
+	m.audiences = append([]string(nil), audiences...)
+}
+
+// acceptsAudience reports whether the audience of a token includes this
+// service
+func (m *JWTMiddleware) acceptsAudience(claims *TokenClaims) bool {
+	if len(claims.Audience) == 0 {
+		return true
+	}
+	for _, audience := range m.audiences {
+		if contains(claims.Audience, audience) {
+			return true
+		}
+	}
+	return false
+}
+
 // Middleware returns a middleware function that validates JWT
 func (m *JWTMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
 		// Skip validation for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Extract token from Authorization header
-		tokenString, err := m.ExtractToken(r)
-		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "missing_token")
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Verify token
-		claims, err := m.tokenManager.VerifyToken(tokenString)
+		// Authenticate the token
+		principal, tokenString, claims, err := m.authenticate(r)
 		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "invalid_token")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Validate claims
-		if err := m.tokenManager.ValidateClaims(claims); err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "invalid_claims")
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			authErr := common.AsAuthError(err)
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), authErr.Reason)
+			http.Error(w, authErr.Message, authErr.Status)
 			return
 		}
 
-		// Add authentication info to context
-		ctx := r.Context()
-		ctx = common.WithAuthMethod(ctx, common.AuthMethodJWT)
-		ctx = common.WithServiceID(ctx, claims.ServiceID)
-		ctx = common.WithRoles(ctx, claims.Roles)
+		// Add the authenticated principal and the token to context
+		ctx := common.WithPrincipal(r.Context(), principal)
+		ctx = context.WithValue(ctx, TokenContextKey, tokenString)
+		ctx = context.WithValue(ctx, ClaimsContextKey, claims)
 		r = r.WithContext(ctx)
 
 		// Record successful authentication
@@ -85,25 +116,58 @@ func (m *JWTMiddleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// shouldSkipValidation determines if authentication should be skipped
-func (m *JWTMiddleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
-		"/auth/token", // Token endpoint
+// Authenticate verifies the bearer token of the request and returns the
+// principal of its service. The raw token and typed claims are only added
+// to the context by Middleware; in a chain, read Principal.Claims.
+func (m *JWTMiddleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	principal, _, _, err := m.authenticate(r)
+	return principal, err
+}
+
+// authenticate verifies the bearer token of the request
+func (m *JWTMiddleware) authenticate(r *http.Request) (*common.Principal, string, *TokenClaims, error) {
+	// Extract token from Authorization header
+	tokenString, err := m.ExtractToken(r)
+	if err != nil {
+		return nil, "", nil, common.Unauthorized("missing_token", "Authorization header required", common.ErrNoCredentials)
 	}
 
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
-		}
+	// Verify token
+	claims, err := m.tokenManager.VerifyToken(tokenString)
+	if err != nil {
+		return nil, "", nil, common.Unauthorized("invalid_token", "Invalid token", err)
 	}
-	return false
+
+	// Validate claims
+	if err := m.tokenManager.ValidateClaims(claims); err != nil {
+		return nil, "", nil, common.Unauthorized("invalid_claims", "Invalid token claims", err)
+	}
+
+	// Certificate-bound tokens must be presented with their certificate
+	if err := VerifyCertificateBinding(claims, r.TLS); err != nil {
+		return nil, "", nil, common.Unauthorized("certificate_mismatch", "Invalid token", err)
+	}
+
+	// Tokens for an audience are only accepted by it
+	if !m.acceptsAudience(claims) {
+		return nil, "", nil, common.Unauthorized("invalid_audience", "Invalid token", fmt.Errorf("token audience %v does not include this service", []string(claims.Audience)))
+	}
+
+	principal := common.NewPrincipal(common.AuthMethodJWT, claims.ServiceID)
+	principal.Issuer = claims.Issuer
+	principal.Roles = claims.Roles
+	principal.Scopes = strings.Fields(claims.Scope)
+	principal.Claims = common.ClaimsToMap(claims)
+	return principal, tokenString, claims, nil
 }
 
 // ExtractToken extracts the JWT from the Authorization header
 func (m *JWTMiddleware) ExtractToken(r *http.Request) (string, error) {
+	return extractBearerToken(r)
+}
+
+// extractBearerToken extracts a bearer token from the Authorization header
+func extractBearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return "", fmt.Errorf("authorization header required")
@@ -139,44 +203,23 @@ func GetClaimsFromContext(ctx context.Context) (*TokenClaims, error) {
 func (m *JWTMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get authentication method
-			method, err := common.GetAuthMethodFromContext(r.Context())
+			// Get the authenticated principal
+			principal, err := common.GetPrincipalFromContext(r.Context())
 			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "missing_auth_method")
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "missing_principal")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
 			// Verify JWT authentication
-			if method != common.AuthMethodJWT {
+			if !principal.HasMethod(common.AuthMethodJWT) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "invalid_auth_method")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Get roles from context
-			tokenRoles, err := common.GetRolesFromContext(r.Context())
-			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "missing_roles")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			// Check if any required role is present
-			hasRole := false
-			for _, requiredRole := range roles {
-				for _, tokenRole := range tokenRoles {
-					if requiredRole == tokenRole {
-						hasRole = true
-						break
-					}
-				}
-				if hasRole {
-					break
-				}
-			}
-
-			if !hasRole {
+			// Check if this method granted any required role
+			if !principal.HasMethodRole(common.AuthMethodJWT, roles...) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "insufficient_roles")
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
@@ -9,6 +9,8 @@ import (
 	"testing"
 	"time"
 
+	"mTLS_demo/auth/common"
+
 	"github.com/stretchr/testify/assert"
 )
 
@@ -156,6 +158,21 @@ func TestJWTMiddleware_RequireRole(t *testing.T) {
 			assert.Equal(t, tt.expectedStatus, rr.Code)
 		})
 	}
+
+	// Behind another middleware, only the roles of the token count
+	workload := common.NewPrincipal(common.AuthMethodMTLS, "test-service")
+	workload.Roles = []string{"admin"}
+	for token, expectedStatus := range map[string]int{userToken: http.StatusForbidden, adminToken: http.StatusOK} {
+		req := httptest.NewRequest("GET", "/api/test", nil)
+		req = req.WithContext(common.WithPrincipal(req.Context(), workload))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		middleware.Middleware(middleware.RequireRole("admin")(handler)).ServeHTTP(rr, req)
+		assert.Equal(t, expectedStatus, rr.Code)
+	}
 }
 
 func TestJWTMiddleware_ContextValues(t *testing.T) {
@@ -179,6 +196,15 @@ func TestJWTMiddleware_ContextValues(t *testing.T) {
 		assert.Equal(t, []string{"admin"}, claims.Roles)
 		assert.Equal(t, "read:write", claims.Scope)
 
+		// Check the authenticated principal
+		principal, err := common.GetPrincipalFromContext(r.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, "test-service", principal.Subject)
+		assert.Equal(t, []string{"admin"}, principal.Roles)
+		assert.Equal(t, []string{"read:write"}, principal.Scopes)
+		assert.Equal(t, "test-service", principal.Claims["service_id"])
+		assert.False(t, principal.AuthTime.IsZero())
+
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -0,0 +1,123 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"sync"
+)
+
+// Client authentication methods of the token endpoint
+const (
+	// ClientAuthTLS authenticates the client by its certificate (RFC 8705)
+	ClientAuthTLS = "tls_client_auth"
+	// ClientAuthAPIKey authenticates the client by an API key owned by it
+	ClientAuthAPIKey = "api_key"
+	// ClientAuthPrivateKeyJWT authenticates the client by an assertion
+	// signed with its key (RFC 7523)
+	ClientAuthPrivateKeyJWT = "private_key_jwt"
+	// ClientAuthSVID authenticates the client by a JWT-SVID of its workload
+	ClientAuthSVID = "spiffe_jwt"
+)
+
+// Client is a client registered with the token endpoint. The roles and
+// scopes of its tokens come from the registration, never from the request.
+type Client struct {
+	// ID is the client_id, and the service ID of its tokens
+	ID string
+	// AuthMethods are the client authentication methods it may use
+	AuthMethods []string
+	// SPIFFEID is the SPIFFE ID of its workload, for tls_client_auth and
+	// spiffe_jwt
+	SPIFFEID string
+	// PublicKey verifies its client assertions, for private_key_jwt
+	PublicKey crypto.PublicKey
+	// Roles are granted to every token of the client
+	Roles []string
+	// Scopes are the scopes the client may request. A request without a
+	// scope is granted all of them.
+	Scopes []string
+}
+
+// AllowsAuthMethod reports whether the client may authenticate with method
+func (c *Client) AllowsAuthMethod(method string) bool {
+	for _, m := range c.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the registration
+func (c *Client) Validate() error {
+	if c.ID == "" {
+		return fmt.Errorf("client ID is required")
+	}
+	if len(c.AuthMethods) == 0 {
+		return fmt.Errorf("client %s has no authentication method", c.ID)
+	}
+	for _, method := range c.AuthMethods {
+		switch method {
+		case ClientAuthTLS, ClientAuthSVID:
+			if c.SPIFFEID == "" {
+				return fmt.Errorf("client %s uses %s without a SPIFFE ID", c.ID, method)
+			}
+		case ClientAuthPrivateKeyJWT:
+			if c.PublicKey == nil {
+				return fmt.Errorf("client %s uses %s without a public key", c.ID, method)
+			}
+		case ClientAuthAPIKey:
+		default:
+			return fmt.Errorf("client %s has unknown authentication method %q", c.ID, method)
+		}
+	}
+	if len(c.Roles) == 0 {
+		return fmt.Errorf("client %s has no roles", c.ID)
+	}
+	return nil
+}
+
+// ClientRegistry looks up registered clients
+type ClientRegistry interface {
+	GetClient(ctx context.Context, clientID string) (*Client, error)
+}
+
+// InMemoryClientRegistry is a simple in-memory implementation of
+// ClientRegistry
+type InMemoryClientRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+// NewInMemoryClientRegistry creates a new in-memory client registry
+func NewInMemoryClientRegistry() *InMemoryClientRegistry {
+	return &InMemoryClientRegistry{
+		clients: make(map[string]*Client),
+	}
+}
+
+// GetClient retrieves a client by its ID
+func (r *InMemoryClientRegistry) GetClient(ctx context.Context, clientID string) (*Client, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	client, exists := r.clients[clientID]
+	if !exists {
+		return nil, fmt.Errorf("client not found")
+	}
+	return client, nil
+}
+
+// AddClient registers a client
+func (r *InMemoryClientRegistry) AddClient(client *Client) error {
+	if err := client.Validate(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.clients[client.ID] = client
+	return nil
+}
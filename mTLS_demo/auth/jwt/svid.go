@@ -0,0 +1,228 @@
+package jwt
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// RoleSource maps the SPIFFE ID of a validated JWT-SVID to roles. The
+// SPIFFE ID based role sources of the mtls package satisfy it; they are
+// called with a nil certificate.
+type RoleSource interface {
+	Roles(cert *x509.Certificate, id spiffeid.ID) ([]string, error)
+}
+
+// SVIDConfig configures JWT-SVID authentication
+type SVIDConfig struct {
+	// Bundles provides the JWT authorities of each trust domain, usually a
+	// Workload API client. A token is only accepted if it is signed by an
+	// authority of the trust domain of its subject.
+	Bundles jwtbundle.Source
+	// Audience lists the accepted audiences. A token must name at least one.
+	Audience []string
+
+	// AllowedIDs lists the exact SPIFFE IDs allowed to authenticate
+	AllowedIDs []string
+	// AllowedTrustDomains allows any workload from the listed trust domains
+	AllowedTrustDomains []string
+	// AllowedIDPatterns allows SPIFFE IDs matching a pattern such as
+	// spiffe://prod.example/ns/*/sa/frontend, where '*' matches one path segment
+	AllowedIDPatterns []string
+
+	// RoleSources map the token's SPIFFE ID to roles. Roles from all sources
+	// are merged.
+	RoleSources []RoleSource
+	// DefaultRoles are assigned when no role source yields a role
+	DefaultRoles []string
+
+	// Routes configures the routes served without a token. /health,
+	// /metrics and /auth/token are skipped by default.
+	Routes common.RouteConfig
+}
+
+// SVIDMiddleware authenticates requests carrying a JWT-SVID as bearer token.
+// It is meant for paths where mTLS terminates at a load balancer, so the
+// caller's identity cannot be taken from the TLS connection.
+type SVIDMiddleware struct {
+	config      *SVIDConfig
+	matcher     *spiffe.Matcher
+	skip        *common.RouteMatcher
+	metrics     *common.AuthMetricsCollector
+	serviceName string
+}
+
+// NewSVIDMiddleware creates a new JWT-SVID middleware
+func NewSVIDMiddleware(config *SVIDConfig, serviceName string) (*SVIDMiddleware, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.Bundles == nil {
+		return nil, fmt.Errorf("JWT bundle source is required")
+	}
+	if len(config.Audience) == 0 {
+		return nil, fmt.Errorf("at least one audience is required")
+	}
+
+	matcher, err := spiffe.NewMatcher(config.AllowedIDs, config.AllowedTrustDomains, config.AllowedIDPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization rules: %v", err)
+	}
+
+	skip, err := common.NewSkipMatcher(config.Routes, serviceName, defaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SVIDMiddleware{
+		config:      config,
+		matcher:     matcher,
+		skip:        skip,
+		metrics:     common.NewAuthMetricsCollector(),
+		serviceName: serviceName,
+	}, nil
+}
+
+// ValidateToken checks the signature, expiry and audience of a JWT-SVID and
+// that its SPIFFE ID is allowed
+func (m *SVIDMiddleware) ValidateToken(token string) (*jwtsvid.SVID, error) {
+	svid, err := jwtsvid.ParseAndValidate(token, m.config.Bundles, m.config.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT-SVID: %v", err)
+	}
+
+	if err := m.matcher.Match(svid.ID); err != nil {
+		return nil, err
+	}
+
+	return svid, nil
+}
+
+// Middleware returns a middleware function that validates JWT-SVIDs. The
+// result is exposed through the same context values as JWTMiddleware.
+func (m *SVIDMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// Skip validation for certain paths
+		if m.skip.Match(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Authenticate the JWT-SVID
+		principal, tokenString, svid, err := m.authenticate(r)
+		if err != nil {
+			authErr := common.AsAuthError(err)
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), authErr.Reason)
+			http.Error(w, authErr.Message, authErr.Status)
+			return
+		}
+
+		// Add the authenticated principal and the token to context
+		ctx := common.WithPrincipal(r.Context(), principal)
+		ctx = context.WithValue(ctx, TokenContextKey, tokenString)
+		ctx = context.WithValue(ctx, ClaimsContextKey, svidClaims(svid, principal.Roles))
+		r = r.WithContext(ctx)
+
+		// Record successful authentication
+		m.metrics.RecordAuthRequest(m.serviceName, string(common.AuthMethodJWT), "success", time.Since(start).Seconds())
+
+		// Call next handler
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticate validates the JWT-SVID of the request and returns the
+// principal of its SPIFFE ID
+func (m *SVIDMiddleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	principal, _, _, err := m.authenticate(r)
+	return principal, err
+}
+
+// authenticate validates the JWT-SVID of the request
+func (m *SVIDMiddleware) authenticate(r *http.Request) (*common.Principal, string, *jwtsvid.SVID, error) {
+	// Extract token from Authorization header
+	tokenString, err := extractBearerToken(r)
+	if err != nil {
+		return nil, "", nil, common.Unauthorized("missing_token", "Authorization header required", common.ErrNoCredentials)
+	}
+
+	// Validate token
+	svid, err := m.ValidateToken(tokenString)
+	if err != nil {
+		if errors.Is(err, spiffe.ErrIDNotAllowed) {
+			return nil, "", nil, common.Forbidden("id_not_allowed", "Forbidden", err)
+		}
+		return nil, "", nil, common.Unauthorized("invalid_token", "Invalid token", err)
+	}
+
+	principal := common.NewSPIFFEPrincipal(common.AuthMethodJWT, svid.ID)
+	principal.Roles = m.roles(svid.ID)
+	principal.Claims = svid.Claims
+	if issuer, ok := svid.Claims["iss"].(string); ok {
+		principal.Issuer = issuer
+	}
+	return principal, tokenString, svid, nil
+}
+
+// RequireRole creates a middleware that checks for required roles
+func (m *SVIDMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	// JWT-SVIDs are exposed through the same context values as other JWTs
+	jwtMiddleware := &JWTMiddleware{metrics: m.metrics, serviceName: m.serviceName}
+	return jwtMiddleware.RequireRole(roles...)
+}
+
+// roles collects the roles of a SPIFFE ID from all role sources
+func (m *SVIDMiddleware) roles(id spiffeid.ID) []string {
+	// Merge roles from all sources, dropping duplicates
+	var roles []string
+	seen := make(map[string]bool)
+	for _, source := range m.config.RoleSources {
+		sourceRoles, err := source.Roles(nil, id)
+		if err != nil {
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodJWT), "role_source_failed")
+			continue
+		}
+		for _, role := range sourceRoles {
+			if role != "" && !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		return append([]string(nil), m.config.DefaultRoles...)
+	}
+
+	return roles
+}
+
+// svidClaims describes a validated JWT-SVID as TokenClaims
+func svidClaims(svid *jwtsvid.SVID, roles []string) *TokenClaims {
+	claims := &TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   svid.ID.String(),
+			Audience:  svid.Audience,
+			ExpiresAt: jwt.NewNumericDate(svid.Expiry),
+		},
+		ServiceID: svid.ID.String(),
+		Roles:     roles,
+	}
+	if iat, ok := svid.Claims["iat"].(float64); ok {
+		claims.IssuedAt = jwt.NewNumericDate(time.Unix(int64(iat), 0))
+	}
+	return claims
+}
@@ -0,0 +1,247 @@
+package jwt
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestSVIDMiddleware(t *testing.T) (*SVIDMiddleware, *spiffetest.JWTAuthority, *spiffetest.JWTAuthority) {
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+	otherAuthority := spiffetest.NewJWTAuthority(t, "other.org", "key-1")
+
+	middleware, err := NewSVIDMiddleware(&SVIDConfig{
+		Bundles:             jwtbundle.NewSet(authority.Bundle(t), otherAuthority.Bundle(t)),
+		Audience:            []string{"spiffe://example.org/backend"},
+		AllowedTrustDomains: []string{"example.org"},
+		RoleSources:         []RoleSource{testRoleSource{"spiffe://example.org/frontend": {"admin"}}},
+		DefaultRoles:        []string{"reader"},
+	}, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create SVID middleware: %v", err)
+	}
+
+	return middleware, authority, otherAuthority
+}
+
+func TestSVIDMiddleware_Middleware(t *testing.T) {
+	middleware, authority, otherAuthority := setupTestSVIDMiddleware(t)
+	audience := []string{"spiffe://example.org/backend"}
+	expiry := time.Now().Add(5 * time.Minute)
+
+	// Same key ID, wrong trust domain key
+	impostor := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+
+	tests := []struct {
+		name           string
+		path           string
+		token          string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid token",
+			path:           "/api/test",
+			token:          "Bearer " + authority.SignSVID(t, "spiffe://example.org/frontend", audience, expiry),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Missing token",
+			path:           "/api/test",
+			token:          "",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Wrong audience",
+			path:           "/api/test",
+			token:          "Bearer " + authority.SignSVID(t, "spiffe://example.org/frontend", []string{"spiffe://example.org/other"}, expiry),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Expired token",
+			path:           "/api/test",
+			token:          "Bearer " + authority.SignSVID(t, "spiffe://example.org/frontend", audience, time.Now().Add(-time.Minute)),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Unknown signing key",
+			path:           "/api/test",
+			token:          "Bearer " + impostor.SignSVID(t, "spiffe://example.org/frontend", audience, expiry),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Signed by another trust domain",
+			path:           "/api/test",
+			token:          "Bearer " + otherAuthority.SignSVID(t, "spiffe://example.org/frontend", audience, expiry),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Trust domain not allowed",
+			path:           "/api/test",
+			token:          "Bearer " + otherAuthority.SignSVID(t, "spiffe://other.org/frontend", audience, expiry),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Skip validation path",
+			path:           "/health",
+			token:          "",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test request
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Create test handler
+			handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			// Serve request
+			handler.ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestSVIDMiddleware_Context(t *testing.T) {
+	middleware, authority, _ := setupTestSVIDMiddleware(t)
+	audience := []string{"spiffe://example.org/backend"}
+	expiry := time.Now().Add(5 * time.Minute)
+
+	tests := []struct {
+		name          string
+		id            string
+		expectedRoles []string
+	}{
+		{
+			name:          "Mapped roles",
+			id:            "spiffe://example.org/frontend",
+			expectedRoles: []string{"admin"},
+		},
+		{
+			name:          "Default roles",
+			id:            "spiffe://example.org/batch",
+			expectedRoles: []string{"reader"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := authority.SignSVID(t, tt.id, audience, expiry)
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+
+			// Check the values set for downstream handlers
+			handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, err := common.GetPrincipalFromContext(r.Context())
+				assert.NoError(t, err)
+				assert.Equal(t, []common.AuthMethod{common.AuthMethodJWT}, principal.Methods)
+				assert.Equal(t, tt.id, principal.Subject)
+				assert.Equal(t, tt.id, principal.SPIFFEID.String())
+				assert.Equal(t, "example.org", principal.TrustDomain)
+				assert.Equal(t, tt.expectedRoles, principal.Roles)
+				assert.Equal(t, tt.id, principal.Claims["sub"])
+
+				ctxToken, err := GetTokenFromContext(r.Context())
+				assert.NoError(t, err)
+				assert.Equal(t, token, ctxToken)
+
+				claims, err := GetClaimsFromContext(r.Context())
+				assert.NoError(t, err)
+				assert.Equal(t, tt.id, claims.Subject)
+				assert.Equal(t, tt.id, claims.ServiceID)
+				assert.Equal(t, expiry.Unix(), claims.ExpiresAt.Unix())
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+		})
+	}
+}
+
+func TestSVIDMiddleware_RequireRole(t *testing.T) {
+	middleware, authority, _ := setupTestSVIDMiddleware(t)
+	audience := []string{"spiffe://example.org/backend"}
+	expiry := time.Now().Add(5 * time.Minute)
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{
+			name:           "Has required role",
+			id:             "spiffe://example.org/frontend",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Missing required role",
+			id:             "spiffe://example.org/batch",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.Header.Set("Authorization", "Bearer "+authority.SignSVID(t, tt.id, audience, expiry))
+			rr := httptest.NewRecorder()
+
+			handler := middleware.Middleware(middleware.RequireRole("admin")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})))
+
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestNewSVIDMiddleware_InvalidConfig(t *testing.T) {
+	bundles := jwtbundle.NewSet()
+
+	tests := []struct {
+		name   string
+		config *SVIDConfig
+	}{
+		{name: "Nil config", config: nil},
+		{name: "Missing bundles", config: &SVIDConfig{Audience: []string{"backend"}}},
+		{name: "Missing audience", config: &SVIDConfig{Bundles: bundles}},
+		{name: "Invalid pattern", config: &SVIDConfig{Bundles: bundles, Audience: []string{"backend"}, AllowedIDPatterns: []string{"not-a-spiffe-id"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSVIDMiddleware(tt.config, "test-service")
+			assert.Error(t, err)
+		})
+	}
+}
+
+// testRoleSource maps SPIFFE IDs to roles
+type testRoleSource map[string][]string
+
+func (s testRoleSource) Roles(_ *x509.Certificate, id spiffeid.ID) ([]string, error) {
+	return s[id.String()], nil
+}
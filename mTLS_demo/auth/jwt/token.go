@@ -1,3 +1,32 @@
+// Package jwt issues and verifies the service's own access tokens.
+//
+// TokenHandler serves the OAuth2 client_credentials grant. Callers
+// authenticate with a client certificate (tls_client_auth), an API key in
+// X-API-Key or a client assertion, and get the roles and scopes registered
+// for their client in the ClientRegistry. Tokens requested over mTLS are
+// bound to the client certificate. Client assertions are private_key_jwt
+// JWTs built with NewClientAssertion or JWT-SVIDs fetched with
+// NewSVIDAssertion, sent with ClientAssertionForm. They must be addressed
+// to the token endpoint URL, expire within five minutes and are
+// single-use, so a fresh SVID is needed for every token request.
+// RefreshHandler looks the client up in the same registry, so refreshed
+// tokens get its current roles and only the scopes it still allows.
+//
+// ExchangeHandler serves OAuth2 token exchange (RFC 8693), so a service can
+// call its backends on behalf of a user. The actor presents the subject
+// token it received together with its own actor token, and builds the
+// request with TokenExchangeForm. A subject token is an ID token checked
+// by an IDTokenVerifier such as oidc.Middleware, a JWT-SVID addressed to
+// the actor or a token of this service. An actor token is a JWT-SVID
+// addressed to the exchange endpoint or a token of this service. The
+// ExchangePolicy lists which actors may exchange which subject token types
+// for which audiences. The issued token keeps the subject, is limited to
+// one audience and to the roles and scopes both the rule and the subject
+// token allow, never outlives the subject token and carries an act claim
+// with the actor prepended to any earlier chain. Resource services must
+// call JWTMiddleware.SetAudiences with their own identity, since tokens
+// with an aud claim are rejected by services it does not name. Exchanged
+// tokens cannot be refreshed; the subject token is exchanged again instead.
 package jwt
 
 import (
@@ -5,7 +34,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/rsa"
-	"encoding/json"
+	"crypto/x509"
 	"fmt"
 	"time"
 
@@ -25,6 +54,12 @@ type TokenClaims struct {
 	ServiceID string   `json:"service_id"`
 	Roles     []string `json:"roles"`
 	Scope     string   `json:"scope,omitempty"`
+
+	// Confirmation binds the token to a client certificate
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// Actor names the party acting on behalf of the subject of an
+	// exchanged token
+	Actor *Actor `json:"act,omitempty"`
 }
 
 // NewTokenManager creates a new token manager
@@ -51,8 +86,25 @@ func NewTokenManager(signingKey crypto.PrivateKey, verifyingKey crypto.PublicKey
 
 // GenerateToken creates a new JWT token
 func (tm *TokenManager) GenerateToken(serviceID string, roles []string, scope string, duration time.Duration) (string, error) {
+	return tm.signToken(tm.newClaims(serviceID, roles, scope, duration))
+}
+
+// GenerateBoundToken creates a new JWT token bound to the client
+// certificate cert. It is only accepted over connections using cert.
+func (tm *TokenManager) GenerateBoundToken(serviceID string, roles []string, scope string, duration time.Duration, cert *x509.Certificate) (string, error) {
+	if cert == nil {
+		return "", fmt.Errorf("client certificate is required")
+	}
+
+	claims := tm.newClaims(serviceID, roles, scope, duration)
+	claims.Confirmation = &Confirmation{X5TS256: CertificateThumbprint(cert)}
+	return tm.signToken(claims)
+}
+
+// newClaims creates the claims of a new token
+func (tm *TokenManager) newClaims(serviceID string, roles []string, scope string, duration time.Duration) TokenClaims {
 	now := time.Now()
-	claims := TokenClaims{
+	return TokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(now.Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(now),
@@ -64,7 +116,10 @@ func (tm *TokenManager) GenerateToken(serviceID string, roles []string, scope st
 		Roles:     roles,
 		Scope:     scope,
 	}
+}
 
+// signToken signs claims
+func (tm *TokenManager) signToken(claims TokenClaims) (string, error) {
 	token := jwt.NewWithClaims(tm.signingMethod, claims)
 	return token.SignedString(tm.signingKey)
 }
@@ -137,7 +192,19 @@ func (tm *TokenManager) RefreshToken(tokenString string, duration time.Duration)
 	if err != nil {
 		return "", fmt.Errorf("failed to verify token: %v", err)
 	}
+	return tm.reissueToken(claims, claims.Roles, claims.Scope, duration)
+}
+
+// reissueToken creates a new token for the service of verified claims with
+// roles and scope, keeping the certificate binding
+func (tm *TokenManager) reissueToken(claims *TokenClaims, roles []string, scope string, duration time.Duration) (string, error) {
+	// Exchanged tokens never outlive their subject token; the actor
+	// exchanges the subject token again instead
+	if claims.Actor != nil {
+		return "", fmt.Errorf("exchanged tokens cannot be refreshed")
+	}
 
-	// Create new token with extended expiration
-	return tm.GenerateToken(claims.ServiceID, claims.Roles, claims.Scope, duration)
+	newClaims := tm.newClaims(claims.ServiceID, roles, scope, duration)
+	newClaims.Confirmation = claims.Confirmation
+	return tm.signToken(newClaims)
 } 
\ No newline at end of file
@@ -1,27 +1,65 @@
 package mtls
 
 import (
-	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/revocation"
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 )
 
 // Middleware handles mTLS authentication
 type Middleware struct {
 	config     *Config
-	metrics    common.AuthMetricsCollector
+	bundles    spiffe.BundleSource
+	matcher    *spiffe.Matcher
+	skip       *common.RouteMatcher
+	metrics    *common.AuthMetricsCollector
 	serviceName string
 }
 
 // Config holds the mTLS configuration
 type Config struct {
+	// TrustBundle is a fixed set of trusted roots, used when BundleSource is nil
 	TrustBundle []*x509.Certificate
-	AllowedCNs  []string
+	// BundleSource provides the trusted roots. It is queried on every
+	// verification, so a reloaded bundle takes effect immediately.
+	BundleSource spiffe.BundleSource
+	// BundleSet, if set, holds one bundle per trust domain and takes
+	// precedence over BundleSource and TrustBundle. Peers are verified only
+	// against the bundle of their own trust domain.
+	BundleSet *spiffe.BundleSet
+
+	// AllowedIDs lists the exact SPIFFE IDs allowed to connect
+	AllowedIDs []string
+	// AllowedTrustDomains allows any workload from the listed trust domains
+	AllowedTrustDomains []string
+	// AllowedIDPatterns allows SPIFFE IDs matching a pattern such as
+	// spiffe://prod.example/ns/*/sa/frontend, where '*' matches one path segment
+	AllowedIDPatterns []string
+
+	// RoleSources extract roles from verified client certificates. Roles
+	// from all sources are merged.
+	RoleSources []RoleSource
+	// DefaultRoles are assigned when no role source yields a role
+	DefaultRoles []string
+
+	// RevocationChecker, if set, checks the verified chain for revoked
+	// certificates. OCSP responses stapled by the peer are passed to
+	// checkers implementing revocation.StapleChecker.
+	RevocationChecker revocation.Checker
+
+	// Routes configures the routes served without a client certificate.
+	// /health and /metrics are skipped by default.
+	Routes common.RouteConfig
 }
 
 // NewMiddleware creates a new mTLS middleware
@@ -30,8 +68,26 @@ func NewMiddleware(config *Config, serviceName string) (*Middleware, error) {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 
+	matcher, err := spiffe.NewMatcher(config.AllowedIDs, config.AllowedTrustDomains, config.AllowedIDPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization rules: %v", err)
+	}
+
+	skip, err := common.NewSkipMatcher(config.Routes, serviceName, common.DefaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles := config.BundleSource
+	if bundles == nil {
+		bundles = spiffe.NewMemoryBundleSource(config.TrustBundle)
+	}
+
 	return &Middleware{
 		config:     config,
+		bundles:    bundles,
+		matcher:    matcher,
+		skip:       skip,
 		metrics:    common.NewAuthMetricsCollector(),
 		serviceName: serviceName,
 	}, nil
@@ -43,41 +99,22 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		// Skip validation for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Check if TLS connection exists
-		if r.TLS == nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "no_tls")
-			http.Error(w, "TLS required", http.StatusUnauthorized)
+		// Authenticate the client certificate
+		principal, err := m.Authenticate(r)
+		if err != nil {
+			authErr := common.AsAuthError(err)
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), authErr.Reason)
+			http.Error(w, authErr.Message, authErr.Status)
 			return
 		}
 
-		// Verify client certificate
-		if len(r.TLS.PeerCertificates) == 0 {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "no_certificate")
-			http.Error(w, "Client certificate required", http.StatusUnauthorized)
-			return
-		}
-
-		// Get client certificate
-		clientCert := r.TLS.PeerCertificates[0]
-
-		// Verify certificate
-		if err := m.VerifyCertificate(clientCert); err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "invalid_certificate")
-			http.Error(w, "Invalid certificate", http.StatusUnauthorized)
-			return
-		}
-
-		// Add authentication info to context
-		ctx := r.Context()
-		ctx = common.WithAuthMethod(ctx, common.AuthMethodMTLS)
-		ctx = common.WithServiceID(ctx, clientCert.Subject.CommonName)
-		ctx = common.WithRoles(ctx, m.GetCertificateRoles(clientCert))
-		r = r.WithContext(ctx)
+		// Add the authenticated principal to context
+		r = r.WithContext(common.WithPrincipal(r.Context(), principal))
 
 		// Record successful authentication
 		m.metrics.RecordAuthRequest(m.serviceName, string(common.AuthMethodMTLS), "success", time.Since(start).Seconds())
@@ -87,101 +124,244 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// shouldSkipValidation determines if authentication should be skipped
-func (m *Middleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
+// Authenticate verifies the client X509-SVID of the connection and returns
+// the principal of its SPIFFE ID
+func (m *Middleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	// Check if TLS connection exists
+	if r.TLS == nil {
+		return nil, common.Unauthorized("no_tls", "TLS required", common.ErrNoCredentials)
 	}
 
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
+	// Verify client certificate
+	if len(r.TLS.PeerCertificates) == 0 {
+		return nil, common.Unauthorized("no_certificate", "Client certificate required", common.ErrNoCredentials)
+	}
+
+	// Verify certificate chain
+	id, chain, err := m.VerifyConnection(r.TLS)
+	if err != nil {
+		switch {
+		case errors.Is(err, spiffe.ErrIDNotAllowed):
+			return nil, common.Forbidden("id_not_allowed", "Forbidden", err)
+		case errors.Is(err, spiffe.ErrInvalidSVID):
+			return nil, common.Unauthorized("invalid_svid", "Invalid certificate", err)
+		case errors.Is(err, spiffe.ErrUnknownTrustDomain):
+			return nil, common.Unauthorized("unknown_trust_domain", "Invalid certificate", err)
+		case errors.Is(err, revocation.ErrRevoked):
+			return nil, common.Unauthorized("certificate_revoked", "Invalid certificate", err)
+		case errors.Is(err, revocation.ErrUnavailable):
+			return nil, common.Unauthorized("revocation_unavailable", "Invalid certificate", err)
+		default:
+			return nil, common.Unauthorized("invalid_certificate", "Invalid certificate", err)
 		}
 	}
-	return false
+
+	principal := common.NewSPIFFEPrincipal(common.AuthMethodMTLS, id)
+	principal.Roles = m.GetCertificateRoles(r.TLS.PeerCertificates[0])
+	principal.Certificates = chain
+	return principal, nil
+}
+
+// VerifyCertificate verifies a client X509-SVID that was presented without
+// intermediates and returns its SPIFFE ID
+func (m *Middleware) VerifyCertificate(cert *x509.Certificate) (spiffeid.ID, error) {
+	id, _, err := m.verifyChain([]*x509.Certificate{cert}, nil, nil)
+	return id, err
+}
+
+// VerifyConnection verifies the client X509-SVID presented on a TLS
+// connection, using the intermediates sent by the peer. Chains already
+// verified during the handshake are reused when they end at a root in the
+// trust bundle. It returns the SPIFFE ID and the verified chain, leaf first.
+func (m *Middleware) VerifyConnection(state *tls.ConnectionState) (spiffeid.ID, []*x509.Certificate, error) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return spiffeid.ID{}, nil, fmt.Errorf("no peer certificates")
+	}
+
+	return m.verifyChain(state.PeerCertificates, state.VerifiedChains, state.OCSPResponse)
 }
 
-// VerifyCertificate verifies the client certificate
-func (m *Middleware) VerifyCertificate(cert *x509.Certificate) error {
-	// Check if CN is allowed
-	cnAllowed := false
-	for _, allowedCN := range m.config.AllowedCNs {
-		if cert.Subject.CommonName == allowedCN {
-			cnAllowed = true
-			break
+// verifyChain verifies the leaf of certs against the trust bundle
+func (m *Middleware) verifyChain(certs []*x509.Certificate, verifiedChains [][]*x509.Certificate, staple []byte) (spiffeid.ID, []*x509.Certificate, error) {
+	leaf := certs[0]
+
+	// Enforce the X509-SVID rules before trusting the URI SAN
+	id, err := spiffe.ValidateX509SVID(leaf)
+	if err != nil {
+		return spiffeid.ID{}, nil, err
+	}
+
+	// Get the current trust bundle for the peer's trust domain
+	bundle, err := m.bundleFor(id.TrustDomain())
+	if err != nil {
+		return spiffeid.ID{}, nil, err
+	}
+
+	// Reuse a chain from the handshake if it ends at one of our roots
+	chain := trustedVerifiedChain(leaf, verifiedChains, bundle)
+	if chain == nil {
+		// Verify certificate against trust bundle
+		opts := x509.VerifyOptions{
+			Roots:         bundle.Pool(),
+			CurrentTime:   time.Now(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			Intermediates: x509.NewCertPool(),
+		}
+
+		for _, intermediate := range certs[1:] {
+			opts.Intermediates.AddCert(intermediate)
+		}
+
+		chains, err := leaf.Verify(opts)
+		if err != nil {
+			return spiffeid.ID{}, nil, fmt.Errorf("certificate verification failed: %v", err)
+		}
+		chain = chains[0]
+	}
+
+	// Check the chain for revoked certificates
+	if m.config.RevocationChecker != nil {
+		if err := revocation.CheckStaple(m.config.RevocationChecker, chain, staple); err != nil {
+			return spiffeid.ID{}, nil, err
+		}
+		if err := m.config.RevocationChecker.Check(chain); err != nil {
+			return spiffeid.ID{}, nil, err
 		}
 	}
-	if !cnAllowed {
-		return fmt.Errorf("certificate CN not allowed")
+
+	// Check if the SPIFFE ID is authorized
+	if err := m.matcher.Match(id); err != nil {
+		return id, nil, err
 	}
 
-	// Verify certificate against trust bundle
-	opts := x509.VerifyOptions{
-		Roots:         x509.NewCertPool(),
-		CurrentTime:   time.Now(),
-		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
-		Intermediates: x509.NewCertPool(),
+	return id, chain, nil
+}
+
+// bundleFor returns the bundle used to verify peers from a trust domain
+func (m *Middleware) bundleFor(td spiffeid.TrustDomain) (*spiffe.Bundle, error) {
+	if m.config.BundleSet != nil {
+		bundle, err := m.config.BundleSet.Bundle(td)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get trust bundle: %w", err)
+		}
+		return bundle, nil
 	}
 
-	for _, root := range m.config.TrustBundle {
-		opts.Roots.AddCert(root)
+	bundle, err := m.bundles.Bundle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trust bundle: %v", err)
 	}
+	return bundle, nil
+}
 
-	_, err := cert.Verify(opts)
-	return err
+// trustedVerifiedChain returns the first handshake-verified chain for leaf
+// whose root is in bundle, or nil if there is none
+func trustedVerifiedChain(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate, bundle *spiffe.Bundle) []*x509.Certificate {
+	for _, chain := range verifiedChains {
+		if len(chain) == 0 || !chain[0].Equal(leaf) {
+			continue
+		}
+
+		if bundle.Contains(chain[len(chain)-1]) {
+			return chain
+		}
+	}
+	return nil
 }
 
-// GetCertificateRoles extracts roles from the certificate
+// GetCertificateRoles extracts roles from the certificate using the configured role sources
 func (m *Middleware) GetCertificateRoles(cert *x509.Certificate) []string {
-	// Extract roles from certificate extensions or SAN
-	// This is a placeholder - implement according to your certificate structure
-	return []string{"service"}
+	id, err := spiffe.IDFromCertificate(cert)
+	if err != nil {
+		return nil
+	}
+
+	// Merge roles from all sources, dropping duplicates
+	var roles []string
+	seen := make(map[string]bool)
+	for _, source := range m.config.RoleSources {
+		sourceRoles, err := source.Roles(cert, id)
+		if err != nil {
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "role_source_failed")
+			continue
+		}
+		for _, role := range sourceRoles {
+			if role != "" && !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	if len(roles) == 0 {
+		return append([]string(nil), m.config.DefaultRoles...)
+	}
+
+	return roles
 }
 
-// RequireRole creates a middleware that checks for required roles
-func (m *Middleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+// AllowTrustDomains creates a middleware that only admits peers from the
+// listed trust domains, for routes narrower than the middleware config
+func (m *Middleware) AllowTrustDomains(trustDomains ...string) func(http.Handler) http.Handler {
+	return m.trustDomainPolicy(trustDomains, true)
+}
+
+// DenyTrustDomains creates a middleware that rejects peers from the listed
+// trust domains
+func (m *Middleware) DenyTrustDomains(trustDomains ...string) func(http.Handler) http.Handler {
+	return m.trustDomainPolicy(trustDomains, false)
+}
+
+// trustDomainPolicy admits peers whose trust domain is listed (allow) or not
+// listed (deny)
+func (m *Middleware) trustDomainPolicy(trustDomains []string, allow bool) func(http.Handler) http.Handler {
+	listed := make(map[string]bool, len(trustDomains))
+	for _, td := range trustDomains {
+		listed[strings.ToLower(td)] = true
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get authentication method
-			method, err := common.GetAuthMethodFromContext(r.Context())
-			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "missing_auth_method")
+			// Get the peer SPIFFE ID
+			principal, err := common.GetPrincipalFromContext(r.Context())
+			if err != nil || principal.SPIFFEID.IsZero() {
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "missing_spiffe_id")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Verify mTLS authentication
-			if method != common.AuthMethodMTLS {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "invalid_auth_method")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if listed[principal.TrustDomain] != allow {
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "trust_domain_not_allowed")
+				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
 			}
 
-			// Get roles from context
-			certRoles, err := common.GetRolesFromContext(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole creates a middleware that checks for required roles
+func (m *Middleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Get the authenticated principal
+			principal, err := common.GetPrincipalFromContext(r.Context())
 			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "missing_roles")
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "missing_principal")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Check if any required role is present
-			hasRole := false
-			for _, requiredRole := range roles {
-				for _, certRole := range certRoles {
-					if requiredRole == certRole {
-						hasRole = true
-						break
-					}
-				}
-				if hasRole {
-					break
-				}
+			// Verify mTLS authentication
+			if !principal.HasMethod(common.AuthMethodMTLS) {
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "invalid_auth_method")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
 			}
 
-			if !hasRole {
+			// Check if this method granted any required role
+			if !principal.HasMethodRole(common.AuthMethodMTLS, roles...) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodMTLS), "insufficient_roles")
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
@@ -0,0 +1,497 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mTLS_demo/auth/common"
+	"mTLS_demo/transport/revocation"
+	"mTLS_demo/transport/spiffe"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestMiddleware(t *testing.T, config *Config) (*Middleware, *spiffetest.CA) {
+	ca := spiffetest.NewCA(t, "example.org")
+	config.TrustBundle = ca.Roots()
+
+	middleware, err := NewMiddleware(config, "test-service")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	return middleware, ca
+}
+
+func TestMiddleware_Middleware(t *testing.T) {
+	middleware, ca := setupTestMiddleware(t, &Config{
+		AllowedIDs:        []string{"spiffe://example.org/ns/demo/sa/backend"},
+		AllowedIDPatterns: []string{"spiffe://example.org/ns/*/sa/frontend"},
+	})
+	otherCA := spiffetest.NewCA(t, "example.org")
+
+	tests := []struct {
+		name           string
+		path           string
+		tls            *tls.ConnectionState
+		expectedStatus int
+	}{
+		{
+			name:           "Skip validation path",
+			path:           "/health",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "No TLS",
+			path:           "/api/test",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "No client certificate",
+			path:           "/api/test",
+			tls:            &tls.ConnectionState{},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Allowed SPIFFE ID",
+			path:           "/api/test",
+			tls:            peerState(ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/backend").Certificate),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Allowed SPIFFE ID pattern",
+			path:           "/api/test",
+			tls:            peerState(ca.IssueSVID(t, "spiffe://example.org/ns/payments/sa/frontend").Certificate),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "SPIFFE ID not allowed",
+			path:           "/api/test",
+			tls:            peerState(ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/other").Certificate),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Untrusted issuer",
+			path:           "/api/test",
+			tls:            peerState(otherCA.IssueSVID(t, "spiffe://example.org/ns/demo/sa/backend").Certificate),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Leaf is a CA",
+			path:           "/api/test",
+			tls:            peerState(ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/backend", spiffetest.WithCA()).Certificate),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "CN only certificate",
+			path:           "/api/test",
+			tls:            peerState(ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/backend", spiffetest.WithURIs()).Certificate),
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.TLS = tt.tls
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestMiddleware_ContextValues(t *testing.T) {
+	middleware, ca := setupTestMiddleware(t, &Config{
+		AllowedTrustDomains: []string{"example.org"},
+	})
+	svid := ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend")
+
+	// Create test handler that checks context values
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := common.GetPrincipalFromContext(r.Context())
+		assert.NoError(t, err)
+
+		// Check subject is the SPIFFE ID
+		assert.Equal(t, "spiffe://example.org/ns/demo/sa/frontend", principal.Subject)
+		assert.Equal(t, []common.AuthMethod{common.AuthMethodMTLS}, principal.Methods)
+
+		// Check parsed SPIFFE ID
+		assert.Equal(t, "example.org", principal.TrustDomain)
+		assert.Equal(t, "/ns/demo/sa/frontend", principal.SPIFFEID.Path())
+		assert.Len(t, principal.Certificates, 2)
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Create test request
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.TLS = peerState(svid.Certificate)
+
+	// Create response recorder
+	rr := httptest.NewRecorder()
+
+	// Apply middleware
+	middleware.Middleware(handler).ServeHTTP(rr, req)
+
+	// Check response
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestMiddleware_IntermediateChain(t *testing.T) {
+	middleware, ca := setupTestMiddleware(t, &Config{
+		AllowedTrustDomains: []string{"example.org"},
+	})
+	intermediate := ca.NewIntermediate(t)
+	svid := intermediate.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend")
+	untrusted := spiffetest.NewCA(t, "example.org").NewIntermediate(t)
+	untrustedSVID := untrusted.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend")
+
+	tests := []struct {
+		name           string
+		tls            *tls.ConnectionState
+		expectedStatus int
+		expectedChain  int
+	}{
+		{
+			name:           "Leaf with intermediate",
+			tls:            peerState(svid.Chain...),
+			expectedStatus: http.StatusOK,
+			expectedChain:  3,
+		},
+		{
+			name:           "Leaf without intermediate",
+			tls:            peerState(svid.Certificate),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "Chain verified during handshake",
+			tls: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{svid.Certificate},
+				VerifiedChains:   [][]*x509.Certificate{append(svid.Chain, ca.Certificate)},
+			},
+			expectedStatus: http.StatusOK,
+			expectedChain:  3,
+		},
+		{
+			name: "Handshake chain ending at untrusted root",
+			tls: &tls.ConnectionState{
+				PeerCertificates: untrustedSVID.Chain,
+				VerifiedChains:   [][]*x509.Certificate{append(untrustedSVID.Chain, untrusted.Roots()...)},
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler that checks the verified chain
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				principal, err := common.GetPrincipalFromContext(r.Context())
+				assert.NoError(t, err)
+				chain := principal.Certificates
+				assert.Len(t, chain, tt.expectedChain)
+				assert.True(t, chain[len(chain)-1].Equal(ca.Certificate))
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.TLS = tt.tls
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestMiddleware_BundleSource(t *testing.T) {
+	oldCA := spiffetest.NewCA(t, "example.org")
+	newCA := spiffetest.NewCA(t, "example.org")
+	oldSVID := oldCA.IssueSVID(t, "spiffe://example.org/a")
+	newSVID := newCA.IssueSVID(t, "spiffe://example.org/a")
+
+	bundles := spiffe.NewMemoryBundleSource(oldCA.Roots())
+	middleware, err := NewMiddleware(&Config{
+		BundleSource:        bundles,
+		AllowedTrustDomains: []string{"example.org"},
+	}, "test-service")
+	assert.NoError(t, err)
+
+	_, err = middleware.VerifyCertificate(oldSVID.Certificate)
+	assert.NoError(t, err)
+	_, err = middleware.VerifyCertificate(newSVID.Certificate)
+	assert.Error(t, err)
+
+	// Roll the bundle without recreating the middleware
+	bundles.SetRoots(newCA.Roots())
+
+	_, err = middleware.VerifyCertificate(oldSVID.Certificate)
+	assert.Error(t, err)
+	_, err = middleware.VerifyCertificate(newSVID.Certificate)
+	assert.NoError(t, err)
+
+	// A chain verified during the handshake against a removed root is not trusted
+	_, _, err = middleware.VerifyConnection(&tls.ConnectionState{
+		PeerCertificates: oldSVID.Chain,
+		VerifiedChains:   [][]*x509.Certificate{append(oldSVID.Chain, oldCA.Certificate)},
+	})
+	assert.Error(t, err)
+}
+
+func TestMiddleware_BundleSet(t *testing.T) {
+	caA := spiffetest.NewCA(t, "a.example")
+	caB := spiffetest.NewCA(t, "b.example")
+	caC := spiffetest.NewCA(t, "c.example")
+
+	bundles := spiffe.NewBundleSet()
+	bundles.Set(spiffeid.RequireTrustDomainFromString("a.example"), spiffe.NewMemoryBundleSource(caA.Roots()))
+	bundles.Set(spiffeid.RequireTrustDomainFromString("b.example"), spiffe.NewMemoryBundleSource(caB.Roots()))
+
+	middleware, err := NewMiddleware(&Config{
+		BundleSet:           bundles,
+		AllowedTrustDomains: []string{"a.example", "b.example", "c.example"},
+	}, "test-service")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		cert           *x509.Certificate
+		route          func(http.Handler) http.Handler
+		expectedStatus int
+	}{
+		{
+			name:           "Peer from own trust domain",
+			cert:           caA.IssueSVID(t, "spiffe://a.example/frontend").Certificate,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Federated peer",
+			cert:           caB.IssueSVID(t, "spiffe://b.example/frontend").Certificate,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Peer chaining to another domain's root",
+			cert:           caB.IssueSVID(t, "spiffe://a.example/frontend").Certificate,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Peer from domain without bundle",
+			cert:           caC.IssueSVID(t, "spiffe://c.example/frontend").Certificate,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Route allows peer domain",
+			cert:           caA.IssueSVID(t, "spiffe://a.example/frontend").Certificate,
+			route:          middleware.AllowTrustDomains("a.example"),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Route does not allow peer domain",
+			cert:           caB.IssueSVID(t, "spiffe://b.example/frontend").Certificate,
+			route:          middleware.AllowTrustDomains("a.example"),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Route denies peer domain",
+			cert:           caB.IssueSVID(t, "spiffe://b.example/frontend").Certificate,
+			route:          middleware.DenyTrustDomains("b.example"),
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			if tt.route != nil {
+				handler = tt.route(handler)
+			}
+
+			// Create test request
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.TLS = peerState(tt.cert)
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(handler).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestMiddleware_Revocation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	good := ca.IssueSVID(t, "spiffe://example.org/good")
+	revoked := ca.IssueSVID(t, "spiffe://example.org/revoked")
+
+	// Publish a CRL listing the revoked certificate
+	crlPath := filepath.Join(t.TempDir(), "ca.crl")
+	assert.NoError(t, os.WriteFile(crlPath, ca.CreateCRL(t, time.Now().Add(time.Hour), revoked.Certificate), 0600))
+	checker, err := revocation.NewCRLChecker(&revocation.CRLConfig{Files: []string{crlPath}})
+	assert.NoError(t, err)
+
+	middleware, err := NewMiddleware(&Config{
+		TrustBundle:         ca.Roots(),
+		AllowedTrustDomains: []string{"example.org"},
+		RevocationChecker:   checker,
+	}, "test-service")
+	assert.NoError(t, err)
+
+	_, err = middleware.VerifyCertificate(good.Certificate)
+	assert.NoError(t, err)
+
+	_, err = middleware.VerifyCertificate(revoked.Certificate)
+	assert.ErrorIs(t, err, revocation.ErrRevoked)
+
+	// Create test request
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.TLS = peerState(revoked.Certificate)
+
+	// Create response recorder
+	rr := httptest.NewRecorder()
+
+	// Apply middleware
+	middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, req)
+
+	// Check response
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestMiddleware_StapledOCSP(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+	good := ca.IssueSVID(t, "spiffe://example.org/good", spiffetest.WithOCSPServer(responder.URL))
+	revoked := ca.IssueSVID(t, "spiffe://example.org/revoked", spiffetest.WithOCSPServer(responder.URL))
+	responder.Revoke(revoked.Certificate)
+
+	checker, err := revocation.NewOCSPChecker(&revocation.OCSPConfig{})
+	assert.NoError(t, err)
+
+	middleware, err := NewMiddleware(&Config{
+		TrustBundle:         ca.Roots(),
+		AllowedTrustDomains: []string{"example.org"},
+		RevocationChecker:   checker,
+	}, "test-service")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		svid           *spiffetest.SVID
+		expectedStatus int
+	}{
+		{name: "Good staple", svid: good, expectedStatus: http.StatusOK},
+		{name: "Revoked staple", svid: revoked, expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test request with a stapled OCSP response
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.TLS = peerState(tt.svid.Certificate)
+			req.TLS.OCSPResponse = responder.Staple(t, tt.svid.Certificate)
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware
+			middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+
+	// Staples were used instead of querying the responder
+	assert.Equal(t, 0, responder.Requests())
+}
+
+func TestMiddleware_SkipRoutes(t *testing.T) {
+	middleware, _ := setupTestMiddleware(t, &Config{
+		AllowedTrustDomains: []string{"example.org"},
+		Routes: common.RouteConfig{
+			SkipRoutes: []common.RouteRule{
+				{Pattern: "/public/**"},
+				{Methods: []string{http.MethodGet}, Pattern: "/docs/*"},
+			},
+		},
+	})
+
+	handler := middleware.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{method: http.MethodGet, path: "/public/index.html", expectedStatus: http.StatusOK},
+		{method: http.MethodGet, path: "/docs/api", expectedStatus: http.StatusOK},
+		{method: http.MethodPost, path: "/docs/api", expectedStatus: http.StatusUnauthorized},
+		// Configured routes replace the defaults
+		{method: http.MethodGet, path: "/health", expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			// Create test request without TLS
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestNewMiddleware_InvalidConfig(t *testing.T) {
+	_, err := NewMiddleware(nil, "test-service")
+	assert.Error(t, err)
+
+	_, err = NewMiddleware(&Config{AllowedIDs: []string{"not-a-spiffe-id"}}, "test-service")
+	assert.Error(t, err)
+	_, err = NewMiddleware(&Config{Routes: common.RouteConfig{SkipRoutes: []common.RouteRule{{Pattern: "health"}}}}, "test-service")
+	assert.Error(t, err)
+}
+
+// peerState builds a connection state presenting the given peer certificates
+func peerState(certs ...*x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{PeerCertificates: certs}
+}
@@ -0,0 +1,220 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// RoleSource extracts roles from a verified client certificate
+type RoleSource interface {
+	// Roles returns the roles granted to the certificate holder
+	Roles(cert *x509.Certificate, id spiffeid.ID) ([]string, error)
+}
+
+// ExtensionRoleSource reads roles from a custom X.509 extension. The
+// extension value is either a DER SEQUENCE OF UTF8String or a single
+// UTF8String holding a comma separated list.
+type ExtensionRoleSource struct {
+	OID asn1.ObjectIdentifier
+}
+
+// NewExtensionRoleSource creates a role source for the extension OID
+func NewExtensionRoleSource(oid asn1.ObjectIdentifier) *ExtensionRoleSource {
+	return &ExtensionRoleSource{OID: oid}
+}
+
+// Roles implements RoleSource
+func (s *ExtensionRoleSource) Roles(cert *x509.Certificate, _ spiffeid.ID) ([]string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(s.OID) {
+			continue
+		}
+
+		// Try a sequence of strings first
+		var roles []string
+		if rest, err := asn1.Unmarshal(ext.Value, &roles); err == nil && len(rest) == 0 {
+			return roles, nil
+		}
+
+		// Fall back to a single comma separated string
+		var value string
+		if rest, err := asn1.UnmarshalWithParams(ext.Value, &value, "utf8"); err == nil && len(rest) == 0 {
+			return splitRoles(value), nil
+		}
+
+		return nil, fmt.Errorf("failed to decode role extension %s", s.OID)
+	}
+	return nil, nil
+}
+
+// SubjectOURoleSource uses the Subject organizational units as roles
+type SubjectOURoleSource struct{}
+
+// NewSubjectOURoleSource creates a role source reading Subject OU values
+func NewSubjectOURoleSource() *SubjectOURoleSource {
+	return &SubjectOURoleSource{}
+}
+
+// Roles implements RoleSource
+func (s *SubjectOURoleSource) Roles(cert *x509.Certificate, _ spiffeid.ID) ([]string, error) {
+	return append([]string(nil), cert.Subject.OrganizationalUnit...), nil
+}
+
+// PathSegmentRoleSource uses one segment of the SPIFFE ID path as the role.
+// Index 0 is the first segment; negative indexes count from the end, so -1
+// selects "frontend" in spiffe://example.org/ns/demo/sa/frontend.
+type PathSegmentRoleSource struct {
+	Index int
+}
+
+// NewPathSegmentRoleSource creates a role source for the SPIFFE ID path segment
+func NewPathSegmentRoleSource(index int) *PathSegmentRoleSource {
+	return &PathSegmentRoleSource{Index: index}
+}
+
+// Roles implements RoleSource
+func (s *PathSegmentRoleSource) Roles(_ *x509.Certificate, id spiffeid.ID) ([]string, error) {
+	segments := strings.Split(strings.TrimPrefix(id.Path(), "/"), "/")
+	if len(segments) == 1 && segments[0] == "" {
+		return nil, nil
+	}
+
+	index := s.Index
+	if index < 0 {
+		index += len(segments)
+	}
+	if index < 0 || index >= len(segments) {
+		return nil, nil
+	}
+
+	return []string{segments[index]}, nil
+}
+
+// MappingFileRoleSource maps SPIFFE IDs to roles using a JSON file of the form
+// {"spiffe://example.org/ns/demo/sa/frontend": ["reader", "writer"]}.
+// The file is re-read when its modification time or size changes.
+type MappingFileRoleSource struct {
+	path           string
+	reloadInterval time.Duration
+	onError        func(error)
+
+	mu        sync.RWMutex
+	roles     map[string][]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+// NewMappingFileRoleSource loads the mapping file and checks it for changes
+// at most once per reloadInterval. onError is called for every failed
+// reload; failures are logged when it is nil.
+func NewMappingFileRoleSource(path string, reloadInterval time.Duration, onError func(error)) (*MappingFileRoleSource, error) {
+	if onError == nil {
+		onError = func(err error) {
+			log.Printf("Warning: keeping previous role mapping: %v", err)
+		}
+	}
+
+	s := &MappingFileRoleSource{
+		path:           path,
+		reloadInterval: reloadInterval,
+		onError:        onError,
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload re-reads the mapping file. On error the previous mapping is kept.
+func (s *MappingFileRoleSource) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat role mapping file: %v", err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read role mapping file: %v", err)
+	}
+
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse role mapping file: %v", err)
+	}
+
+	// Normalize the IDs so lookups match the parsed form
+	roles := make(map[string][]string, len(raw))
+	for rawID, idRoles := range raw {
+		id, err := spiffeid.FromString(rawID)
+		if err != nil {
+			return fmt.Errorf("invalid SPIFFE ID %q in role mapping file: %v", rawID, err)
+		}
+		roles[id.String()] = idRoles
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roles = roles
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.lastCheck = time.Now()
+
+	return nil
+}
+
+// Roles implements RoleSource
+func (s *MappingFileRoleSource) Roles(_ *x509.Certificate, id spiffeid.ID) ([]string, error) {
+	s.reloadIfChanged()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.roles[id.String()], nil
+}
+
+// reloadIfChanged reloads the file when it changed since the last load
+func (s *MappingFileRoleSource) reloadIfChanged() {
+	s.mu.Lock()
+	if time.Since(s.lastCheck) < s.reloadInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastCheck = time.Now()
+	modTime, size := s.modTime, s.size
+	s.mu.Unlock()
+
+	info, err := os.Stat(s.path)
+	if err == nil && info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+
+	// Keep serving the previous mapping if the new file is missing or
+	// invalid
+	if err := s.Reload(); err != nil {
+		s.onError(err)
+	}
+}
+
+// splitRoles splits a comma separated role list
+func splitRoles(value string) []string {
+	var roles []string
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,208 @@
+package mtls
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+// withRoleExtension adds a role extension with the given DER value
+func withRoleExtension(t *testing.T, value interface{}) spiffetest.Option {
+	der, err := asn1.Marshal(value)
+	assert.NoError(t, err)
+	return func(tmpl *x509.Certificate) {
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, pkix.Extension{Id: testRoleOID, Value: der})
+	}
+}
+
+func TestExtensionRoleSource_Roles(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	source := NewExtensionRoleSource(testRoleOID)
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		expected []string
+	}{
+		{
+			name:     "Sequence of roles",
+			cert:     ca.IssueSVID(t, "spiffe://example.org/a", withRoleExtension(t, []string{"reader", "writer"})).Certificate,
+			expected: []string{"reader", "writer"},
+		},
+		{
+			name:     "Comma separated roles",
+			cert:     ca.IssueSVID(t, "spiffe://example.org/a", withRoleExtension(t, "reader, admin")).Certificate,
+			expected: []string{"reader", "admin"},
+		},
+		{
+			name:     "No extension",
+			cert:     ca.IssueSVID(t, "spiffe://example.org/a").Certificate,
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles, err := source.Roles(tt.cert, spiffeid.RequireFromString("spiffe://example.org/a"))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, roles)
+		})
+	}
+}
+
+func TestPathSegmentRoleSource_Roles(t *testing.T) {
+	id := spiffeid.RequireFromString("spiffe://example.org/ns/demo/sa/frontend")
+
+	tests := []struct {
+		name     string
+		index    int
+		expected []string
+	}{
+		{name: "First segment", index: 0, expected: []string{"ns"}},
+		{name: "Last segment", index: -1, expected: []string{"frontend"}},
+		{name: "Namespace", index: 1, expected: []string{"demo"}},
+		{name: "Out of range", index: 10, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles, err := NewPathSegmentRoleSource(tt.index).Roles(nil, id)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, roles)
+		})
+	}
+}
+
+func TestMappingFileRoleSource_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"spiffe://example.org/frontend": ["reader"]}`), 0600))
+
+	var reloadErrs []error
+	source, err := NewMappingFileRoleSource(path, 0, func(err error) {
+		reloadErrs = append(reloadErrs, err)
+	})
+	assert.NoError(t, err)
+
+	id := spiffeid.RequireFromString("spiffe://example.org/frontend")
+	roles, err := source.Roles(nil, id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reader"}, roles)
+
+	// Rewrite the mapping; the next lookup picks it up
+	assert.NoError(t, os.WriteFile(path, []byte(`{"spiffe://example.org/frontend": ["reader", "admin"]}`), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+
+	roles, err = source.Roles(nil, id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reader", "admin"}, roles)
+
+	assert.Empty(t, reloadErrs)
+
+	// An invalid file keeps the last good mapping and reports the error
+	assert.NoError(t, os.WriteFile(path, []byte(`{not json`), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute)))
+
+	roles, err = source.Roles(nil, id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reader", "admin"}, roles)
+	assert.Len(t, reloadErrs, 1)
+
+	// So does a removed file
+	assert.NoError(t, os.Remove(path))
+	roles, err = source.Roles(nil, id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reader", "admin"}, roles)
+	assert.Len(t, reloadErrs, 2)
+}
+
+func TestNewMappingFileRoleSource_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"not-a-spiffe-id": ["reader"]}`), 0600))
+
+	_, err := NewMappingFileRoleSource(path, time.Second, nil)
+	assert.Error(t, err)
+
+	_, err = NewMappingFileRoleSource(filepath.Join(t.TempDir(), "missing.json"), time.Second, nil)
+	assert.Error(t, err)
+}
+
+func TestMiddleware_RequireRole(t *testing.T) {
+	middleware, ca := setupTestMiddleware(t, &Config{
+		AllowedTrustDomains: []string{"example.org"},
+		RoleSources: []RoleSource{
+			NewSubjectOURoleSource(),
+			NewPathSegmentRoleSource(-1),
+		},
+	})
+
+	tests := []struct {
+		name           string
+		cert           *x509.Certificate
+		requiredRoles  []string
+		expectedStatus int
+	}{
+		{
+			name:           "Role from Subject OU",
+			cert:           ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend", spiffetest.WithSubject(pkix.Name{OrganizationalUnit: []string{"admin"}})).Certificate,
+			requiredRoles:  []string{"admin"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Role from SPIFFE ID path",
+			cert:           ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate,
+			requiredRoles:  []string{"frontend"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Missing required role",
+			cert:           ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate,
+			requiredRoles:  []string{"admin"},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test handler
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// Create test request
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.TLS = peerState(tt.cert)
+
+			// Create response recorder
+			rr := httptest.NewRecorder()
+
+			// Apply middleware chain
+			middleware.Middleware(middleware.RequireRole(tt.requiredRoles...)(handler)).ServeHTTP(rr, req)
+
+			// Check response
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestMiddleware_DefaultRoles(t *testing.T) {
+	middleware, ca := setupTestMiddleware(t, &Config{
+		AllowedTrustDomains: []string{"example.org"},
+		DefaultRoles:        []string{"service"},
+	})
+
+	roles := middleware.GetCertificateRoles(ca.IssueSVID(t, "spiffe://example.org/a").Certificate)
+	assert.Equal(t, []string{"service"}, roles)
+}
@@ -17,7 +17,8 @@ type Middleware struct {
 	provider    *oidc.Provider
 	verifier    *oidc.IDTokenVerifier
 	config      *oauth2.Config
-	metrics     common.AuthMetricsCollector
+	skip        *common.RouteMatcher
+	metrics     *common.AuthMetricsCollector
 	serviceName string
 }
 
@@ -37,6 +38,18 @@ type Config struct {
 	// Additional settings
 	AllowedAudiences []string
 	AllowedIssuers   []string
+
+	// Routes configures the routes served without an ID token. /health,
+	// /metrics and the /auth/callback endpoint are skipped by default.
+	Routes common.RouteConfig
+}
+
+// defaultSkipRoutes are served without an ID token unless Routes says
+// otherwise
+var defaultSkipRoutes = []common.RouteRule{
+	{Pattern: "/health"},
+	{Pattern: "/metrics"},
+	{Pattern: "/auth/callback"}, // OIDC callback endpoint
 }
 
 // NewMiddleware creates a new OIDC middleware
@@ -45,6 +58,11 @@ func NewMiddleware(config *Config, serviceName string) (*Middleware, error) {
 		return nil, fmt.Errorf("config cannot be nil")
 	}
 
+	skip, err := common.NewSkipMatcher(config.Routes, serviceName, defaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create OIDC provider
 	provider, err := oidc.NewProvider(context.Background(), config.IssuerURL)
 	if err != nil {
@@ -65,7 +83,6 @@ func NewMiddleware(config *Config, serviceName string) (*Middleware, error) {
 		SkipClientIDCheck:    true,
 		SkipIssuerCheck:      config.SkipIssuerCheck,
 		SkipExpiryCheck:      config.SkipExpiryCheck,
-		InsecureSkipVerify:   false,
 		SupportedSigningAlgs: []string{oidc.RS256, oidc.ES256},
 	})
 
@@ -73,6 +90,7 @@ func NewMiddleware(config *Config, serviceName string) (*Middleware, error) {
 		provider:    provider,
 		verifier:    verifier,
 		config:      oauth2Config,
+		skip:        skip,
 		metrics:     common.NewAuthMetricsCollector(),
 		serviceName: serviceName,
 	}, nil
@@ -84,48 +102,22 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 		start := time.Now()
 
 		// Skip validation for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Extract token from Authorization header
-		tokenString, err := m.ExtractToken(r)
-		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "missing_token")
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Verify token
-		token, err := m.verifier.Verify(r.Context(), tokenString)
+		// Authenticate the ID token
+		principal, err := m.Authenticate(r)
 		if err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "invalid_token")
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		// Parse claims
-		var claims struct {
-			Subject string   `json:"sub"`
-			Email   string   `json:"email"`
-			Name    string   `json:"name"`
-			Groups  []string `json:"groups"`
-			Roles   []string `json:"roles"`
-		}
-
-		if err := token.Claims(&claims); err != nil {
-			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "invalid_claims")
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+			authErr := common.AsAuthError(err)
+			m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), authErr.Reason)
+			http.Error(w, authErr.Message, authErr.Status)
 			return
 		}
 
-		// Add authentication info to context
-		ctx := r.Context()
-		ctx = common.WithAuthMethod(ctx, common.AuthMethodOIDC)
-		ctx = common.WithServiceID(ctx, claims.Subject)
-		ctx = common.WithRoles(ctx, claims.Roles)
-		r = r.WithContext(ctx)
+		// Add the authenticated principal to context
+		r = r.WithContext(common.WithPrincipal(r.Context(), principal))
 
 		// Record successful authentication
 		m.metrics.RecordAuthRequest(m.serviceName, string(common.AuthMethodOIDC), "success", time.Since(start).Seconds())
@@ -135,21 +127,48 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 	})
 }
 
-// shouldSkipValidation determines if authentication should be skipped
-func (m *Middleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
-		"/auth/callback", // OIDC callback endpoint
+// Authenticate verifies the ID token of the request and returns the
+// principal of its subject
+func (m *Middleware) Authenticate(r *http.Request) (*common.Principal, error) {
+	// Extract token from Authorization header
+	tokenString, err := m.ExtractToken(r)
+	if err != nil {
+		return nil, common.Unauthorized("missing_token", "Authorization header required", common.ErrNoCredentials)
+	}
+
+	return m.VerifyIDToken(r.Context(), tokenString)
+}
+
+// VerifyIDToken verifies a raw ID token and returns the principal of its
+// subject. The token exchange endpoint uses it for ID token subject tokens.
+func (m *Middleware) VerifyIDToken(ctx context.Context, rawIDToken string) (*common.Principal, error) {
+	// Verify token
+	token, err := m.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, common.Unauthorized("invalid_token", "Invalid token", err)
 	}
 
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
-		}
+	// Parse claims
+	var claims struct {
+		Subject string   `json:"sub"`
+		Email   string   `json:"email"`
+		Name    string   `json:"name"`
+		Groups  []string `json:"groups"`
+		Roles   []string `json:"roles"`
+	}
+	var rawClaims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return nil, common.Unauthorized("invalid_claims", "Invalid token claims", err)
+	}
+	if err := token.Claims(&rawClaims); err != nil {
+		return nil, common.Unauthorized("invalid_claims", "Invalid token claims", err)
 	}
-	return false
+
+	principal := common.NewPrincipal(common.AuthMethodOIDC, claims.Subject)
+	principal.Issuer = token.Issuer
+	principal.Roles = claims.Roles
+	principal.Claims = rawClaims
+	return principal, nil
 }
 
 // ExtractToken extracts the token from the Authorization header
@@ -171,44 +190,23 @@ func (m *Middleware) ExtractToken(r *http.Request) (string, error) {
 func (m *Middleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get authentication method
-			method, err := common.GetAuthMethodFromContext(r.Context())
+			// Get the authenticated principal
+			principal, err := common.GetPrincipalFromContext(r.Context())
 			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "missing_auth_method")
+				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "missing_principal")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
 			// Verify OIDC authentication
-			if method != common.AuthMethodOIDC {
+			if !principal.HasMethod(common.AuthMethodOIDC) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "invalid_auth_method")
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			// Get roles from context
-			tokenRoles, err := common.GetRolesFromContext(r.Context())
-			if err != nil {
-				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "missing_roles")
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			// Check if any required role is present
-			hasRole := false
-			for _, requiredRole := range roles {
-				for _, tokenRole := range tokenRoles {
-					if requiredRole == tokenRole {
-						hasRole = true
-						break
-					}
-				}
-				if hasRole {
-					break
-				}
-			}
-
-			if !hasRole {
+			// Check if this method granted any required role
+			if !principal.HasMethodRole(common.AuthMethodOIDC, roles...) {
 				m.metrics.RecordAuthError(m.serviceName, string(common.AuthMethodOIDC), "insufficient_roles")
 				http.Error(w, "Forbidden", http.StatusForbidden)
 				return
@@ -5,7 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
-	"time"
+
+	"mTLS_demo/auth/common"
 
 	"golang.org/x/time/rate"
 )
@@ -70,6 +71,7 @@ type Middleware struct {
 	limiter     Limiter
 	keyFunc     func(*http.Request) string
 	waitOnLimit bool
+	skip        *common.RouteMatcher
 }
 
 // Config holds the rate limiting configuration
@@ -83,6 +85,10 @@ type Config struct {
 
 	// Whether to wait when rate limit is exceeded
 	WaitOnLimit bool
+
+	// Routes configures the routes that are not rate limited. /health and
+	// /metrics are skipped by default.
+	Routes common.RouteConfig
 }
 
 // DefaultKeyFunc returns a key based on the client's IP address
@@ -112,6 +118,11 @@ func NewMiddleware(config *Config) (*Middleware, error) {
 		return nil, fmt.Errorf("burst must be positive")
 	}
 
+	skip, err := common.NewSkipMatcher(config.Routes, "rate limiter", common.DefaultSkipRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
 	keyFunc := config.KeyFunc
 	if keyFunc == nil {
 		keyFunc = DefaultKeyFunc
@@ -121,6 +132,7 @@ func NewMiddleware(config *Config) (*Middleware, error) {
 		limiter:     NewRateLimiter(config.RequestsPerSecond, config.Burst),
 		keyFunc:     keyFunc,
 		waitOnLimit: config.WaitOnLimit,
+		skip:        skip,
 	}, nil
 }
 
@@ -128,7 +140,7 @@ func NewMiddleware(config *Config) (*Middleware, error) {
 func (m *Middleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Skip rate limiting for certain paths
-		if m.shouldSkipValidation(r.URL.Path) {
+		if m.skip.Match(r) {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -154,20 +166,4 @@ func (m *Middleware) Middleware(next http.Handler) http.Handler {
 		// Call next handler
 		next.ServeHTTP(w, r)
 	})
-}
-
-// shouldSkipValidation determines if rate limiting should be skipped
-func (m *Middleware) shouldSkipValidation(path string) bool {
-	// Add paths that should skip validation
-	skipPaths := []string{
-		"/health",
-		"/metrics",
-	}
-
-	for _, skipPath := range skipPaths {
-		if path == skipPath {
-			return true
-		}
-	}
-	return false
-} 
\ No newline at end of file
+}
\ No newline at end of file
@@ -35,6 +35,13 @@ func main() {
 		Scopes:         []string{"openid", "profile", "email"},
 		SkipIssuerCheck: true, // Only for testing
 		SkipExpiryCheck: true, // Only for testing
+		Routes: common.RouteConfig{
+			// Reported at startup if a skip route ever covers them
+			RoleRoutes: []common.RoleRoute{
+				{Path: "/api/user", Roles: []string{"user"}},
+				{Path: "/api/admin", Roles: []string{"admin"}},
+			},
+		},
 	}
 	oidcMiddleware, err := oidc.NewMiddleware(oidcConfig, "example-service")
 	if err != nil {
@@ -73,24 +80,27 @@ func main() {
 	// Service-to-service endpoints (API key auth required)
 	mux.Handle("/api/service", apiKeyMiddleware.RequireRole("service")(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			serviceID, _ := common.GetServiceIDFromContext(r.Context())
-			w.Write([]byte("Hello service: " + serviceID))
+			// RequireRole only passes requests with a principal
+			principal, _ := common.GetPrincipalFromContext(r.Context())
+			w.Write([]byte("Hello service: " + principal.Subject))
 		}),
 	))
 
 	// User endpoints (OIDC auth required)
 	mux.Handle("/api/user", oidcMiddleware.RequireRole("user")(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userID, _ := common.GetServiceIDFromContext(r.Context())
-			w.Write([]byte("Hello user: " + userID))
+			// RequireRole only passes requests with a principal
+			principal, _ := common.GetPrincipalFromContext(r.Context())
+			w.Write([]byte("Hello user: " + principal.Subject))
 		}),
 	))
 
 	// Admin endpoints (OIDC auth with admin role required)
 	mux.Handle("/api/admin", oidcMiddleware.RequireRole("admin")(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			userID, _ := common.GetServiceIDFromContext(r.Context())
-			w.Write([]byte("Hello admin: " + userID))
+			// RequireRole only passes requests with a principal
+			principal, _ := common.GetPrincipalFromContext(r.Context())
+			w.Write([]byte("Hello admin: " + principal.Subject))
 		}),
 	))
 
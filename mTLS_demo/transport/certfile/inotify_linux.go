@@ -0,0 +1,78 @@
+//go:build linux
+
+package certfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the events that can change a file in a watched
+// directory: writes, renames, creations, deletions and symlink swaps
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// inotify watches directories for file changes
+type inotify struct {
+	file *os.File
+	buf  []byte
+}
+
+// newInotify starts watching dirs
+func newInotify(dirs []string) (*inotify, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1 failed: %v", err)
+	}
+
+	for _, dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, watchMask); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+		}
+	}
+
+	// A non-blocking descriptor is handled by the runtime poller, so Close
+	// interrupts a pending Read
+	return &inotify{
+		file: os.NewFile(uintptr(fd), "inotify"),
+		buf:  make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1)),
+	}, nil
+}
+
+// Read blocks until events arrive and returns the names of the files they
+// concern. An empty name is returned when the kernel dropped events.
+func (n *inotify) Read() ([]string, error) {
+	count, err := n.file.Read(n.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for offset := 0; offset+unix.SizeofInotifyEvent <= count; {
+		event := (*unix.InotifyEvent)(unsafe.Pointer(&n.buf[offset]))
+		nameStart := offset + unix.SizeofInotifyEvent
+		offset = nameStart + int(event.Len)
+
+		switch {
+		case event.Mask&unix.IN_Q_OVERFLOW != 0:
+			names = append(names, "")
+		case event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0:
+			return nil, fmt.Errorf("watched directory was removed")
+		case event.Len > 0:
+			name := n.buf[nameStart:offset]
+			names = append(names, string(bytes.TrimRight(name, "\x00")))
+		}
+	}
+
+	return names, nil
+}
+
+// Close stops watching
+func (n *inotify) Close() error {
+	return n.file.Close()
+}
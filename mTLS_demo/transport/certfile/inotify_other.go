@@ -0,0 +1,23 @@
+//go:build !linux
+
+package certfile
+
+import "fmt"
+
+// inotify is only implemented on Linux
+type inotify struct{}
+
+// newInotify reports that file watching is unsupported
+func newInotify([]string) (*inotify, error) {
+	return nil, fmt.Errorf("file watching is only supported on Linux")
+}
+
+// Read is never called
+func (n *inotify) Read() ([]string, error) {
+	return nil, fmt.Errorf("file watching is only supported on Linux")
+}
+
+// Close is never called
+func (n *inotify) Close() error {
+	return nil
+}
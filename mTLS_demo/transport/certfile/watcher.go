@@ -0,0 +1,453 @@
+// Package certfile serves a certificate, key and trust bundle written to
+// disk by another process, such as spiffe-helper, reloading them as soon as
+// the files change.
+package certfile
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe"
+)
+
+const defaultDebounce = 100 * time.Millisecond
+
+// ErrNotReady is returned until a valid certificate and key have been loaded
+var ErrNotReady = errors.New("no valid certificate loaded")
+
+// Store receives every certificate pair and trust bundle loaded by a Watcher
+type Store interface {
+	// StoreX509SVID stores a certificate chain, leaf first, and its key.
+	// The key is wiped after it is rotated out, so stores that keep it must take
+	// their own copy.
+	StoreX509SVID(chain []*x509.Certificate, key crypto.Signer) error
+	// SetTrustBundle replaces the trusted roots
+	SetTrustBundle(roots []*x509.Certificate)
+}
+
+// Config configures a Watcher
+type Config struct {
+	// CertPath is the PEM certificate chain, leaf first
+	CertPath string
+	// KeyPath is the PEM private key of the leaf certificate
+	KeyPath string
+	// BundlePath is the optional PEM trust bundle
+	BundlePath string
+	// Store optionally receives every certificate pair and trust bundle
+	Store Store
+	// Debounce is how long the files must stay unchanged before they are
+	// reloaded. It defaults to 100ms.
+	Debounce time.Duration
+	// RetireDelay is how long a rotated-out key stays usable, so handshakes
+	// in progress and subscribers still serving the previous certificate
+	// can finish. It defaults to securemem.DefaultRetireDelay.
+	RetireDelay time.Duration
+}
+
+// RotationEvent describes a certificate replaced by a Watcher
+type RotationEvent struct {
+	// OldSerial is the hex serial of the replaced certificate, empty for the
+	// first certificate loaded
+	OldSerial string
+	// NewSerial is the hex serial of the new certificate
+	NewSerial string
+	// NotAfter is the expiry of the new certificate
+	NotAfter time.Time
+}
+
+// Watcher loads a certificate, key and trust bundle from disk and reloads
+// them on inotify events. A new certificate is only served once its key has
+// been checked against it; until then the last good pair is kept. The key
+// is held in locked memory and wiped on Close or once the retire delay has
+// passed after it was rotated out.
+type Watcher struct {
+	config  Config
+	bundle  *spiffe.MemoryBundleSource
+	retired *securemem.Retirer
+	metrics *common.MetricsCollector
+
+	// reloadMu serializes reloads
+	reloadMu   sync.Mutex
+	pairHash   [sha256.Size]byte
+	bundleHash [sha256.Size]byte
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	subscribers []func(RotationEvent)
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// NewWatcher creates a watcher. Nothing is loaded until Run or Reload is
+// called.
+func NewWatcher(config *Config) (*Watcher, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.CertPath == "" || config.KeyPath == "" {
+		return nil, fmt.Errorf("certificate and key paths are required")
+	}
+
+	w := &Watcher{
+		config:  *config,
+		bundle:  spiffe.NewMemoryBundleSource(nil),
+		metrics: common.NewMetricsCollector(),
+		ready:   make(chan struct{}),
+	}
+	if w.config.Debounce <= 0 {
+		w.config.Debounce = defaultDebounce
+	}
+	if w.config.RetireDelay <= 0 {
+		w.config.RetireDelay = securemem.DefaultRetireDelay
+	}
+	w.retired = securemem.NewRetirer(w.config.RetireDelay)
+
+	return w, nil
+}
+
+// Run loads the files and reloads them whenever they change, until ctx is
+// cancelled. Bursts of events are coalesced until the files have been quiet
+// for the debounce period. onError is called for every failed reload.
+func (w *Watcher) Run(ctx context.Context, onError func(error)) error {
+	notify, err := newInotify(w.dirs())
+	if err != nil {
+		return fmt.Errorf("failed to watch certificate files: %v", err)
+	}
+	defer notify.Close()
+
+	// Load only once watching, so writes in between are not missed
+	w.reload(onError)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	events := make(chan []string)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			names, err := notify.Read()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case events <- names:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErr:
+			return fmt.Errorf("certificate file watch failed: %v", err)
+		case names := <-events:
+			if w.relevant(names) {
+				debounce = time.After(w.config.Debounce)
+			}
+		case <-debounce:
+			debounce = nil
+			w.reload(onError)
+		}
+	}
+}
+
+// reload reloads the files, passing any error to onError
+func (w *Watcher) reload(onError func(error)) {
+	if err := w.Reload(); err != nil && onError != nil {
+		onError(err)
+	}
+}
+
+// Reload reloads the certificate pair and trust bundle if their contents
+// changed. On error the last good pair and bundle are kept.
+func (w *Watcher) Reload() error {
+	w.reloadMu.Lock()
+	defer w.reloadMu.Unlock()
+
+	var errs []error
+	if err := w.reloadPair(); err != nil {
+		errs = append(errs, err)
+	}
+	if w.config.BundlePath != "" {
+		if err := w.reloadBundle(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Ready once a pair is served and the bundle had its first chance to load
+	if _, err := w.Certificate(); err == nil {
+		w.readyOnce.Do(func() { close(w.ready) })
+	}
+
+	return errors.Join(errs...)
+}
+
+// reloadPair loads the certificate and key if either changed. The caller
+// holds reloadMu.
+func (w *Watcher) reloadPair() error {
+	certPEM, err := os.ReadFile(w.config.CertPath)
+	if err != nil {
+		w.metrics.RecordCertificateReload("error")
+		return fmt.Errorf("failed to read certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(w.config.KeyPath)
+	if err != nil {
+		w.metrics.RecordCertificateReload("error")
+		return fmt.Errorf("failed to read key: %v", err)
+	}
+	defer securemem.Wipe(keyPEM)
+
+	hash := sha256.New()
+	hash.Write(certPEM)
+	hash.Write(keyPEM)
+	var pairHash [sha256.Size]byte
+	copy(pairHash[:], hash.Sum(nil))
+	if pairHash == w.pairHash {
+		w.metrics.RecordCertificateReload("unchanged")
+		return nil
+	}
+
+	// A writer may have replaced only one of the files so far; the pair is
+	// checked and the next event retries
+	cert, err := loadPair(certPEM, keyPEM)
+	if err != nil {
+		w.metrics.RecordCertificateReload("invalid")
+		return fmt.Errorf("%s and %s are not a valid pair: %v", w.config.CertPath, w.config.KeyPath, err)
+	}
+
+	if w.config.Store != nil {
+		if err := w.config.Store.StoreX509SVID(cert.chain, cert.key); err != nil {
+			cert.key.Destroy()
+			w.metrics.RecordCertificateReload("invalid")
+			return fmt.Errorf("failed to store certificate: %v", err)
+		}
+	}
+
+	tlsCert := &tls.Certificate{PrivateKey: cert.key, Leaf: cert.chain[0]}
+	for _, c := range cert.chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, c.Raw)
+	}
+
+	w.mu.Lock()
+	previous := w.cert
+	w.cert = tlsCert
+	subscribers := w.subscribers
+	w.mu.Unlock()
+
+	w.pairHash = pairHash
+	w.metrics.RecordCertificateReload("rotated")
+
+	event := RotationEvent{
+		NewSerial: fmt.Sprintf("%x", tlsCert.Leaf.SerialNumber),
+		NotAfter:  tlsCert.Leaf.NotAfter,
+	}
+	if previous != nil {
+		event.OldSerial = fmt.Sprintf("%x", previous.Leaf.SerialNumber)
+	}
+	for _, fn := range subscribers {
+		fn(event)
+	}
+
+	// Subscribers have switched to the new certificate, but handshakes that
+	// fetched the previous one may still sign with its key
+	if previous != nil {
+		w.retired.Retire(previous.PrivateKey)
+	}
+
+	return nil
+}
+
+// reloadBundle loads the trust bundle if it changed. The caller holds
+// reloadMu.
+func (w *Watcher) reloadBundle() error {
+	bundlePEM, err := os.ReadFile(w.config.BundlePath)
+	if err != nil {
+		return fmt.Errorf("failed to read trust bundle: %v", err)
+	}
+
+	bundleHash := sha256.Sum256(bundlePEM)
+	if bundleHash == w.bundleHash {
+		return nil
+	}
+
+	roots, err := spiffe.ParseBundlePEM(bundlePEM)
+	if err != nil {
+		return fmt.Errorf("invalid trust bundle %s: %v", w.config.BundlePath, err)
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("trust bundle %s contains no certificates", w.config.BundlePath)
+	}
+
+	w.bundle.SetRoots(roots)
+	if w.config.Store != nil {
+		w.config.Store.SetTrustBundle(roots)
+	}
+	w.bundleHash = bundleHash
+
+	return nil
+}
+
+// WaitUntilReady blocks until a valid certificate pair has been loaded
+func (w *Watcher) WaitUntilReady(ctx context.Context) error {
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrNotReady, ctx.Err())
+	}
+}
+
+// Close wipes the key of the current certificate
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	cert := w.cert
+	w.cert = nil
+	w.mu.Unlock()
+
+	if cert != nil {
+		securemem.Zero(cert.PrivateKey)
+	}
+	w.retired.Flush()
+	return nil
+}
+
+// Certificate returns the last valid certificate
+func (w *Watcher) Certificate() (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.cert == nil {
+		return nil, ErrNotReady
+	}
+	return w.cert, nil
+}
+
+// GetCertificate serves the last valid certificate as
+// tls.Config.GetCertificate
+func (w *Watcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return w.Certificate()
+}
+
+// GetClientCertificate serves the last valid certificate as
+// tls.Config.GetClientCertificate
+func (w *Watcher) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return w.Certificate()
+}
+
+// Bundle returns the trust bundle, so the watcher can be used as a
+// spiffe.BundleSource
+func (w *Watcher) Bundle() (*spiffe.Bundle, error) {
+	return w.bundle.Bundle()
+}
+
+// SubscribeBundle registers fn to be called after every trust bundle change
+func (w *Watcher) SubscribeBundle(fn func(spiffe.BundleUpdate)) {
+	w.bundle.Subscribe(fn)
+}
+
+// Subscribe registers fn to be called with every certificate rotation. fn
+// runs synchronously on the goroutine reloading the files.
+func (w *Watcher) Subscribe(fn func(RotationEvent)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// dirs returns the directories holding the watched files. Directories are
+// watched rather than files so that files replaced by rename, or through a
+// Kubernetes ..data symlink swap, keep being tracked.
+func (w *Watcher) dirs() []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, path := range w.paths() {
+		dir := filepath.Dir(path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// paths returns the watched files
+func (w *Watcher) paths() []string {
+	paths := []string{w.config.CertPath, w.config.KeyPath}
+	if w.config.BundlePath != "" {
+		paths = append(paths, w.config.BundlePath)
+	}
+	return paths
+}
+
+// relevant reports whether events on names may have changed a watched file.
+// An empty name stands for lost events.
+func (w *Watcher) relevant(names []string) bool {
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(name, "..") {
+			return true
+		}
+		for _, path := range w.paths() {
+			if name == filepath.Base(path) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyPair is a certificate chain with its key in locked memory
+type keyPair struct {
+	chain []*x509.Certificate
+	key   *securemem.Signer
+}
+
+// loadPair parses a PEM certificate chain and key and checks that they
+// belong together and that the certificate is currently valid
+func loadPair(certPEM, keyPEM []byte) (*keyPair, error) {
+	chain, err := spiffe.ParseBundlePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+
+	key, err := securemem.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	defer securemem.Zero(key)
+
+	public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !public.Equal(chain[0].PublicKey) {
+		return nil, fmt.Errorf("private key does not match certificate")
+	}
+
+	now := time.Now()
+	if now.Before(chain[0].NotBefore) || now.After(chain[0].NotAfter) {
+		return nil, fmt.Errorf("certificate is outside its validity period")
+	}
+
+	locked, err := securemem.NewSigner(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to protect private key: %v", err)
+	}
+
+	return &keyPair{chain: chain, key: locked}, nil
+}
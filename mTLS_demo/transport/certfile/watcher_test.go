@@ -0,0 +1,285 @@
+package certfile
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcher_Rotation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	dir := t.TempDir()
+	writeSVID(t, dir, svidA)
+
+	store := mtls.NewSecureCertificateStore("", "", "")
+	watcher, events, _ := setupTestWatcher(t, dir, store)
+
+	cert, err := watcher.Certificate()
+	assert.NoError(t, err)
+	assert.True(t, cert.Leaf.Equal(svidA.Certificate))
+	assert.True(t, store.GetCertificate().Leaf.Equal(svidA.Certificate))
+	previousKey := cert.PrivateKey.(crypto.Signer)
+
+	// Files replaced by rename are picked up
+	writeSVID(t, dir, svidB)
+	assert.Eventually(t, func() bool {
+		cert, err := watcher.GetCertificate(nil)
+		return err == nil && cert.Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, store.GetCertificate().Leaf.Equal(svidB.Certificate))
+
+	assert.Equal(t, []RotationEvent{
+		{NewSerial: serial(svidA), NotAfter: svidA.Certificate.NotAfter},
+		{OldSerial: serial(svidA), NewSerial: serial(svidB), NotAfter: svidB.Certificate.NotAfter},
+	}, events.list())
+
+	// The previous key stays usable for handshakes in progress, then is
+	// wiped
+	digest := sha256.Sum256([]byte("message"))
+	_, err = previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return errors.Is(err, securemem.ErrDestroyed)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWatcher_PartialWrite(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	dir := t.TempDir()
+	writeSVID(t, dir, svidA)
+	watcher, events, errs := setupTestWatcher(t, dir, nil)
+
+	// A new certificate next to the old key is rejected and the last good
+	// pair keeps being served
+	writeFile(t, filepath.Join(dir, "svid.pem"), spiffetest.EncodeCertificates(svidB.Chain))
+	assert.Eventually(t, func() bool {
+		return len(errs.list()) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cert, err := watcher.Certificate()
+	assert.NoError(t, err)
+	assert.True(t, cert.Leaf.Equal(svidA.Certificate))
+
+	// The pair is served once the key catches up
+	writeFile(t, filepath.Join(dir, "svid_key.pem"), encodeKey(t, svidB))
+	assert.Eventually(t, func() bool {
+		cert, err := watcher.Certificate()
+		return err == nil && cert.Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, events.list(), 2)
+}
+
+func TestWatcher_Debounce(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	dir := t.TempDir()
+	writeSVID(t, dir, svidA)
+	watcher, events, errs := setupTestWatcher(t, dir, nil)
+
+	// Certificate and key written in quick succession cause one reload
+	writeFile(t, filepath.Join(dir, "svid.pem"), spiffetest.EncodeCertificates(svidB.Chain))
+	writeFile(t, filepath.Join(dir, "svid_key.pem"), encodeKey(t, svidB))
+	assert.Eventually(t, func() bool {
+		cert, err := watcher.Certificate()
+		return err == nil && cert.Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Empty(t, errs.list())
+	assert.Len(t, events.list(), 2)
+}
+
+func TestWatcher_SymlinkSwap(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	otherCA := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	// Lay the files out like a Kubernetes secret volume
+	dir := t.TempDir()
+	writeVersion(t, dir, "..v1", svidA, ca)
+	assert.NoError(t, os.Symlink("..v1", filepath.Join(dir, "..data")))
+	for _, name := range []string{"svid.pem", "svid_key.pem", "bundle.pem"} {
+		assert.NoError(t, os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)))
+	}
+
+	watcher, err := NewWatcher(&Config{
+		CertPath:   filepath.Join(dir, "svid.pem"),
+		KeyPath:    filepath.Join(dir, "svid_key.pem"),
+		BundlePath: filepath.Join(dir, "bundle.pem"),
+		Debounce:   20 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	runTestWatcher(t, watcher, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, watcher.WaitUntilReady(ctx))
+
+	bundle, err := watcher.Bundle()
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(ca.Certificate))
+
+	// Swap the ..data symlink to a new version, as the kubelet does
+	writeVersion(t, dir, "..v2", svidB, otherCA)
+	assert.NoError(t, os.Symlink("..v2", filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+
+	assert.Eventually(t, func() bool {
+		cert, err := watcher.Certificate()
+		bundle, _ := watcher.Bundle()
+		return err == nil && cert.Leaf.Equal(svidB.Certificate) && bundle.Contains(otherCA.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	bundle, err = watcher.Bundle()
+	assert.NoError(t, err)
+	assert.False(t, bundle.Contains(ca.Certificate))
+}
+
+func TestWatcher_NotReady(t *testing.T) {
+	dir := t.TempDir()
+	watcher, err := NewWatcher(&Config{
+		CertPath: filepath.Join(dir, "svid.pem"),
+		KeyPath:  filepath.Join(dir, "svid_key.pem"),
+	})
+	assert.NoError(t, err)
+
+	_, err = watcher.Certificate()
+	assert.ErrorIs(t, err, ErrNotReady)
+	assert.Error(t, watcher.Reload())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, watcher.WaitUntilReady(ctx), ErrNotReady)
+}
+
+func TestNewWatcher_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{name: "Nil config", config: nil},
+		{name: "Missing certificate path", config: &Config{KeyPath: "svid_key.pem"}},
+		{name: "Missing key path", config: &Config{CertPath: "svid.pem"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewWatcher(tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+// setupTestWatcher runs a watcher on svid.pem and svid_key.pem in dir until
+// the test finishes, once the first pair has been loaded
+func setupTestWatcher(t *testing.T, dir string, store Store) (*Watcher, *recorder[RotationEvent], *recorder[error]) {
+	watcher, err := NewWatcher(&Config{
+		CertPath:    filepath.Join(dir, "svid.pem"),
+		KeyPath:     filepath.Join(dir, "svid_key.pem"),
+		Store:       store,
+		Debounce:    200 * time.Millisecond,
+		RetireDelay: 100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	events := &recorder[RotationEvent]{}
+	watcher.Subscribe(events.add)
+	errs := &recorder[error]{}
+	runTestWatcher(t, watcher, errs.add)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, watcher.WaitUntilReady(ctx))
+
+	return watcher, events, errs
+}
+
+// runTestWatcher runs watcher in the background until the test finishes
+func runTestWatcher(t *testing.T, watcher *Watcher, onError func(error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, watcher.Run(ctx, onError))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		watcher.Close()
+	})
+}
+
+// recorder collects values passed to a callback
+type recorder[T any] struct {
+	mu     sync.Mutex
+	values []T
+}
+
+func (r *recorder[T]) add(value T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, value)
+}
+
+func (r *recorder[T]) list() []T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]T(nil), r.values...)
+}
+
+// writeSVID replaces the certificate and key files in dir
+func writeSVID(t *testing.T, dir string, svid *spiffetest.SVID) {
+	writeFile(t, filepath.Join(dir, "svid.pem"), spiffetest.EncodeCertificates(svid.Chain))
+	writeFile(t, filepath.Join(dir, "svid_key.pem"), encodeKey(t, svid))
+}
+
+// writeVersion writes a certificate, key and bundle into a new version
+// directory under dir
+func writeVersion(t *testing.T, dir, version string, svid *spiffetest.SVID, ca *spiffetest.CA) {
+	versionDir := filepath.Join(dir, version)
+	assert.NoError(t, os.Mkdir(versionDir, 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(versionDir, "svid.pem"), spiffetest.EncodeCertificates(svid.Chain), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(versionDir, "svid_key.pem"), encodeKey(t, svid), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(versionDir, "bundle.pem"), ca.RootPEM(), 0600))
+}
+
+// writeFile replaces path atomically through a temporary file
+func writeFile(t *testing.T, path string, data []byte) {
+	tmp := path + ".tmp"
+	assert.NoError(t, os.WriteFile(tmp, data, 0600))
+	assert.NoError(t, os.Rename(tmp, path))
+}
+
+func encodeKey(t *testing.T, svid *spiffetest.SVID) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func serial(svid *spiffetest.SVID) string {
+	return fmt.Sprintf("%x", svid.Certificate.SerialNumber)
+}
@@ -58,6 +58,102 @@ var (
 		},
 		[]string{"service"},
 	)
+
+	// Revocation metrics
+	TransportRevokedCertificates = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_revoked_certificates_total",
+			Help: "Total number of certificates rejected as revoked",
+		},
+		[]string{"method", "source"},
+	)
+
+	TransportStaleCRLs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_crl_stale_total",
+			Help: "Total number of checks against a CRL past its next update",
+		},
+		[]string{"source"},
+	)
+
+	TransportRevocationCheckErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_revocation_check_errors_total",
+			Help: "Total number of revocation checks that could not be completed",
+		},
+		[]string{"method", "error_type"},
+	)
+
+	// Federation metrics
+	TransportBundleFetches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_federation_bundle_fetches_total",
+			Help: "Total number of federated bundle fetches by result",
+		},
+		[]string{"trust_domain", "result"},
+	)
+
+	TransportBundleSequence = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "transport_federation_bundle_sequence",
+			Help: "Sequence number of the last accepted federated bundle",
+		},
+		[]string{"trust_domain"},
+	)
+
+	// Workload API metrics
+	TransportWorkloadAPIEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_workload_api_events_total",
+			Help: "Total number of Workload API updates and errors",
+		},
+		[]string{"event"},
+	)
+
+	// Certificate store metrics
+	TransportCertificateExpiry = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "transport_certificate_expiry_seconds",
+			Help: "Time until the served certificate expires in seconds",
+		},
+	)
+
+	TransportCertificateRotations = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "transport_certificate_rotations_total",
+			Help: "Total number of certificates stored",
+		},
+	)
+
+	TransportCertificateValidationErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_certificate_validation_errors_total",
+			Help: "Total number of certificates rejected by the certificate store",
+		},
+		[]string{"reason"},
+	)
+
+	TransportCertificateReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "transport_certificate_file_reloads_total",
+			Help: "Total number of certificate file reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	TransportCertificateNextRotation = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "transport_certificate_next_rotation_timestamp_seconds",
+			Help: "Unix time of the next scheduled certificate rotation attempt",
+		},
+	)
+
+	TransportCertificateRotationFailures = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "transport_certificate_rotation_consecutive_failures",
+			Help: "Number of certificate rotation attempts that failed in a row",
+		},
+	)
 )
 
 // MetricsCollector handles transport layer metrics
@@ -101,4 +197,60 @@ func (m *MetricsCollector) RecordConnectionError(service, errorType string) {
 // RecordConnectionLatency records connection establishment latency
 func (m *MetricsCollector) RecordConnectionLatency(service string, duration time.Duration) {
 	TransportConnectionLatency.WithLabelValues(service).Observe(duration.Seconds())
-} 
\ No newline at end of file
+} 
+
+// RecordRevocationHit records a certificate rejected as revoked
+func (m *MetricsCollector) RecordRevocationHit(method, source string) {
+	TransportRevokedCertificates.WithLabelValues(method, source).Inc()
+}
+
+// RecordStaleCRL records a check against a CRL past its next update
+func (m *MetricsCollector) RecordStaleCRL(source string) {
+	TransportStaleCRLs.WithLabelValues(source).Inc()
+}
+
+// RecordRevocationCheckError records a revocation check that could not be completed
+func (m *MetricsCollector) RecordRevocationCheckError(method, errorType string) {
+	TransportRevocationCheckErrors.WithLabelValues(method, errorType).Inc()
+}
+
+// RecordBundleFetch records a federated bundle fetch
+func (m *MetricsCollector) RecordBundleFetch(trustDomain, result string) {
+	TransportBundleFetches.WithLabelValues(trustDomain, result).Inc()
+}
+
+// RecordBundleSequence records the sequence number of an accepted federated bundle
+func (m *MetricsCollector) RecordBundleSequence(trustDomain string, sequence uint64) {
+	TransportBundleSequence.WithLabelValues(trustDomain).Set(float64(sequence))
+}
+
+// RecordWorkloadAPIEvent records a Workload API update or error
+func (m *MetricsCollector) RecordWorkloadAPIEvent(event string) {
+	TransportWorkloadAPIEvents.WithLabelValues(event).Inc()
+}
+
+// RecordCertificateRotation records a newly stored certificate
+func (m *MetricsCollector) RecordCertificateRotation(notAfter time.Time) {
+	TransportCertificateRotations.Inc()
+	TransportCertificateExpiry.Set(time.Until(notAfter).Seconds())
+}
+
+// RecordCertificateValidationError records a certificate rejected by the store
+func (m *MetricsCollector) RecordCertificateValidationError(reason string) {
+	TransportCertificateValidationErrors.WithLabelValues(reason).Inc()
+}
+
+// RecordCertificateReload records the result of reloading certificate files
+func (m *MetricsCollector) RecordCertificateReload(result string) {
+	TransportCertificateReloads.WithLabelValues(result).Inc()
+}
+
+// RecordNextRotation records when the next certificate rotation is attempted
+func (m *MetricsCollector) RecordNextRotation(at time.Time) {
+	TransportCertificateNextRotation.Set(float64(at.Unix()))
+}
+
+// RecordRotationFailures records the number of consecutive failed rotations
+func (m *MetricsCollector) RecordRotationFailures(count int) {
+	TransportCertificateRotationFailures.Set(float64(count))
+}
@@ -0,0 +1,450 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	minRefreshInterval     = 10 * time.Second
+	defaultFetchTimeout    = 10 * time.Second
+	retryInterval          = 30 * time.Second
+	maxBundleSize          = 1 << 20
+)
+
+// ErrSequenceRollback is returned when an endpoint serves a bundle older
+// than the last accepted one, or a different bundle under the same sequence
+// number
+var ErrSequenceRollback = errors.New("bundle sequence number rollback")
+
+// EndpointConfig configures the bundle endpoint of a federated trust domain
+type EndpointConfig struct {
+	// TrustDomain is the federated trust domain
+	TrustDomain string
+	// URL is the https URL of the bundle endpoint
+	URL string
+	// Profile selects how the endpoint is authenticated
+	Profile Profile
+	// RootCAs verifies an https_web endpoint. Defaults to the system roots.
+	RootCAs *x509.CertPool
+	// EndpointSPIFFEID is the SPIFFE ID of an https_spiffe endpoint
+	EndpointSPIFFEID string
+	// BootstrapRoots verify an https_spiffe endpoint until a bundle for the
+	// endpoint's trust domain is held in the bundle set
+	BootstrapRoots []*x509.Certificate
+	// StatePath persists the last accepted bundle so it survives restarts
+	// and endpoint outages
+	StatePath string
+}
+
+// ClientConfig configures a federation Client
+type ClientConfig struct {
+	Endpoints []EndpointConfig
+	// RefreshInterval is used when a bundle has no refresh hint. Defaults
+	// to five minutes.
+	RefreshInterval time.Duration
+	// FetchTimeout bounds a single fetch. Defaults to ten seconds.
+	FetchTimeout time.Duration
+}
+
+// Client polls the bundle endpoints of federated trust domains and keeps
+// their bundles in a bundle set, so that peers of those domains can be
+// verified by auth/mtls
+type Client struct {
+	set       *spiffe.BundleSet
+	endpoints []*endpoint
+	metrics   *common.MetricsCollector
+}
+
+// endpoint tracks one federated trust domain
+type endpoint struct {
+	config     EndpointConfig
+	td         spiffeid.TrustDomain
+	endpointID spiffeid.ID
+	client     *http.Client
+	set        *spiffe.BundleSet
+	metrics    *common.MetricsCollector
+	interval   time.Duration
+
+	mu     sync.Mutex
+	bundle *spiffebundle.Bundle
+	source *spiffe.MemoryBundleSource
+}
+
+// NewClient creates a client that feeds set. Bundles persisted by a previous
+// run are loaded immediately.
+func NewClient(config *ClientConfig, set *spiffe.BundleSet) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if set == nil {
+		return nil, fmt.Errorf("bundle set cannot be nil")
+	}
+
+	interval := config.RefreshInterval
+	if interval <= 0 {
+		interval = defaultRefreshInterval
+	}
+	timeout := config.FetchTimeout
+	if timeout <= 0 {
+		timeout = defaultFetchTimeout
+	}
+
+	c := &Client{
+		set:     set,
+		metrics: common.NewMetricsCollector(),
+	}
+
+	seen := make(map[spiffeid.TrustDomain]bool)
+	for _, endpointConfig := range config.Endpoints {
+		e, err := newEndpoint(endpointConfig, set, c.metrics, interval, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if seen[e.td] {
+			return nil, fmt.Errorf("duplicate endpoint for trust domain %s", e.td)
+		}
+		seen[e.td] = true
+
+		if err := e.loadState(); err != nil {
+			return nil, err
+		}
+		c.endpoints = append(c.endpoints, e)
+	}
+
+	return c, nil
+}
+
+// newEndpoint validates an endpoint configuration
+func newEndpoint(config EndpointConfig, set *spiffe.BundleSet, metrics *common.MetricsCollector, interval, timeout time.Duration) (*endpoint, error) {
+	td, err := spiffeid.TrustDomainFromString(config.TrustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust domain: %v", err)
+	}
+
+	u, err := url.Parse(config.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("bundle endpoint of %s must be an https URL", td)
+	}
+
+	e := &endpoint{
+		config:   config,
+		td:       td,
+		set:      set,
+		metrics:  metrics,
+		interval: interval,
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch config.Profile {
+	case ProfileHTTPSWeb:
+		tlsConfig.RootCAs = config.RootCAs
+	case ProfileHTTPSSPIFFE:
+		e.endpointID, err = spiffeid.FromString(config.EndpointSPIFFEID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint SPIFFE ID for %s: %v", td, err)
+		}
+		// The endpoint presents an SVID, which has no DNS name to check
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = e.verifyEndpoint
+	default:
+		return nil, fmt.Errorf("unsupported bundle endpoint profile %q", config.Profile)
+	}
+
+	e.client = &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	return e, nil
+}
+
+// Refresh fetches the bundle of every endpoint once
+func (c *Client) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, e := range c.endpoints {
+		if _, err := e.fetch(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Run polls every endpoint until ctx is cancelled. Each endpoint is polled
+// at its bundle's refresh hint; failed fetches are retried sooner and keep
+// the last accepted bundle in place.
+func (c *Client) Run(ctx context.Context, onError func(error)) {
+	var wg sync.WaitGroup
+	for _, e := range c.endpoints {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			e.run(ctx, onError)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// JWTAuthorities returns the JWT-SVID signing keys last published by a
+// federated trust domain
+func (c *Client) JWTAuthorities(td spiffeid.TrustDomain) (map[string]crypto.PublicKey, bool) {
+	for _, e := range c.endpoints {
+		if e.td != td {
+			continue
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.bundle == nil {
+			return nil, false
+		}
+		return e.bundle.JWTAuthorities(), true
+	}
+	return nil, false
+}
+
+// run polls the endpoint until ctx is cancelled
+func (e *endpoint) run(ctx context.Context, onError func(error)) {
+	for {
+		wait, err := e.fetch(ctx)
+		if err != nil && onError != nil {
+			onError(err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// fetch downloads, validates and applies the bundle. It returns the delay
+// before the next fetch.
+func (e *endpoint) fetch(ctx context.Context) (time.Duration, error) {
+	bundle, err := e.download(ctx)
+	if err != nil {
+		e.metrics.RecordBundleFetch(e.td.Name(), "fetch_failed")
+		return retryInterval, fmt.Errorf("failed to fetch bundle of %s: %v", e.td, err)
+	}
+
+	if err := e.apply(bundle, true); err != nil {
+		if errors.Is(err, ErrSequenceRollback) {
+			e.metrics.RecordBundleFetch(e.td.Name(), "rollback")
+		} else {
+			e.metrics.RecordBundleFetch(e.td.Name(), "invalid")
+		}
+		return retryInterval, err
+	}
+
+	e.metrics.RecordBundleFetch(e.td.Name(), "success")
+	return e.refreshInterval(bundle), nil
+}
+
+// download fetches and parses the bundle document
+func (e *endpoint) download(ctx context.Context) (*spiffebundle.Bundle, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBundleSize {
+		return nil, fmt.Errorf("bundle exceeds %d bytes", maxBundleSize)
+	}
+
+	bundle, err := spiffebundle.Parse(e.td, body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle: %v", err)
+	}
+	return bundle, nil
+}
+
+// apply validates bundle against the last accepted one and publishes it to
+// the bundle set. persist writes it to the state file.
+func (e *endpoint) apply(bundle *spiffebundle.Bundle, persist bool) error {
+	roots := bundle.X509Authorities()
+	if len(roots) == 0 {
+		return fmt.Errorf("bundle of %s has no X.509 authorities", e.td)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	changed := e.bundle == nil || !e.bundle.Equal(bundle)
+	sequence, hasSequence := bundle.SequenceNumber()
+	if e.bundle != nil {
+		previous, hadSequence := e.bundle.SequenceNumber()
+		if hadSequence && (!hasSequence || sequence < previous) {
+			return fmt.Errorf("%w: %s served sequence %d after %d", ErrSequenceRollback, e.td, sequence, previous)
+		}
+		// Content only changes together with the sequence number
+		if hadSequence && sequence == previous && changed {
+			return fmt.Errorf("%w: %s changed its bundle without increasing sequence %d", ErrSequenceRollback, e.td, sequence)
+		}
+	}
+
+	if persist && changed && e.config.StatePath != "" {
+		if err := writeState(e.config.StatePath, bundle); err != nil {
+			return err
+		}
+	}
+
+	e.bundle = bundle
+	if e.source == nil {
+		e.source = spiffe.NewMemoryBundleSource(roots)
+		e.set.Set(e.td, e.source)
+	} else {
+		e.source.SetRoots(roots)
+	}
+	if hasSequence {
+		e.metrics.RecordBundleSequence(e.td.Name(), sequence)
+	}
+
+	return nil
+}
+
+// refreshInterval returns the polling interval for bundle
+func (e *endpoint) refreshInterval(bundle *spiffebundle.Bundle) time.Duration {
+	interval, ok := bundle.RefreshHint()
+	if !ok || interval <= 0 {
+		interval = e.interval
+	}
+	if interval < minRefreshInterval {
+		interval = minRefreshInterval
+	}
+	return interval
+}
+
+// verifyEndpoint authenticates an https_spiffe endpoint by its SVID
+func (e *endpoint) verifyEndpoint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("bundle endpoint presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse endpoint certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	id, err := spiffe.ValidateX509SVID(certs[0])
+	if err != nil {
+		return err
+	}
+	if id != e.endpointID {
+		return fmt.Errorf("unexpected bundle endpoint ID %s, expected %s", id, e.endpointID)
+	}
+
+	roots := e.config.BootstrapRoots
+	if bundle, err := e.set.Bundle(id.TrustDomain()); err == nil {
+		roots = bundle.Roots
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("no bundle to verify endpoint of trust domain %s", id.TrustDomain())
+	}
+
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to verify bundle endpoint: %v", err)
+	}
+
+	return nil
+}
+
+// loadState seeds the endpoint with the bundle persisted by a previous run
+func (e *endpoint) loadState() error {
+	if e.config.StatePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.config.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read persisted bundle of %s: %v", e.td, err)
+	}
+
+	bundle, err := spiffebundle.Parse(e.td, data)
+	if err != nil {
+		return fmt.Errorf("invalid persisted bundle of %s: %v", e.td, err)
+	}
+
+	return e.apply(bundle, false)
+}
+
+// writeState atomically replaces the state file with bundle
+func writeState(path string, bundle *spiffebundle.Bundle) error {
+	data, err := bundle.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to persist bundle: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to persist bundle: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to persist bundle: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to persist bundle: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+var otherTD = spiffeid.RequireTrustDomainFromString("other.org")
+
+func TestHandler_Document(t *testing.T) {
+	caA := spiffetest.NewCA(t, "other.org")
+	caB := spiffetest.NewCA(t, "other.org")
+	source := spiffe.NewMemoryBundleSource(caA.Roots())
+
+	handler, err := NewHandler(&HandlerConfig{
+		TrustDomain:  "other.org",
+		BundleSource: source,
+		JWTAuthorities: func() map[string]crypto.PublicKey {
+			return map[string]crypto.PublicKey{"key-1": caA.PrivateKey.Public()}
+		},
+		RefreshHint: time.Minute,
+	})
+	assert.NoError(t, err)
+
+	// Create test request
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), `"use":"x509-svid"`)
+	assert.Contains(t, rec.Body.String(), `"use":"jwt-svid"`)
+
+	bundle, err := spiffebundle.Parse(otherTD, rec.Body.Bytes())
+	assert.NoError(t, err)
+	assert.True(t, bundle.HasX509Authority(caA.Certificate))
+	assert.True(t, bundle.HasJWTAuthority("key-1"))
+	hint, ok := bundle.RefreshHint()
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, hint)
+	first, ok := bundle.SequenceNumber()
+	assert.True(t, ok)
+
+	// The sequence number is stable while the authorities are unchanged
+	document, err := handler.Document()
+	assert.NoError(t, err)
+	bundle, err = spiffebundle.Parse(otherTD, document)
+	assert.NoError(t, err)
+	sequence, _ := bundle.SequenceNumber()
+	assert.Equal(t, first, sequence)
+
+	// and increases when they change
+	source.SetRoots(caB.Roots())
+	document, err = handler.Document()
+	assert.NoError(t, err)
+	bundle, err = spiffebundle.Parse(otherTD, document)
+	assert.NoError(t, err)
+	sequence, _ = bundle.SequenceNumber()
+	assert.Greater(t, sequence, first)
+	assert.False(t, bundle.HasX509Authority(caA.Certificate))
+
+	// Only GET is served
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestClient_HTTPSWeb(t *testing.T) {
+	peerCA := spiffetest.NewCA(t, "other.org")
+	handler, err := NewHandler(&HandlerConfig{
+		TrustDomain:  "other.org",
+		BundleSource: spiffe.NewMemoryBundleSource(peerCA.Roots()),
+	})
+	assert.NoError(t, err)
+
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+
+	set := spiffe.NewBundleSet()
+	client, err := NewClient(&ClientConfig{Endpoints: []EndpointConfig{{
+		TrustDomain: "other.org",
+		URL:         server.URL,
+		Profile:     ProfileHTTPSWeb,
+		RootCAs:     webRoots(server),
+	}}}, set)
+	assert.NoError(t, err)
+
+	// Nothing is trusted before the first fetch
+	_, err = set.Bundle(otherTD)
+	assert.ErrorIs(t, err, spiffe.ErrUnknownTrustDomain)
+
+	assert.NoError(t, client.Refresh(context.Background()))
+	bundle, err := set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(peerCA.Certificate))
+
+	// A peer of the federated domain now verifies against the fetched bundle
+	peer := peerCA.IssueSVID(t, "spiffe://other.org/service")
+	_, err = peer.Certificate.Verify(x509.VerifyOptions{
+		Roots:     bundle.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	assert.NoError(t, err)
+
+	// An endpoint with an untrusted web certificate is rejected
+	untrusted, err := NewClient(&ClientConfig{Endpoints: []EndpointConfig{{
+		TrustDomain: "other.org",
+		URL:         server.URL,
+		Profile:     ProfileHTTPSWeb,
+		RootCAs:     x509.NewCertPool(),
+	}}}, spiffe.NewBundleSet())
+	assert.NoError(t, err)
+	assert.Error(t, untrusted.Refresh(context.Background()))
+}
+
+func TestClient_HTTPSSPIFFE(t *testing.T) {
+	peerCA := spiffetest.NewCA(t, "other.org")
+	rotatedCA := spiffetest.NewCA(t, "other.org")
+	source := spiffe.NewMemoryBundleSource(append(peerCA.Roots(), rotatedCA.Roots()...))
+	handler, err := NewHandler(&HandlerConfig{TrustDomain: "other.org", BundleSource: source})
+	assert.NoError(t, err)
+
+	svid := peerCA.IssueSVID(t, "spiffe://other.org/bundle-endpoint")
+	url := serveSVID(t, handler, svid)
+
+	tests := []struct {
+		name           string
+		endpointID     string
+		bootstrapRoots []*x509.Certificate
+		wantErr        bool
+	}{
+		{name: "Valid endpoint", endpointID: svid.ID, bootstrapRoots: peerCA.Roots()},
+		{name: "Unexpected endpoint ID", endpointID: "spiffe://other.org/other", bootstrapRoots: peerCA.Roots(), wantErr: true},
+		{name: "Untrusted endpoint", endpointID: svid.ID, bootstrapRoots: spiffetest.NewCA(t, "other.org").Roots(), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := spiffe.NewBundleSet()
+			client, err := NewClient(&ClientConfig{Endpoints: []EndpointConfig{{
+				TrustDomain:      "other.org",
+				URL:              url,
+				Profile:          ProfileHTTPSSPIFFE,
+				EndpointSPIFFEID: tt.endpointID,
+				BootstrapRoots:   tt.bootstrapRoots,
+			}}}, set)
+			assert.NoError(t, err)
+
+			err = client.Refresh(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			bundle, err := set.Bundle(otherTD)
+			assert.NoError(t, err)
+			assert.True(t, bundle.Contains(rotatedCA.Certificate))
+		})
+	}
+}
+
+func TestClient_SequenceRollback(t *testing.T) {
+	caA := spiffetest.NewCA(t, "other.org")
+	caB := spiffetest.NewCA(t, "other.org")
+
+	endpoint := newStaticEndpoint()
+	server := httptest.NewTLSServer(endpoint)
+	defer server.Close()
+
+	set := spiffe.NewBundleSet()
+	client, err := NewClient(&ClientConfig{Endpoints: []EndpointConfig{{
+		TrustDomain: "other.org",
+		URL:         server.URL,
+		Profile:     ProfileHTTPSWeb,
+		RootCAs:     webRoots(server),
+	}}}, set)
+	assert.NoError(t, err)
+
+	endpoint.set(t, caA, 10)
+	assert.NoError(t, client.Refresh(context.Background()))
+
+	// An older bundle is rejected and the current one is kept
+	endpoint.set(t, caB, 9)
+	assert.ErrorIs(t, client.Refresh(context.Background()), ErrSequenceRollback)
+	bundle, err := set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caA.Certificate))
+
+	// A different bundle under the same sequence number is rejected
+	endpoint.set(t, caB, 10)
+	assert.ErrorIs(t, client.Refresh(context.Background()), ErrSequenceRollback)
+	bundle, err = set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caA.Certificate))
+	assert.False(t, bundle.Contains(caB.Certificate))
+
+	// The same bundle is served again
+	endpoint.set(t, caA, 10)
+	assert.NoError(t, client.Refresh(context.Background()))
+
+	// A newer bundle is accepted
+	endpoint.set(t, caB, 11)
+	assert.NoError(t, client.Refresh(context.Background()))
+	bundle, err = set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caB.Certificate))
+}
+
+func TestClient_Persistence(t *testing.T) {
+	caA := spiffetest.NewCA(t, "other.org")
+	caB := spiffetest.NewCA(t, "other.org")
+	statePath := filepath.Join(t.TempDir(), "other.org.json")
+
+	endpoint := newStaticEndpoint()
+	server := httptest.NewTLSServer(endpoint)
+	defer server.Close()
+
+	config := &ClientConfig{Endpoints: []EndpointConfig{{
+		TrustDomain: "other.org",
+		URL:         server.URL,
+		Profile:     ProfileHTTPSWeb,
+		RootCAs:     webRoots(server),
+		StatePath:   statePath,
+	}}}
+
+	client, err := NewClient(config, spiffe.NewBundleSet())
+	assert.NoError(t, err)
+	endpoint.set(t, caA, 5)
+	assert.NoError(t, client.Refresh(context.Background()))
+
+	// A restarted client trusts the persisted bundle before any fetch
+	set := spiffe.NewBundleSet()
+	client, err = NewClient(config, set)
+	assert.NoError(t, err)
+	bundle, err := set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caA.Certificate))
+
+	// and still refuses to roll back
+	endpoint.set(t, caB, 4)
+	assert.ErrorIs(t, client.Refresh(context.Background()), ErrSequenceRollback)
+
+	// An unreachable endpoint keeps the persisted bundle
+	server.Close()
+	assert.Error(t, client.Refresh(context.Background()))
+	bundle, err = set.Bundle(otherTD)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caA.Certificate))
+}
+
+func TestNewClient_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint EndpointConfig
+	}{
+		{name: "Invalid trust domain", endpoint: EndpointConfig{TrustDomain: "Not Valid", URL: "https://example.org", Profile: ProfileHTTPSWeb}},
+		{name: "Plain HTTP", endpoint: EndpointConfig{TrustDomain: "other.org", URL: "http://example.org", Profile: ProfileHTTPSWeb}},
+		{name: "Unknown profile", endpoint: EndpointConfig{TrustDomain: "other.org", URL: "https://example.org", Profile: "ftp"}},
+		{name: "Missing endpoint ID", endpoint: EndpointConfig{TrustDomain: "other.org", URL: "https://example.org", Profile: ProfileHTTPSSPIFFE}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewClient(&ClientConfig{Endpoints: []EndpointConfig{tt.endpoint}}, spiffe.NewBundleSet())
+			assert.Error(t, err)
+		})
+	}
+}
+
+// webRoots returns a pool trusting the certificate of an httptest TLS server
+func webRoots(server *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	return pool
+}
+
+// serveSVID serves handler over TLS with svid and returns its URL
+func serveSVID(t *testing.T, handler http.Handler, svid *spiffetest.SVID) string {
+	cert := svid.TLSCertificate()
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = tls.NewListener(server.Listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+	server.Start()
+	t.Cleanup(server.Close)
+	return "https://" + server.Listener.Addr().String()
+}
+
+// staticEndpoint serves a bundle document chosen by the test
+type staticEndpoint struct {
+	mu       sync.Mutex
+	document []byte
+}
+
+func newStaticEndpoint() *staticEndpoint {
+	return &staticEndpoint{}
+}
+
+// set serves the roots of ca with the given sequence number
+func (e *staticEndpoint) set(t *testing.T, ca *spiffetest.CA, sequence uint64) {
+	bundle := spiffebundle.FromX509Authorities(otherTD, ca.Roots())
+	bundle.SetSequenceNumber(sequence)
+	document, err := bundle.Marshal()
+	assert.NoError(t, err)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.document = document
+}
+
+func (e *staticEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(e.document)
+}
@@ -0,0 +1,185 @@
+package federation
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/spiffebundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// Profile is a SPIFFE bundle endpoint profile. It only changes how a client
+// authenticates the endpoint; the served document is the same.
+type Profile string
+
+const (
+	// ProfileHTTPSWeb authenticates the endpoint with a web PKI certificate
+	ProfileHTTPSWeb Profile = "https_web"
+	// ProfileHTTPSSPIFFE authenticates the endpoint with an X509-SVID
+	ProfileHTTPSSPIFFE Profile = "https_spiffe"
+)
+
+const defaultRefreshHint = 5 * time.Minute
+
+// HandlerConfig configures a bundle endpoint Handler
+type HandlerConfig struct {
+	// TrustDomain is the trust domain whose bundle is published
+	TrustDomain string
+	// BundleSource provides the X.509 authorities of the trust domain
+	BundleSource spiffe.BundleSource
+	// JWTAuthorities optionally returns the JWT-SVID signing keys by key ID
+	JWTAuthorities func() map[string]crypto.PublicKey
+	// RefreshHint tells clients how often to poll. Defaults to five minutes.
+	RefreshHint time.Duration
+}
+
+// Handler serves the bundle of a trust domain as a SPIFFE bundle document.
+// For the https_web profile serve it with a web PKI certificate; for
+// https_spiffe serve it with the endpoint's X509-SVID.
+type Handler struct {
+	td     spiffeid.TrustDomain
+	config HandlerConfig
+
+	mu       sync.Mutex
+	digest   [sha256.Size]byte
+	sequence uint64
+	document []byte
+	now      func() time.Time
+}
+
+// NewHandler creates a bundle endpoint handler
+func NewHandler(config *HandlerConfig) (*Handler, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.BundleSource == nil {
+		return nil, fmt.Errorf("bundle source cannot be nil")
+	}
+
+	td, err := spiffeid.TrustDomainFromString(config.TrustDomain)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trust domain: %v", err)
+	}
+
+	h := &Handler{
+		td:     td,
+		config: *config,
+		now:    time.Now,
+	}
+	if h.config.RefreshHint <= 0 {
+		h.config.RefreshHint = defaultRefreshHint
+	}
+
+	return h, nil
+}
+
+// ServeHTTP implements http.Handler
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	document, err := h.Document()
+	if err != nil {
+		http.Error(w, "bundle unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(document)
+}
+
+// Document returns the current bundle document. The sequence number only
+// increases when the published authorities change. It starts from the
+// current Unix time so that it keeps increasing across restarts.
+func (h *Handler) Document() ([]byte, error) {
+	bundle, err := h.config.BundleSource.Bundle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bundle: %v", err)
+	}
+	if len(bundle.Roots) == 0 {
+		return nil, fmt.Errorf("bundle has no X.509 authorities")
+	}
+
+	var jwtAuthorities map[string]crypto.PublicKey
+	if h.config.JWTAuthorities != nil {
+		jwtAuthorities = h.config.JWTAuthorities()
+	}
+
+	digest, err := authoritiesDigest(bundle.Roots, jwtAuthorities)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.document != nil && digest == h.digest {
+		return h.document, nil
+	}
+
+	doc := spiffebundle.FromX509Authorities(h.td, bundle.Roots)
+	for keyID, key := range jwtAuthorities {
+		if err := doc.AddJWTAuthority(keyID, key); err != nil {
+			return nil, fmt.Errorf("invalid JWT authority %q: %v", keyID, err)
+		}
+	}
+	doc.SetRefreshHint(h.config.RefreshHint)
+
+	sequence := uint64(h.now().Unix())
+	if sequence <= h.sequence {
+		sequence = h.sequence + 1
+	}
+	doc.SetSequenceNumber(sequence)
+
+	document, err := doc.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal bundle: %v", err)
+	}
+
+	h.digest = digest
+	h.sequence = sequence
+	h.document = document
+
+	return document, nil
+}
+
+// authoritiesDigest hashes the authorities independently of their order
+func authoritiesDigest(roots []*x509.Certificate, jwtAuthorities map[string]crypto.PublicKey) ([sha256.Size]byte, error) {
+	var entries [][]byte
+	for _, root := range roots {
+		entries = append(entries, append([]byte("x509:"), root.Raw...))
+	}
+	for keyID, key := range jwtAuthorities {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return [sha256.Size]byte{}, fmt.Errorf("invalid JWT authority %q: %v", keyID, err)
+		}
+		entries = append(entries, append([]byte("jwt:"+keyID+":"), der...))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i], entries[j]) < 0
+	})
+
+	h := sha256.New()
+	for _, entry := range entries {
+		fmt.Fprintf(h, "%d:", len(entry))
+		h.Write(entry)
+	}
+
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
@@ -0,0 +1,49 @@
+package mtls
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ErrUnexpectedPeer is returned when a verified peer does not have the
+// SPIFFE ID the caller expects to reach
+var ErrUnexpectedPeer = errors.New("unexpected peer SPIFFE ID")
+
+// Authorizer checks the SPIFFE ID of a peer whose X509-SVID has been
+// verified. Errors wrap ErrUnexpectedPeer and name the expected and actual
+// IDs.
+type Authorizer func(id spiffeid.ID) error
+
+// AuthorizeID authorizes exactly the SPIFFE ID expected
+func AuthorizeID(expected spiffeid.ID) Authorizer {
+	return func(id spiffeid.ID) error {
+		if id != expected {
+			return fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedPeer, expected, id)
+		}
+		return nil
+	}
+}
+
+// AuthorizeMemberOf authorizes any SPIFFE ID in the trust domain td
+func AuthorizeMemberOf(td spiffeid.TrustDomain) Authorizer {
+	return func(id spiffeid.ID) error {
+		if !id.MemberOf(td) {
+			return fmt.Errorf("%w: expected a member of %s, got %s", ErrUnexpectedPeer, td, id)
+		}
+		return nil
+	}
+}
+
+// AuthorizeIf authorizes the SPIFFE IDs for which match returns true.
+// expected describes the accepted IDs in errors, for example
+// "a backend in any namespace".
+func AuthorizeIf(expected string, match func(spiffeid.ID) bool) Authorizer {
+	return func(id spiffeid.ID) error {
+		if !match(id) {
+			return fmt.Errorf("%w: expected %s, got %s", ErrUnexpectedPeer, expected, id)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,332 @@
+package mtls
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe"
+)
+
+const (
+	defaultRotationFraction = 0.8
+	defaultRotationJitter   = 0.05
+	defaultInitialBackoff   = time.Second
+	defaultMaxBackoff       = 5 * time.Minute
+)
+
+// RenewFunc fetches a replacement certificate chain, leaf first, and its
+// private key. The key is wiped once the store has taken its own copy.
+type RenewFunc func(ctx context.Context) ([]*x509.Certificate, crypto.Signer, error)
+
+// RotationConfig configures a RotationScheduler
+type RotationConfig struct {
+	// Fraction of the certificate lifetime after which rotation is
+	// attempted. It defaults to 0.8.
+	Fraction float64
+	// Jitter is the largest fraction of the lifetime added at random to the
+	// rotation point, so replicas do not all renew at once. It defaults to
+	// 0.05; Fraction plus Jitter must be below 1.
+	Jitter float64
+	// Renew fetches the replacement certificate. It defaults to reading the
+	// store's certificate and key files.
+	Renew RenewFunc
+	// InitialBackoff is the delay before the first retry. It doubles after
+	// every failure up to MaxBackoff. They default to 1s and 5m.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// RotationEventType is the kind of a RotationEvent
+type RotationEventType string
+
+const (
+	// RotationScheduled is published whenever the next attempt is planned
+	RotationScheduled RotationEventType = "scheduled"
+	// RotationSucceeded is published when a replacement has been stored
+	RotationSucceeded RotationEventType = "rotated"
+	// RotationFailed is published when an attempt failed and the current
+	// certificate keeps being served
+	RotationFailed RotationEventType = "failed"
+)
+
+// RotationEvent describes a step of a RotationScheduler
+type RotationEvent struct {
+	Type RotationEventType
+	// Serial is the hex serial of the certificate being served
+	Serial string
+	// OldSerial is the hex serial of the replaced certificate, set for
+	// RotationSucceeded
+	OldSerial string
+	// NotAfter is the expiry of the certificate being served
+	NotAfter time.Time
+	// NextRotation is when the next attempt is planned
+	NextRotation time.Time
+	// ConsecutiveFailures counts the attempts that failed in a row
+	ConsecutiveFailures int
+	// Err is the cause of a RotationFailed event
+	Err error
+}
+
+// RotationScheduler rotates the certificate of a SecureCertificateStore in
+// the background. Rotation is attempted once a configurable fraction of the
+// certificate lifetime has passed and retried with exponential backoff on
+// failure. The store keeps serving the current certificate until a valid
+// replacement has been stored.
+type RotationScheduler struct {
+	store   *SecureCertificateStore
+	config  RotationConfig
+	metrics *common.MetricsCollector
+
+	mu           sync.Mutex
+	subscribers  []func(RotationEvent)
+	nextRotation time.Time
+	failures     int
+}
+
+// NewRotationScheduler creates a scheduler for store. Nothing happens until
+// Run is called.
+func NewRotationScheduler(store *SecureCertificateStore, config *RotationConfig) (*RotationScheduler, error) {
+	if store == nil {
+		return nil, fmt.Errorf("certificate store cannot be nil")
+	}
+
+	var c RotationConfig
+	if config != nil {
+		c = *config
+	}
+	if c.Fraction == 0 {
+		c.Fraction = defaultRotationFraction
+	}
+	if c.Jitter == 0 {
+		c.Jitter = defaultRotationJitter
+	}
+	if c.Fraction <= 0 || c.Jitter < 0 || c.Fraction+c.Jitter >= 1 {
+		return nil, fmt.Errorf("rotation fraction %v plus jitter %v must be between 0 and 1", c.Fraction, c.Jitter)
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = defaultInitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	if c.MaxBackoff < c.InitialBackoff {
+		c.MaxBackoff = c.InitialBackoff
+	}
+	if c.Renew == nil {
+		c.Renew = store.renewFromFiles
+	}
+
+	return &RotationScheduler{
+		store:   store,
+		config:  c,
+		metrics: common.NewMetricsCollector(),
+	}, nil
+}
+
+// Subscribe registers fn to be called with every event. fn is called from
+// the scheduler goroutine and must not block.
+func (r *RotationScheduler) Subscribe(fn func(RotationEvent)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribers = append(r.subscribers, fn)
+}
+
+// NextRotation returns when the next rotation attempt is planned
+func (r *RotationScheduler) NextRotation() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nextRotation
+}
+
+// ConsecutiveFailures returns the number of attempts that failed in a row
+func (r *RotationScheduler) ConsecutiveFailures() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures
+}
+
+// Run rotates the certificate until ctx is cancelled. Without a
+// certificate in the store, rotation is attempted straight away.
+func (r *RotationScheduler) Run(ctx context.Context) error {
+	var retryAt time.Time
+	for {
+		cert := r.store.GetCertificate()
+
+		next := retryAt
+		if cert != nil && (retryAt.IsZero() || !rotationDue(cert.Leaf, r.config.Fraction, time.Now())) {
+			// First schedule, or the certificate was replaced by someone
+			// else since the last failure
+			r.setFailures(0)
+			next = r.rotationTime(cert.Leaf)
+		}
+		r.schedule(cert, next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		// Another writer may have rotated the certificate in the meantime
+		current := r.store.GetCertificate()
+		if current != nil && !rotationDue(current.Leaf, r.config.Fraction, time.Now()) {
+			retryAt = time.Time{}
+			continue
+		}
+
+		if err := r.rotate(ctx, current); err != nil {
+			failures := r.setFailures(r.ConsecutiveFailures() + 1)
+			retryAt = time.Now().Add(r.backoff(failures))
+			r.publish(RotationEvent{
+				Type:                RotationFailed,
+				NextRotation:        retryAt,
+				ConsecutiveFailures: failures,
+				Err:                 err,
+			}, current)
+			continue
+		}
+		retryAt = time.Time{}
+	}
+}
+
+// rotate fetches and stores a replacement for current
+func (r *RotationScheduler) rotate(ctx context.Context, current *tls.Certificate) error {
+	chain, key, err := r.config.Renew(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to renew certificate: %v", err)
+	}
+	defer securemem.Zero(key)
+
+	if len(chain) == 0 {
+		return fmt.Errorf("renewed certificate chain is empty")
+	}
+	if current != nil && chain[0].Equal(current.Leaf) {
+		return fmt.Errorf("no new certificate available yet")
+	}
+
+	if err := r.store.StoreX509SVID(chain, key); err != nil {
+		return err
+	}
+
+	r.setFailures(0)
+	event := RotationEvent{Type: RotationSucceeded}
+	if current != nil {
+		event.OldSerial = serialHex(current.Leaf)
+	}
+	r.publish(event, r.store.GetCertificate())
+
+	return nil
+}
+
+// schedule records next as the planned attempt
+func (r *RotationScheduler) schedule(cert *tls.Certificate, next time.Time) {
+	r.mu.Lock()
+	r.nextRotation = next
+	failures := r.failures
+	r.mu.Unlock()
+
+	r.metrics.RecordNextRotation(next)
+	r.publish(RotationEvent{
+		Type:                RotationScheduled,
+		NextRotation:        next,
+		ConsecutiveFailures: failures,
+	}, cert)
+}
+
+// setFailures records the number of consecutive failures and returns it
+func (r *RotationScheduler) setFailures(failures int) int {
+	r.mu.Lock()
+	r.failures = failures
+	r.mu.Unlock()
+
+	r.metrics.RecordRotationFailures(failures)
+	return failures
+}
+
+// publish fills in the served certificate and passes event to subscribers
+func (r *RotationScheduler) publish(event RotationEvent, cert *tls.Certificate) {
+	if cert != nil && cert.Leaf != nil {
+		event.Serial = serialHex(cert.Leaf)
+		event.NotAfter = cert.Leaf.NotAfter
+	}
+
+	r.mu.Lock()
+	subscribers := r.subscribers
+	r.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+// rotationTime picks the rotation point of leaf, with jitter, never later
+// than its expiry
+func (r *RotationScheduler) rotationTime(leaf *x509.Certificate) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	fraction := r.config.Fraction + rand.Float64()*r.config.Jitter
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// backoff returns the delay before the retry following failures failed
+// attempts
+func (r *RotationScheduler) backoff(failures int) time.Duration {
+	delay := r.config.InitialBackoff
+	for i := 1; i < failures && delay < r.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.config.MaxBackoff {
+		delay = r.config.MaxBackoff
+	}
+	return delay
+}
+
+// rotationDue reports whether fraction of the lifetime of leaf has passed
+func rotationDue(leaf *x509.Certificate, fraction float64, now time.Time) bool {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	threshold := leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+	return !now.Before(threshold)
+}
+
+// renewFromFiles reads the certificate and key files of the store
+func (s *SecureCertificateStore) renewFromFiles(ctx context.Context) ([]*x509.Certificate, crypto.Signer, error) {
+	if s.certPath == "" || s.keyPath == "" {
+		return nil, nil, fmt.Errorf("certificate store has no certificate files")
+	}
+
+	certPEM, err := os.ReadFile(s.certPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	keyPEM, err := os.ReadFile(s.keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	defer securemem.Wipe(keyPEM)
+
+	chain, err := spiffe.ParseBundlePEM(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load certificate: %v", err)
+	}
+	key, err := securemem.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load private key: %v", err)
+	}
+
+	return chain, key, nil
+}
+
+// serialHex formats the serial number of cert
+func serialHex(cert *x509.Certificate) string {
+	return fmt.Sprintf("%x", cert.SerialNumber)
+}
@@ -0,0 +1,199 @@
+package mtls
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotationScheduler_Rotate(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(-time.Second), time.Now().Add(time.Second)))
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	store := NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreX509SVID(svidA.Chain, svidA.PrivateKey))
+
+	scheduler, events := setupTestScheduler(t, store, func(ctx context.Context) ([]*x509.Certificate, crypto.Signer, error) {
+		return svidB.Chain, svidB.PrivateKey, nil
+	})
+
+	assert.Eventually(t, func() bool {
+		return store.GetCertificate().Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The first attempt was planned within the jitter of the rotation point
+	first := events.list()[0]
+	assert.Equal(t, RotationScheduled, first.Type)
+	assert.Equal(t, serialHex(svidA.Certificate), first.Serial)
+	lifetime := svidA.Certificate.NotAfter.Sub(svidA.Certificate.NotBefore)
+	assert.WithinRange(t, first.NextRotation,
+		svidA.Certificate.NotBefore.Add(lifetime/2),
+		svidA.Certificate.NotBefore.Add(lifetime*6/10))
+
+	assert.Eventually(t, func() bool {
+		for _, event := range events.list() {
+			if event.Type == RotationSucceeded {
+				return event.OldSerial == serialHex(svidA.Certificate) && event.Serial == serialHex(svidB.Certificate)
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The next attempt is planned for the new certificate
+	assert.Eventually(t, func() bool {
+		return scheduler.NextRotation().After(svidA.Certificate.NotAfter)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, scheduler.ConsecutiveFailures())
+}
+
+func TestRotationScheduler_Retry(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(-time.Hour), time.Now().Add(time.Minute)))
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+	expired := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)))
+
+	store := NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreX509SVID(svidA.Chain, svidA.PrivateKey))
+
+	// The source fails, then returns the current certificate, then an
+	// invalid one, before the replacement is available
+	var mu sync.Mutex
+	attempts := 0
+	scheduler, events := setupTestScheduler(t, store, func(ctx context.Context) ([]*x509.Certificate, crypto.Signer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+
+		// The current certificate keeps being served meanwhile
+		assert.True(t, store.GetCertificate().Leaf.Equal(svidA.Certificate))
+
+		switch attempts {
+		case 1:
+			return nil, nil, fmt.Errorf("agent unavailable")
+		case 2:
+			return svidA.Chain, svidA.PrivateKey, nil
+		case 3:
+			return expired.Chain, expired.PrivateKey, nil
+		}
+		return svidB.Chain, svidB.PrivateKey, nil
+	})
+
+	assert.Eventually(t, func() bool {
+		return store.GetCertificate().Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var failures []int
+	for _, event := range events.list() {
+		if event.Type == RotationFailed {
+			assert.Error(t, event.Err)
+			assert.Equal(t, serialHex(svidA.Certificate), event.Serial)
+			failures = append(failures, event.ConsecutiveFailures)
+		}
+	}
+	assert.Equal(t, []int{1, 2, 3}, failures)
+	assert.Equal(t, 0, scheduler.ConsecutiveFailures())
+}
+
+func TestRotationScheduler_InvalidConfig(t *testing.T) {
+	store := NewSecureCertificateStore("", "", "")
+
+	tests := []struct {
+		name   string
+		store  *SecureCertificateStore
+		config *RotationConfig
+	}{
+		{name: "Nil store", store: nil, config: nil},
+		{name: "Negative fraction", store: store, config: &RotationConfig{Fraction: -0.5}},
+		{name: "Negative jitter", store: store, config: &RotationConfig{Jitter: -0.1}},
+		{name: "Rotation past expiry", store: store, config: &RotationConfig{Fraction: 0.9, Jitter: 0.2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRotationScheduler(tt.store, tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRotationScheduler_Backoff(t *testing.T) {
+	scheduler, err := NewRotationScheduler(NewSecureCertificateStore("", "", ""), &RotationConfig{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: time.Second},
+		{failures: 2, expected: 2 * time.Second},
+		{failures: 4, expected: 8 * time.Second},
+		{failures: 5, expected: 10 * time.Second},
+		{failures: 100, expected: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d failures", tt.failures), func(t *testing.T) {
+			assert.Equal(t, tt.expected, scheduler.backoff(tt.failures))
+		})
+	}
+}
+
+// setupTestScheduler runs a scheduler for store with renew until the test
+// finishes. Rotation starts at half the lifetime and retries quickly.
+func setupTestScheduler(t *testing.T, store *SecureCertificateStore, renew RenewFunc) (*RotationScheduler, *eventRecorder) {
+	scheduler, err := NewRotationScheduler(store, &RotationConfig{
+		Fraction:       0.5,
+		Jitter:         0.1,
+		Renew:          renew,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	events := &eventRecorder{}
+	scheduler.Subscribe(events.add)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, scheduler.Run(ctx))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		store.Close()
+	})
+
+	return scheduler, events
+}
+
+// eventRecorder collects the events of a scheduler
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []RotationEvent
+}
+
+func (r *eventRecorder) add(event RotationEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) list() []RotationEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RotationEvent(nil), r.events...)
+}
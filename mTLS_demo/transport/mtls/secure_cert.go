@@ -1,44 +1,36 @@
 package mtls
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"mTLS_demo/transport/common"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe"
 )
 
-var (
-	// Certificate metrics
-	certExpirationTime = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "mtls_cert_expiration_time",
-		Help: "Time until certificate expiration in seconds",
-	})
-
-	certRotationCount = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mtls_cert_rotations_total",
-		Help: "Total number of certificate rotations",
-	})
-
-	certValidationErrors = promauto.NewCounter(prometheus.CounterOpts{
-		Name: "mtls_cert_validation_errors_total",
-		Help: "Total number of certificate validation errors",
-	})
-)
-
-// SecureCertificateStore manages TLS certificates with secure storage
+// SecureCertificateStore manages TLS certificates with secure storage. The
+// private key may be any crypto.Signer with an RSA, ECDSA or Ed25519 public
+// key, and must match the certificate. Software keys are copied into locked
+// memory that never reaches disk, and wiped on Close or once a grace period
+// has passed after they were rotated out.
 type SecureCertificateStore struct {
 	certPath     string
 	keyPath      string
 	trustPath    string
 	cert         *tls.Certificate
-	trustBundle  *x509.CertPool
+	bundle       *spiffe.MemoryBundleSource
+	retired      *securemem.Retirer
+	metrics      *common.MetricsCollector
 	mutex        sync.RWMutex
 	lastRotation time.Time
 }
@@ -46,63 +38,110 @@ type SecureCertificateStore struct {
 // NewSecureCertificateStore creates a new secure certificate store
 func NewSecureCertificateStore(certPath, keyPath, trustPath string) *SecureCertificateStore {
 	return &SecureCertificateStore{
-		certPath:    certPath,
-		keyPath:     keyPath,
-		trustPath:   trustPath,
-		trustBundle: x509.NewCertPool(),
+		certPath:  certPath,
+		keyPath:   keyPath,
+		trustPath: trustPath,
+		bundle:    spiffe.NewMemoryBundleSource(nil),
+		retired:   securemem.NewRetirer(securemem.DefaultRetireDelay),
+		metrics:   common.NewMetricsCollector(),
 	}
 }
 
-// StoreCertificate stores a new certificate and key
+// StoreCertificate stores a new PEM encoded certificate chain and key. The
+// key is parsed in memory; keyPEM may be wiped by the caller afterwards.
 func (s *SecureCertificateStore) StoreCertificate(certPEM, keyPEM []byte) error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
-	// Create memory-mapped files for sensitive data
-	certFile, err := ioutil.TempFile("", "cert-*")
+	chain, err := spiffe.ParseBundlePEM(certPEM)
 	if err != nil {
-		return fmt.Errorf("failed to create temp cert file: %v", err)
+		s.metrics.RecordCertificateValidationError("invalid_cert")
+		return fmt.Errorf("failed to load certificate: %v", err)
 	}
-	defer os.Remove(certFile.Name())
 
-	keyFile, err := ioutil.TempFile("", "key-*")
+	key, err := securemem.ParsePrivateKeyPEM(keyPEM)
 	if err != nil {
-		return fmt.Errorf("failed to create temp key file: %v", err)
+		s.metrics.RecordCertificateValidationError("invalid_key")
+		return fmt.Errorf("failed to load private key: %v", err)
 	}
-	defer os.Remove(keyFile.Name())
+	// The decoded key is only needed until it is copied into locked memory
+	defer securemem.Zero(key)
+
+	return s.StoreX509SVID(chain, key)
+}
 
-	// Write certificate and key to temp files
-	if err := ioutil.WriteFile(certFile.Name(), certPEM, 0600); err != nil {
-		return fmt.Errorf("failed to write cert: %v", err)
+// StoreX509SVID stores a certificate chain, leaf first, and its private key
+// received in memory, for example from the Workload API. The store keeps its
+// own copy of the key, so the caller's key is left untouched.
+func (s *SecureCertificateStore) StoreX509SVID(chain []*x509.Certificate, key crypto.Signer) error {
+	if len(chain) == 0 {
+		return fmt.Errorf("certificate chain is empty")
 	}
-	if err := ioutil.WriteFile(keyFile.Name(), keyPEM, 0600); err != nil {
-		return fmt.Errorf("failed to write key: %v", err)
+
+	cert := &tls.Certificate{
+		PrivateKey: key,
+		Leaf:       chain[0],
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
 	}
 
-	// Load the certificate
-	cert, err := tls.LoadX509KeyPair(certFile.Name(), keyFile.Name())
-	if err != nil {
-		return fmt.Errorf("failed to load certificate: %v", err)
+	return s.store(cert, key)
+}
+
+// store validates cert and its key and makes it the current certificate
+func (s *SecureCertificateStore) store(cert *tls.Certificate, key crypto.Signer) error {
+	if reason, err := validateKey(cert.Leaf, key); err != nil {
+		s.metrics.RecordCertificateValidationError(reason)
+		return fmt.Errorf("certificate validation failed: %v", err)
 	}
 
-	// Validate the certificate
-	if err := s.validateCertificate(&cert); err != nil {
-		certValidationErrors.Inc()
+	if reason, err := validateCertificate(cert.Leaf); err != nil {
+		s.metrics.RecordCertificateValidationError(reason)
 		return fmt.Errorf("certificate validation failed: %v", err)
 	}
 
-	s.cert = &cert
+	// Hardware-backed signers have no key material to copy and are used as is
+	locked, err := securemem.NewSigner(key)
+	if err == nil {
+		cert.PrivateKey = locked
+	} else if !errors.Is(err, securemem.ErrNotExportable) {
+		return fmt.Errorf("failed to protect private key: %v", err)
+	}
+
+	s.mutex.Lock()
+	previous := s.cert
+	s.cert = cert
 	s.lastRotation = time.Now()
-	certRotationCount.Inc()
+	s.mutex.Unlock()
 
-	// Update metrics
-	if cert.Leaf != nil {
-		certExpirationTime.Set(time.Until(cert.Leaf.NotAfter).Seconds())
+	s.metrics.RecordCertificateRotation(cert.Leaf.NotAfter)
+
+	// Handshakes that already fetched the previous certificate may still
+	// sign with its key
+	if previous != nil {
+		if signer, ok := previous.PrivateKey.(*securemem.Signer); ok {
+			s.retired.Retire(signer)
+		}
 	}
 
 	return nil
 }
 
+// Close wipes the stored private key and the keys rotated out before it.
+// The store holds no certificate afterwards.
+func (s *SecureCertificateStore) Close() error {
+	s.mutex.Lock()
+	cert := s.cert
+	s.cert = nil
+	s.mutex.Unlock()
+
+	if cert != nil {
+		if signer, ok := cert.PrivateKey.(*securemem.Signer); ok {
+			signer.Destroy()
+		}
+	}
+	s.retired.Flush()
+	return nil
+}
+
 // GetCertificate returns the current certificate
 func (s *SecureCertificateStore) GetCertificate() *tls.Certificate {
 	s.mutex.RLock()
@@ -110,52 +149,110 @@ func (s *SecureCertificateStore) GetCertificate() *tls.Certificate {
 	return s.cert
 }
 
+// Certificate returns the current certificate, so the store can be used as
+// a CertificateSource
+func (s *SecureCertificateStore) Certificate() (*tls.Certificate, error) {
+	cert := s.GetCertificate()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate stored")
+	}
+	return cert, nil
+}
+
 // GetTrustBundle returns the current trust bundle
 func (s *SecureCertificateStore) GetTrustBundle() *x509.CertPool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	return s.trustBundle
+	bundle, _ := s.bundle.Bundle()
+	return bundle.Pool()
 }
 
-// validateCertificate performs security checks on the certificate
-func (s *SecureCertificateStore) validateCertificate(cert *tls.Certificate) error {
-	if cert == nil || cert.Leaf == nil {
-		return fmt.Errorf("invalid certificate")
+// Bundle returns the current trust bundle, so the store can be used as a
+// spiffe.BundleSource
+func (s *SecureCertificateStore) Bundle() (*spiffe.Bundle, error) {
+	return s.bundle.Bundle()
+}
+
+// validateKey checks that key is of a supported type and belongs to leaf.
+// It returns the metrics reason on failure.
+func validateKey(leaf *x509.Certificate, key crypto.Signer) (string, error) {
+	if leaf == nil {
+		return "invalid_cert", fmt.Errorf("invalid certificate")
+	}
+	if key == nil {
+		return "unsupported_key", fmt.Errorf("private key is missing")
 	}
 
-	// Check expiration
-	if time.Now().After(cert.Leaf.NotAfter) {
-		return fmt.Errorf("certificate has expired")
+	// Compare by public key so hardware-backed signers are accepted too
+	var matches bool
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		matches = pub.Equal(leaf.PublicKey)
+	case *ecdsa.PublicKey:
+		matches = pub.Equal(leaf.PublicKey)
+	case ed25519.PublicKey:
+		matches = pub.Equal(leaf.PublicKey)
+	default:
+		return "unsupported_key", fmt.Errorf("unsupported private key type %T", pub)
 	}
 
-	// Check if certificate is about to expire (80% of lifetime)
-	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
-	threshold := cert.Leaf.NotAfter.Add(-lifetime * 20 / 100)
-	if time.Now().After(threshold) {
-		return fmt.Errorf("certificate is approaching expiration")
+	if !matches {
+		return "key_mismatch", fmt.Errorf("private key does not match certificate public key")
 	}
 
+	return "", nil
+}
+
+// validateCertificate performs security checks on the leaf certificate. It
+// returns the metrics reason on failure.
+func validateCertificate(leaf *x509.Certificate) (string, error) {
+	now := time.Now()
+
+	// Check validity period
+	if now.After(leaf.NotAfter) {
+		return "expired", fmt.Errorf("certificate has expired")
+	}
+	if now.Before(leaf.NotBefore) {
+		return "not_yet_valid", fmt.Errorf("certificate is not yet valid")
+	}
+
+	// A certificate close to expiry is still accepted: it is the one served
+	// while a replacement is being fetched
+
 	// Verify key usage
-	if cert.Leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
-		return fmt.Errorf("certificate missing digital signature key usage")
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return "invalid_key_usage", fmt.Errorf("certificate missing digital signature key usage")
 	}
 
-	return nil
+	// The certificate is served to clients and presented to servers
+	hasClientAuth := false
+	hasServerAuth := false
+	for _, eku := range leaf.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth {
+			hasClientAuth = true
+		}
+		if eku == x509.ExtKeyUsageServerAuth {
+			hasServerAuth = true
+		}
+	}
+	if !hasClientAuth || !hasServerAuth {
+		return "invalid_extended_key_usage", fmt.Errorf("certificate does not have required extended key usage")
+	}
+
+	return "", nil
 }
 
-// RotateCertificate rotates the certificate if needed
+// RotateCertificate reloads the certificate files once the current
+// certificate is past the default rotation point. RotationScheduler does
+// this in the background with retries.
 func (s *SecureCertificateStore) RotateCertificate() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
+	s.mutex.RLock()
+	cert := s.cert
+	s.mutex.RUnlock()
 
-	if s.cert == nil || s.cert.Leaf == nil {
+	if cert == nil || cert.Leaf == nil {
 		return fmt.Errorf("no certificate to rotate")
 	}
 
-	// Check if rotation is needed (80% of lifetime)
-	lifetime := s.cert.Leaf.NotAfter.Sub(s.cert.Leaf.NotBefore)
-	threshold := s.cert.Leaf.NotAfter.Add(-lifetime * 20 / 100)
-	if time.Now().Before(threshold) {
+	if !rotationDue(cert.Leaf, defaultRotationFraction, time.Now()) {
 		return nil // No rotation needed
 	}
 
@@ -169,24 +266,30 @@ func (s *SecureCertificateStore) RotateCertificate() error {
 	if err != nil {
 		return fmt.Errorf("failed to read key: %v", err)
 	}
+	defer securemem.Wipe(keyPEM)
 
 	// Store new certificate
 	return s.StoreCertificate(certPEM, keyPEM)
 }
 
+// SetTrustBundle replaces the trust bundle with roots
+func (s *SecureCertificateStore) SetTrustBundle(roots []*x509.Certificate) {
+	s.bundle.SetRoots(roots)
+}
+
 // LoadTrustBundle loads the trust bundle from file
 func (s *SecureCertificateStore) LoadTrustBundle() error {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-
 	trustPEM, err := ioutil.ReadFile(s.trustPath)
 	if err != nil {
 		return fmt.Errorf("failed to read trust bundle: %v", err)
 	}
 
-	if !s.trustBundle.AppendCertsFromPEM(trustPEM) {
-		return fmt.Errorf("failed to parse trust bundle")
+	// Replace the roots so those removed from the file stop being trusted
+	roots, err := spiffe.ParseBundlePEM(trustPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse trust bundle: %v", err)
 	}
+	s.bundle.SetRoots(roots)
 
 	return nil
-} 
\ No newline at end of file
+}
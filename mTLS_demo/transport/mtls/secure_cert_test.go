@@ -0,0 +1,227 @@
+package mtls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureCertificateStore_KeyTypes(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{name: "RSA", key: newRSAKey(t)},
+		{name: "ECDSA P-256", key: newECDSAKey(t, elliptic.P256())},
+		{name: "ECDSA P-384", key: newECDSAKey(t, elliptic.P384())},
+		{name: "Ed25519", key: newEd25519Key(t)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svid := ca.IssueSVIDWithKey(t, "spiffe://example.org/backend", tt.key)
+
+			// Stored in memory, as received from the Workload API
+			store := NewSecureCertificateStore("", "", "")
+			assert.NoError(t, store.StoreX509SVID(svid.Chain, tt.key))
+			assert.True(t, store.GetCertificate().Leaf.Equal(svid.Certificate))
+
+			// Stored from PEM files
+			keyDER, err := x509.MarshalPKCS8PrivateKey(tt.key)
+			assert.NoError(t, err)
+			keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+			store = NewSecureCertificateStore("", "", "")
+			assert.NoError(t, store.StoreCertificate(spiffetest.EncodeCertificates(svid.Chain), keyPEM))
+			assert.True(t, store.GetCertificate().Leaf.Equal(svid.Certificate))
+		})
+	}
+}
+
+func TestSecureCertificateStore_Validation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/backend")
+	expired := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour)))
+	notYetValid := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour)))
+	noDigitalSignature := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithKeyUsage(x509.KeyUsageKeyEncipherment))
+
+	tests := []struct {
+		name  string
+		chain []*x509.Certificate
+		key   crypto.Signer
+	}{
+		{
+			name:  "Empty chain",
+			chain: nil,
+			key:   svid.PrivateKey,
+		},
+		{
+			name:  "Missing key",
+			chain: svid.Chain,
+			key:   nil,
+		},
+		{
+			name:  "Key of another certificate",
+			chain: svid.Chain,
+			key:   newECDSAKey(t, elliptic.P256()),
+		},
+		{
+			name:  "Key of another type",
+			chain: svid.Chain,
+			key:   newEd25519Key(t),
+		},
+		{
+			name:  "Expired certificate",
+			chain: expired.Chain,
+			key:   expired.PrivateKey,
+		},
+		{
+			name:  "Not yet valid certificate",
+			chain: notYetValid.Chain,
+			key:   notYetValid.PrivateKey,
+		},
+		{
+			name:  "Missing digital signature key usage",
+			chain: noDigitalSignature.Chain,
+			key:   noDigitalSignature.PrivateKey,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewSecureCertificateStore("", "", "")
+			assert.Error(t, store.StoreX509SVID(tt.chain, tt.key))
+			assert.Nil(t, store.GetCertificate())
+		})
+	}
+}
+
+func TestSecureCertificateStore_ExpiringCertificate(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+
+	// Past 90% of its lifetime, the certificate is still served while it
+	// is being rotated
+	expiring := ca.IssueSVID(t, "spiffe://example.org/backend", spiffetest.WithValidity(time.Now().Add(-9*time.Hour), time.Now().Add(time.Hour)))
+
+	store := NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreX509SVID(expiring.Chain, expiring.PrivateKey))
+	assert.True(t, store.GetCertificate().Leaf.Equal(expiring.Certificate))
+}
+
+func TestSecureCertificateStore_MismatchedPEM(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/backend")
+	other := ca.IssueSVID(t, "spiffe://example.org/frontend")
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(other.PrivateKey)
+	assert.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	store := NewSecureCertificateStore("", "", "")
+	assert.Error(t, store.StoreCertificate(spiffetest.EncodeCertificates(svid.Chain), keyPEM))
+	assert.Nil(t, store.GetCertificate())
+}
+
+func TestSecureCertificateStore_NoKeyOnDisk(t *testing.T) {
+	// Anything written to a temp file or the working directory ends up here
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(svidA.PrivateKey)
+	assert.NoError(t, err)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	store := NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreCertificate(spiffetest.EncodeCertificates(svidA.Chain), keyPEM))
+	first, ok := store.GetCertificate().PrivateKey.(*securemem.Signer)
+	assert.True(t, ok)
+
+	// Rotating retires the previous key: handshakes that already fetched
+	// the previous certificate can still sign until the grace period ends
+	store.retired = securemem.NewRetirer(50 * time.Millisecond)
+	assert.NoError(t, store.StoreX509SVID(svidB.Chain, svidB.PrivateKey))
+	second, ok := store.GetCertificate().PrivateKey.(*securemem.Signer)
+	assert.True(t, ok)
+
+	digest := sha256.Sum256([]byte("message"))
+	_, err = first.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := first.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return errors.Is(err, securemem.ErrDestroyed)
+	}, time.Second, 10*time.Millisecond)
+	_, err = second.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	// The caller's key is left usable
+	_, err = svidB.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+
+	// Closing wipes the current key and retired keys right away
+	assert.NoError(t, store.StoreX509SVID(svidA.Chain, svidA.PrivateKey))
+	store.retired = securemem.NewRetirer(time.Hour)
+	third, ok := store.GetCertificate().PrivateKey.(*securemem.Signer)
+	assert.True(t, ok)
+	assert.NoError(t, store.StoreX509SVID(svidB.Chain, svidB.PrivateKey))
+	second, ok = store.GetCertificate().PrivateKey.(*securemem.Signer)
+	assert.True(t, ok)
+	assert.NoError(t, store.Close())
+	_, err = third.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.ErrorIs(t, err, securemem.ErrDestroyed)
+	assert.Nil(t, store.GetCertificate())
+	_, err = second.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.ErrorIs(t, err, securemem.ErrDestroyed)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func newRSAKey(t *testing.T) crypto.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	return key
+}
+
+func newECDSAKey(t *testing.T, curve elliptic.Curve) crypto.Signer {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate ECDSA key: %v", err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) crypto.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate Ed25519 key: %v", err)
+	}
+	return key
+}
@@ -0,0 +1,327 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// CertificateSource provides the current certificate and trust bundle.
+// workload.Client, certfile.Watcher and SecureCertificateStore implement it.
+type CertificateSource interface {
+	Certificate() (*tls.Certificate, error)
+	Bundle() (*spiffe.Bundle, error)
+}
+
+// bundleSetSource is implemented by sources that also hold the bundles of
+// federated trust domains, such as workload.Client
+type bundleSetSource interface {
+	Bundles() *spiffe.BundleSet
+}
+
+// ServerTLSConfig returns a server tls.Config that serves the current
+// certificate of source and requires client certificates chaining to its
+// current bundle. When source also holds federated bundles, as
+// workload.Client does, clients are verified against the bundle of their
+// own trust domain instead. Every handshake picks up rotations and bundle changes, so
+// the config can be handed to a running listener once.
+//
+// base supplies the remaining settings, such as cipher suites or a
+// VerifyConnection callback, and may be nil. A GetCertificate set on base
+// replaces the source certificate, for example to staple OCSP responses. A
+// GetConfigForClient set on base runs first; the config it returns, if any,
+// is used for the handshake with client verification added to it.
+//
+// The returned config is copied at every handshake, so settings added to
+// it later, such as the NextProtos of an http.Server, apply too.
+func ServerTLSConfig(source CertificateSource, base *tls.Config) *tls.Config {
+	config := baseConfig(base)
+	if config.GetCertificate == nil {
+		config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return source.Certificate()
+		}
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	// Snapshot the bundle for each handshake
+	next := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		bundle, err := source.Bundle()
+		if err != nil {
+			return nil, fmt.Errorf("no trust bundle for client verification: %v", err)
+		}
+
+		perConn := config.Clone()
+		if next != nil {
+			custom, err := next(hello)
+			if err != nil {
+				return nil, err
+			}
+			if custom != nil {
+				perConn = custom.Clone()
+				if perConn.GetCertificate == nil && len(perConn.Certificates) == 0 {
+					perConn.GetCertificate = config.GetCertificate
+				}
+				if len(perConn.NextProtos) == 0 {
+					perConn.NextProtos = config.NextProtos
+				}
+				if perConn.MinVersion < tls.VersionTLS12 {
+					perConn.MinVersion = tls.VersionTLS12
+				}
+			}
+		}
+		perConn.GetConfigForClient = nil
+		perConn.ClientAuth = tls.RequireAndVerifyClientCert
+		perConn.ClientCAs = bundle.Pool()
+		if set, ok := source.(bundleSetSource); ok {
+			perConn.ClientCAs = federatedPool(set.Bundles(), bundle)
+			perConn.VerifyConnection = verifyClientDomain(source, perConn.VerifyConnection)
+		}
+		return perConn, nil
+	}
+
+	return config
+}
+
+// federatedPool returns a pool holding the roots of own and of every
+// trust domain in set
+func federatedPool(set *spiffe.BundleSet, own *spiffe.Bundle) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, root := range own.Roots {
+		pool.AddCert(root)
+	}
+	for _, td := range set.TrustDomains() {
+		bundle, err := set.Bundle(td)
+		if err != nil {
+			continue
+		}
+		for _, root := range bundle.Roots {
+			pool.AddCert(root)
+		}
+	}
+	return pool
+}
+
+// verifyClientDomain returns a VerifyConnection callback that checks the
+// client's X509-SVID chains to the bundle of its own trust domain, so a CA
+// of one federated domain cannot vouch for IDs in another. The handshake
+// has already verified the chain against the union of all bundles, which
+// keeps VerifiedChains populated. next, if set, runs afterwards.
+func verifyClientDomain(source CertificateSource, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("client presented no certificate")
+		}
+
+		id, err := spiffe.ValidateX509SVID(state.PeerCertificates[0])
+		if err != nil {
+			return fmt.Errorf("client certificate is not an X509-SVID: %w", err)
+		}
+
+		bundle, err := peerBundle(source, id.TrustDomain())
+		if err != nil {
+			return fmt.Errorf("no trust bundle for client %s: %v", id, err)
+		}
+		if _, err := verifyPeer(state, bundle.Pool(), x509.ExtKeyUsageClientAuth); err != nil {
+			return err
+		}
+
+		if next == nil {
+			return nil
+		}
+		return next(state)
+	}
+}
+
+// ClientTLSConfig returns a client tls.Config that presents the current
+// certificate of source and accepts servers whose X509-SVID chains to the
+// current bundle of their trust domain and whose SPIFFE ID is accepted by
+// authorize. Host names are not checked, as SVIDs usually carry none. It
+// can be set once on a long-lived http.Transport; rotations and bundle
+// changes apply to the next handshake.
+//
+// base supplies the remaining settings and may be nil. A VerifyConnection
+// set on base runs after the server has been authorized and sees the
+// verified chains.
+func ClientTLSConfig(source CertificateSource, authorize Authorizer, base *tls.Config) *tls.Config {
+	config := baseConfig(base)
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return source.Certificate()
+	}
+
+	// RootCAs is fixed once a handshake starts and implies a host name
+	// check, so the SVID is verified here instead
+	next := config.VerifyConnection
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if authorize == nil {
+			return fmt.Errorf("no expected server SPIFFE ID configured")
+		}
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server presented no certificate")
+		}
+
+		id, err := spiffe.ValidateX509SVID(state.PeerCertificates[0])
+		if err != nil {
+			return fmt.Errorf("server certificate is not an X509-SVID: %w", err)
+		}
+
+		bundle, err := peerBundle(source, id.TrustDomain())
+		if err != nil {
+			return fmt.Errorf("no trust bundle for server %s: %v", id, err)
+		}
+
+		chains, err := verifyPeer(state, bundle.Pool(), x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return err
+		}
+		if err := authorize(id); err != nil {
+			return err
+		}
+
+		if next == nil {
+			return nil
+		}
+		state.VerifiedChains = chains
+		return next(state)
+	}
+
+	return config
+}
+
+// peerBundle returns the bundle a peer in td is verified against
+func peerBundle(source CertificateSource, td spiffeid.TrustDomain) (*spiffe.Bundle, error) {
+	if set, ok := source.(bundleSetSource); ok {
+		return set.Bundles().Bundle(td)
+	}
+	return source.Bundle()
+}
+
+// baseConfig copies base and applies secure defaults
+func baseConfig(base *tls.Config) *tls.Config {
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return config
+}
+
+// verifyPeer verifies the certificate chain presented by the peer against
+// roots
+func verifyPeer(state tls.ConnectionState, roots *x509.CertPool, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("peer presented no certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	chains, err := state.PeerCertificates[0].Verify(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify peer certificate: %v", err)
+	}
+	return chains, nil
+}
+
+// ConnectionTracker closes server connections established with a rotated
+// certificate once they are idle, so clients reconnect and see the new one
+// without requests being cut off. Set ConnState as http.Server.ConnState and
+// call Rotated after every rotation. HTTP/2 connections never report idle
+// and are left to the server's IdleTimeout.
+type ConnectionTracker struct {
+	mu         sync.Mutex
+	generation uint64
+	conns      map[net.Conn]*trackedConn
+}
+
+// trackedConn is the state of a connection seen by a ConnectionTracker
+type trackedConn struct {
+	generation uint64
+	idle       bool
+}
+
+// NewConnectionTracker creates a connection tracker
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		conns: make(map[net.Conn]*trackedConn),
+	}
+}
+
+// ConnState implements http.Server.ConnState
+func (t *ConnectionTracker) ConnState(conn net.Conn, state http.ConnState) {
+	if t.update(conn, state) {
+		conn.Close()
+	}
+}
+
+// update records the new state of conn and reports whether it should be
+// closed
+func (t *ConnectionTracker) update(conn net.Conn, state http.ConnState) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateNew:
+		t.conns[conn] = &trackedConn{generation: t.generation}
+	case http.StateActive:
+		if c, ok := t.conns[conn]; ok {
+			c.idle = false
+		}
+	case http.StateIdle:
+		c, ok := t.conns[conn]
+		if !ok {
+			return false
+		}
+		if c.generation < t.generation {
+			// The request in flight at rotation has completed
+			delete(t.conns, conn)
+			return true
+		}
+		c.idle = true
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, conn)
+	}
+	return false
+}
+
+// Rotated closes the idle connections established before the call. Active
+// ones are closed as soon as their current request completes.
+func (t *ConnectionTracker) Rotated() {
+	t.mu.Lock()
+	t.generation++
+	var idle []net.Conn
+	for conn, c := range t.conns {
+		if c.idle {
+			delete(t.conns, conn)
+			idle = append(idle, conn)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// Len returns the number of open connections
+func (t *ConnectionTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
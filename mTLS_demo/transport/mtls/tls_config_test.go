@@ -0,0 +1,439 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerTLSConfig_Rotation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	serverStore := setupTestStore(t, svidA, ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	addr := setupTestTLSServer(t, ServerTLSConfig(serverStore, nil), nil)
+
+	// The certificate at handshake time is served
+	state, err := dialTestServer(addr, clientStore)
+	assert.NoError(t, err)
+	assert.True(t, state.PeerCertificates[0].Equal(svidA.Certificate))
+
+	assert.NoError(t, serverStore.StoreX509SVID(svidB.Chain, svidB.PrivateKey))
+	state, err = dialTestServer(addr, clientStore)
+	assert.NoError(t, err)
+	assert.True(t, state.PeerCertificates[0].Equal(svidB.Certificate))
+}
+
+func TestServerTLSConfig_BundleChange(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	otherCA := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	serverStore := setupTestStore(t, svid, ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	addr := setupTestTLSServer(t, ServerTLSConfig(serverStore, nil), nil)
+
+	_, err := dialTestServer(addr, clientStore)
+	assert.NoError(t, err)
+
+	// Clients of a root removed from the server bundle are rejected
+	serverStore.SetTrustBundle(otherCA.Roots())
+	_, err = dialTestServer(addr, clientStore)
+	assert.Error(t, err)
+
+	// Servers of a root removed from the client bundle are rejected
+	serverStore.SetTrustBundle(ca.Roots())
+	clientStore.SetTrustBundle(otherCA.Roots())
+	_, err = dialTestServer(addr, clientStore)
+	assert.Error(t, err)
+}
+
+func TestServerTLSConfig_FederatedClients(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	otherCA := spiffetest.NewCA(t, "other.org")
+
+	// The server trusts its own domain and the federated other.org
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	bundles := spiffe.NewBundleSet()
+	bundles.Set(spiffeid.RequireTrustDomainFromString("example.org"), serverStore)
+	bundles.Set(spiffeid.RequireTrustDomainFromString("other.org"), spiffe.NewMemoryBundleSource(otherCA.Roots()))
+	federated := &federatedTestSource{SecureCertificateStore: serverStore, bundles: bundles}
+
+	tests := []struct {
+		name    string
+		source  CertificateSource
+		svid    *spiffetest.SVID
+		wantErr bool
+	}{
+		{
+			name:   "Own trust domain",
+			source: federated,
+			svid:   ca.IssueSVID(t, "spiffe://example.org/frontend"),
+		},
+		{
+			name:   "Federated trust domain",
+			source: federated,
+			svid:   otherCA.IssueSVID(t, "spiffe://other.org/frontend"),
+		},
+		{
+			name:    "Federated CA vouching for another domain",
+			source:  federated,
+			svid:    otherCA.IssueSVID(t, "spiffe://example.org/frontend"),
+			wantErr: true,
+		},
+		{
+			name:    "Own CA vouching for a federated domain",
+			source:  federated,
+			svid:    ca.IssueSVID(t, "spiffe://other.org/frontend"),
+			wantErr: true,
+		},
+		{
+			name:    "Federated trust domain without a bundle set",
+			source:  serverStore,
+			svid:    otherCA.IssueSVID(t, "spiffe://other.org/frontend"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Chained verification sees the verified chains
+			var chains atomic.Int32
+			addr := setupTestTLSServer(t, ServerTLSConfig(tt.source, &tls.Config{
+				VerifyConnection: func(state tls.ConnectionState) error {
+					chains.Store(int32(len(state.VerifiedChains)))
+					return nil
+				},
+			}), nil)
+
+			clientStore := setupTestStore(t, tt.svid, ca)
+			_, err := dialTestServer(addr, clientStore)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotZero(t, chains.Load())
+		})
+	}
+}
+
+func TestServerTLSConfig_HandshakeSettings(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	backend := spiffeid.RequireFromString("spiffe://example.org/backend")
+
+	tests := []struct {
+		name         string
+		custom       func(*tls.ClientHelloInfo) (*tls.Config, error)
+		clientCert   bool
+		wantErr      bool
+		wantVersion  uint16
+		wantProtocol string
+	}{
+		{
+			name:         "Settings added after creation",
+			clientCert:   true,
+			wantVersion:  tls.VersionTLS13,
+			wantProtocol: "h2",
+		},
+		{
+			name:         "Caller keeps the config",
+			custom:       func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, nil },
+			clientCert:   true,
+			wantVersion:  tls.VersionTLS13,
+			wantProtocol: "h2",
+		},
+		{
+			name:         "Caller config",
+			custom:       func(*tls.ClientHelloInfo) (*tls.Config, error) { return &tls.Config{MaxVersion: tls.VersionTLS12}, nil },
+			clientCert:   true,
+			wantVersion:  tls.VersionTLS12,
+			wantProtocol: "h2",
+		},
+		{
+			name:    "Caller config still verifies clients",
+			custom:  func(*tls.ClientHelloInfo) (*tls.Config, error) { return &tls.Config{MaxVersion: tls.VersionTLS12}, nil },
+			wantErr: true,
+		},
+		{
+			name:       "Caller error",
+			custom:     func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, fmt.Errorf("rejected") },
+			clientCert: true,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Protocols are set after the config was created, as an
+			// http.Server does
+			config := ServerTLSConfig(serverStore, &tls.Config{GetConfigForClient: tt.custom})
+			config.NextProtos = []string{"h2", "http/1.1"}
+			addr := setupTestTLSServer(t, config, nil)
+
+			clientConfig := ClientTLSConfig(clientStore, AuthorizeID(backend), &tls.Config{NextProtos: []string{"h2"}})
+			if !tt.clientCert {
+				clientConfig.GetClientCertificate = nil
+			}
+			conn, err := tls.Dial("tcp", addr, clientConfig)
+			if err == nil {
+				defer conn.Close()
+
+				// Wait for the server to verify the client certificate
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if _, readErr := conn.Read(make([]byte, 1)); readErr != nil && !isTimeout(readErr) {
+					err = readErr
+				}
+			}
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				state := conn.ConnectionState()
+				assert.Equal(t, tt.wantVersion, state.Version)
+				assert.Equal(t, tt.wantProtocol, state.NegotiatedProtocol)
+			}
+		})
+	}
+}
+
+func TestClientTLSConfig_Authorization(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	addr := setupTestTLSServer(t, ServerTLSConfig(serverStore, nil), nil)
+
+	backend := spiffeid.RequireFromString("spiffe://example.org/backend")
+	frontend := spiffeid.RequireFromString("spiffe://example.org/frontend")
+
+	tests := []struct {
+		name      string
+		authorize Authorizer
+		verify    func(tls.ConnectionState) error
+		wantErr   string
+	}{
+		{
+			name:      "Expected ID",
+			authorize: AuthorizeID(backend),
+		},
+		{
+			name:      "Unexpected ID",
+			authorize: AuthorizeID(frontend),
+			wantErr:   "expected spiffe://example.org/frontend, got spiffe://example.org/backend",
+		},
+		{
+			name:      "Expected trust domain",
+			authorize: AuthorizeMemberOf(spiffeid.RequireTrustDomainFromString("example.org")),
+		},
+		{
+			name:      "Unexpected trust domain",
+			authorize: AuthorizeMemberOf(spiffeid.RequireTrustDomainFromString("other.org")),
+			wantErr:   "expected a member of other.org, got spiffe://example.org/backend",
+		},
+		{
+			name: "Predicate",
+			authorize: AuthorizeIf("a backend", func(id spiffeid.ID) bool {
+				return id.Path() == "/backend"
+			}),
+		},
+		{
+			name: "Predicate rejects",
+			authorize: AuthorizeIf("a database", func(id spiffeid.ID) bool {
+				return id.Path() == "/database"
+			}),
+			wantErr: "expected a database, got spiffe://example.org/backend",
+		},
+		{
+			name:      "No expected ID",
+			authorize: nil,
+			wantErr:   "no expected server SPIFFE ID configured",
+		},
+		{
+			name:      "Chained verification sees the verified chains",
+			authorize: AuthorizeID(backend),
+			verify: func(state tls.ConnectionState) error {
+				if len(state.VerifiedChains) == 0 {
+					return fmt.Errorf("no verified chains")
+				}
+				return nil
+			},
+		},
+		{
+			name:      "Chained verification rejects",
+			authorize: AuthorizeID(backend),
+			verify: func(tls.ConnectionState) error {
+				return fmt.Errorf("rejected")
+			},
+			wantErr: "rejected",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The server name does not have to match the SVID
+			config := ClientTLSConfig(clientStore, tt.authorize, &tls.Config{
+				ServerName:       "backend.example.com",
+				VerifyConnection: tt.verify,
+			})
+			conn, err := tls.Dial("tcp", addr, config)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			conn.Close()
+		})
+	}
+}
+
+func TestClientTLSConfig_UnexpectedPeer(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	addr := setupTestTLSServer(t, ServerTLSConfig(serverStore, nil), nil)
+
+	config := ClientTLSConfig(clientStore, AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/frontend")), nil)
+	_, err := tls.Dial("tcp", addr, config)
+	assert.ErrorIs(t, err, ErrUnexpectedPeer)
+}
+
+func TestConnectionTracker_Rotated(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+
+	tracker := NewConnectionTracker()
+	var newConns atomic.Int32
+	release := make(chan struct{})
+	addr := setupTestTLSServer(t, ServerTLSConfig(serverStore, nil), &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-release
+			}
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				newConns.Add(1)
+			}
+			tracker.ConnState(conn, state)
+		},
+	})
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: ClientTLSConfig(clientStore, AuthorizeID(spiffeid.RequireFromString("spiffe://example.org/backend")), nil)},
+	}
+	get := func(path string) {
+		resp, err := client.Get("https://" + addr + path)
+		if assert.NoError(t, err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	// Idle connections are reused until a rotation closes them
+	get("/")
+	get("/")
+	assert.Equal(t, int32(1), newConns.Load())
+	tracker.Rotated()
+	assert.Eventually(t, func() bool { return tracker.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+	get("/")
+	assert.Equal(t, int32(2), newConns.Load())
+
+	// A request in flight at rotation completes before its connection is
+	// closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		get("/slow")
+	}()
+	assert.Eventually(t, func() bool {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		for _, c := range tracker.conns {
+			if !c.idle {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	tracker.Rotated()
+	close(release)
+	<-done
+	assert.Eventually(t, func() bool { return tracker.Len() == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// federatedTestSource is a certificate store that also holds federated
+// bundles
+type federatedTestSource struct {
+	*SecureCertificateStore
+	bundles *spiffe.BundleSet
+}
+
+func (s *federatedTestSource) Bundles() *spiffe.BundleSet {
+	return s.bundles
+}
+
+// setupTestStore creates a store holding svid and trusting ca
+func setupTestStore(t *testing.T, svid *spiffetest.SVID, ca *spiffetest.CA) *SecureCertificateStore {
+	store := NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreX509SVID(svid.Chain, svid.PrivateKey))
+	store.SetTrustBundle(ca.Roots())
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// setupTestTLSServer serves server, or an empty handler, with config on a
+// local port until the test finishes and returns its address
+func setupTestTLSServer(t *testing.T, config *tls.Config, server *http.Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	if server == nil {
+		server = &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	}
+	go server.Serve(tls.NewListener(listener, config))
+	t.Cleanup(func() { server.Close() })
+
+	return listener.Addr().String()
+}
+
+// dialTestServer completes a handshake with the server at addr as a client
+// of store
+func dialTestServer(addr string, store *SecureCertificateStore) (tls.ConnectionState, error) {
+	backend := spiffeid.RequireFromString("spiffe://example.org/backend")
+	conn, err := tls.Dial("tcp", addr, ClientTLSConfig(store, AuthorizeID(backend), nil))
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+
+	// Read until the server has verified the client certificate; TLS 1.3
+	// reports client certificate errors after the handshake
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !isTimeout(err) {
+		return tls.ConnectionState{}, err
+	}
+	return conn.ConnectionState(), nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,301 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+)
+
+const (
+	defaultCRLRefreshInterval = time.Hour
+	defaultCRLFetchTimeout    = 10 * time.Second
+	retryInterval             = 30 * time.Second
+	maxCRLSize                = 10 << 20
+)
+
+// CRLConfig configures a CRLChecker
+type CRLConfig struct {
+	// Files lists local CRL files, PEM or DER encoded. A file only applies
+	// to certificates issued by the CRL issuer.
+	Files []string
+	// FetchDistributionPoints downloads CRLs from the HTTP CRL distribution
+	// points listed in each certificate
+	FetchDistributionPoints bool
+	// HTTPClient is used to fetch distribution points. Defaults to a client
+	// with a 10 second timeout.
+	HTTPClient *http.Client
+	// RefreshInterval bounds how long a CRL without NextUpdate is cached.
+	// Defaults to one hour.
+	RefreshInterval time.Duration
+	// FailOpen accepts certificates whose revocation status cannot be
+	// determined, for example when the CRL cannot be fetched or is stale.
+	// By default such certificates are rejected.
+	FailOpen bool
+	// RejectUncovered rejects certificates that no CRL applies to: their
+	// issuer has no CRL file, they list no distribution point, or the
+	// files that might cover them could not be read yet. By default they
+	// are accepted, since the files usually only cover some issuers.
+	// FailOpen does not apply to them.
+	RejectUncovered bool
+}
+
+// CRLChecker checks certificates against certificate revocation lists
+type CRLChecker struct {
+	config  CRLConfig
+	client  *http.Client
+	metrics *common.MetricsCollector
+
+	mu      sync.Mutex
+	entries map[string]*crlEntry
+	now     func() time.Time
+}
+
+// crlEntry caches one CRL source
+type crlEntry struct {
+	mu sync.Mutex
+
+	crl       *x509.RevocationList
+	err       error
+	expires   time.Time
+	nextFetch time.Time
+	checkedBy *x509.Certificate
+}
+
+// NewCRLChecker creates a CRL based revocation checker
+func NewCRLChecker(config *CRLConfig) (*CRLChecker, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if len(config.Files) == 0 && !config.FetchDistributionPoints {
+		return nil, fmt.Errorf("no CRL files or distribution points configured")
+	}
+
+	c := &CRLChecker{
+		config:  *config,
+		client:  config.HTTPClient,
+		metrics: common.NewMetricsCollector(),
+		entries: make(map[string]*crlEntry),
+		now:     time.Now,
+	}
+	if c.client == nil {
+		c.client = &http.Client{Timeout: defaultCRLFetchTimeout}
+	}
+	if c.config.RefreshInterval <= 0 {
+		c.config.RefreshInterval = defaultCRLRefreshInterval
+	}
+
+	return c, nil
+}
+
+// Check implements Checker
+func (c *CRLChecker) Check(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.checkCertificate(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCertificate checks cert against every CRL source published by issuer.
+// Only errors of sources that apply to cert count: its distribution points
+// and files holding a CRL of issuer.
+func (c *CRLChecker) checkCertificate(cert, issuer *x509.Certificate) error {
+	checked := false
+	var lastErr, unknownErr error
+
+	for _, source := range c.sources(cert) {
+		crl, fresh, err := c.load(source, issuer)
+		if err == errIssuerMismatch {
+			continue
+		}
+		if err != nil {
+			c.metrics.RecordRevocationCheckError("crl", "fetch_failed")
+			if errors.Is(err, errIssuerUnknown) && !listsDistributionPoint(cert, source) {
+				// A file that was never read may belong to any issuer
+				unknownErr = err
+				continue
+			}
+			lastErr = err
+			continue
+		}
+
+		// A stale list still proves revocation, but not validity
+		if isRevoked(crl, cert) {
+			c.metrics.RecordRevocationHit("crl", source)
+			return fmt.Errorf("%w: serial %s listed by %s", ErrRevoked, cert.SerialNumber, source)
+		}
+		if !fresh {
+			c.metrics.RecordStaleCRL(source)
+			lastErr = fmt.Errorf("CRL from %s is stale", source)
+			continue
+		}
+
+		checked = true
+	}
+
+	if checked {
+		return nil
+	}
+	if lastErr == nil {
+		if !c.config.RejectUncovered {
+			return nil
+		}
+		if unknownErr != nil {
+			return fmt.Errorf("%w: no CRL of %s loaded: %v", ErrUnavailable, issuer.Subject, unknownErr)
+		}
+		return fmt.Errorf("%w: no CRL of %s configured", ErrUnavailable, issuer.Subject)
+	}
+	if c.config.FailOpen {
+		c.metrics.RecordRevocationCheckError("crl", "fail_open")
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, lastErr)
+}
+
+// sources returns the CRL locations that may cover cert
+func (c *CRLChecker) sources(cert *x509.Certificate) []string {
+	sources := append([]string(nil), c.config.Files...)
+	if c.config.FetchDistributionPoints {
+		for _, dp := range cert.CRLDistributionPoints {
+			if strings.HasPrefix(dp, "http://") || strings.HasPrefix(dp, "https://") {
+				sources = append(sources, dp)
+			}
+		}
+	}
+	return sources
+}
+
+// listsDistributionPoint reports whether source is a CRL distribution point
+// of cert
+func listsDistributionPoint(cert *x509.Certificate, source string) bool {
+	for _, dp := range cert.CRLDistributionPoints {
+		if dp == source {
+			return true
+		}
+	}
+	return false
+}
+
+// errIssuerMismatch marks a CRL source published by a different issuer
+var errIssuerMismatch = errors.New("CRL issuer mismatch")
+
+// errIssuerUnknown marks a CRL source that has never been loaded, so its
+// issuer is not known
+var errIssuerUnknown = errors.New("CRL issuer unknown")
+
+// load returns the cached CRL for source, refreshing it once it passes its
+// NextUpdate. fresh reports whether the returned CRL is still current.
+func (c *CRLChecker) load(source string, issuer *x509.Certificate) (crl *x509.RevocationList, fresh bool, err error) {
+	c.mu.Lock()
+	entry, ok := c.entries[source]
+	if !ok {
+		entry = &crlEntry{}
+		c.entries[source] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(entry.nextFetch) {
+		crl, err := c.fetch(source)
+		if err != nil {
+			// Keep any previous list so revoked serials stay rejected
+			entry.err = err
+			entry.nextFetch = now.Add(retryInterval)
+		} else {
+			entry.crl = crl
+			entry.err = nil
+			entry.checkedBy = nil
+			entry.expires = crl.NextUpdate
+			if entry.expires.IsZero() {
+				entry.expires = now.Add(c.config.RefreshInterval)
+			}
+			// Don't refetch a stale list on every check
+			entry.nextFetch = entry.expires
+			if entry.nextFetch.Before(now.Add(retryInterval)) {
+				entry.nextFetch = now.Add(retryInterval)
+			}
+		}
+	}
+	if entry.crl == nil {
+		return nil, false, fmt.Errorf("%w: %v", errIssuerUnknown, entry.err)
+	}
+
+	// Only trust lists signed by the certificate issuer. CAs rotated under
+	// the same subject are told apart by their key identifiers.
+	if !bytes.Equal(entry.crl.RawIssuer, issuer.RawSubject) {
+		return nil, false, errIssuerMismatch
+	}
+	if len(entry.crl.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 &&
+		!bytes.Equal(entry.crl.AuthorityKeyId, issuer.SubjectKeyId) {
+		return nil, false, errIssuerMismatch
+	}
+	if entry.checkedBy == nil || !entry.checkedBy.Equal(issuer) {
+		if err := entry.crl.CheckSignatureFrom(issuer); err != nil {
+			return nil, false, fmt.Errorf("invalid CRL signature from %s: %v", source, err)
+		}
+		entry.checkedBy = issuer
+	}
+
+	return entry.crl, !now.After(entry.expires), nil
+}
+
+// fetch reads and parses a CRL from a file or URL
+func (c *CRLChecker) fetch(source string) (*x509.RevocationList, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := c.client.Get(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch CRL from %s: %v", source, err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch CRL from %s: status %d", source, resp.StatusCode)
+		}
+
+		data, err = io.ReadAll(io.LimitReader(resp.Body, maxCRLSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CRL from %s: %v", source, err)
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CRL file: %v", err)
+		}
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL from %s: %v", source, err)
+	}
+	return crl, nil
+}
+
+// isRevoked reports whether cert's serial number is listed in crl
+func isRevoked(crl *x509.RevocationList, cert *x509.Certificate) bool {
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,224 @@
+package revocation
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCRL writes a PEM encoded CRL to a temporary file
+func writeCRL(t *testing.T, der []byte) string {
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
+
+// chain returns the verified chain of an SVID issued by ca
+func chain(ca *spiffetest.CA, svid *spiffetest.SVID) []*x509.Certificate {
+	return append(append([]*x509.Certificate(nil), svid.Chain...), ca.Roots()...)
+}
+
+func TestCRLChecker_Files(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	intermediate := ca.NewIntermediate(t)
+	otherCA := spiffetest.NewCA(t, "other.org")
+
+	good := intermediate.IssueSVID(t, "spiffe://example.org/good")
+	revoked := intermediate.IssueSVID(t, "spiffe://example.org/revoked")
+	revokedIntermediate := ca.NewIntermediate(t)
+
+	checker, err := NewCRLChecker(&CRLConfig{
+		Files: []string{
+			writeCRL(t, intermediate.CreateCRL(t, time.Now().Add(time.Hour), revoked.Certificate)),
+			writeCRL(t, ca.CreateCRL(t, time.Now().Add(time.Hour), revokedIntermediate.Certificate)),
+			writeCRL(t, otherCA.CreateCRL(t, time.Now().Add(time.Hour), good.Certificate)),
+		},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		revoked bool
+	}{
+		{name: "Valid certificate", chain: chain(ca, good)},
+		{name: "Revoked leaf", chain: chain(ca, revoked), revoked: true},
+		{name: "Revoked intermediate", chain: chain(ca, revokedIntermediate.IssueSVID(t, "spiffe://example.org/a")), revoked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checker.Check(tt.chain)
+			if tt.revoked {
+				assert.ErrorIs(t, err, ErrRevoked)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCRLChecker_DistributionPoint(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+
+	var fetches int32
+	var crl atomic.Value
+	crl.Store(ca.CreateCRL(t, time.Now().Add(time.Hour)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(crl.Load().([]byte))
+	}))
+	defer server.Close()
+
+	svid := ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithCRLDistributionPoints(server.URL+"/ca.crl"))
+
+	checker, err := NewCRLChecker(&CRLConfig{FetchDistributionPoints: true})
+	assert.NoError(t, err)
+
+	// The CRL is cached until its next update
+	assert.NoError(t, checker.Check(chain(ca, svid)))
+	assert.NoError(t, checker.Check(chain(ca, svid)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// Once the cached CRL expires the new one is fetched
+	crl.Store(ca.CreateCRL(t, time.Now().Add(3*time.Hour), svid.Certificate))
+	checker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.ErrorIs(t, checker.Check(chain(ca, svid)), ErrRevoked)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
+
+func TestCRLChecker_FailureModes(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	unreachable := ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithCRLDistributionPoints(server.URL+"/ca.crl"))
+	stale := ca.IssueSVID(t, "spiffe://example.org/b")
+	staleCRL := writeCRL(t, ca.CreateCRL(t, time.Now().Add(-time.Minute)))
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		files    []string
+		svid     *spiffetest.SVID
+		wantErr  bool
+	}{
+		{name: "Unreachable fail closed", svid: unreachable, wantErr: true},
+		{name: "Unreachable fail open", failOpen: true, svid: unreachable},
+		{name: "Stale fail closed", files: []string{staleCRL}, svid: stale, wantErr: true},
+		{name: "Stale fail open", failOpen: true, files: []string{staleCRL}, svid: stale},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := NewCRLChecker(&CRLConfig{
+				Files:                   tt.files,
+				FetchDistributionPoints: true,
+				FailOpen:                tt.failOpen,
+			})
+			assert.NoError(t, err)
+
+			err = checker.Check(chain(ca, tt.svid))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnavailable)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCRLChecker_RevokedByStaleCRL(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/a")
+
+	// A stale CRL still rejects listed certificates when failing open
+	checker, err := NewCRLChecker(&CRLConfig{
+		Files:    []string{writeCRL(t, ca.CreateCRL(t, time.Now().Add(-time.Minute), svid.Certificate))},
+		FailOpen: true,
+	})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, checker.Check(chain(ca, svid)), ErrRevoked)
+}
+
+func TestCRLChecker_IssuerKeyMismatch(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/a")
+
+	// Same subject, different key: the CRL does not apply to this CA
+	rotated := spiffetest.NewCA(t, "example.org")
+
+	checker, err := NewCRLChecker(&CRLConfig{
+		Files: []string{writeCRL(t, rotated.CreateCRL(t, time.Now().Add(time.Hour), svid.Certificate))},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, checker.Check(chain(ca, svid)))
+}
+
+func TestCRLChecker_Coverage(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	otherCA := spiffetest.NewCA(t, "other.org")
+	covered := ca.IssueSVID(t, "spiffe://example.org/a")
+	uncovered := otherCA.IssueSVID(t, "spiffe://other.org/a")
+
+	files := []string{
+		writeCRL(t, ca.CreateCRL(t, time.Now().Add(time.Hour))),
+		filepath.Join(t.TempDir(), "missing.crl"),
+	}
+
+	tests := []struct {
+		name            string
+		files           []string
+		rejectUncovered bool
+		svid            *spiffetest.SVID
+		ca              *spiffetest.CA
+		wantErr         bool
+	}{
+		// An unreadable file does not fail certificates another CRL covers
+		{name: "Covered", files: files, svid: covered, ca: ca},
+		{name: "Covered, rejecting uncovered", files: files, rejectUncovered: true, svid: covered, ca: ca},
+		{name: "Uncovered", files: files, svid: uncovered, ca: otherCA},
+		{name: "Uncovered, rejecting uncovered", files: files, rejectUncovered: true, svid: uncovered, ca: otherCA, wantErr: true},
+		{name: "Only an unreadable file", files: files[1:], svid: covered, ca: ca},
+		{name: "Only an unreadable file, rejecting uncovered", files: files[1:], rejectUncovered: true, svid: covered, ca: ca, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := NewCRLChecker(&CRLConfig{
+				Files:           tt.files,
+				RejectUncovered: tt.rejectUncovered,
+			})
+			assert.NoError(t, err)
+
+			err = checker.Check(chain(tt.ca, tt.svid))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnavailable)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewCRLChecker_InvalidConfig(t *testing.T) {
+	_, err := NewCRLChecker(nil)
+	assert.Error(t, err)
+
+	_, err = NewCRLChecker(&CRLConfig{})
+	assert.Error(t, err)
+}
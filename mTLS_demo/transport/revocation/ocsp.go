@@ -0,0 +1,311 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	defaultOCSPRefreshInterval = time.Hour
+	defaultOCSPFetchTimeout    = 10 * time.Second
+	maxOCSPResponseSize        = 1 << 20
+	maxOCSPEntries             = 10000
+)
+
+// OCSPConfig configures an OCSPChecker
+type OCSPConfig struct {
+	// HTTPClient is used to query OCSP responders. Defaults to a client
+	// with a 10 second timeout.
+	HTTPClient *http.Client
+	// RefreshInterval bounds how long a response without NextUpdate is
+	// cached. Defaults to one hour.
+	RefreshInterval time.Duration
+	// FailOpen accepts certificates whose status cannot be determined, for
+	// example when the responder is unreachable or answers "unknown".
+	// By default such certificates are rejected.
+	FailOpen bool
+}
+
+// OCSPChecker checks certificates with the OCSP responders listed in their
+// Authority Information Access extension. Responses, including responses
+// stapled by peers, are cached until their NextUpdate.
+type OCSPChecker struct {
+	config  OCSPConfig
+	client  *http.Client
+	metrics *common.MetricsCollector
+
+	mu      sync.Mutex
+	entries map[string]*ocspEntry
+	now     func() time.Time
+}
+
+// ocspEntry caches the status of one certificate
+type ocspEntry struct {
+	mu sync.Mutex
+
+	resp      *ocsp.Response
+	err       error
+	expires   time.Time
+	nextFetch time.Time
+}
+
+// NewOCSPChecker creates an OCSP based revocation checker
+func NewOCSPChecker(config *OCSPConfig) (*OCSPChecker, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+
+	c := &OCSPChecker{
+		config:  *config,
+		client:  config.HTTPClient,
+		metrics: common.NewMetricsCollector(),
+		entries: make(map[string]*ocspEntry),
+		now:     time.Now,
+	}
+	if c.client == nil {
+		c.client = &http.Client{Timeout: defaultOCSPFetchTimeout}
+	}
+	if c.config.RefreshInterval <= 0 {
+		c.config.RefreshInterval = defaultOCSPRefreshInterval
+	}
+
+	return c, nil
+}
+
+// Check implements Checker
+func (c *OCSPChecker) Check(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.checkCertificate(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckStaple implements StapleChecker. A valid staple is cached so the
+// following Check does not query the responder; an invalid or expired one
+// is ignored.
+func (c *OCSPChecker) CheckStaple(chain []*x509.Certificate, staple []byte) error {
+	if len(chain) < 2 || len(staple) == 0 {
+		return nil
+	}
+	cert, issuer := chain[0], chain[1]
+
+	resp, err := parseResponse(staple, cert, issuer)
+	if err != nil {
+		c.metrics.RecordRevocationCheckError("ocsp", "invalid_staple")
+		return nil
+	}
+	if resp.Status == ocsp.Revoked {
+		c.metrics.RecordRevocationHit("ocsp", "staple")
+		return fmt.Errorf("%w: serial %s revoked according to stapled OCSP response", ErrRevoked, cert.SerialNumber)
+	}
+	// An expired staple must not delay querying the responder
+	if !resp.NextUpdate.IsZero() && c.now().After(resp.NextUpdate) {
+		c.metrics.RecordRevocationCheckError("ocsp", "stale_staple")
+		return nil
+	}
+
+	entry := c.entry(cert, issuer)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	// Prefer the staple only if it is newer than what we have
+	if entry.resp == nil || resp.ThisUpdate.After(entry.resp.ThisUpdate) {
+		c.store(entry, resp)
+	}
+	return nil
+}
+
+// Response returns a current OCSP response for cert, querying the responder
+// if the cached response has expired. It is used to staple responses.
+func (c *OCSPChecker) Response(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	resp, fresh, err := c.load(cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, fmt.Errorf("OCSP response for serial %s is stale", cert.SerialNumber)
+	}
+	return resp, nil
+}
+
+// checkCertificate checks the status of cert as reported by issuer's responder
+func (c *OCSPChecker) checkCertificate(cert, issuer *x509.Certificate) error {
+	resp, fresh, err := c.load(cert, issuer)
+	if err == errNoResponder {
+		return nil
+	}
+
+	var unavailable error
+	switch {
+	case err != nil:
+		c.metrics.RecordRevocationCheckError("ocsp", "fetch_failed")
+		unavailable = err
+	case resp.Status == ocsp.Revoked:
+		// A stale response still proves revocation
+		c.metrics.RecordRevocationHit("ocsp", responder(cert))
+		return fmt.Errorf("%w: serial %s revoked according to OCSP", ErrRevoked, cert.SerialNumber)
+	case !fresh:
+		c.metrics.RecordRevocationCheckError("ocsp", "stale_response")
+		unavailable = fmt.Errorf("OCSP response for serial %s is stale", cert.SerialNumber)
+	case resp.Status != ocsp.Good:
+		c.metrics.RecordRevocationCheckError("ocsp", "unknown_status")
+		unavailable = fmt.Errorf("OCSP status of serial %s is unknown", cert.SerialNumber)
+	default:
+		return nil
+	}
+
+	if c.config.FailOpen {
+		c.metrics.RecordRevocationCheckError("ocsp", "fail_open")
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrUnavailable, unavailable)
+}
+
+// errNoResponder marks a certificate without an OCSP responder or cached response
+var errNoResponder = errors.New("no OCSP responder")
+
+// load returns the cached response for cert, querying the responder once
+// it passes its NextUpdate. fresh reports whether the response is current.
+func (c *OCSPChecker) load(cert, issuer *x509.Certificate) (resp *ocsp.Response, fresh bool, err error) {
+	entry := c.entry(cert, issuer)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	now := c.now()
+	if !now.Before(entry.nextFetch) {
+		if responder(cert) == "" {
+			if entry.resp == nil {
+				return nil, false, errNoResponder
+			}
+		} else if resp, err := c.fetch(cert, issuer); err != nil {
+			// Keep any previous response so a revocation stays visible
+			entry.err = err
+			entry.nextFetch = now.Add(retryInterval)
+		} else {
+			c.store(entry, resp)
+		}
+	}
+	if entry.resp == nil {
+		return nil, false, entry.err
+	}
+
+	return entry.resp, !now.After(entry.expires), nil
+}
+
+// entry returns the cache entry for cert
+func (c *OCSPChecker) entry(cert, issuer *x509.Certificate) *ocspEntry {
+	sum := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	key := hex.EncodeToString(sum[:]) + "/" + cert.SerialNumber.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		// Short-lived SVIDs leave many dead entries behind; start over
+		// rather than growing without bound
+		if len(c.entries) >= maxOCSPEntries {
+			c.entries = make(map[string]*ocspEntry)
+		}
+		entry = &ocspEntry{}
+		c.entries[key] = entry
+	}
+	return entry
+}
+
+// store caches resp in entry until its NextUpdate. The caller holds entry.mu.
+func (c *OCSPChecker) store(entry *ocspEntry, resp *ocsp.Response) {
+	now := c.now()
+
+	entry.resp = resp
+	entry.err = nil
+	entry.expires = resp.NextUpdate
+	if entry.expires.IsZero() {
+		entry.expires = now.Add(c.config.RefreshInterval)
+	}
+
+	// Don't query the responder for a stale response on every check
+	entry.nextFetch = entry.expires
+	if entry.nextFetch.Before(now.Add(retryInterval)) {
+		entry.nextFetch = now.Add(retryInterval)
+	}
+}
+
+// fetch queries the OCSP responder of cert
+func (c *OCSPChecker) fetch(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP request: %v", err)
+	}
+
+	url := responder(cert)
+	httpResp, err := c.client.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query OCSP responder %s: %v", url, err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query OCSP responder %s: status %d", url, httpResp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCSP response from %s: %v", url, err)
+	}
+
+	resp, err := parseResponse(body, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response from %s: %v", url, err)
+	}
+	return resp, nil
+}
+
+// parseResponse parses and verifies an OCSP response for cert. Delegated
+// responder certificates must carry the OCSP signing extended key usage.
+func parseResponse(der []byte, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Certificate != nil && !resp.Certificate.Equal(issuer) {
+		delegated := false
+		for _, usage := range resp.Certificate.ExtKeyUsage {
+			if usage == x509.ExtKeyUsageOCSPSigning {
+				delegated = true
+				break
+			}
+		}
+		if !delegated {
+			return nil, fmt.Errorf("responder certificate is not authorized for OCSP signing")
+		}
+	}
+
+	return resp, nil
+}
+
+// responder returns the first HTTP OCSP responder of cert
+func responder(cert *x509.Certificate) string {
+	for _, url := range cert.OCSPServer {
+		if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+			return url
+		}
+	}
+	return ""
+}
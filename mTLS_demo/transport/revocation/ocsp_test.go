@@ -0,0 +1,248 @@
+package revocation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPChecker_Check(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+
+	good := ca.IssueSVID(t, "spiffe://example.org/good", spiffetest.WithOCSPServer(responder.URL))
+	revoked := ca.IssueSVID(t, "spiffe://example.org/revoked", spiffetest.WithOCSPServer(responder.URL))
+	responder.Revoke(revoked.Certificate)
+
+	checker, err := NewOCSPChecker(&OCSPConfig{})
+	assert.NoError(t, err)
+
+	// Responses are cached until their next update
+	assert.NoError(t, checker.Check(chain(ca, good)))
+	assert.NoError(t, checker.Check(chain(ca, good)))
+	assert.Equal(t, 1, responder.Requests())
+
+	assert.ErrorIs(t, checker.Check(chain(ca, revoked)), ErrRevoked)
+
+	// Certificates without a responder are not checked
+	assert.NoError(t, checker.Check(chain(ca, ca.IssueSVID(t, "spiffe://example.org/none"))))
+
+	// The response is queried again once it expires
+	responder.SetValidity(3 * time.Hour)
+	checker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.NoError(t, checker.Check(chain(ca, good)))
+	assert.Equal(t, 3, responder.Requests())
+}
+
+func TestOCSPChecker_FailureModes(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+	responder.SetValidity(-time.Minute)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	unreachable := ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithOCSPServer(server.URL))
+	stale := ca.IssueSVID(t, "spiffe://example.org/b", spiffetest.WithOCSPServer(responder.URL))
+
+	tests := []struct {
+		name     string
+		failOpen bool
+		svid     *spiffetest.SVID
+		wantErr  bool
+	}{
+		{name: "Unreachable fail closed", svid: unreachable, wantErr: true},
+		{name: "Unreachable fail open", failOpen: true, svid: unreachable},
+		{name: "Stale fail closed", svid: stale, wantErr: true},
+		{name: "Stale fail open", failOpen: true, svid: stale},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := NewOCSPChecker(&OCSPConfig{FailOpen: tt.failOpen})
+			assert.NoError(t, err)
+
+			err = checker.Check(chain(ca, tt.svid))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrUnavailable)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestOCSPChecker_CheckStaple(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+	otherCA := spiffetest.NewCA(t, "example.org")
+
+	good := ca.IssueSVID(t, "spiffe://example.org/good", spiffetest.WithOCSPServer(responder.URL))
+	revoked := ca.IssueSVID(t, "spiffe://example.org/revoked")
+	responder.Revoke(revoked.Certificate)
+
+	checker, err := NewOCSPChecker(&OCSPConfig{})
+	assert.NoError(t, err)
+
+	// A good staple is used instead of querying the responder
+	assert.NoError(t, checker.CheckStaple(chain(ca, good), responder.Staple(t, good.Certificate)))
+	assert.NoError(t, checker.Check(chain(ca, good)))
+	assert.Equal(t, 0, responder.Requests())
+
+	// A revoked staple rejects the certificate
+	assert.ErrorIs(t, checker.CheckStaple(chain(ca, revoked), responder.Staple(t, revoked.Certificate)), ErrRevoked)
+
+	// A staple signed by another CA is ignored
+	forged := otherCA.NewOCSPResponder(t).Staple(t, revoked.Certificate)
+	assert.NoError(t, checker.CheckStaple(chain(ca, revoked), forged))
+	assert.NoError(t, checker.Check(chain(ca, revoked)))
+
+	// An expired staple is ignored and the responder is queried
+	expiring := ca.IssueSVID(t, "spiffe://example.org/expiring", spiffetest.WithOCSPServer(responder.URL))
+	responder.SetValidity(-time.Minute)
+	expired := responder.Staple(t, expiring.Certificate)
+	responder.SetValidity(time.Hour)
+	assert.NoError(t, checker.CheckStaple(chain(ca, expiring), expired))
+	assert.NoError(t, checker.Check(chain(ca, expiring)))
+	assert.Equal(t, 1, responder.Requests())
+}
+
+func TestStapler_Handshake(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+	server := ca.IssueSVID(t, "spiffe://example.org/server", spiffetest.WithOCSPServer(responder.URL))
+
+	serverChecker, err := NewOCSPChecker(&OCSPConfig{})
+	assert.NoError(t, err)
+
+	cert := server.TLSCertificate()
+	stapler := NewStapler(serverChecker, func() (*tls.Certificate, error) { return &cert, nil }, spiffe.NewMemoryBundleSource(ca.Roots()))
+	assert.NoError(t, stapler.Refresh())
+	assert.Equal(t, 1, responder.Requests())
+
+	stapled, err := stapler.GetCertificate(nil)
+	assert.NoError(t, err)
+	resp, err := ocsp.ParseResponseForCert(stapled.OCSPStaple, server.Certificate, ca.Certificate)
+	assert.NoError(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+
+	// Serve the stapled certificate
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.Listener = tls.NewListener(ts.Listener, &tls.Config{GetCertificate: stapler.GetCertificate})
+	ts.Start()
+	defer ts.Close()
+
+	// The client checks the staple without contacting the responder
+	clientChecker, err := NewOCSPChecker(&OCSPConfig{})
+	assert.NoError(t, err)
+
+	// The SVID has no DNS SAN, so the client verifies the chain itself
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Certificate)
+	checkRevocation := VerifyConnection(MultiChecker{clientChecker})
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			chains, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{Roots: roots})
+			if err != nil {
+				return err
+			}
+			state.VerifiedChains = chains
+			return checkRevocation(state)
+		},
+	}}}
+
+	url := "https://" + ts.Listener.Addr().String()
+	httpResp, err := client.Get(url)
+	assert.NoError(t, err)
+	if err == nil {
+		httpResp.Body.Close()
+	}
+	assert.Equal(t, 1, responder.Requests())
+
+	// A revoked staple fails the handshake
+	responder.Revoke(server.Certificate)
+	responder.SetValidity(3 * time.Hour)
+	serverChecker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	assert.NoError(t, stapler.Refresh())
+	client.CloseIdleConnections()
+
+	_, err = client.Get(url)
+	assert.Error(t, err)
+}
+
+func TestStapler_Rotation(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	responder := ca.NewOCSPResponder(t)
+	newCA := spiffetest.NewCA(t, "example.org")
+	newResponder := newCA.NewOCSPResponder(t)
+
+	first := ca.IssueSVID(t, "spiffe://example.org/server", spiffetest.WithOCSPServer(responder.URL))
+	second := ca.IssueSVID(t, "spiffe://example.org/server", spiffetest.WithOCSPServer(responder.URL))
+	third := newCA.IssueSVID(t, "spiffe://example.org/server", spiffetest.WithOCSPServer(newResponder.URL))
+
+	// The source rotates the certificate without telling the stapler
+	var mu sync.Mutex
+	current := first.TLSCertificate()
+	rotate := func(svid *spiffetest.SVID) {
+		mu.Lock()
+		defer mu.Unlock()
+		current = svid.TLSCertificate()
+	}
+	source := func() (*tls.Certificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		cert := current
+		return &cert, nil
+	}
+
+	checker, err := NewOCSPChecker(&OCSPConfig{})
+	assert.NoError(t, err)
+	bundle := spiffe.NewMemoryBundleSource(ca.Roots())
+	stapler := NewStapler(checker, source, bundle)
+	assert.NoError(t, stapler.Refresh())
+
+	served := func() *tls.Certificate {
+		cert, err := stapler.GetCertificate(nil)
+		assert.NoError(t, err)
+		return cert
+	}
+	assert.True(t, served().Leaf.Equal(first.Certificate))
+	assert.NotEmpty(t, served().OCSPStaple)
+
+	// A rotated certificate is served on the next handshake and stapled in
+	// the background
+	rotate(second)
+	cert := served()
+	assert.Equal(t, second.Certificate.Raw, cert.Certificate[0])
+	assert.Empty(t, cert.OCSPStaple)
+	assert.Eventually(t, func() bool {
+		cert := served()
+		return cert.Leaf != nil && cert.Leaf.Equal(second.Certificate) && len(cert.OCSPStaple) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The issuer of a certificate from a CA added to the bundle later is
+	// found in the current bundle
+	rotate(third)
+	assert.Error(t, stapler.Refresh())
+	bundle.SetRoots(append(ca.Roots(), newCA.Roots()...))
+	assert.NoError(t, stapler.Refresh())
+
+	resp, err := ocsp.ParseResponseForCert(served().OCSPStaple, third.Certificate, newCA.Certificate)
+	assert.NoError(t, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+}
@@ -0,0 +1,81 @@
+// Package revocation checks X.509 certificate chains for revocation.
+package revocation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrRevoked is returned when a certificate in the chain has been revoked
+	ErrRevoked = errors.New("certificate revoked")
+	// ErrUnavailable is returned by a fail-closed checker when revocation
+	// status could not be determined
+	ErrUnavailable = errors.New("revocation status unavailable")
+)
+
+// Checker checks a verified certificate chain for revocation
+type Checker interface {
+	// Check checks every certificate in chain against its issuer. The chain
+	// is ordered leaf first and ends at the trust anchor.
+	Check(chain []*x509.Certificate) error
+}
+
+// StapleChecker is implemented by checkers that can use an OCSP response
+// stapled by the peer for the leaf certificate
+type StapleChecker interface {
+	// CheckStaple checks the stapled response for chain[0], issued by
+	// chain[1]. It is called before Check on the same chain.
+	CheckStaple(chain []*x509.Certificate, staple []byte) error
+}
+
+// MultiChecker runs several checkers; a chain must pass all of them
+type MultiChecker []Checker
+
+// Check implements Checker
+func (m MultiChecker) Check(chain []*x509.Certificate) error {
+	for _, checker := range m {
+		if err := checker.Check(chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckStaple implements StapleChecker
+func (m MultiChecker) CheckStaple(chain []*x509.Certificate, staple []byte) error {
+	for _, checker := range m {
+		if err := CheckStaple(checker, chain, staple); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckStaple passes a stapled OCSP response to checker if it supports staples
+func CheckStaple(checker Checker, chain []*x509.Certificate, staple []byte) error {
+	stapleChecker, ok := checker.(StapleChecker)
+	if !ok || len(staple) == 0 {
+		return nil
+	}
+	return stapleChecker.CheckStaple(chain, staple)
+}
+
+// VerifyConnection returns a tls.Config VerifyConnection callback that
+// checks every verified peer chain, and any stapled OCSP response, with
+// checker
+func VerifyConnection(checker Checker) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			if err := CheckStaple(checker, chain, state.OCSPResponse); err != nil {
+				return fmt.Errorf("peer certificate rejected: %w", err)
+			}
+			if err := checker.Check(chain); err != nil {
+				return fmt.Errorf("peer certificate rejected: %w", err)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,160 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/spiffe"
+)
+
+// Stapler attaches OCSP responses to a serving certificate. The certificate
+// is read from source on every handshake: a rotated certificate is served
+// right away, without a staple, while a staple for it is fetched in the
+// background.
+type Stapler struct {
+	checker *OCSPChecker
+	source  func() (*tls.Certificate, error)
+	issuers spiffe.BundleSource
+
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	expires    time.Time
+	refreshing bool
+}
+
+// NewStapler creates a stapler for the certificate returned by source.
+// issuers provides CA certificates, typically the trust bundle, used to
+// find the issuer of a leaf that is served without intermediates. It is
+// read on every refresh, so CAs added to the bundle are picked up.
+func NewStapler(checker *OCSPChecker, source func() (*tls.Certificate, error), issuers spiffe.BundleSource) *Stapler {
+	return &Stapler{
+		checker: checker,
+		source:  source,
+		issuers: issuers,
+	}
+}
+
+// Refresh reloads the certificate from source and fetches a new staple for
+// it. If the staple cannot be fetched the certificate is still served,
+// keeping the previous staple when the leaf is unchanged.
+func (s *Stapler) Refresh() error {
+	cert, err := s.source()
+	if err != nil {
+		return fmt.Errorf("failed to get certificate: %v", err)
+	}
+
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("certificate has no leaf")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse certificate: %v", err)
+		}
+	}
+
+	stapled := *cert
+	stapled.Leaf = leaf
+
+	var expires time.Time
+	var stapleErr error
+	if issuer, err := s.findIssuer(leaf, cert.Certificate[1:]); err != nil {
+		stapleErr = err
+	} else if resp, err := s.checker.Response(leaf, issuer); err != nil {
+		stapleErr = err
+	} else {
+		stapled.OCSPStaple = resp.Raw
+		expires = resp.NextUpdate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the previous staple while it is still valid
+	if stapleErr != nil && s.cert != nil && s.cert.Leaf.Equal(leaf) && time.Now().Before(s.expires) {
+		stapled.OCSPStaple = s.cert.OCSPStaple
+		expires = s.expires
+	}
+	s.cert = &stapled
+	s.expires = expires
+
+	if stapleErr != nil {
+		return fmt.Errorf("failed to staple OCSP response: %v", stapleErr)
+	}
+	return nil
+}
+
+// Run refreshes the staple every interval until ctx is cancelled
+func (s *Stapler) Run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// GetCertificate returns the stapled certificate. It can be used as
+// tls.Config.GetCertificate. If source has rotated the certificate since
+// the last refresh, the new certificate is returned unstapled and a refresh
+// is started in the background.
+func (s *Stapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	current, err := s.source()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cert != nil && len(current.Certificate) > 0 && bytes.Equal(s.cert.Certificate[0], current.Certificate[0]) {
+		return s.cert, nil
+	}
+
+	// Errors are reported by the next refresh of Run
+	if !s.refreshing {
+		s.refreshing = true
+		go func() {
+			s.Refresh()
+
+			s.mu.Lock()
+			s.refreshing = false
+			s.mu.Unlock()
+		}()
+	}
+	return current, nil
+}
+
+// findIssuer returns the certificate that signed leaf
+func (s *Stapler) findIssuer(leaf *x509.Certificate, chain [][]byte) (*x509.Certificate, error) {
+	var candidates []*x509.Certificate
+	if s.issuers != nil {
+		if bundle, err := s.issuers.Bundle(); err == nil {
+			candidates = append(candidates, bundle.Roots...)
+		}
+	}
+	for _, der := range chain {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			candidates = append([]*x509.Certificate{cert}, candidates...)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if leaf.CheckSignatureFrom(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("issuer of certificate %s not found", leaf.SerialNumber)
+}
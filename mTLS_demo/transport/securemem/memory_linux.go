@@ -0,0 +1,52 @@
+//go:build linux
+
+package securemem
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocLocked maps anonymous memory for size bytes, locks it into RAM and
+// excludes it from core dumps
+func allocLocked(size int) ([]byte, error) {
+	pageSize := os.Getpagesize()
+	length := (size + pageSize - 1) / pageSize * pageSize
+
+	mem, err := unix.Mmap(-1, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("mmap failed: %v", err)
+	}
+
+	if err := unix.Mlock(mem); err != nil {
+		unix.Munmap(mem)
+		return nil, fmt.Errorf("mlock failed: %v", err)
+	}
+
+	if err := unix.Madvise(mem, unix.MADV_DONTDUMP); err != nil {
+		unix.Munlock(mem)
+		unix.Munmap(mem)
+		return nil, fmt.Errorf("madvise failed: %v", err)
+	}
+
+	return mem, nil
+}
+
+// freeLocked unlocks and unmaps memory returned by allocLocked
+func freeLocked(mem []byte) {
+	mem = mem[:cap(mem)]
+	unix.Munlock(mem)
+	unix.Munmap(mem)
+}
+
+// DisableCoreDumps marks the process non-dumpable, so it produces no core
+// dumps and other processes of the same user cannot attach to it or read
+// its memory through /proc
+func DisableCoreDumps() error {
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to mark process non-dumpable: %v", err)
+	}
+	return nil
+}
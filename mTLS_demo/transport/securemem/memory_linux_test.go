@@ -0,0 +1,18 @@
+//go:build linux
+
+package securemem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestDisableCoreDumps(t *testing.T) {
+	assert.NoError(t, DisableCoreDumps())
+
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dumpable)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package securemem
+
+import "fmt"
+
+// allocLocked allocates ordinary memory; locking is only implemented on Linux
+func allocLocked(size int) ([]byte, error) {
+	return make([]byte, size), nil
+}
+
+// freeLocked releases memory returned by allocLocked
+func freeLocked([]byte) {}
+
+// DisableCoreDumps is only implemented on Linux
+func DisableCoreDumps() error {
+	return fmt.Errorf("marking the process non-dumpable is not supported on this platform")
+}
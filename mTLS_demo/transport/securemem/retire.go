@@ -0,0 +1,89 @@
+package securemem
+
+import (
+	"crypto"
+	"sync"
+	"time"
+)
+
+// DefaultRetireDelay is how long a key rotated out of use stays usable
+// before it is wiped. Handshakes that picked up the previous certificate,
+// and caches that serve it until they refresh, finish within it.
+const DefaultRetireDelay = time.Minute
+
+// Retirer wipes keys that were rotated out once a grace period has passed.
+// A certificate getter may have handed out the previous certificate just
+// before a rotation, and its handshake still needs the key to sign.
+type Retirer struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]crypto.PrivateKey
+	timers  map[uint64]*time.Timer
+}
+
+// NewRetirer creates a retirer that wipes keys after delay. A delay of zero
+// or less wipes them right away.
+func NewRetirer(delay time.Duration) *Retirer {
+	return &Retirer{
+		delay:   delay,
+		pending: make(map[uint64]crypto.PrivateKey),
+		timers:  make(map[uint64]*time.Timer),
+	}
+}
+
+// Retire schedules key to be wiped with Zero once the grace period has
+// passed
+func (r *Retirer) Retire(key crypto.PrivateKey) {
+	if key == nil {
+		return
+	}
+	if r.delay <= 0 {
+		Zero(key)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := r.next
+	r.next++
+	r.pending[id] = key
+	r.timers[id] = time.AfterFunc(r.delay, func() { r.expire(id) })
+}
+
+// Flush wipes every retired key right away, for example on Close
+func (r *Retirer) Flush() {
+	r.mu.Lock()
+	pending := r.pending
+	timers := r.timers
+	r.pending = make(map[uint64]crypto.PrivateKey)
+	r.timers = make(map[uint64]*time.Timer)
+	r.mu.Unlock()
+
+	for id, key := range pending {
+		timers[id].Stop()
+		Zero(key)
+	}
+}
+
+// Pending returns the number of retired keys not wiped yet
+func (r *Retirer) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// expire wipes a retired key whose grace period has passed
+func (r *Retirer) expire(id uint64) {
+	r.mu.Lock()
+	key, ok := r.pending[id]
+	delete(r.pending, id)
+	delete(r.timers, id)
+	r.mu.Unlock()
+
+	if ok {
+		Zero(key)
+	}
+}
@@ -0,0 +1,66 @@
+package securemem
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSigner(t *testing.T) *Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	signer, err := NewSigner(key)
+	assert.NoError(t, err)
+	return signer
+}
+
+func TestRetirer_Retire(t *testing.T) {
+	digest := sha256.Sum256([]byte("message"))
+	retirer := NewRetirer(50 * time.Millisecond)
+
+	// The key stays usable during the grace period
+	signer := newTestSigner(t)
+	retirer.Retire(signer)
+	_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retirer.Pending())
+
+	// and is wiped afterwards
+	assert.Eventually(t, func() bool {
+		_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, retirer.Pending())
+}
+
+func TestRetirer_Flush(t *testing.T) {
+	digest := sha256.Sum256([]byte("message"))
+	retirer := NewRetirer(time.Hour)
+
+	first := newTestSigner(t)
+	second := newTestSigner(t)
+	retirer.Retire(first)
+	retirer.Retire(second)
+	retirer.Retire(nil)
+	assert.Equal(t, 2, retirer.Pending())
+
+	// Flushing wipes every retired key right away
+	retirer.Flush()
+	assert.Equal(t, 0, retirer.Pending())
+	for _, signer := range []*Signer{first, second} {
+		_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		assert.ErrorIs(t, err, ErrDestroyed)
+	}
+
+	// Without a grace period, keys are wiped right away
+	signer := newTestSigner(t)
+	NewRetirer(0).Retire(signer)
+	_, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.ErrorIs(t, err, ErrDestroyed)
+}
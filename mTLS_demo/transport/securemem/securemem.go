@@ -0,0 +1,216 @@
+// Package securemem keeps private keys outside the Go heap in memory that is
+// locked into RAM, excluded from core dumps and wiped when released.
+package securemem
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+)
+
+var (
+	// ErrDestroyed is returned when a destroyed buffer or signer is used
+	ErrDestroyed = errors.New("secure memory has been destroyed")
+	// ErrNotExportable is returned for signers whose key material cannot be
+	// read, such as hardware-backed keys
+	ErrNotExportable = errors.New("private key cannot be exported")
+)
+
+// Buffer holds bytes in locked memory. The contents are zeroed and the
+// memory released by Destroy.
+type Buffer struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewBuffer copies data into newly allocated locked memory
+func NewBuffer(data []byte) (*Buffer, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("buffer cannot be empty")
+	}
+
+	mem, err := allocLocked(len(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate locked memory: %v", err)
+	}
+	copy(mem, data)
+
+	return &Buffer{data: mem[:len(data)]}, nil
+}
+
+// Use calls fn with the buffer contents. fn must not retain the slice.
+func (b *Buffer) Use(fn func([]byte) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.data == nil {
+		return ErrDestroyed
+	}
+	return fn(b.data)
+}
+
+// Destroy zeroes the contents and releases the memory. It waits for calls
+// to Use to return and is safe to call more than once.
+func (b *Buffer) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data == nil {
+		return
+	}
+	Wipe(b.data)
+	freeLocked(b.data)
+	b.data = nil
+}
+
+// Signer is a crypto.Signer whose private key is kept PKCS#8 encoded in a
+// Buffer. The key is decoded for each signature and the decoded copy
+// zeroed afterwards. Copies made inside the Go crypto packages are out of
+// reach, so that last step is best effort.
+type Signer struct {
+	public crypto.PublicKey
+	der    *Buffer
+}
+
+// NewSigner copies an RSA, ECDSA or Ed25519 private key, or another Signer,
+// into locked memory. The caller remains responsible for key; Zero can be
+// used to wipe it once it is no longer needed.
+func NewSigner(key crypto.Signer) (*Signer, error) {
+	if s, ok := key.(*Signer); ok {
+		var copied *Signer
+		err := s.der.Use(func(der []byte) error {
+			buf, err := NewBuffer(der)
+			if err != nil {
+				return err
+			}
+			copied = &Signer{public: s.public, der: buf}
+			return nil
+		})
+		return copied, err
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrNotExportable, key)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %v", err)
+	}
+	defer Wipe(der)
+
+	buf, err := NewBuffer(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Signer{public: key.Public(), der: buf}, nil
+}
+
+// Public implements crypto.Signer
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var signature []byte
+	err := s.der.Use(func(der []byte) error {
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return fmt.Errorf("failed to decode private key: %v", err)
+		}
+		defer Zero(key)
+
+		signature, err = key.(crypto.Signer).Sign(rand, digest, opts)
+		return err
+	})
+	return signature, err
+}
+
+// Destroy zeroes the key and releases its memory. Signing fails afterwards.
+func (s *Signer) Destroy() {
+	s.der.Destroy()
+}
+
+// ParsePrivateKeyPEM parses a PKCS#8, PKCS#1 or SEC 1 PEM encoded private
+// key. The decoded DER is wiped before returning.
+func ParsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	defer Wipe(block.Bytes)
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T cannot sign", key)
+	}
+	return signer, nil
+}
+
+// Zero overwrites the private values of an RSA, ECDSA or Ed25519 key in
+// place. Other key types are left untouched.
+func Zero(key crypto.PrivateKey) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		zeroInt(k.D)
+		for _, prime := range k.Primes {
+			zeroInt(prime)
+		}
+		zeroInt(k.Precomputed.Dp)
+		zeroInt(k.Precomputed.Dq)
+		zeroInt(k.Precomputed.Qinv)
+	case *ecdsa.PrivateKey:
+		zeroInt(k.D)
+	case ed25519.PrivateKey:
+		Wipe(k)
+	case *Signer:
+		k.Destroy()
+	}
+}
+
+// zeroInt overwrites the words backing n
+func zeroInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
+
+// Wipe overwrites b with zeros, for example PEM data read from a file
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
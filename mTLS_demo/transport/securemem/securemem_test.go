@@ -0,0 +1,158 @@
+package securemem
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigner_KeyTypes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	digest := sha256.Sum256([]byte("message"))
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		digest []byte
+		opts   crypto.SignerOpts
+		verify func(pub crypto.PublicKey, signature []byte) bool
+	}{
+		{
+			name:   "RSA PKCS#1 v1.5",
+			key:    rsaKey,
+			digest: digest[:],
+			opts:   crypto.SHA256,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+			},
+		},
+		{
+			name:   "RSA PSS",
+			key:    rsaKey,
+			digest: digest[:],
+			opts:   &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256},
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return rsa.VerifyPSS(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature, nil) == nil
+			},
+		},
+		{
+			name:   "ECDSA",
+			key:    ecdsaKey,
+			digest: digest[:],
+			opts:   crypto.SHA256,
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], signature)
+			},
+		},
+		{
+			name:   "Ed25519",
+			key:    ed25519Key,
+			digest: []byte("message"),
+			opts:   crypto.Hash(0),
+			verify: func(pub crypto.PublicKey, signature []byte) bool {
+				return ed25519.Verify(pub.(ed25519.PublicKey), []byte("message"), signature)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigner(tt.key)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.key.Public(), signer.Public())
+
+			signature, err := signer.Sign(rand.Reader, tt.digest, tt.opts)
+			assert.NoError(t, err)
+			assert.True(t, tt.verify(signer.Public(), signature))
+
+			// A copy outlives the signer it was made from
+			copied, err := NewSigner(signer)
+			assert.NoError(t, err)
+			signer.Destroy()
+
+			_, err = signer.Sign(rand.Reader, tt.digest, tt.opts)
+			assert.ErrorIs(t, err, ErrDestroyed)
+
+			signature, err = copied.Sign(rand.Reader, tt.digest, tt.opts)
+			assert.NoError(t, err)
+			assert.True(t, tt.verify(copied.Public(), signature))
+			copied.Destroy()
+		})
+	}
+}
+
+func TestSigner_NotExportable(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	_, err = NewSigner(opaqueSigner{key})
+	assert.ErrorIs(t, err, ErrNotExportable)
+}
+
+func TestBuffer_Destroy(t *testing.T) {
+	buf, err := NewBuffer([]byte("secret"))
+	assert.NoError(t, err)
+
+	assert.NoError(t, buf.Use(func(data []byte) error {
+		assert.Equal(t, []byte("secret"), data)
+		return nil
+	}))
+
+	buf.Destroy()
+	buf.Destroy()
+	assert.ErrorIs(t, buf.Use(func([]byte) error { return nil }), ErrDestroyed)
+}
+
+func TestZero(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// Keep the backing words to check they were overwritten in place
+	rsaWords := rsaKey.D.Bits()
+	ecdsaWords := ecdsaKey.D.Bits()
+
+	Zero(rsaKey)
+	Zero(ecdsaKey)
+	Zero(ed25519Key)
+
+	assert.Zero(t, rsaKey.D.Sign())
+	for _, prime := range rsaKey.Primes {
+		assert.Zero(t, prime.Sign())
+	}
+	assert.Zero(t, ecdsaKey.D.Sign())
+	for _, word := range append(rsaWords, ecdsaWords...) {
+		assert.Zero(t, word)
+	}
+	assert.Equal(t, make(ed25519.PrivateKey, ed25519.PrivateKeySize), ed25519Key)
+}
+
+// opaqueSigner hides the type of the key it wraps, like a hardware signer
+type opaqueSigner struct {
+	key crypto.Signer
+}
+
+func (s opaqueSigner) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+func (s opaqueSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.key.Sign(rand, digest, opts)
+}
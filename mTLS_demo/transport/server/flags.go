@@ -0,0 +1,67 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Flags holds the listener addresses and file paths of a secure server.
+// Each flag defaults to an environment variable, so the same settings can
+// come from the command line or a deployment manifest.
+type Flags struct {
+	// Addr is the mTLS listener address (-addr, SERVER_ADDR)
+	Addr string
+	// OpsAddr is the health and metrics listener address (-ops-addr,
+	// OPS_ADDR)
+	OpsAddr string
+	// CertFile, KeyFile and BundleFile name PEM files written by another
+	// process, such as spiffe-helper. When unset, the SVID is streamed from
+	// the Workload API (-cert-file, TLS_CERT_FILE, -key-file, TLS_KEY_FILE,
+	// -bundle-file, TLS_BUNDLE_FILE).
+	CertFile   string
+	KeyFile    string
+	BundleFile string
+	// CRLFile is an optional CRL for client certificates (-crl-file,
+	// CRL_FILE)
+	CRLFile string
+	// WorkloadAPIAddr is the Workload API address (-workload-api,
+	// SPIFFE_ENDPOINT_SOCKET)
+	WorkloadAPIAddr string
+}
+
+// Register defines the flags on fs
+func (f *Flags) Register(fs *flag.FlagSet) {
+	fs.StringVar(&f.Addr, "addr", env("SERVER_ADDR", defaultAddr), "mTLS listener address")
+	fs.StringVar(&f.OpsAddr, "ops-addr", env("OPS_ADDR", defaultOpsAddr), "health and metrics listener address")
+	fs.StringVar(&f.CertFile, "cert-file", env("TLS_CERT_FILE", ""), "PEM certificate chain; the Workload API is used when unset")
+	fs.StringVar(&f.KeyFile, "key-file", env("TLS_KEY_FILE", ""), "PEM private key of -cert-file")
+	fs.StringVar(&f.BundleFile, "bundle-file", env("TLS_BUNDLE_FILE", ""), "PEM trust bundle used with -cert-file")
+	fs.StringVar(&f.CRLFile, "crl-file", env("CRL_FILE", ""), "optional CRL for client certificates")
+	fs.StringVar(&f.WorkloadAPIAddr, "workload-api", env("SPIFFE_ENDPOINT_SOCKET", ""), "Workload API address")
+}
+
+// Validate checks that the flags are consistent
+func (f *Flags) Validate() error {
+	if f.Addr == "" || f.OpsAddr == "" {
+		return fmt.Errorf("listener addresses cannot be empty")
+	}
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return fmt.Errorf("certificate and key files must be set together")
+	}
+	if f.CertFile != "" && f.BundleFile == "" {
+		return fmt.Errorf("a bundle file is required with certificate files")
+	}
+	if f.Addr == f.OpsAddr {
+		return fmt.Errorf("mTLS and operations listeners must use different addresses")
+	}
+	return nil
+}
+
+// env returns the environment variable key, or fallback when it is unset
+func env(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,189 @@
+// Package server bootstraps an HTTPS server that requires client
+// certificates, runs every application request through an authentication
+// chain and serves health checks and metrics on a separate plain listener.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"mTLS_demo/transport/mtls"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	defaultAddr              = ":8443"
+	defaultOpsAddr           = ":8080"
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+)
+
+// Config configures a Server
+type Config struct {
+	// Addr is the address of the mTLS listener. It defaults to ":8443".
+	Addr string
+	// OpsAddr is the address of the listener serving /health and /metrics
+	// without client certificates. It defaults to ":8080".
+	OpsAddr string
+	// Source provides the server certificate and the bundle client
+	// certificates are verified against
+	Source mtls.CertificateSource
+	// TLSConfig optionally supplies further TLS settings, such as a
+	// VerifyConnection callback or a stapling GetCertificate
+	TLSConfig *tls.Config
+	// Auth is the authentication chain every application request goes
+	// through
+	Auth func(http.Handler) http.Handler
+	// Handler serves the application routes
+	Handler http.Handler
+	// Health optionally reports whether the service is healthy. The server
+	// is unhealthy without a certificate regardless.
+	Health func() error
+}
+
+// Server is a secure HTTPS server with a separate operations listener
+type Server struct {
+	config Config
+	server *http.Server
+	ops    *http.Server
+	conns  *mtls.ConnectionTracker
+}
+
+// New creates a server. Client certificates are required and verified
+// against the current bundle of the source on every handshake.
+func New(config *Config) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+	if config.Source == nil {
+		return nil, fmt.Errorf("certificate source is required")
+	}
+	if config.Handler == nil {
+		return nil, fmt.Errorf("handler is required")
+	}
+	if config.Auth == nil {
+		return nil, fmt.Errorf("authentication chain is required")
+	}
+
+	s := &Server{
+		config: *config,
+		conns:  mtls.NewConnectionTracker(),
+	}
+	if s.config.Addr == "" {
+		s.config.Addr = defaultAddr
+	}
+	if s.config.OpsAddr == "" {
+		s.config.OpsAddr = defaultOpsAddr
+	}
+
+	// http.Server only adds its protocols to the listener's copy of the
+	// config, which per-connection configs are not cloned from
+	tlsConfig := mtls.ServerTLSConfig(s.config.Source, s.config.TLSConfig)
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	s.server = &http.Server{
+		Addr:              s.config.Addr,
+		Handler:           s.config.Auth(s.config.Handler),
+		TLSConfig:         tlsConfig,
+		ConnState:         s.conns.ConnState,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+
+	ops := http.NewServeMux()
+	ops.HandleFunc("/health", s.handleHealth)
+	ops.Handle("/metrics", promhttp.Handler())
+	s.ops = &http.Server{
+		Addr:              s.config.OpsAddr,
+		Handler:           ops,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+
+	return s, nil
+}
+
+// ListenAndServe listens on both addresses and serves until Shutdown is
+// called or either listener fails
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.config.Addr, err)
+	}
+
+	opsListener, err := net.Listen("tcp", s.config.OpsAddr)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen on %s: %v", s.config.OpsAddr, err)
+	}
+
+	return s.Serve(listener, opsListener)
+}
+
+// Serve serves mTLS on listener and health checks and metrics on
+// opsListener until Shutdown is called or either fails
+func (s *Server) Serve(listener, opsListener net.Listener) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- serveError("mTLS", s.server.ServeTLS(listener, "", ""))
+	}()
+	go func() {
+		errs <- serveError("operations", s.ops.Serve(opsListener))
+	}()
+
+	// A failing listener takes the other one down
+	err := <-errs
+	if err != nil {
+		s.server.Close()
+		s.ops.Close()
+	}
+	if second := <-errs; err == nil {
+		err = second
+	}
+	return err
+}
+
+// Shutdown gracefully stops both listeners
+func (s *Server) Shutdown(ctx context.Context) error {
+	return errors.Join(s.server.Shutdown(ctx), s.ops.Shutdown(ctx))
+}
+
+// Rotated closes idle client connections established with the previous
+// certificate. It should be called after every rotation.
+func (s *Server) Rotated() {
+	s.conns.Rotated()
+}
+
+// handleHealth reports whether a certificate is available and the service
+// is healthy
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.config.Source.Certificate(); err != nil {
+		http.Error(w, "Certificate error", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.config.Health != nil {
+		if err := s.config.Health(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "OK")
+}
+
+// serveError hides the error returned by a server that was shut down
+func serveError(name string, err error) error {
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return fmt.Errorf("%s listener failed: %v", name, err)
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_ClientCertificates(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	addr, _ := setupTestServer(t, &Config{Source: serverStore})
+
+	backend := spiffeid.RequireFromString("spiffe://example.org/backend")
+
+	tests := []struct {
+		name       string
+		tlsConfig  *tls.Config
+		wantStatus int
+	}{
+		{
+			name:       "Client with a certificate",
+			tlsConfig:  mtls.ClientTLSConfig(clientStore, mtls.AuthorizeID(backend), nil),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "Client without a certificate",
+			tlsConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+		{
+			name: "Client with an untrusted certificate",
+			tlsConfig: mtls.ClientTLSConfig(
+				setupTestStore(t, spiffetest.NewCA(t, "example.org").IssueSVID(t, "spiffe://example.org/frontend"), ca),
+				mtls.AuthorizeID(backend), nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create test request
+			client := setupTestClient(t, tt.tlsConfig)
+			resp, err := client.Get("https://" + addr + "/hello")
+
+			if tt.wantStatus == 0 {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				defer resp.Body.Close()
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestServer_AuthChain(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+	clientStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+
+	// Only /allowed passes the chain
+	addr, _ := setupTestServer(t, &Config{
+		Source: serverStore,
+		Auth: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/allowed" {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		},
+	})
+
+	backend := spiffeid.RequireFromString("spiffe://example.org/backend")
+	client := setupTestClient(t, mtls.ClientTLSConfig(clientStore, mtls.AuthorizeID(backend), nil))
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: "/allowed", wantStatus: http.StatusOK},
+		{path: "/denied", wantStatus: http.StatusUnauthorized},
+		// Operations routes are not served on the mTLS listener
+		{path: "/health", wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := client.Get("https://" + addr + tt.path)
+			if assert.NoError(t, err) {
+				defer resp.Body.Close()
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+				assert.Equal(t, "HTTP/2.0", resp.Proto)
+			}
+		})
+	}
+}
+
+func TestServer_OpsListener(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	serverStore := setupTestStore(t, ca.IssueSVID(t, "spiffe://example.org/backend"), ca)
+
+	healthErr := fmt.Errorf("circuit breaker open")
+	var unhealthy atomic.Bool
+	_, opsAddr := setupTestServer(t, &Config{
+		Source: serverStore,
+		Health: func() error {
+			if unhealthy.Load() {
+				return healthErr
+			}
+			return nil
+		},
+	})
+
+	client := setupTestClient(t, nil)
+	get := func(path string) (int, string) {
+		resp, err := client.Get("http://" + opsAddr + path)
+		if !assert.NoError(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Served without client certificates
+	status, _ := get("/health")
+	assert.Equal(t, http.StatusOK, status)
+	status, body := get("/metrics")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "go_goroutines")
+
+	// Application routes are not served here
+	status, _ = get("/hello")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	unhealthy.Store(true)
+	status, body = get("/health")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, healthErr.Error())
+
+	// Without a certificate the server is unhealthy
+	unhealthy.Store(false)
+	assert.NoError(t, serverStore.Close())
+	status, _ = get("/health")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestNew_InvalidConfig(t *testing.T) {
+	store := mtls.NewSecureCertificateStore("", "", "")
+	handler := http.NotFoundHandler()
+	auth := func(next http.Handler) http.Handler { return next }
+
+	tests := []struct {
+		name   string
+		config *Config
+	}{
+		{name: "Nil config", config: nil},
+		{name: "Missing source", config: &Config{Handler: handler, Auth: auth}},
+		{name: "Missing handler", config: &Config{Source: store, Auth: auth}},
+		{name: "Missing auth chain", config: &Config{Source: store, Handler: handler}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.config)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFlags(t *testing.T) {
+	t.Setenv("SERVER_ADDR", ":9443")
+	t.Setenv("TLS_CERT_FILE", "/run/spiffe/svid.pem")
+	t.Setenv("SPIFFE_ENDPOINT_SOCKET", "")
+
+	// Environment variables set the defaults, flags override them
+	var flags Flags
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Register(fs)
+	assert.NoError(t, fs.Parse([]string{"-ops-addr", ":9090", "-key-file", "/run/spiffe/svid_key.pem"}))
+
+	assert.Equal(t, Flags{
+		Addr:     ":9443",
+		OpsAddr:  ":9090",
+		CertFile: "/run/spiffe/svid.pem",
+		KeyFile:  "/run/spiffe/svid_key.pem",
+	}, flags)
+	assert.Error(t, flags.Validate())
+
+	flags.BundleFile = "/run/spiffe/bundle.pem"
+	assert.NoError(t, flags.Validate())
+}
+
+func TestFlags_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   Flags
+		wantErr bool
+	}{
+		{
+			name:  "Workload API",
+			flags: Flags{Addr: ":8443", OpsAddr: ":8080"},
+		},
+		{
+			name:  "Certificate files",
+			flags: Flags{Addr: ":8443", OpsAddr: ":8080", CertFile: "svid.pem", KeyFile: "svid_key.pem", BundleFile: "bundle.pem"},
+		},
+		{
+			name:    "Certificate without key",
+			flags:   Flags{Addr: ":8443", OpsAddr: ":8080", CertFile: "svid.pem", BundleFile: "bundle.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "Certificate files without bundle",
+			flags:   Flags{Addr: ":8443", OpsAddr: ":8080", CertFile: "svid.pem", KeyFile: "svid_key.pem"},
+			wantErr: true,
+		},
+		{
+			name:    "Shared listener address",
+			flags:   Flags{Addr: ":8443", OpsAddr: ":8443"},
+			wantErr: true,
+		},
+		{
+			name:    "Missing address",
+			flags:   Flags{OpsAddr: ":8080"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.flags.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// setupTestServer serves config on local ports until the test finishes and
+// returns the mTLS and operations addresses. Handler answers OK and Auth
+// lets every request through unless set.
+func setupTestServer(t *testing.T, config *Config) (string, string) {
+	if config.Handler == nil {
+		config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "OK")
+		})
+	}
+	if config.Auth == nil {
+		config.Auth = func(next http.Handler) http.Handler { return next }
+	}
+
+	server, err := New(config)
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	opsListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, server.Serve(listener, opsListener))
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, server.Shutdown(ctx))
+		<-done
+	})
+
+	return listener.Addr().String(), opsListener.Addr().String()
+}
+
+// setupTestClient creates a client with its own transport, offering
+// HTTP/2. Its idle
+// connections are closed when the test finishes, before the server shuts
+// down, so Shutdown does not wait for them.
+func setupTestClient(t *testing.T, tlsConfig *tls.Config) *http.Client {
+	transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+	t.Cleanup(transport.CloseIdleConnections)
+	return &http.Client{Transport: transport}
+}
+
+// setupTestStore creates a store holding svid and trusting ca
+func setupTestStore(t *testing.T, svid *spiffetest.SVID, ca *spiffetest.CA) *mtls.SecureCertificateStore {
+	store := mtls.NewSecureCertificateStore("", "", "")
+	assert.NoError(t, store.StoreX509SVID(svid.Chain, svid.PrivateKey))
+	store.SetTrustBundle(ca.Roots())
+	t.Cleanup(func() { store.Close() })
+	return store
+}
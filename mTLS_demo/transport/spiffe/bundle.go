@@ -0,0 +1,316 @@
+package spiffe
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bundle is an immutable snapshot of trusted X.509 roots
+type Bundle struct {
+	// Version increases every time the source content changes
+	Version uint64
+	Roots   []*x509.Certificate
+
+	pool *x509.CertPool
+}
+
+// newBundle creates a bundle snapshot
+func newBundle(version uint64, roots []*x509.Certificate) *Bundle {
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	return &Bundle{Version: version, Roots: roots, pool: pool}
+}
+
+// Pool returns the roots as a certificate pool
+func (b *Bundle) Pool() *x509.CertPool {
+	return b.pool
+}
+
+// Contains reports whether cert is one of the bundle roots
+func (b *Bundle) Contains(cert *x509.Certificate) bool {
+	for _, root := range b.Roots {
+		if root.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// BundleUpdate describes a change of the bundle held by a source
+type BundleUpdate struct {
+	Previous *Bundle
+	Current  *Bundle
+	Added    []*x509.Certificate
+	Removed  []*x509.Certificate
+}
+
+// BundleSource provides the current trust bundle. Callers should query it
+// on every verification so that reloads take effect immediately.
+type BundleSource interface {
+	// Bundle returns the current bundle
+	Bundle() (*Bundle, error)
+}
+
+// BundleSourceFunc adapts a function to a BundleSource
+type BundleSourceFunc func() (*Bundle, error)
+
+// Bundle implements BundleSource
+func (f BundleSourceFunc) Bundle() (*Bundle, error) {
+	return f()
+}
+
+// bundleStore holds the current bundle of a source and notifies subscribers
+// when it is replaced
+type bundleStore struct {
+	mu          sync.RWMutex
+	current     *Bundle
+	subscribers []func(BundleUpdate)
+}
+
+// Subscribe registers fn to be called after every bundle change. fn runs
+// synchronously on the goroutine that replaced the bundle.
+func (s *bundleStore) Subscribe(fn func(BundleUpdate)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// load returns the current bundle
+func (s *bundleStore) load() *Bundle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// replace atomically swaps in roots. The version only changes, and
+// subscribers are only notified, when the set of roots differs.
+func (s *bundleStore) replace(roots []*x509.Certificate) {
+	s.mu.Lock()
+	previous := s.current
+	added, removed := diffRoots(previous, roots)
+	if previous != nil && len(added) == 0 && len(removed) == 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	var version uint64 = 1
+	if previous != nil {
+		version = previous.Version + 1
+	}
+	s.current = newBundle(version, roots)
+	update := BundleUpdate{Previous: previous, Current: s.current, Added: added, Removed: removed}
+	subscribers := s.subscribers
+	s.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(update)
+	}
+}
+
+// diffRoots returns the roots added and removed relative to previous
+func diffRoots(previous *Bundle, roots []*x509.Certificate) (added, removed []*x509.Certificate) {
+	if previous == nil {
+		return roots, nil
+	}
+	for _, root := range roots {
+		if !previous.Contains(root) {
+			added = append(added, root)
+		}
+	}
+	current := &Bundle{Roots: roots}
+	for _, root := range previous.Roots {
+		if !current.Contains(root) {
+			removed = append(removed, root)
+		}
+	}
+	return added, removed
+}
+
+// MemoryBundleSource is a bundle source updated programmatically
+type MemoryBundleSource struct {
+	bundleStore
+}
+
+// NewMemoryBundleSource creates a bundle source holding roots
+func NewMemoryBundleSource(roots []*x509.Certificate) *MemoryBundleSource {
+	s := &MemoryBundleSource{}
+	s.replace(roots)
+	return s
+}
+
+// Bundle implements BundleSource
+func (s *MemoryBundleSource) Bundle() (*Bundle, error) {
+	return s.load(), nil
+}
+
+// SetRoots replaces the bundle roots
+func (s *MemoryBundleSource) SetRoots(roots []*x509.Certificate) {
+	s.replace(append([]*x509.Certificate(nil), roots...))
+}
+
+// FileBundleSource reads a PEM bundle from a file or from every .pem and
+// .crt file in a directory. The path is checked for changes at most once
+// per reload interval; an unreadable or empty bundle keeps the previous one.
+type FileBundleSource struct {
+	bundleStore
+
+	path           string
+	reloadInterval time.Duration
+
+	checkMu   sync.Mutex
+	signature string
+	lastCheck time.Time
+}
+
+// NewFileBundleSource loads the bundle at path, which may be a file or a
+// directory
+func NewFileBundleSource(path string, reloadInterval time.Duration) (*FileBundleSource, error) {
+	s := &FileBundleSource{
+		path:           path,
+		reloadInterval: reloadInterval,
+	}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Bundle implements BundleSource
+func (s *FileBundleSource) Bundle() (*Bundle, error) {
+	s.reloadIfChanged()
+	return s.load(), nil
+}
+
+// Reload re-reads the bundle. On error the previous bundle is kept.
+func (s *FileBundleSource) Reload() error {
+	s.checkMu.Lock()
+	defer s.checkMu.Unlock()
+	return s.reload()
+}
+
+// reload reads the bundle files. The caller holds checkMu.
+func (s *FileBundleSource) reload() error {
+	files, signature, err := bundleFiles(s.path)
+	if err != nil {
+		return err
+	}
+
+	var roots []*x509.Certificate
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read trust bundle: %v", err)
+		}
+		certs, err := ParseBundlePEM(data)
+		if err != nil {
+			return fmt.Errorf("invalid trust bundle %s: %v", file, err)
+		}
+		roots = append(roots, certs...)
+	}
+	if len(roots) == 0 {
+		return fmt.Errorf("trust bundle %s contains no certificates", s.path)
+	}
+
+	s.replace(roots)
+	s.signature = signature
+	s.lastCheck = time.Now()
+
+	return nil
+}
+
+// reloadIfChanged reloads the bundle when the files changed since the last load
+func (s *FileBundleSource) reloadIfChanged() {
+	// Don't block verification behind a reload already in progress
+	if !s.checkMu.TryLock() {
+		return
+	}
+	defer s.checkMu.Unlock()
+
+	if time.Since(s.lastCheck) < s.reloadInterval {
+		return
+	}
+	s.lastCheck = time.Now()
+
+	_, signature, err := bundleFiles(s.path)
+	if err != nil || signature == s.signature {
+		return
+	}
+
+	// Keep serving the previous bundle if the new one is invalid
+	_ = s.reload()
+}
+
+// bundleFiles lists the bundle files at path and a signature of their
+// names, sizes and modification times
+func bundleFiles(path string) ([]string, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to stat trust bundle: %v", err)
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read trust bundle directory: %v", err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if !entry.IsDir() && (ext == ".pem" || ext == ".crt") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var signature strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to stat trust bundle: %v", err)
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return files, signature.String(), nil
+}
+
+// ParseBundlePEM parses the CERTIFICATE blocks of a PEM bundle
+func ParseBundlePEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(bytes.TrimSpace(data)) > 0 {
+		return nil, fmt.Errorf("trailing data after PEM certificates")
+	}
+
+	return certs, nil
+}
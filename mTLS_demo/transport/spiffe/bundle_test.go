@@ -0,0 +1,122 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryBundleSource_SetRoots(t *testing.T) {
+	caA := spiffetest.NewCA(t, "example.org")
+	caB := spiffetest.NewCA(t, "example.org")
+
+	source := NewMemoryBundleSource(caA.Roots())
+	var updates []BundleUpdate
+	source.Subscribe(func(update BundleUpdate) {
+		updates = append(updates, update)
+	})
+
+	bundle, err := source.Bundle()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), bundle.Version)
+
+	// Setting the same roots is not a change
+	source.SetRoots(caA.Roots())
+	assert.Empty(t, updates)
+
+	// Replacing a root reports what was added and removed
+	source.SetRoots(caB.Roots())
+	assert.Len(t, updates, 1)
+	assert.Equal(t, uint64(2), updates[0].Current.Version)
+	assert.Equal(t, uint64(1), updates[0].Previous.Version)
+	assert.True(t, updates[0].Added[0].Equal(caB.Certificate))
+	assert.True(t, updates[0].Removed[0].Equal(caA.Certificate))
+
+	bundle, err = source.Bundle()
+	assert.NoError(t, err)
+	assert.False(t, bundle.Contains(caA.Certificate))
+	assert.True(t, bundle.Contains(caB.Certificate))
+}
+
+func TestFileBundleSource_Reload(t *testing.T) {
+	caA := spiffetest.NewCA(t, "example.org")
+	caB := spiffetest.NewCA(t, "example.org")
+
+	path := filepath.Join(t.TempDir(), "bundle.pem")
+	writeBundle(t, path, caA.Certificate, caB.Certificate)
+
+	source, err := NewFileBundleSource(path, 0)
+	assert.NoError(t, err)
+
+	bundle, err := source.Bundle()
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Roots, 2)
+
+	// Removing a root from the file stops trusting it
+	writeBundle(t, path, caB.Certificate)
+	bundle, err = source.Bundle()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), bundle.Version)
+	assert.False(t, bundle.Contains(caA.Certificate))
+	assert.True(t, bundle.Contains(caB.Certificate))
+
+	// An invalid file keeps the last good bundle
+	assert.NoError(t, os.WriteFile(path, []byte("not a bundle"), 0600))
+	assert.NoError(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	bundle, err = source.Bundle()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), bundle.Version)
+	assert.True(t, bundle.Contains(caB.Certificate))
+}
+
+func TestFileBundleSource_Directory(t *testing.T) {
+	caA := spiffetest.NewCA(t, "example.org")
+	caB := spiffetest.NewCA(t, "other.org")
+
+	dir := t.TempDir()
+	writeBundle(t, filepath.Join(dir, "a.pem"), caA.Certificate)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0600))
+
+	source, err := NewFileBundleSource(dir, 0)
+	assert.NoError(t, err)
+
+	bundle, err := source.Bundle()
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Roots, 1)
+
+	// Adding a file adds its roots
+	writeBundle(t, filepath.Join(dir, "b.crt"), caB.Certificate)
+	bundle, err = source.Bundle()
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Roots, 2)
+
+	// Removing a file removes its roots
+	assert.NoError(t, os.Remove(filepath.Join(dir, "a.pem")))
+	bundle, err = source.Bundle()
+	assert.NoError(t, err)
+	assert.Len(t, bundle.Roots, 1)
+	assert.True(t, bundle.Contains(caB.Certificate))
+}
+
+func TestNewFileBundleSource_Invalid(t *testing.T) {
+	_, err := NewFileBundleSource(filepath.Join(t.TempDir(), "missing.pem"), time.Second)
+	assert.Error(t, err)
+
+	empty := t.TempDir()
+	_, err = NewFileBundleSource(empty, time.Second)
+	assert.Error(t, err)
+}
+
+// writeBundle writes certs as a PEM bundle and bumps the modification time
+// so the change is seen even within the filesystem timestamp granularity
+func writeBundle(t *testing.T, path string, certs ...*x509.Certificate) {
+	assert.NoError(t, os.WriteFile(path, spiffetest.EncodeCertificates(certs), 0600))
+	modTime := time.Now().Add(time.Duration(len(certs)) * time.Second)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+}
@@ -0,0 +1,74 @@
+package spiffe
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// ErrUnknownTrustDomain is returned when no bundle is held for a trust domain
+var ErrUnknownTrustDomain = errors.New("unknown trust domain")
+
+// BundleSet holds a bundle source per trust domain. A peer is verified only
+// against the bundle of its own trust domain, so a federated domain cannot
+// vouch for identities in another domain.
+type BundleSet struct {
+	mu      sync.RWMutex
+	sources map[spiffeid.TrustDomain]BundleSource
+}
+
+// NewBundleSet creates an empty bundle set
+func NewBundleSet() *BundleSet {
+	return &BundleSet{
+		sources: make(map[spiffeid.TrustDomain]BundleSource),
+	}
+}
+
+// Set sets the bundle source of a trust domain, replacing any existing one
+func (s *BundleSet) Set(td spiffeid.TrustDomain, source BundleSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources[td] = source
+}
+
+// Remove stops trusting a trust domain
+func (s *BundleSet) Remove(td spiffeid.TrustDomain) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sources, td)
+}
+
+// Source returns the bundle source of a trust domain
+func (s *BundleSet) Source(td spiffeid.TrustDomain) (BundleSource, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	source, ok := s.sources[td]
+	return source, ok
+}
+
+// Bundle returns the current bundle of a trust domain
+func (s *BundleSet) Bundle(td spiffeid.TrustDomain) (*Bundle, error) {
+	source, ok := s.Source(td)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTrustDomain, td)
+	}
+	return source.Bundle()
+}
+
+// TrustDomains returns the trust domains in the set, sorted by name
+func (s *BundleSet) TrustDomains() []spiffeid.TrustDomain {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tds := make([]spiffeid.TrustDomain, 0, len(s.sources))
+	for td := range s.sources {
+		tds = append(tds, td)
+	}
+	sort.Slice(tds, func(i, j int) bool {
+		return tds[i].Name() < tds[j].Name()
+	})
+	return tds
+}
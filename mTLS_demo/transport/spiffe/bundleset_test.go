@@ -0,0 +1,34 @@
+package spiffe
+
+import (
+	"testing"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundleSet_Bundle(t *testing.T) {
+	caA := spiffetest.NewCA(t, "a.example")
+	caB := spiffetest.NewCA(t, "b.example")
+	tdA := spiffeid.RequireTrustDomainFromString("a.example")
+	tdB := spiffeid.RequireTrustDomainFromString("b.example")
+
+	set := NewBundleSet()
+	set.Set(tdB, NewMemoryBundleSource(caB.Roots()))
+	set.Set(tdA, NewMemoryBundleSource(caA.Roots()))
+	assert.Equal(t, []spiffeid.TrustDomain{tdA, tdB}, set.TrustDomains())
+
+	bundle, err := set.Bundle(tdA)
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(caA.Certificate))
+	assert.False(t, bundle.Contains(caB.Certificate))
+
+	_, err = set.Bundle(spiffeid.RequireTrustDomainFromString("c.example"))
+	assert.ErrorIs(t, err, ErrUnknownTrustDomain)
+
+	set.Remove(tdA)
+	_, err = set.Bundle(tdA)
+	assert.ErrorIs(t, err, ErrUnknownTrustDomain)
+}
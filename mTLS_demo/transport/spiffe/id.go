@@ -0,0 +1,178 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+var (
+	// ErrInvalidSVID is returned when a certificate does not satisfy the X509-SVID rules
+	ErrInvalidSVID = errors.New("invalid X509-SVID")
+	// ErrIDNotAllowed is returned when a SPIFFE ID does not match any authorization rule
+	ErrIDNotAllowed = errors.New("SPIFFE ID not allowed")
+)
+
+// IDFromCertificate extracts the SPIFFE ID from the URI SAN of a certificate.
+// X509-SVIDs must carry exactly one URI SAN.
+func IDFromCertificate(cert *x509.Certificate) (spiffeid.ID, error) {
+	if cert == nil {
+		return spiffeid.ID{}, fmt.Errorf("%w: certificate is nil", ErrInvalidSVID)
+	}
+
+	switch len(cert.URIs) {
+	case 0:
+		return spiffeid.ID{}, fmt.Errorf("%w: certificate has no URI SAN", ErrInvalidSVID)
+	case 1:
+	default:
+		return spiffeid.ID{}, fmt.Errorf("%w: certificate has %d URI SANs, expected exactly one", ErrInvalidSVID, len(cert.URIs))
+	}
+
+	id, err := spiffeid.FromURI(cert.URIs[0])
+	if err != nil {
+		return spiffeid.ID{}, fmt.Errorf("%w: %v", ErrInvalidSVID, err)
+	}
+	return id, nil
+}
+
+// ValidateX509SVID checks that a leaf certificate follows the X509-SVID
+// specification and returns its SPIFFE ID. It does not verify the chain.
+func ValidateX509SVID(cert *x509.Certificate) (spiffeid.ID, error) {
+	id, err := IDFromCertificate(cert)
+	if err != nil {
+		return spiffeid.ID{}, err
+	}
+
+	// Leaf SVIDs must not be able to issue certificates
+	if cert.IsCA {
+		return id, fmt.Errorf("%w: leaf certificate has the CA flag set", ErrInvalidSVID)
+	}
+	if cert.KeyUsage&x509.KeyUsageCertSign != 0 {
+		return id, fmt.Errorf("%w: leaf certificate has keyCertSign key usage", ErrInvalidSVID)
+	}
+	if cert.KeyUsage&x509.KeyUsageCRLSign != 0 {
+		return id, fmt.Errorf("%w: leaf certificate has cRLSign key usage", ErrInvalidSVID)
+	}
+
+	// Leaf SVIDs must be usable for signing during the TLS handshake
+	if cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return id, fmt.Errorf("%w: leaf certificate is missing digitalSignature key usage", ErrInvalidSVID)
+	}
+
+	return id, nil
+}
+
+// Matcher authorizes SPIFFE IDs against exact IDs, whole trust domains
+// and path patterns. A zero Matcher rejects every ID.
+type Matcher struct {
+	ids          map[string]struct{}
+	trustDomains map[string]struct{}
+	patterns     []idPattern
+}
+
+// idPattern is a SPIFFE ID whose path may contain path.Match wildcards
+type idPattern struct {
+	raw         string
+	trustDomain string
+	path        string
+}
+
+// NewMatcher creates a matcher from exact SPIFFE IDs, trust domain names and
+// ID patterns such as spiffe://prod.example/ns/*/sa/frontend. A '*' in a
+// pattern matches exactly one path segment.
+func NewMatcher(ids, trustDomains, patterns []string) (*Matcher, error) {
+	m := &Matcher{
+		ids:          make(map[string]struct{}),
+		trustDomains: make(map[string]struct{}),
+	}
+
+	for _, raw := range ids {
+		id, err := spiffeid.FromString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed SPIFFE ID %q: %v", raw, err)
+		}
+		m.ids[id.String()] = struct{}{}
+	}
+
+	for _, raw := range trustDomains {
+		td, err := spiffeid.TrustDomainFromString(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed trust domain %q: %v", raw, err)
+		}
+		m.trustDomains[td.Name()] = struct{}{}
+	}
+
+	for _, raw := range patterns {
+		pattern, err := parseIDPattern(raw)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, pattern)
+	}
+
+	return m, nil
+}
+
+// parseIDPattern validates a SPIFFE ID pattern
+func parseIDPattern(raw string) (idPattern, error) {
+	rest := strings.TrimPrefix(raw, "spiffe://")
+	if rest == raw {
+		return idPattern{}, fmt.Errorf("invalid SPIFFE ID pattern %q: scheme must be spiffe", raw)
+	}
+
+	tdName, idPath := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		tdName, idPath = rest[:i], rest[i:]
+	}
+
+	td, err := spiffeid.TrustDomainFromString(tdName)
+	if err != nil {
+		return idPattern{}, fmt.Errorf("invalid SPIFFE ID pattern %q: %v", raw, err)
+	}
+
+	// Reject malformed globs up front instead of failing every match later
+	if _, err := path.Match(idPath, ""); err != nil {
+		return idPattern{}, fmt.Errorf("invalid SPIFFE ID pattern %q: %v", raw, err)
+	}
+
+	return idPattern{
+		raw:         raw,
+		trustDomain: td.Name(),
+		path:        idPath,
+	}, nil
+}
+
+// Match returns nil if the ID is authorized by any rule
+func (m *Matcher) Match(id spiffeid.ID) error {
+	if m == nil || id.IsZero() {
+		return fmt.Errorf("%w: %q", ErrIDNotAllowed, id)
+	}
+
+	if _, ok := m.ids[id.String()]; ok {
+		return nil
+	}
+
+	if _, ok := m.trustDomains[id.TrustDomain().Name()]; ok {
+		return nil
+	}
+
+	for _, pattern := range m.patterns {
+		if pattern.trustDomain != id.TrustDomain().Name() {
+			continue
+		}
+		if ok, _ := path.Match(pattern.path, id.Path()); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrIDNotAllowed, id)
+}
+
+// Empty reports whether the matcher has no rules
+func (m *Matcher) Empty() bool {
+	return m == nil || (len(m.ids) == 0 && len(m.trustDomains) == 0 && len(m.patterns) == 0)
+}
@@ -0,0 +1,132 @@
+package spiffe
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateX509SVID(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantID  string
+		wantErr bool
+	}{
+		{
+			name:   "Valid SVID",
+			cert:   ca.IssueSVID(t, "spiffe://example.org/ns/demo/sa/frontend").Certificate,
+			wantID: "spiffe://example.org/ns/demo/sa/frontend",
+		},
+		{
+			name:    "No URI SAN",
+			cert:    ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithURIs()).Certificate,
+			wantErr: true,
+		},
+		{
+			name:    "Multiple URI SANs",
+			cert:    ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithURIs("spiffe://example.org/a", "spiffe://example.org/b")).Certificate,
+			wantErr: true,
+		},
+		{
+			name:    "Non SPIFFE URI",
+			cert:    ca.IssueSVID(t, "https://example.org/a").Certificate,
+			wantErr: true,
+		},
+		{
+			name:    "CA certificate",
+			cert:    ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithCA()).Certificate,
+			wantErr: true,
+		},
+		{
+			name:    "CRL signing key usage",
+			cert:    ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithKeyUsage(x509.KeyUsageDigitalSignature|x509.KeyUsageCRLSign)).Certificate,
+			wantErr: true,
+		},
+		{
+			name:    "Missing digital signature key usage",
+			cert:    ca.IssueSVID(t, "spiffe://example.org/a", spiffetest.WithKeyUsage(x509.KeyUsageKeyEncipherment)).Certificate,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ValidateX509SVID(tt.cert)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidSVID)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantID, id.String())
+		})
+	}
+}
+
+func TestMatcher_Match(t *testing.T) {
+	matcher, err := NewMatcher(
+		[]string{"spiffe://example.org/backend"},
+		[]string{"partner.example"},
+		[]string{"spiffe://prod.example/ns/*/sa/frontend"},
+	)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		id      string
+		allowed bool
+	}{
+		{name: "Exact ID", id: "spiffe://example.org/backend", allowed: true},
+		{name: "Other ID in same trust domain", id: "spiffe://example.org/frontend", allowed: false},
+		{name: "Allowed trust domain", id: "spiffe://partner.example/anything/here", allowed: true},
+		{name: "Pattern match", id: "spiffe://prod.example/ns/payments/sa/frontend", allowed: true},
+		{name: "Pattern wildcard spans one segment only", id: "spiffe://prod.example/ns/a/b/sa/frontend", allowed: false},
+		{name: "Pattern in other trust domain", id: "spiffe://staging.example/ns/payments/sa/frontend", allowed: false},
+		{name: "Pattern different suffix", id: "spiffe://prod.example/ns/payments/sa/backend", allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := matcher.Match(spiffeid.RequireFromString(tt.id))
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrIDNotAllowed)
+			}
+		})
+	}
+}
+
+func TestNewMatcher_InvalidRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		ids          []string
+		trustDomains []string
+		patterns     []string
+	}{
+		{name: "Invalid ID", ids: []string{"https://example.org/a"}},
+		{name: "Invalid trust domain", trustDomains: []string{"Example.ORG!"}},
+		{name: "Pattern without scheme", patterns: []string{"example.org/ns/*"}},
+		{name: "Malformed pattern", patterns: []string{"spiffe://example.org/ns/[a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMatcher(tt.ids, tt.trustDomains, tt.patterns)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatcher_Empty(t *testing.T) {
+	matcher, err := NewMatcher(nil, nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, matcher.Empty())
+	assert.ErrorIs(t, matcher.Match(spiffeid.RequireFromString("spiffe://example.org/a")), ErrIDNotAllowed)
+}
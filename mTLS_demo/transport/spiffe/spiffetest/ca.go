@@ -0,0 +1,310 @@
+// Package spiffetest provides an in-memory certificate authority that issues
+// X509-SVIDs for tests.
+package spiffetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// CA is a test certificate authority for a single trust domain
+type CA struct {
+	TrustDomain string
+	Certificate *x509.Certificate
+	PrivateKey  crypto.Signer
+
+	// parent is set for intermediate CAs
+	parent *CA
+}
+
+// SVID is an X509-SVID issued by a test CA
+type SVID struct {
+	ID          string
+	Certificate *x509.Certificate
+	// Chain holds the leaf followed by any intermediates, excluding the root
+	Chain      []*x509.Certificate
+	PrivateKey crypto.Signer
+}
+
+// Option modifies a certificate template before it is signed
+type Option func(*x509.Certificate)
+
+// NewCA creates a self-signed root CA for the trust domain
+func NewCA(t testing.TB, trustDomain string, opts ...Option) *CA {
+	t.Helper()
+
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(t),
+		Subject:               pkix.Name{Organization: []string{"SPIFFE"}, CommonName: trustDomain + " root"},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, opt := range opts {
+		opt(tmpl)
+	}
+
+	return &CA{
+		TrustDomain: trustDomain,
+		Certificate: sign(t, tmpl, tmpl, key.Public(), key),
+		PrivateKey:  key,
+	}
+}
+
+// NewIntermediate creates an intermediate CA signed by ca
+func (ca *CA) NewIntermediate(t testing.TB, opts ...Option) *CA {
+	t.Helper()
+
+	key := newKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(t),
+		Subject:               pkix.Name{Organization: []string{"SPIFFE"}, CommonName: ca.TrustDomain + " intermediate"},
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: ca.TrustDomain}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(12 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, opt := range opts {
+		opt(tmpl)
+	}
+
+	return &CA{
+		TrustDomain: ca.TrustDomain,
+		Certificate: sign(t, tmpl, ca.Certificate, key.Public(), ca.PrivateKey),
+		PrivateKey:  key,
+		parent:      ca,
+	}
+}
+
+// IssueSVID issues a leaf X509-SVID for the SPIFFE ID
+func (ca *CA) IssueSVID(t testing.TB, id string, opts ...Option) *SVID {
+	t.Helper()
+	return ca.IssueSVIDWithKey(t, id, newKey(t), opts...)
+}
+
+// IssueSVIDWithKey issues a leaf X509-SVID for the SPIFFE ID certifying the
+// public key of key
+func (ca *CA) IssueSVIDWithKey(t testing.TB, id string, key crypto.Signer, opts ...Option) *SVID {
+	t.Helper()
+
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatalf("invalid SPIFFE ID %q: %v", id, err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(t),
+		Subject:               pkix.Name{Organization: []string{"SPIRE"}},
+		URIs:                  []*url.URL{uri},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, opt := range opts {
+		opt(tmpl)
+	}
+
+	leaf := sign(t, tmpl, ca.Certificate, key.Public(), ca.PrivateKey)
+	return &SVID{
+		ID:          id,
+		Certificate: leaf,
+		Chain:       append([]*x509.Certificate{leaf}, ca.intermediates()...),
+		PrivateKey:  key,
+	}
+}
+
+// Roots returns the root certificate of the CA hierarchy
+func (ca *CA) Roots() []*x509.Certificate {
+	root := ca
+	for root.parent != nil {
+		root = root.parent
+	}
+	return []*x509.Certificate{root.Certificate}
+}
+
+// RootPEM returns the PEM encoded root certificate
+func (ca *CA) RootPEM() []byte {
+	return EncodeCertificates(ca.Roots())
+}
+
+// intermediates returns the intermediate chain from ca up to, but excluding, the root
+func (ca *CA) intermediates() []*x509.Certificate {
+	var chain []*x509.Certificate
+	for current := ca; current.parent != nil; current = current.parent {
+		chain = append(chain, current.Certificate)
+	}
+	return chain
+}
+
+// TLSCertificate returns the SVID as a tls.Certificate
+func (s *SVID) TLSCertificate() tls.Certificate {
+	cert := tls.Certificate{
+		PrivateKey: s.PrivateKey,
+		Leaf:       s.Certificate,
+	}
+	for _, c := range s.Chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// CertPEM returns the PEM encoded certificate chain
+func (s *SVID) CertPEM() []byte {
+	return EncodeCertificates(s.Chain)
+}
+
+// KeyPEM returns the PEM encoded PKCS#8 private key
+func (s *SVID) KeyPEM(t testing.TB) []byte {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(s.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// CreateCRL returns a DER encoded CRL signed by ca that lists the revoked
+// certificates and expires at nextUpdate
+func (ca *CA) CreateCRL(t testing.TB, nextUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	t.Helper()
+
+	tmpl := &x509.RevocationList{
+		Number:     newSerial(t),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, cert := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, ca.Certificate, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to create CRL: %v", err)
+	}
+	return der
+}
+
+// EncodeCertificates PEM encodes a list of certificates
+func EncodeCertificates(certs []*x509.Certificate) []byte {
+	var out []byte
+	for _, cert := range certs {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return out
+}
+
+// WithCA marks the leaf as a CA certificate
+func WithCA() Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.IsCA = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+}
+
+// WithURIs replaces the URI SANs of the certificate
+func WithURIs(uris ...string) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.URIs = nil
+		for _, raw := range uris {
+			if u, err := url.Parse(raw); err == nil {
+				tmpl.URIs = append(tmpl.URIs, u)
+			}
+		}
+	}
+}
+
+// WithKeyUsage replaces the key usage of the certificate
+func WithKeyUsage(usage x509.KeyUsage) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.KeyUsage = usage
+	}
+}
+
+// WithCRLDistributionPoints sets the CRL distribution points of the certificate
+func WithCRLDistributionPoints(urls ...string) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.CRLDistributionPoints = urls
+	}
+}
+
+// WithOCSPServer sets the OCSP responder URLs of the certificate
+func WithOCSPServer(urls ...string) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.OCSPServer = urls
+	}
+}
+
+// WithValidity sets the validity window of the certificate
+func WithValidity(notBefore, notAfter time.Time) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.NotBefore = notBefore
+		tmpl.NotAfter = notAfter
+	}
+}
+
+// WithSubject sets the subject of the certificate
+func WithSubject(subject pkix.Name) Option {
+	return func(tmpl *x509.Certificate) {
+		tmpl.Subject = subject
+	}
+}
+
+// newKey generates a P-256 key, the SPIRE default
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key
+}
+
+// newSerial generates a random certificate serial number
+func newSerial(t testing.TB) *big.Int {
+	t.Helper()
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		t.Fatalf("failed to generate serial: %v", err)
+	}
+	return serial
+}
+
+// sign creates and parses a certificate
+func sign(t testing.TB, tmpl, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return cert
+}
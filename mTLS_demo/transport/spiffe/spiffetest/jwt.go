@@ -0,0 +1,66 @@
+package spiffetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+// JWTAuthority signs JWT-SVIDs for a single trust domain
+type JWTAuthority struct {
+	TrustDomain string
+	KeyID       string
+	PrivateKey  *ecdsa.PrivateKey
+}
+
+// NewJWTAuthority creates a JWT signing key for the trust domain
+func NewJWTAuthority(t testing.TB, trustDomain, keyID string) *JWTAuthority {
+	t.Helper()
+
+	return &JWTAuthority{
+		TrustDomain: trustDomain,
+		KeyID:       keyID,
+		PrivateKey:  newKey(t),
+	}
+}
+
+// Bundle returns a JWT bundle holding the authority's public key
+func (a *JWTAuthority) Bundle(t testing.TB) *jwtbundle.Bundle {
+	t.Helper()
+
+	td, err := spiffeid.TrustDomainFromString(a.TrustDomain)
+	if err != nil {
+		t.Fatalf("invalid trust domain %q: %v", a.TrustDomain, err)
+	}
+	return jwtbundle.FromJWTAuthorities(td, map[string]crypto.PublicKey{
+		a.KeyID: a.PrivateKey.Public(),
+	})
+}
+
+// SignSVID signs a JWT-SVID for id, valid for the audience until expiry
+func (a *JWTAuthority) SignSVID(t testing.TB, id string, audience []string, expiry time.Time) string {
+	t.Helper()
+
+	token, err := a.sign(id, audience, expiry)
+	if err != nil {
+		t.Fatalf("failed to sign JWT-SVID: %v", err)
+	}
+	return token
+}
+
+// sign signs a JWT-SVID with the authority's key ID in the header
+func (a *JWTAuthority) sign(id string, audience []string, expiry time.Time) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Subject:   id,
+		Audience:  audience,
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(expiry),
+	})
+	token.Header["kid"] = a.KeyID
+	return token.SignedString(a.PrivateKey)
+}
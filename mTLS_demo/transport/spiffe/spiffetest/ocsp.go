@@ -0,0 +1,128 @@
+package spiffetest
+
+import (
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPResponder is a local OCSP responder answering for one CA. Every
+// certificate is reported as good unless it has been revoked.
+type OCSPResponder struct {
+	URL string
+
+	ca       *CA
+	validity time.Duration
+	requests int32
+
+	mu      sync.Mutex
+	revoked map[string]bool
+}
+
+// NewOCSPResponder starts an OCSP responder for ca. It is shut down when the
+// test finishes.
+func (ca *CA) NewOCSPResponder(t testing.TB) *OCSPResponder {
+	t.Helper()
+
+	r := &OCSPResponder{
+		ca:       ca,
+		validity: time.Hour,
+		revoked:  make(map[string]bool),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(server.Close)
+	r.URL = server.URL
+
+	return r
+}
+
+// Revoke marks cert as revoked
+func (r *OCSPResponder) Revoke(cert *x509.Certificate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked[cert.SerialNumber.String()] = true
+}
+
+// SetValidity sets the lifetime of subsequent responses. A negative value
+// produces responses that are already stale.
+func (r *OCSPResponder) SetValidity(validity time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.validity = validity
+}
+
+// Requests returns the number of requests served
+func (r *OCSPResponder) Requests() int {
+	return int(atomic.LoadInt32(&r.requests))
+}
+
+// Staple returns a signed response for cert, as a server would staple it
+func (r *OCSPResponder) Staple(t testing.TB, cert *x509.Certificate) []byte {
+	t.Helper()
+
+	der, err := r.respond(cert.SerialNumber)
+	if err != nil {
+		t.Fatalf("failed to create OCSP response: %v", err)
+	}
+	return der
+}
+
+// serveHTTP answers POSTed OCSP requests
+func (r *OCSPResponder) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.requests, 1)
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	ocspReq, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, "invalid OCSP request", http.StatusBadRequest)
+		return
+	}
+
+	der, err := r.respond(ocspReq.SerialNumber)
+	if err != nil {
+		http.Error(w, "failed to create OCSP response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(der)
+}
+
+// respond signs a response for the serial number
+func (r *OCSPResponder) respond(serial *big.Int) ([]byte, error) {
+	r.mu.Lock()
+	revoked := r.revoked[serial.String()]
+	validity := r.validity
+	r.mu.Unlock()
+
+	now := time.Now()
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: serial,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(validity),
+	}
+	if validity < 0 {
+		tmpl.ThisUpdate = tmpl.NextUpdate.Add(-time.Hour)
+	}
+	if revoked {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = now.Add(-time.Minute)
+	}
+
+	return ocsp.CreateResponse(r.ca.Certificate, r.ca.Certificate, tmpl, r.ca.PrivateKey)
+}
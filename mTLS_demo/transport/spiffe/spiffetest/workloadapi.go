@@ -0,0 +1,266 @@
+package spiffetest
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// WorkloadAPI is a local Workload API serving X509-SVIDs, JWT-SVIDs and JWT
+// bundles over a unix socket, standing in for the SPIRE agent
+type WorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+
+	// Address is the unix:// address of the socket
+	Address string
+
+	path string
+
+	mu          sync.Mutex
+	server      *grpc.Server
+	response    *workload.X509SVIDResponse
+	jwtBundles  *workload.JWTBundlesResponse
+	authorities map[string]*JWTAuthority
+	jwtTTL      time.Duration
+	jwtFetches  int
+	updated     chan struct{}
+	jwtUpdated  chan struct{}
+}
+
+// NewWorkloadAPI starts a Workload API with no SVID. It is stopped when the
+// test finishes.
+func NewWorkloadAPI(t testing.TB) *WorkloadAPI {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	w := &WorkloadAPI{
+		Address:    "unix://" + path,
+		path:       path,
+		jwtTTL:     5 * time.Minute,
+		updated:    make(chan struct{}),
+		jwtUpdated: make(chan struct{}),
+	}
+	w.Start(t)
+	t.Cleanup(w.Stop)
+
+	return w
+}
+
+// Start serves the Workload API, restarting it after Stop
+func (w *WorkloadAPI) Start(t testing.TB) {
+	t.Helper()
+
+	listener, err := net.Listen("unix", w.path)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", w.path, err)
+	}
+
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, w)
+
+	w.mu.Lock()
+	w.server = server
+	w.mu.Unlock()
+
+	go server.Serve(listener)
+}
+
+// Stop stops serving, breaking every open stream
+func (w *WorkloadAPI) Stop() {
+	w.mu.Lock()
+	server := w.server
+	w.server = nil
+	w.mu.Unlock()
+
+	if server != nil {
+		server.Stop()
+	}
+}
+
+// SetX509SVID serves svid with the roots of its trust domain and the bundles
+// of federated trust domains
+func (w *WorkloadAPI) SetX509SVID(t testing.TB, svid *SVID, bundle *CA, federated ...*CA) {
+	t.Helper()
+
+	key, err := x509.MarshalPKCS8PrivateKey(svid.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	response := &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{{
+			SpiffeId:    svid.ID,
+			X509Svid:    concatDER(svid.Chain),
+			X509SvidKey: key,
+			Bundle:      concatDER(bundle.Roots()),
+		}},
+		FederatedBundles: make(map[string][]byte),
+	}
+	for _, ca := range federated {
+		response.FederatedBundles["spiffe://"+ca.TrustDomain] = concatDER(ca.Roots())
+	}
+
+	w.mu.Lock()
+	w.response = response
+	close(w.updated)
+	w.updated = make(chan struct{})
+	w.mu.Unlock()
+}
+
+// SetJWTAuthorities serves the JWT bundles of the authorities' trust domains
+// and signs JWT-SVIDs with the authority of the requested ID's trust domain
+func (w *WorkloadAPI) SetJWTAuthorities(t testing.TB, authorities ...*JWTAuthority) {
+	t.Helper()
+
+	response := &workload.JWTBundlesResponse{Bundles: make(map[string][]byte)}
+	byTrustDomain := make(map[string]*JWTAuthority)
+	for _, authority := range authorities {
+		jwks, err := authority.Bundle(t).Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal JWT bundle: %v", err)
+		}
+		response.Bundles["spiffe://"+authority.TrustDomain] = jwks
+		byTrustDomain[authority.TrustDomain] = authority
+	}
+
+	w.mu.Lock()
+	w.jwtBundles = response
+	w.authorities = byTrustDomain
+	close(w.jwtUpdated)
+	w.jwtUpdated = make(chan struct{})
+	w.mu.Unlock()
+}
+
+// SetJWTSVIDTTL sets the lifetime of the JWT-SVIDs signed from now on. It
+// defaults to five minutes.
+func (w *WorkloadAPI) SetJWTSVIDTTL(ttl time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.jwtTTL = ttl
+}
+
+// JWTSVIDFetches returns the number of JWT-SVIDs signed so far
+func (w *WorkloadAPI) JWTSVIDFetches() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.jwtFetches
+}
+
+// FetchX509SVID implements the Workload API X509-SVID stream
+func (w *WorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	if err := checkHeader(stream.Context()); err != nil {
+		return err
+	}
+
+	for {
+		w.mu.Lock()
+		response := w.response
+		updated := w.updated
+		w.mu.Unlock()
+
+		if response != nil {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// FetchJWTSVID implements the Workload API JWT-SVID request. The SVID is
+// issued for the requested ID, or the ID of the current X509-SVID.
+func (w *WorkloadAPI) FetchJWTSVID(ctx context.Context, req *workload.JWTSVIDRequest) (*workload.JWTSVIDResponse, error) {
+	if err := checkHeader(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.Audience) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "audience must be specified")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := req.SpiffeId
+	if id == "" && w.response != nil {
+		id = w.response.Svids[0].SpiffeId
+	}
+	spiffeID, err := spiffeid.FromString(id)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, "no identity issued")
+	}
+	authority, ok := w.authorities[spiffeID.TrustDomain().Name()]
+	if !ok {
+		return nil, status.Error(codes.Unavailable, fmt.Sprintf("no JWT authority for %s", spiffeID.TrustDomain()))
+	}
+
+	token, err := authority.sign(id, req.Audience, time.Now().Add(w.jwtTTL))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	w.jwtFetches++
+
+	return &workload.JWTSVIDResponse{
+		Svids: []*workload.JWTSVID{{SpiffeId: id, Svid: token}},
+	}, nil
+}
+
+// FetchJWTBundles implements the Workload API JWT bundle stream
+func (w *WorkloadAPI) FetchJWTBundles(_ *workload.JWTBundlesRequest, stream workload.SpiffeWorkloadAPI_FetchJWTBundlesServer) error {
+	if err := checkHeader(stream.Context()); err != nil {
+		return err
+	}
+
+	for {
+		w.mu.Lock()
+		response := w.jwtBundles
+		updated := w.jwtUpdated
+		w.mu.Unlock()
+
+		if response != nil {
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// checkHeader rejects requests without the Workload API security header
+func checkHeader(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	return nil
+}
+
+// concatDER concatenates the DER encoding of certs
+func concatDER(certs []*x509.Certificate) []byte {
+	var der []byte
+	for _, cert := range certs {
+		der = append(der, cert.Raw...)
+	}
+	return der
+}
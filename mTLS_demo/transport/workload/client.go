@@ -0,0 +1,414 @@
+package workload
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mTLS_demo/transport/common"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// DefaultAddress is the SPIRE agent socket mounted into the workload pods
+const DefaultAddress = "unix:///run/spiffe/workload/spire-agent.sock"
+
+const (
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 30 * time.Second
+)
+
+// ErrNotReady is returned until the first X509-SVID has been received
+var ErrNotReady = errors.New("no X509-SVID received from the Workload API")
+
+// Store receives the X509-SVIDs and trust bundles streamed from the
+// Workload API
+type Store interface {
+	// StoreX509SVID stores a certificate chain, leaf first, and its key.
+	// The key is wiped after the client rotates it out, so stores that keep
+	// it must take their own copy.
+	StoreX509SVID(chain []*x509.Certificate, key crypto.Signer) error
+	// SetTrustBundle replaces the roots of the workload's trust domain
+	SetTrustBundle(roots []*x509.Certificate)
+}
+
+// Config configures a Workload API Client
+type Config struct {
+	// Address of the Workload API. Defaults to the SPIFFE_ENDPOINT_SOCKET
+	// environment variable, then DefaultAddress. A bare socket path is
+	// treated as a unix:// address.
+	Address string
+	// Store optionally receives every X509-SVID and trust bundle update
+	Store Store
+	// InitialBackoff and MaxBackoff bound the exponential delay between
+	// reconnection attempts. They default to one and thirty seconds.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// RetireDelay is how long a rotated-out SVID key stays usable, so
+	// handshakes in progress and subscribers still serving the previous
+	// SVID can finish. It defaults to securemem.DefaultRetireDelay.
+	RetireDelay time.Duration
+}
+
+// Client streams X509-SVIDs, X.509 bundles and JWT bundles from the Workload
+// API. The latest SVID is served by the TLS getters, and the bundles of the
+// workload's own and federated trust domains are kept in a bundle set. SVID
+// keys are held in locked memory and wiped on Close or once the retire delay
+// has passed after they were rotated out.
+type Client struct {
+	config  Config
+	client  *workloadapi.Client
+	bundles *spiffe.BundleSet
+	retired *securemem.Retirer
+	metrics *common.MetricsCollector
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	id          spiffeid.ID
+	sources     map[spiffeid.TrustDomain]*spiffe.MemoryBundleSource
+	jwtBundles  *jwtbundle.Set
+	subscribers []func(*tls.Certificate)
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// NewClient creates a Workload API client. It does not connect until Run
+// is called.
+func NewClient(config *Config) (*Client, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config cannot be nil")
+	}
+
+	c := &Client{
+		config:  *config,
+		bundles: spiffe.NewBundleSet(),
+		metrics: common.NewMetricsCollector(),
+		sources: make(map[spiffeid.TrustDomain]*spiffe.MemoryBundleSource),
+		ready:   make(chan struct{}),
+	}
+	if c.config.Address == "" {
+		c.config.Address = os.Getenv("SPIFFE_ENDPOINT_SOCKET")
+	}
+	if c.config.Address == "" {
+		c.config.Address = DefaultAddress
+	}
+	if strings.HasPrefix(c.config.Address, "/") {
+		c.config.Address = "unix://" + c.config.Address
+	}
+	if c.config.InitialBackoff <= 0 {
+		c.config.InitialBackoff = defaultInitialBackoff
+	}
+	if c.config.MaxBackoff < c.config.InitialBackoff {
+		c.config.MaxBackoff = defaultMaxBackoff
+	}
+	if c.config.RetireDelay <= 0 {
+		c.config.RetireDelay = securemem.DefaultRetireDelay
+	}
+	c.retired = securemem.NewRetirer(c.config.RetireDelay)
+
+	client, err := workloadapi.New(context.Background(),
+		workloadapi.WithAddr(c.config.Address),
+		workloadapi.WithBackoffStrategy(backoffStrategy{
+			initial: c.config.InitialBackoff,
+			max:     c.config.MaxBackoff,
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Workload API client: %v", err)
+	}
+	c.client = client
+
+	return c, nil
+}
+
+// Run streams X.509 and JWT updates until ctx is cancelled, reconnecting
+// with backoff whenever a stream breaks. onError is called for every failed
+// attempt and rejected update.
+func (c *Client) Run(ctx context.Context, onError func(error)) error {
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := &watcher{client: c, ctx: watchCtx, onError: onError}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- c.client.WatchX509Context(watchCtx, w)
+	}()
+	go func() {
+		errs <- c.client.WatchJWTBundles(watchCtx, w)
+	}()
+
+	// A watch only returns on cancellation or a fatal error, which stops
+	// the other one too
+	err := <-errs
+	cancel()
+	<-errs
+
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// WaitUntilReady blocks until the first X509-SVID has been received
+func (c *Client) WaitUntilReady(ctx context.Context) error {
+	select {
+	case <-c.ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %v", ErrNotReady, ctx.Err())
+	}
+}
+
+// Close closes the connection to the Workload API and wipes the SVID key
+// and the keys rotated out before it
+func (c *Client) Close() error {
+	c.mu.Lock()
+	cert := c.cert
+	c.cert = nil
+	c.mu.Unlock()
+
+	if cert != nil {
+		securemem.Zero(cert.PrivateKey)
+	}
+	c.retired.Flush()
+	return c.client.Close()
+}
+
+// Certificate returns the latest X509-SVID
+func (c *Client) Certificate() (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, ErrNotReady
+	}
+	return c.cert, nil
+}
+
+// GetCertificate serves the latest X509-SVID as tls.Config.GetCertificate
+func (c *Client) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate()
+}
+
+// GetClientCertificate serves the latest X509-SVID as
+// tls.Config.GetClientCertificate
+func (c *Client) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate()
+}
+
+// SPIFFEID returns the SPIFFE ID of the latest X509-SVID
+func (c *Client) SPIFFEID() (spiffeid.ID, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return spiffeid.ID{}, ErrNotReady
+	}
+	return c.id, nil
+}
+
+// Bundle returns the bundle of the workload's own trust domain, so the
+// client can be used as a spiffe.BundleSource
+func (c *Client) Bundle() (*spiffe.Bundle, error) {
+	id, err := c.SPIFFEID()
+	if err != nil {
+		return nil, err
+	}
+	return c.bundles.Bundle(id.TrustDomain())
+}
+
+// Bundles returns the bundles of the workload's own and federated trust
+// domains. The set is updated in place as new bundles arrive.
+func (c *Client) Bundles() *spiffe.BundleSet {
+	return c.bundles
+}
+
+// Subscribe registers fn to be called with every new X509-SVID. fn runs
+// synchronously on the goroutine receiving updates.
+func (c *Client) Subscribe(fn func(*tls.Certificate)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribers = append(c.subscribers, fn)
+}
+
+// update applies an X.509 context received from the Workload API
+func (c *Client) update(x509Context *workloadapi.X509Context) error {
+	svid := x509Context.DefaultSVID()
+	if len(svid.Certificates) == 0 {
+		return fmt.Errorf("X509-SVID %s has no certificates", svid.ID)
+	}
+
+	// Move the key into locked memory and wipe the decoded copy
+	key, err := securemem.NewSigner(svid.PrivateKey)
+	securemem.Zero(svid.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to protect X509-SVID key: %v", err)
+	}
+
+	cert := &tls.Certificate{
+		PrivateKey: key,
+		Leaf:       svid.Certificates[0],
+	}
+	for _, chainCert := range svid.Certificates {
+		cert.Certificate = append(cert.Certificate, chainCert.Raw)
+	}
+
+	// Hand the SVID to the store first so a rejected SVID is not served
+	if c.config.Store != nil {
+		if err := c.config.Store.StoreX509SVID(svid.Certificates, key); err != nil {
+			key.Destroy()
+			return fmt.Errorf("failed to store X509-SVID: %v", err)
+		}
+	}
+	c.updateBundles(x509Context, svid.ID.TrustDomain())
+
+	c.mu.Lock()
+	previous := c.cert
+	c.cert = cert
+	c.id = svid.ID
+	subscribers := c.subscribers
+	c.mu.Unlock()
+
+	c.metrics.RecordWorkloadAPIEvent("svid_update")
+	c.readyOnce.Do(func() { close(c.ready) })
+
+	for _, fn := range subscribers {
+		fn(cert)
+	}
+
+	// Subscribers have switched to the new SVID, but handshakes that
+	// fetched the previous one may still sign with its key
+	if previous != nil {
+		c.retired.Retire(previous.PrivateKey)
+	}
+
+	return nil
+}
+
+// updateBundles mirrors the received bundles into the bundle set. Trust
+// domains no longer federated with are removed.
+func (c *Client) updateBundles(x509Context *workloadapi.X509Context, own spiffeid.TrustDomain) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	received := make(map[spiffeid.TrustDomain]bool)
+	for _, bundle := range x509Context.Bundles.Bundles() {
+		td := bundle.TrustDomain()
+		roots := bundle.X509Authorities()
+		received[td] = true
+
+		source, ok := c.sources[td]
+		if !ok {
+			source = spiffe.NewMemoryBundleSource(roots)
+			c.sources[td] = source
+			c.bundles.Set(td, source)
+		} else {
+			source.SetRoots(roots)
+		}
+
+		if td == own && c.config.Store != nil {
+			c.config.Store.SetTrustBundle(roots)
+		}
+	}
+
+	for td := range c.sources {
+		if !received[td] {
+			delete(c.sources, td)
+			c.bundles.Remove(td)
+		}
+	}
+
+	c.metrics.RecordWorkloadAPIEvent("bundle_update")
+}
+
+// watcher receives X.509 context and JWT bundle updates for a Client
+type watcher struct {
+	client  *Client
+	ctx     context.Context
+	onError func(error)
+}
+
+// OnX509ContextUpdate implements workloadapi.X509ContextWatcher
+func (w *watcher) OnX509ContextUpdate(x509Context *workloadapi.X509Context) {
+	if err := w.client.update(x509Context); err != nil {
+		w.reportError(err)
+	}
+}
+
+// OnX509ContextWatchError implements workloadapi.X509ContextWatcher
+func (w *watcher) OnX509ContextWatchError(err error) {
+	w.watchError("X.509", err)
+}
+
+// OnJWTBundlesUpdate implements workloadapi.JWTBundleWatcher
+func (w *watcher) OnJWTBundlesUpdate(set *jwtbundle.Set) {
+	w.client.updateJWTBundles(set)
+}
+
+// OnJWTBundlesWatchError implements workloadapi.JWTBundleWatcher
+func (w *watcher) OnJWTBundlesWatchError(err error) {
+	w.watchError("JWT bundle", err)
+}
+
+// watchError reports a broken stream
+func (w *watcher) watchError(stream string, err error) {
+	// Cancelling the context ends the stream with an error; don't report it
+	if w.ctx.Err() != nil {
+		return
+	}
+	w.reportError(fmt.Errorf("Workload API %s stream failed: %v", stream, err))
+}
+
+// reportError records err and passes it to the error callback
+func (w *watcher) reportError(err error) {
+	w.client.metrics.RecordWorkloadAPIEvent("error")
+	if w.onError != nil {
+		w.onError(err)
+	}
+}
+
+// backoffStrategy doubles the reconnection delay up to a maximum
+type backoffStrategy struct {
+	initial time.Duration
+	max     time.Duration
+}
+
+// NewBackoff implements workloadapi.BackoffStrategy
+func (s backoffStrategy) NewBackoff() workloadapi.Backoff {
+	return &backoff{initial: s.initial, max: s.max}
+}
+
+// backoff is the state of one reconnection sequence
+type backoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+// Next implements workloadapi.Backoff
+func (b *backoff) Next() time.Duration {
+	if b.next == 0 {
+		b.next = b.initial
+	}
+	delay := b.next
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return delay
+}
+
+// Reset implements workloadapi.Backoff
+func (b *backoff) Reset() {
+	b.next = 0
+}
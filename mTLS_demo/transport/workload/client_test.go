@@ -0,0 +1,249 @@
+package workload
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	exampleTD = spiffeid.RequireTrustDomainFromString("example.org")
+	otherTD   = spiffeid.RequireTrustDomainFromString("other.org")
+)
+
+func TestClient_Updates(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	otherCA := spiffetest.NewCA(t, "other.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, svidA, ca, otherCA)
+
+	// Stream straight into the transport certificate store
+	store := mtls.NewSecureCertificateStore("", "", "")
+	client := setupTestClient(t, api, store)
+
+	var rotations []*tls.Certificate
+	var mu sync.Mutex
+	client.Subscribe(func(cert *tls.Certificate) {
+		mu.Lock()
+		defer mu.Unlock()
+		rotations = append(rotations, cert)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitUntilReady(ctx))
+
+	cert, err := client.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.True(t, cert.Leaf.Equal(svidA.Certificate))
+	previousKey := cert.PrivateKey.(crypto.Signer)
+	assert.True(t, store.GetCertificate().Leaf.Equal(svidA.Certificate))
+
+	id, err := client.SPIFFEID()
+	assert.NoError(t, err)
+	assert.Equal(t, svidA.ID, id.String())
+
+	// Own and federated bundles are both held
+	bundle, err := client.Bundle()
+	assert.NoError(t, err)
+	assert.True(t, bundle.Contains(ca.Certificate))
+	assert.Equal(t, []spiffeid.TrustDomain{exampleTD, otherTD}, client.Bundles().TrustDomains())
+
+	// A rotated SVID is served without reconnecting, and a dropped
+	// federation relationship removes the bundle
+	api.SetX509SVID(t, svidB, ca)
+	assert.Eventually(t, func() bool {
+		cert, err := client.GetClientCertificate(nil)
+		return err == nil && cert.Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, store.GetCertificate().Leaf.Equal(svidB.Certificate))
+	assert.Equal(t, []spiffeid.TrustDomain{exampleTD}, client.Bundles().TrustDomains())
+
+	// The previous key stays usable for handshakes in progress, then is
+	// wiped
+	digest := sha256.Sum256([]byte("message"))
+	_, err = previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := previousKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+		return errors.Is(err, securemem.ErrDestroyed)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, rotations, 2)
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, svidA, ca)
+
+	var errs []error
+	var mu sync.Mutex
+	client, err := NewClient(&Config{
+		Address:        api.Address,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	runTestClient(t, client, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitUntilReady(ctx))
+
+	// The last SVID keeps being served while the agent is down
+	api.Stop()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cert, err := client.Certificate()
+	assert.NoError(t, err)
+	assert.True(t, cert.Leaf.Equal(svidA.Certificate))
+
+	// Updates resume once the agent is back
+	api.SetX509SVID(t, svidB, ca)
+	api.Start(t)
+	assert.Eventually(t, func() bool {
+		cert, err := client.Certificate()
+		return err == nil && cert.Leaf.Equal(svidB.Certificate)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClient_RejectedSVID(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svidA := ca.IssueSVID(t, "spiffe://example.org/backend")
+	svidB := ca.IssueSVID(t, "spiffe://example.org/backend")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, svidA, ca)
+
+	store := &rejectingStore{}
+	client := setupTestClient(t, api, store)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitUntilReady(ctx))
+
+	// An SVID rejected by the store is not served
+	store.reject(svidB.Certificate)
+	api.SetX509SVID(t, svidB, ca)
+	assert.Eventually(t, func() bool {
+		return store.rejections() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cert, err := client.Certificate()
+	assert.NoError(t, err)
+	assert.True(t, cert.Leaf.Equal(svidA.Certificate))
+}
+
+func TestClient_NotReady(t *testing.T) {
+	api := spiffetest.NewWorkloadAPI(t)
+	client := setupTestClient(t, api, nil)
+
+	_, err := client.Certificate()
+	assert.ErrorIs(t, err, ErrNotReady)
+	_, err = client.Bundle()
+	assert.ErrorIs(t, err, ErrNotReady)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, client.WaitUntilReady(ctx), ErrNotReady)
+}
+
+func TestBackoff(t *testing.T) {
+	b := backoffStrategy{initial: time.Second, max: 5 * time.Second}.NewBackoff()
+	assert.Equal(t, time.Second, b.Next())
+	assert.Equal(t, 2*time.Second, b.Next())
+	assert.Equal(t, 4*time.Second, b.Next())
+	assert.Equal(t, 5*time.Second, b.Next())
+
+	b.Reset()
+	assert.Equal(t, time.Second, b.Next())
+}
+
+// setupTestClient runs a client against api until the test finishes
+func setupTestClient(t *testing.T, api *spiffetest.WorkloadAPI, store Store) *Client {
+	client, err := NewClient(&Config{
+		Address:        api.Address,
+		Store:          store,
+		InitialBackoff: 10 * time.Millisecond,
+		RetireDelay:    100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	runTestClient(t, client, nil)
+	return client
+}
+
+// runTestClient runs client in the background until the test finishes
+func runTestClient(t *testing.T, client *Client, onError func(error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Run(ctx, onError)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		client.Close()
+	})
+}
+
+// rejectingStore rejects a chosen certificate
+type rejectingStore struct {
+	mu       sync.Mutex
+	rejected *x509.Certificate
+	count    int
+}
+
+func (s *rejectingStore) reject(cert *x509.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected = cert
+}
+
+func (s *rejectingStore) rejections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+func (s *rejectingStore) StoreX509SVID(chain []*x509.Certificate, key crypto.Signer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejected != nil && chain[0].Equal(s.rejected) {
+		s.count++
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func (s *rejectingStore) SetTrustBundle(roots []*x509.Certificate) {}
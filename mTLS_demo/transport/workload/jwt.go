@@ -0,0 +1,135 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/bundle/jwtbundle"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+)
+
+// ErrNoJWTBundles is returned until the first JWT bundles have been received
+var ErrNoJWTBundles = errors.New("no JWT bundles received from the Workload API")
+
+// GetJWTBundleForTrustDomain returns the JWT authorities of a trust domain,
+// so the client can be used as a jwtbundle.Source to validate JWT-SVIDs
+func (c *Client) GetJWTBundleForTrustDomain(td spiffeid.TrustDomain) (*jwtbundle.Bundle, error) {
+	c.mu.RLock()
+	set := c.jwtBundles
+	c.mu.RUnlock()
+
+	if set == nil {
+		return nil, ErrNoJWTBundles
+	}
+	return set.GetJWTBundleForTrustDomain(td)
+}
+
+// FetchJWTSVID fetches a JWT-SVID for the workload's identity, valid for
+// audience and any extra audiences
+func (c *Client) FetchJWTSVID(ctx context.Context, audience string, extraAudiences ...string) (*jwtsvid.SVID, error) {
+	svid, err := c.client.FetchJWTSVID(ctx, jwtsvid.Params{
+		Audience:       audience,
+		ExtraAudiences: extraAudiences,
+	})
+	if err != nil {
+		c.metrics.RecordWorkloadAPIEvent("error")
+		return nil, fmt.Errorf("failed to fetch JWT-SVID for %s: %v", audience, err)
+	}
+
+	c.metrics.RecordWorkloadAPIEvent("jwt_svid_fetch")
+	return svid, nil
+}
+
+// updateJWTBundles replaces the JWT bundles with a set received from the
+// Workload API
+func (c *Client) updateJWTBundles(set *jwtbundle.Set) {
+	c.mu.Lock()
+	c.jwtBundles = set
+	c.mu.Unlock()
+
+	c.metrics.RecordWorkloadAPIEvent("jwt_bundle_update")
+}
+
+// JWTSource hands out JWT-SVIDs for one audience. An SVID is reused until
+// half of its remaining lifetime at fetch time has passed.
+type JWTSource struct {
+	client         *Client
+	audience       string
+	extraAudiences []string
+
+	mu        sync.Mutex
+	svid      *jwtsvid.SVID
+	refreshAt time.Time
+}
+
+// NewJWTSource creates a JWT-SVID source for audience and any extra
+// audiences
+func (c *Client) NewJWTSource(audience string, extraAudiences ...string) *JWTSource {
+	return &JWTSource{
+		client:         c,
+		audience:       audience,
+		extraAudiences: extraAudiences,
+	}
+}
+
+// Token returns a JWT-SVID, fetching a new one when the cached SVID is close
+// to expiry. If the fetch fails, the cached SVID is returned while it is
+// still valid.
+func (s *JWTSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.svid != nil && now.Before(s.refreshAt) {
+		return s.svid.Marshal(), nil
+	}
+
+	svid, err := s.client.FetchJWTSVID(ctx, s.audience, s.extraAudiences...)
+	if err != nil {
+		if s.svid != nil && now.Before(s.svid.Expiry) {
+			return s.svid.Marshal(), nil
+		}
+		return "", err
+	}
+
+	s.svid = svid
+	s.refreshAt = now.Add(svid.Expiry.Sub(now) / 2)
+	return svid.Marshal(), nil
+}
+
+// RoundTripper returns an http.RoundTripper sending a JWT-SVID as the bearer
+// token of every request. Requests are sent through base, or
+// http.DefaultTransport if base is nil.
+func (s *JWTSource) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &bearerTransport{source: s, base: base}
+}
+
+// bearerTransport adds a JWT-SVID to outgoing requests
+type bearerTransport struct {
+	source *JWTSource
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(r.Context())
+	if err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return nil, err
+	}
+
+	// Requests must not be modified by a RoundTripper
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,126 @@
+package workload
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"mTLS_demo/transport/spiffe/spiffetest"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_JWTSVID(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	svid := ca.IssueSVID(t, "spiffe://example.org/frontend")
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+	otherAuthority := spiffetest.NewJWTAuthority(t, "other.org", "key-1")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, svid, ca)
+	client := setupTestClient(t, api, nil)
+
+	// No JWT bundles until the agent sends them
+	_, err := client.GetJWTBundleForTrustDomain(exampleTD)
+	assert.ErrorIs(t, err, ErrNoJWTBundles)
+
+	api.SetJWTAuthorities(t, authority, otherAuthority)
+	assert.Eventually(t, func() bool {
+		_, err := client.GetJWTBundleForTrustDomain(otherTD)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A fetched JWT-SVID validates against the streamed bundles
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fetched, err := client.FetchJWTSVID(ctx, "spiffe://example.org/backend", "spiffe://example.org/audit")
+	assert.NoError(t, err)
+
+	validated, err := jwtsvid.ParseAndValidate(fetched.Marshal(), client, []string{"spiffe://example.org/audit"})
+	assert.NoError(t, err)
+	assert.Equal(t, svid.ID, validated.ID.String())
+	assert.Equal(t, []string{"spiffe://example.org/backend", "spiffe://example.org/audit"}, validated.Audience)
+
+	// Removed authorities are no longer trusted
+	api.SetJWTAuthorities(t, otherAuthority)
+	assert.Eventually(t, func() bool {
+		_, err := jwtsvid.ParseAndValidate(fetched.Marshal(), client, []string{"spiffe://example.org/backend"})
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestJWTSource_Token(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	api.SetJWTAuthorities(t, authority)
+	client := setupTestClient(t, api, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitUntilReady(ctx))
+
+	// A long-lived SVID is fetched once
+	api.SetJWTSVIDTTL(time.Hour)
+	source := client.NewJWTSource("spiffe://example.org/backend")
+	first, err := source.Token(ctx)
+	assert.NoError(t, err)
+	second, err := source.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, api.JWTSVIDFetches())
+
+	// An SVID past half of its lifetime is replaced
+	api.SetJWTSVIDTTL(2 * time.Second)
+	source = client.NewJWTSource("spiffe://example.org/backend")
+	_, err = source.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, api.JWTSVIDFetches())
+
+	time.Sleep(1100 * time.Millisecond)
+	_, err = source.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, api.JWTSVIDFetches())
+}
+
+func TestJWTSource_RoundTripper(t *testing.T) {
+	ca := spiffetest.NewCA(t, "example.org")
+	authority := spiffetest.NewJWTAuthority(t, "example.org", "key-1")
+
+	api := spiffetest.NewWorkloadAPI(t)
+	api.SetX509SVID(t, ca.IssueSVID(t, "spiffe://example.org/frontend"), ca)
+	api.SetJWTAuthorities(t, authority)
+	client := setupTestClient(t, api, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.WaitUntilReady(ctx))
+
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: client.NewJWTSource("spiffe://example.org/backend").RoundTripper(nil)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	resp, err := httpClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	// The token is added to a copy of the request
+	assert.True(t, strings.HasPrefix(authHeader, "Bearer "))
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	token := strings.TrimPrefix(authHeader, "Bearer ")
+	validated, err := jwtsvid.ParseAndValidate(token, authority.Bundle(t), []string{"spiffe://example.org/backend"})
+	assert.NoError(t, err)
+	assert.Equal(t, "spiffe://example.org/frontend", validated.ID.String())
+}
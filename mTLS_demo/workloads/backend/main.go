@@ -3,10 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -15,8 +14,15 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	authmtls "mTLS_demo/auth/mtls"
+	"mTLS_demo/transport/certfile"
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/revocation"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/server"
+	"mTLS_demo/transport/spiffe"
+	"mTLS_demo/transport/workload"
 	"mTLS_demo/workloads/common"
 )
 
@@ -29,33 +35,49 @@ type Response struct {
 
 // Application constants
 const (
-	serverPort        = ":8443"              // HTTPS server port
-	metricsPort       = ":8080"              // Metrics server port
-	certCheckInterval = 30 * time.Second     // Certificate check interval
+	frontendID      = "spiffe://example.org/ns/demo/sa/frontend" // SPIFFE ID allowed to call the backend
+	stapleInterval  = 5 * time.Minute                            // OCSP staple refresh interval
+	svidWaitTimeout = 2 * time.Minute                            // Time to wait for the first SVID
 )
 
+// svidSource provides the backend SVID and trust bundle, streamed from the
+// Workload API or read from files written by spiffe-helper
+type svidSource interface {
+	mtls.CertificateSource
+	Run(ctx context.Context, onError func(error)) error
+	WaitUntilReady(ctx context.Context) error
+	Close() error
+}
+
 // BackendServer represents the backend service
 type BackendServer struct {
-	server         *http.Server              // Main HTTPS server
-	metricsServer  *http.Server              // Metrics server
-	certStore      *common.SecureCertificateStore // Certificate store
+	flags          server.Flags              // Listener addresses and file paths
+	server         *server.Server            // mTLS server with separate health and metrics listener
+	source         svidSource                // Provides the SVID and trust bundle
 	metrics        *common.MetricsCollector  // Metrics collector
 	logger         *zap.Logger              // Structured logger
 	circuitBreaker *common.CircuitBreaker    // Circuit breaker for fault tolerance
+	revocation     revocation.Checker        // Client certificate revocation checker
+	ocsp           *revocation.OCSPChecker   // OCSP checker, also used for stapling
+	stapler        *revocation.Stapler       // Staples OCSP responses to the serving certificate
 }
 
 // NewBackendServer creates a new backend server instance
-func NewBackendServer() (*BackendServer, error) {
+func NewBackendServer(flags server.Flags) (*BackendServer, error) {
+	if err := flags.Validate(); err != nil {
+		return nil, err
+	}
+
 	// Initialize structured logger
 	logger, err := zap.NewProduction()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create logger: %v", err)
 	}
 
-	// Initialize secure certificate store
-	certStore, err := common.NewSecureCertificateStore()
+	// Read the SVID from files if given, otherwise from the SPIRE agent
+	source, err := newSVIDSource(flags)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create certificate store: %v", err)
+		return nil, err
 	}
 
 	// Initialize metrics collector
@@ -64,72 +86,161 @@ func NewBackendServer() (*BackendServer, error) {
 	// Initialize circuit breaker with 5 failure threshold and 30s timeout
 	circuitBreaker := common.NewCircuitBreaker("backend", 5, 30*time.Second)
 
+	// Check client certificates against their CRL distribution points and
+	// the local CRL file, if one is provided
+	crlConfig := &revocation.CRLConfig{FetchDistributionPoints: true}
+	if flags.CRLFile != "" {
+		crlConfig.Files = []string{flags.CRLFile}
+	}
+	crlChecker, err := revocation.NewCRLChecker(crlConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create revocation checker: %v", err)
+	}
+
+	// Query the OCSP responders of client certificates issued by an
+	// enterprise CA, and staple our own responses
+	ocspChecker, err := revocation.NewOCSPChecker(&revocation.OCSPConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OCSP checker: %v", err)
+	}
+
 	return &BackendServer{
-		certStore:      certStore,
+		flags:          flags,
+		source:         source,
 		metrics:        metrics,
 		logger:         logger,
 		circuitBreaker: circuitBreaker,
+		revocation:     revocation.MultiChecker{crlChecker, ocspChecker},
+		ocsp:           ocspChecker,
 	}, nil
 }
 
-// Start initializes and starts the backend server
-func (s *BackendServer) Start() error {
-	// Load initial certificate
-	if err := s.loadCertificate(); err != nil {
-		return fmt.Errorf("failed to load initial certificate: %v", err)
+// newSVIDSource watches the certificate files in flags, or connects to the
+// Workload API when none are given
+func newSVIDSource(flags server.Flags) (svidSource, error) {
+	if flags.CertFile != "" {
+		watcher, err := certfile.NewWatcher(&certfile.Config{
+			CertPath:   flags.CertFile,
+			KeyPath:    flags.KeyFile,
+			BundlePath: flags.BundleFile,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to watch certificate files: %v", err)
+		}
+		return watcher, nil
 	}
 
-	// Create TLS configuration
-	tlsConfig, err := s.createTLSConfig()
+	client, err := workload.NewClient(&workload.Config{Address: flags.WorkloadAPIAddr})
 	if err != nil {
-		return fmt.Errorf("failed to create TLS config: %v", err)
-	}
-
-	// Initialize main HTTPS server
-	s.server = &http.Server{
-		Addr:      serverPort,
-		TLSConfig: tlsConfig,
-		Handler:   s.createRouter(),
+		return nil, fmt.Errorf("failed to create Workload API client: %v", err)
 	}
+	return client, nil
+}
 
-	// Initialize metrics server
-	s.metricsServer = &http.Server{
-		Addr:    metricsPort,
-		Handler: s.createMetricsRouter(),
+// onRotation registers fn to be called after every SVID rotation
+func (s *BackendServer) onRotation(fn func()) {
+	switch source := s.source.(type) {
+	case *workload.Client:
+		source.Subscribe(func(*tls.Certificate) { fn() })
+	case *certfile.Watcher:
+		source.Subscribe(func(certfile.RotationEvent) { fn() })
 	}
+}
 
-	// Start certificate reload goroutine
-	go s.startCertificateReload()
-
-	// Start metrics server
+// Start initializes and starts the backend server
+func (s *BackendServer) Start() error {
+	// Stream SVID and bundle updates
 	go func() {
-		s.logger.Info("Starting metrics server", zap.String("port", metricsPort))
-		if err := s.metricsServer.ListenAndServe(); err != http.ErrServerClosed {
-			s.logger.Fatal("Metrics server failed", zap.Error(err))
+		err := s.source.Run(context.Background(), func(err error) {
+			s.logger.Warn("SVID update failed", zap.Error(err))
+		})
+		if err != nil {
+			s.logger.Fatal("SVID watch failed", zap.Error(err))
 		}
 	}()
 
-	// Start main server
-	s.logger.Info("Starting backend server", zap.String("port", serverPort))
-	return s.server.ListenAndServeTLS("", "")
+	// Wait for the initial SVID
+	ctx, cancel := context.WithTimeout(context.Background(), svidWaitTimeout)
+	defer cancel()
+	if err := s.source.WaitUntilReady(ctx); err != nil {
+		return fmt.Errorf("failed to load initial certificate: %v", err)
+	}
+
+	// Staple OCSP responses to the serving certificate, finding its issuer
+	// in the current trust bundle
+	s.stapler = revocation.NewStapler(s.ocsp, s.source.Certificate, s.source)
+	if err := s.stapler.Refresh(); err != nil {
+		s.logger.Warn("Failed to staple OCSP response", zap.Error(err))
+	}
+
+	// Create the mTLS server, authenticating every application request
+	auth, err := s.createAuthChain()
+	if err != nil {
+		return fmt.Errorf("failed to create auth chain: %v", err)
+	}
+	s.server, err = server.New(&server.Config{
+		Addr:      s.flags.Addr,
+		OpsAddr:   s.flags.OpsAddr,
+		Source:    s.source,
+		TLSConfig: s.createTLSConfig(),
+		Auth:      auth,
+		Handler:   s.createRouter(),
+		Health:    s.checkHealth,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create server: %v", err)
+	}
+
+	// Staple a response for every rotated SVID, and move idle clients over
+	// to it
+	s.onRotation(func() {
+		s.logger.Info("SVID rotated")
+		if err := s.stapler.Refresh(); err != nil {
+			s.logger.Warn("Failed to staple OCSP response", zap.Error(err))
+		}
+		s.server.Rotated()
+	})
+
+	// Refresh the OCSP staple in the background
+	go s.stapler.Run(context.Background(), stapleInterval, func(err error) {
+		s.logger.Warn("Failed to refresh OCSP staple", zap.Error(err))
+	})
+
+	// Start servers
+	s.logger.Info("Starting backend server",
+		zap.String("addr", s.flags.Addr),
+		zap.String("ops_addr", s.flags.OpsAddr),
+	)
+	return s.server.ListenAndServe()
 }
 
-// createRouter sets up the HTTP router with endpoints
+// createRouter sets up the HTTP router with application endpoints
 func (s *BackendServer) createRouter() http.Handler {
 	mux := http.NewServeMux()
 
 	// Register endpoints
 	mux.HandleFunc("/hello", s.handleHello)
-	mux.HandleFunc("/health", s.handleHealth)
 
 	return mux
 }
 
-// createMetricsRouter sets up the metrics endpoint
-func (s *BackendServer) createMetricsRouter() http.Handler {
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	return mux
+// createAuthChain authenticates callers by their client X509-SVID and
+// only admits the frontend. Federated bundles from the Workload API are
+// used when available.
+func (s *BackendServer) createAuthChain() (func(http.Handler) http.Handler, error) {
+	config := &authmtls.Config{
+		BundleSource: s.source,
+		AllowedIDs:   []string{frontendID},
+	}
+	if federated, ok := s.source.(interface{ Bundles() *spiffe.BundleSet }); ok {
+		config.BundleSet = federated.Bundles()
+	}
+
+	middleware, err := authmtls.NewMiddleware(config, "backend")
+	if err != nil {
+		return nil, err
+	}
+	return middleware.Middleware, nil
 }
 
 // handleHello processes hello endpoint requests
@@ -151,107 +262,44 @@ func (s *BackendServer) handleHello(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleHealth processes health check requests
-func (s *BackendServer) handleHealth(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	defer func() {
-		s.metrics.RecordHTTPRequest("/health", r.Method, http.StatusOK, time.Since(start))
-	}()
-
-	// Check certificate validity
-	cert, err := s.certStore.GetCertificate()
-	if err != nil {
-		s.logger.Error("Health check failed: certificate error", zap.Error(err))
-		http.Error(w, "Certificate error", http.StatusInternalServerError)
-		return
-	}
-
-	// Check circuit breaker state
+// checkHealth reports the service as unhealthy while the circuit breaker
+// is open. The server checks the certificate itself.
+func (s *BackendServer) checkHealth() error {
 	if s.circuitBreaker.GetState() == common.StateOpen {
 		s.logger.Warn("Health check: circuit breaker is open")
-		http.Error(w, "Circuit breaker open", http.StatusServiceUnavailable)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, "Backend service is healthy")
-}
-
-// loadCertificate loads and validates the certificate
-func (s *BackendServer) loadCertificate() error {
-	// Load certificate and key from files
-	cert, err := tls.LoadX509KeyPair("/tmp/svid.pem", "/tmp/key.pem")
-	if err != nil {
-		return fmt.Errorf("failed to load certificate: %v", err)
+		return fmt.Errorf("circuit breaker open")
 	}
-
-	// Parse certificate
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %v", err)
-	}
-
-	// Store certificate in secure store
-	return s.certStore.StoreCertificate(x509Cert, cert.PrivateKey.(*rsa.PrivateKey))
+	return nil
 }
 
-// createTLSConfig creates TLS configuration with certificate and trust bundle
-func (s *BackendServer) createTLSConfig() (*tls.Config, error) {
-	// Get certificate from store
-	cert, err := s.certStore.GetCertificate()
-	if err != nil {
-		return nil, err
-	}
-
-	// Load trust bundle
-	rootCAs := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("/tmp/bundle.pem")
-	if err != nil {
-		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
-	}
-	if !rootCAs.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate")
-	}
-
-	// Create TLS config with secure defaults
+// createTLSConfig creates the TLS settings layered on top of the server's
+// client certificate verification: OCSP stapling, revocation checks and
+// secure defaults
+func (s *BackendServer) createTLSConfig() *tls.Config {
 	return &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		RootCAs:     rootCAs,
-		MinVersion:  tls.VersionTLS12,
+		GetCertificate:   s.stapler.GetCertificate,
+		VerifyConnection: revocation.VerifyConnection(s.revocation),
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 		},
-	}, nil
-}
-
-// startCertificateReload starts the certificate reload goroutine
-func (s *BackendServer) startCertificateReload() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
-
-	for range sigChan {
-		s.logger.Info("Received SIGHUP, reloading certificates")
-		if err := s.loadCertificate(); err != nil {
-			s.logger.Error("Failed to reload certificates", zap.Error(err))
-			continue
-		}
-
-		// Update TLS config with new certificate
-		tlsConfig, err := s.createTLSConfig()
-		if err != nil {
-			s.logger.Error("Failed to update TLS config", zap.Error(err))
-			continue
-		}
-		s.server.TLSConfig = tlsConfig
-		s.logger.Info("Certificates reloaded successfully")
 	}
 }
 
 // main is the entry point of the application
 func main() {
+	// Keep SVID keys out of core dumps and away from debuggers
+	if err := securemem.DisableCoreDumps(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Read listener addresses and file paths from flags or environment
+	var flags server.Flags
+	flags.Register(flag.CommandLine)
+	flag.Parse()
+
 	// Create server instance
-	server, err := NewBackendServer()
+	backend, err := NewBackendServer(flags)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
@@ -262,24 +310,25 @@ func main() {
 
 	go func() {
 		<-sigChan
-		server.logger.Info("Shutting down server...")
+		backend.logger.Info("Shutting down server...")
 
 		// Create shutdown context with timeout
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
-		// Shutdown servers
-		if err := server.server.Shutdown(ctx); err != nil {
-			server.logger.Error("Error during server shutdown", zap.Error(err))
+		// Shutdown both listeners
+		if backend.server != nil {
+			if err := backend.server.Shutdown(ctx); err != nil {
+				backend.logger.Error("Error during server shutdown", zap.Error(err))
+			}
 		}
 
-		if err := server.metricsServer.Shutdown(ctx); err != nil {
-			server.logger.Error("Error during metrics server shutdown", zap.Error(err))
-		}
+		// Wipe the SVID key
+		backend.source.Close()
 	}()
 
 	// Start server
-	if err := server.Start(); err != nil {
-		server.logger.Fatal("Server failed", zap.Error(err))
+	if err := backend.Start(); err != nil {
+		backend.logger.Fatal("Server failed", zap.Error(err))
 	}
 } 
\ No newline at end of file
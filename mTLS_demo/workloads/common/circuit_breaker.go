@@ -148,6 +148,13 @@ func (cb *CircuitBreaker) Execute(f func() (interface{}, error)) (interface{}, e
 	return result, nil
 }
 
+// GetState returns the current state of the circuit breaker
+func (cb *CircuitBreaker) GetState() int {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+	return cb.state
+}
+
 // RetryPolicy implements retry logic with exponential backoff
 type RetryPolicy struct {
 	service     string        // Service name for metrics
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -134,8 +135,8 @@ func NewMetricsCollector() *MetricsCollector {
 
 // RecordHTTPRequest records metrics for an HTTP request
 func (m *MetricsCollector) RecordHTTPRequest(path, method string, status int, duration time.Duration) {
-	HTTPRequestDuration.WithLabelValues(path, method, string(status)).Observe(duration.Seconds())
-	HTTPRequestsTotal.WithLabelValues(path, method, string(status)).Inc()
+	HTTPRequestDuration.WithLabelValues(path, method, strconv.Itoa(status)).Observe(duration.Seconds())
+	HTTPRequestsTotal.WithLabelValues(path, method, strconv.Itoa(status)).Inc()
 }
 
 // RecordHTTPError records metrics for an HTTP error
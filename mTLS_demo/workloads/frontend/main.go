@@ -3,10 +3,8 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -16,7 +14,11 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"go.uber.org/zap"
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/securemem"
+	"mTLS_demo/transport/workload"
 	"mTLS_demo/workloads/common"
 )
 
@@ -30,14 +32,16 @@ type Response struct {
 // Application constants
 const (
 	backendURL       = "https://backend:8443/hello" // Backend service URL
+	backendID        = "spiffe://example.org/ns/demo/sa/backend" // SPIFFE ID the backend must present
 	serverPort       = ":8080"                      // Frontend server port
 	certCheckInterval = 30 * time.Second            // Certificate check interval
+	svidWaitTimeout   = 2 * time.Minute             // Time to wait for the first SVID
 )
 
 // FrontendServer represents the frontend service
 type FrontendServer struct {
 	server         *http.Server              // Main HTTP server
-	certStore      *common.SecureCertificateStore // Certificate store
+	workload       *workload.Client          // Streams the SVID and trust bundle from the SPIRE agent
 	metrics        *common.MetricsCollector  // Metrics collector
 	logger         *zap.Logger              // Structured logger
 	circuitBreaker *common.CircuitBreaker    // Circuit breaker for fault tolerance
@@ -53,10 +57,10 @@ func NewFrontendServer() (*FrontendServer, error) {
 		return nil, fmt.Errorf("failed to create logger: %v", err)
 	}
 
-	// Initialize secure certificate store
-	certStore, err := common.NewSecureCertificateStore()
+	// Connect to the Workload API of the SPIRE agent
+	workloadClient, err := workload.NewClient(&workload.Config{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create certificate store: %v", err)
+		return nil, fmt.Errorf("failed to create Workload API client: %v", err)
 	}
 
 	// Initialize metrics collector
@@ -69,7 +73,7 @@ func NewFrontendServer() (*FrontendServer, error) {
 	retryPolicy := common.NewRetryPolicy("frontend", 3, 100*time.Millisecond, 1*time.Second, 0.1)
 
 	return &FrontendServer{
-		certStore:      certStore,
+		workload:       workloadClient,
 		metrics:        metrics,
 		logger:         logger,
 		circuitBreaker: circuitBreaker,
@@ -79,8 +83,20 @@ func NewFrontendServer() (*FrontendServer, error) {
 
 // Start initializes and starts the frontend server
 func (s *FrontendServer) Start() error {
-	// Load initial certificate
-	if err := s.loadCertificate(); err != nil {
+	// Stream SVID and bundle updates from the SPIRE agent
+	go func() {
+		err := s.workload.Run(context.Background(), func(err error) {
+			s.logger.Warn("Workload API update failed", zap.Error(err))
+		})
+		if err != nil {
+			s.logger.Fatal("Workload API watch failed", zap.Error(err))
+		}
+	}()
+
+	// Wait for the initial SVID
+	ctx, cancel := context.WithTimeout(context.Background(), svidWaitTimeout)
+	defer cancel()
+	if err := s.workload.WaitUntilReady(ctx); err != nil {
 		return fmt.Errorf("failed to load initial certificate: %v", err)
 	}
 
@@ -91,22 +107,26 @@ func (s *FrontendServer) Start() error {
 	}
 
 	// Initialize HTTP client with TLS config
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
 	s.client = &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 10 * time.Second,
+		Transport: transport,
+		Timeout:   10 * time.Second,
 	}
 
+	// Reconnect with the new SVID once pooled connections are idle
+	s.workload.Subscribe(func(*tls.Certificate) {
+		s.logger.Info("SVID rotated")
+		transport.CloseIdleConnections()
+	})
+
 	// Initialize server
 	s.server = &http.Server{
 		Addr:    serverPort,
 		Handler: s.createRouter(),
 	}
 
-	// Start certificate reload goroutine
-	go s.startCertificateReload()
-
 	// Start request loop
 	go s.startRequestLoop()
 
@@ -134,8 +154,7 @@ func (s *FrontendServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// Check certificate validity
-	cert, err := s.certStore.GetCertificate()
-	if err != nil {
+	if _, err := s.workload.Certificate(); err != nil {
 		s.logger.Error("Health check failed: certificate error", zap.Error(err))
 		http.Error(w, "Certificate error", http.StatusInternalServerError)
 		return
@@ -152,77 +171,27 @@ func (s *FrontendServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Frontend service is healthy")
 }
 
-// loadCertificate loads and validates the certificate
-func (s *FrontendServer) loadCertificate() error {
-	// Load certificate and key from files
-	cert, err := tls.LoadX509KeyPair("/tmp/svid.pem", "/tmp/key.pem")
-	if err != nil {
-		return fmt.Errorf("failed to load certificate: %v", err)
-	}
-
-	// Parse certificate
-	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return fmt.Errorf("failed to parse certificate: %v", err)
-	}
-
-	// Store certificate in secure store
-	return s.certStore.StoreCertificate(x509Cert, cert.PrivateKey.(*rsa.PrivateKey))
-}
-
 // createTLSConfig creates TLS configuration with certificate and trust bundle
 func (s *FrontendServer) createTLSConfig() (*tls.Config, error) {
-	// Get certificate from store
-	cert, err := s.certStore.GetCertificate()
-	if err != nil {
+	// Check a trust bundle is available
+	if _, err := s.workload.Bundle(); err != nil {
 		return nil, err
 	}
 
-	// Load trust bundle
-	rootCAs := x509.NewCertPool()
-	caCert, err := ioutil.ReadFile("/tmp/bundle.pem")
+	// Only talk to the backend, identified by its SPIFFE ID
+	backend, err := spiffeid.FromString(backendID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load CA certificate: %v", err)
-	}
-	if !rootCAs.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate")
+		return nil, fmt.Errorf("invalid backend SPIFFE ID: %v", err)
 	}
 
-	// Create TLS config with secure defaults
-	return &tls.Config{
-		Certificates: []tls.Certificate{*cert},
-		RootCAs:     rootCAs,
-		MinVersion:  tls.VersionTLS12,
+	// Create TLS config with secure defaults, always presenting the
+	// latest SVID and verifying the backend against the latest bundle
+	return mtls.ClientTLSConfig(s.workload, mtls.AuthorizeID(backend), &tls.Config{
 		CipherSuites: []uint16{
 			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
 		},
-	}, nil
-}
-
-// startCertificateReload starts the certificate reload goroutine
-func (s *FrontendServer) startCertificateReload() {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
-
-	for range sigChan {
-		s.logger.Info("Received SIGHUP, reloading certificates")
-		if err := s.loadCertificate(); err != nil {
-			s.logger.Error("Failed to reload certificates", zap.Error(err))
-			continue
-		}
-
-		// Update TLS config with new certificate
-		tlsConfig, err := s.createTLSConfig()
-		if err != nil {
-			s.logger.Error("Failed to update TLS config", zap.Error(err))
-			continue
-		}
-
-		// Update client transport with new TLS config
-		s.client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
-		s.logger.Info("Certificates reloaded successfully")
-	}
+	}), nil
 }
 
 // startRequestLoop starts the periodic request loop to backend
@@ -296,6 +265,11 @@ func (s *FrontendServer) makeRequest() error {
 
 // main is the entry point of the application
 func main() {
+	// Keep SVID keys out of core dumps and away from debuggers
+	if err := securemem.DisableCoreDumps(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	// Create server instance
 	server, err := NewFrontendServer()
 	if err != nil {
@@ -318,6 +292,9 @@ func main() {
 		if err := server.server.Shutdown(ctx); err != nil {
 			server.logger.Error("Error during server shutdown", zap.Error(err))
 		}
+
+		// Wipe the SVID key
+		server.workload.Close()
 	}()
 
 	// Start server
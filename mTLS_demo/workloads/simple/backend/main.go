@@ -0,0 +1,121 @@
+// simple/backend/main.go
+// Example Go application demonstrating SPIFFE mTLS server implementation
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"mTLS_demo/transport/revocation"
+	"mTLS_demo/transport/workload"
+)
+
+// Optional CRL file for client certificates
+const crlPath = "/tmp/crl.pem"
+
+// Basic handler function
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status": "healthy", "service": "backend"}`))
+}
+
+// Echo handler
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	// Log details about the client certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		clientCert := r.TLS.PeerCertificates[0]
+		log.Printf("Client authenticated with cert: Subject=%s, Issuer=%s", 
+			clientCert.Subject.CommonName, 
+			clientCert.Issuer.CommonName)
+		
+		// Look for SPIFFE ID in URI SAN
+		for _, uri := range clientCert.URIs {
+			if uri.Scheme == "spiffe" {
+				log.Printf("Client SPIFFE ID: %s", uri.String())
+			}
+		}
+	}
+
+	// Echo back the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	
+	log.Printf("Processed request from %s", r.RemoteAddr)
+}
+
+func main() {
+	// Stream the SVID and trust bundle from the SPIRE agent socket
+	source, err := workload.NewClient(&workload.Config{})
+	if err != nil {
+		log.Fatalf("Failed to create Workload API client: %v", err)
+	}
+	go func() {
+		err := source.Run(context.Background(), func(err error) {
+			log.Printf("Workload API update failed: %v", err)
+		})
+		if err != nil {
+			log.Fatalf("Workload API watch failed: %v", err)
+		}
+	}()
+
+	// Wait for the first SVID
+	log.Println("Waiting for SVID certificate...")
+	if err := source.WaitUntilReady(context.Background()); err != nil {
+		log.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	// Use the CA bundle for client verification
+	bundle, err := source.Bundle()
+	if err != nil {
+		log.Fatalf("Failed to load CA bundle: %v", err)
+	}
+
+	// Check client certificates against their CRL distribution points and
+	// the local CRL file, if one is provided
+	crlConfig := &revocation.CRLConfig{FetchDistributionPoints: true}
+	if _, err := os.Stat(crlPath); err == nil {
+		crlConfig.Files = []string{crlPath}
+	}
+	checker, err := revocation.NewCRLChecker(crlConfig)
+	if err != nil {
+		log.Fatalf("Failed to create revocation checker: %v", err)
+	}
+
+	// Configure the TLS server
+	tlsConfig := &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  bundle.Pool(),
+		// Reject revoked client certificates after chain verification
+		VerifyConnection: revocation.VerifyConnection(checker),
+		// Serve the latest SVID during the TLS handshake
+		GetCertificate: source.GetCertificate,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Set up routes
+	http.HandleFunc("/health", healthHandler)
+	http.HandleFunc("/echo", echoHandler)
+	
+	server := &http.Server{
+		Addr:      ":8443",
+		TLSConfig: tlsConfig,
+	}
+
+	// Start the server with empty cert/key arguments since we're using GetCertificate callback
+	log.Printf("Backend server listening on :8443 with mTLS enabled")
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
@@ -1,119 +1,52 @@
-// frontend/main.go
+// simple/frontend/main.go
 // Example Go application demonstrating SPIFFE mTLS client implementation
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"sync"
 	"time"
-)
 
-// SVID file paths provided by SPIFFE Helper
-const (
-	svidPath   = "/tmp/svid.pem"
-	keyPath    = "/tmp/key.pem"
-	bundlePath = "/tmp/bundle.pem"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"mTLS_demo/transport/mtls"
+	"mTLS_demo/transport/workload"
 )
 
-// We'll use this to reload certs when they change
-type certReloader struct {
-	sync.Mutex
-	cert     *tls.Certificate
-	certPath string
-	keyPath  string
-}
-
-// Initialize a certificate reloader
-func newCertReloader(certPath, keyPath string) (*certReloader, error) {
-	cr := &certReloader{
-		certPath: certPath,
-		keyPath:  keyPath,
-	}
-	if err := cr.reload(); err != nil {
-		return nil, err
-	}
-	return cr, nil
-}
-
-// Reload certificates from disk
-func (cr *certReloader) reload() error {
-	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+// Create an mTLS HTTP client using SPIFFE SVIDs
+func createMTLSClient() (*http.Client, error) {
+	// Stream the SVID and trust bundle from the SPIRE agent socket
+	source, err := workload.NewClient(&workload.Config{})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create Workload API client: %v", err)
 	}
-	cr.Lock()
-	defer cr.Unlock()
-	cr.cert = &cert
-	return nil
-}
-
-// Get the current certificate
-func (cr *certReloader) getCert() *tls.Certificate {
-	cr.Lock()
-	defer cr.Unlock()
-	return cr.cert
-}
-
-// Watch for certificate changes
-func (cr *certReloader) watchForChanges(interval time.Duration) {
-	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			if err := cr.reload(); err != nil {
-				log.Printf("Error reloading certificates: %v", err)
-			} else {
-				log.Printf("Certificates reloaded successfully")
-			}
+		err := source.Run(context.Background(), func(err error) {
+			log.Printf("Workload API update failed: %v", err)
+		})
+		if err != nil {
+			log.Fatalf("Workload API watch failed: %v", err)
 		}
 	}()
-}
 
-// Create an mTLS HTTP client using SPIFFE SVIDs
-func createMTLSClient() (*http.Client, error) {
-	// Wait for SVID certificate to be available
-	for {
-		if _, err := os.Stat(svidPath); err == nil {
-			break
-		}
-		log.Println("Waiting for SVID certificate...")
-		time.Sleep(1 * time.Second)
-	}
-
-	// Load CA bundle for server verification
-	bundleData, err := os.ReadFile(bundlePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read CA bundle: %v", err)
-	}
-	
-	bundlePool := x509.NewCertPool()
-	if !bundlePool.AppendCertsFromPEM(bundleData) {
-		return nil, fmt.Errorf("failed to parse CA bundle")
+	// Wait for the first SVID
+	log.Println("Waiting for SVID certificate...")
+	if err := source.WaitUntilReady(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to load certificates: %v", err)
 	}
 
-	// Create certificate reloader
-	reloader, err := newCertReloader(svidPath, keyPath)
+	// Only talk to the backend, identified by its SPIFFE ID
+	backend, err := spiffeid.FromString("spiffe://example.org/ns/demo/sa/backend")
 	if err != nil {
-		return nil, fmt.Errorf("failed to load certificates: %v", err)
+		return nil, fmt.Errorf("invalid backend SPIFFE ID: %v", err)
 	}
-	
-	// Watch for certificate changes
-	reloader.watchForChanges(10 * time.Second)
 
-	// Configure TLS client
-	tlsConfig := &tls.Config{
-		RootCAs: bundlePool,
-		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-			return reloader.getCert(), nil
-		},
-		MinVersion: tls.VersionTLS12,
-	}
+	// Configure TLS client: always present the latest SVID and verify the
+	// backend against the latest CA bundle
+	tlsConfig := mtls.ClientTLSConfig(source, mtls.AuthorizeID(backend), nil)
 
 	// Create HTTP client with custom Transport using our TLS config
 	client := &http.Client{